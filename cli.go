@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +10,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +20,7 @@ import (
 	"github.com/hashicorp/consul-template/logging"
 	"github.com/hashicorp/consul-template/manager"
 	"github.com/hashicorp/consul-template/signals"
+	"github.com/hashicorp/envconsul/pkg/envconsul"
 	"github.com/hashicorp/envconsul/version"
 )
 
@@ -30,6 +35,7 @@ const (
 	ExitCodeParseFlagsError
 	ExitCodeRunnerError
 	ExitCodeConfigError
+	ExitCodeLockError
 )
 
 var (
@@ -106,13 +112,28 @@ func (cli *CLI) Run(args []string) int {
 		return ExitCodeOK
 	}
 
-	// Return an error if no command was given
-	if !config.StringPresent(cfg.Exec.Command) {
+	// Return an error if no command was given, unless the environment is only
+	// written to an output file or directory or printed by a dry run.
+	if !config.StringPresent(cfg.Exec.Command) && !config.StringPresent(cfg.Output.Path) &&
+		!config.StringPresent(cfg.Output.Dir) && !config.BoolVal(cfg.DryRun) {
 		return logError(ErrMissingCommand, ExitCodeConfigError)
 	}
 
+	// Prevent concurrent instances sharing the lock file. The lock is held
+	// across reloads.
+	if path := config.StringVal(cfg.LockFile); path != "" {
+		lock, err := acquireLock(path, config.BoolVal(cfg.LockWait))
+		if err != nil {
+			return logError(err, ExitCodeLockError)
+		}
+		defer lock.Release()
+	}
+
+	// Remember the configuration files, to report which changed on reload.
+	checksums := configChecksums(paths)
+
 	// Initial runner
-	runner, err := NewRunner(cfg, once)
+	runner, err := envconsul.NewRunner(cfg, once)
 	if err != nil {
 		return logError(err, ExitCodeRunnerError)
 	}
@@ -130,6 +151,10 @@ func (cli *CLI) Run(args []string) int {
 			if typed, ok := err.(manager.ErrExitable); ok {
 				code = typed.ExitStatus()
 			}
+
+			// Stop the child as on any other shutdown, with the exec kill signal
+			// and timeout, rather than leaving it running.
+			runner.Stop()
 			return logError(err, code)
 		case <-runner.DoneCh:
 			return ExitCodeOK
@@ -148,6 +173,16 @@ func (cli *CLI) Run(args []string) int {
 
 			switch s {
 			case *cfg.ReloadSignal:
+				// When no configuration file has changed, re-fetch every
+				// dependency in place rather than replacing the runner, so the
+				// child is only restarted if its environment changes.
+				current := configChecksums(paths)
+				if len(changedConfigs(checksums, current)) == 0 {
+					fmt.Fprintf(cli.errStream, "Re-fetching dependencies...\n")
+					runner.Refetch()
+					continue
+				}
+
 				fmt.Fprintf(cli.errStream, "Reloading configuration...\n")
 				runner.Stop()
 
@@ -164,10 +199,11 @@ func (cli *CLI) Run(args []string) int {
 					return logError(err, ExitCodeConfigError)
 				}
 
-				runner, err = NewRunner(cfg, once)
+				runner, err = newReloadedRunner(cfg, once, checksums, current)
 				if err != nil {
 					return logError(err, ExitCodeRunnerError)
 				}
+				checksums = current
 				go runner.Start()
 			case *cfg.KillSignal:
 				fmt.Fprintf(cli.errStream, "Cleaning up...\n")
@@ -207,10 +243,10 @@ func (cli *CLI) stop() {
 // Flag library. This is extracted into a helper to keep the main function
 // small, but it also makes writing tests for parsing command line arguments
 // much easier and cleaner.
-func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error) {
+func (cli *CLI) ParseFlags(args []string) (*envconsul.Config, []string, bool, bool, error) {
 	var once, isVersion bool
 	var no_prefix *bool
-	var c = DefaultConfig()
+	var c = envconsul.DefaultConfig()
 
 	// configPaths stores the list of configuration paths on disk
 	configPaths := make([]string, 0, 6)
@@ -220,6 +256,16 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 	flags.SetOutput(ioutil.Discard)
 	flags.Usage = func() {}
 
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.AnnotateSources = config.Bool(b)
+		return nil
+	}), "annotate-sources", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.CaseFoldPolicy = config.String(s)
+		return nil
+	}), "case-fold-policy", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		configPaths = append(configPaths, s)
 		return nil
@@ -324,6 +370,36 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "consul-transport-tls-handshake-timeout", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.DeltaFile = config.String(s)
+		return nil
+	}), "delta-file", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.DryRun = config.Bool(b)
+		return nil
+	}), "dry-run", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.DryRunRedact = config.Bool(b)
+		return nil
+	}), "dry-run-redact", "")
+
+	flags.Var((funcIntVar)(func(i int) error {
+		c.EmptyEnvExitCode = config.Int(i)
+		return nil
+	}), "empty-env-exit-code", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.EnvSocket = config.String(s)
+		return nil
+	}), "env-socket", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.EnvSocketRedact = config.Bool(b)
+		return nil
+	}), "env-socket-redact", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		c.Exec.Enabled = config.Bool(true)
 		c.Exec.Command = config.String(s)
@@ -344,6 +420,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "exec-kill-timeout", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.ExecShell = config.String(s)
+		return nil
+	}), "exec-shell", "")
+
 	flags.Var((funcDurationVar)(func(d time.Duration) error {
 		c.Exec.Splay = config.TimeDuration(d)
 		return nil
@@ -358,6 +439,21 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "kill-signal", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.LockFile = config.String(s)
+		return nil
+	}), "lock-file", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.LockWait = config.Bool(b)
+		return nil
+	}), "lock-wait", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.LogEnvDiff = config.Bool(b)
+		return nil
+	}), "log-env-diff", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		c.LogLevel = config.String(s)
 		return nil
@@ -376,13 +472,63 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 
 	flags.BoolVar(&once, "once", false, "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.NamedPipe = config.String(s)
+		return nil
+	}), "named-pipe", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.NamespaceDatacenters = config.Bool(b)
+		return nil
+	}), "namespace-datacenters", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.OnceRetry.Enabled = config.Bool(b)
+		return nil
+	}), "once-retry", "")
+
+	flags.Var((funcIntVar)(func(i int) error {
+		c.OnceRetry.Attempts = config.Int(i)
+		return nil
+	}), "once-retry-attempts", "")
+
+	flags.Var((funcDurationVar)(func(d time.Duration) error {
+		c.OnceRetry.Backoff = config.TimeDuration(d)
+		return nil
+	}), "once-retry-backoff", "")
+
+	flags.Var((funcDurationVar)(func(d time.Duration) error {
+		c.OnceRetry.MaxBackoff = config.TimeDuration(d)
+		return nil
+	}), "once-retry-max-backoff", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.Output.Path = config.String(s)
+		return nil
+	}), "output-file", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.Output.Format = config.String(s)
+		return nil
+	}), "output-format", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.Output.DotenvQuoting = config.String(s)
+		return nil
+	}), "output-dotenv-quoting", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.Output.Dir = config.String(s)
+		return nil
+	}), "output-dir", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		c.PidFile = config.String(s)
 		return nil
 	}), "pid-file", "")
 
 	flags.Var((funcVar)(func(s string) error {
-		p, err := ParsePrefixConfig(s)
+		p, err := envconsul.ParsePrefixConfig(s)
 		if err != nil {
 			return err
 		}
@@ -404,13 +550,23 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "reload-signal", "")
 
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.RequireUTF8 = config.Bool(b)
+		return nil
+	}), "require-utf8", "")
+
 	flags.Var((funcBoolVar)(func(b bool) error {
 		c.Sanitize = config.Bool(b)
 		return nil
 	}), "sanitize", "")
 
 	flags.Var((funcVar)(func(s string) error {
-		p, err := ParsePrefixConfig(s)
+		c.SanitizeReplacement = config.String(s)
+		return nil
+	}), "sanitize-replacement", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		p, err := envconsul.ParsePrefixConfig(s)
 		if err != nil {
 			return err
 		}
@@ -419,7 +575,7 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 	}), "secret", "")
 
 	flags.Var((funcVar)(func(s string) error {
-		p, err := ParseServiceConfig(s)
+		p, err := envconsul.ParseServiceConfig(s)
 		if err != nil {
 			return err
 		}
@@ -472,6 +628,69 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "service-format-port", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("format must be specified before query")
+		}
+		serviceConfig.FormatNode = config.String(s)
+		return nil
+	}), "service-format-node", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("format must be specified before query")
+		}
+		serviceConfig.FormatStatus = config.String(s)
+		return nil
+	}), "service-format-status", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("format must be specified before query")
+		}
+		serviceConfig.FormatSRV = config.String(s)
+		return nil
+	}), "service-format-srv", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("format must be specified before query")
+		}
+		serviceConfig.FormatTaggedAddress = config.String(s)
+		return nil
+	}), "service-format-tagged-address", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("group must be specified after query")
+		}
+		serviceConfig.GroupByTag = config.String(s)
+		return nil
+	}), "service-group-by-tag", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("instance must be specified after query")
+		}
+		serviceConfig.Instance = config.String(s)
+		return nil
+	}), "service-instance", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		serviceConfig := c.Services.LastSeviceConfig()
+		if serviceConfig == nil {
+			return fmt.Errorf("sort must be specified after query")
+		}
+		serviceConfig.Sort = config.String(s)
+		return nil
+	}), "service-sort", "")
+
 	flags.Var((funcBoolVar)(func(b bool) error {
 		c.Syslog.Enabled = config.Bool(b)
 		return nil
@@ -482,6 +701,21 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "syslog-facility", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.TelemetryAddr = config.String(s)
+		return nil
+	}), "telemetry-addr", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.TolerateStale = config.Bool(b)
+		return nil
+	}), "tolerate-stale", "")
+
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.TrimKeyNames = config.Bool(b)
+		return nil
+	}), "trim-key-names", "")
+
 	flags.Var((funcBoolVar)(func(b bool) error {
 		c.Upcase = config.Bool(b)
 		return nil
@@ -522,6 +756,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "vault-retry-max-backoff", "")
 
+	flags.Var((funcDurationVar)(func(d time.Duration) error {
+		c.VaultSealedInterval = config.TimeDuration(d)
+		return nil
+	}), "vault-sealed-interval", "")
+
 	flags.Var((funcBoolVar)(func(b bool) error {
 		c.Vault.SSL.Enabled = config.Bool(b)
 		return nil
@@ -587,6 +826,16 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "vault-token", "")
 
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.VaultTokenMandatory = config.Bool(b)
+		return nil
+	}), "vault-token-mandatory", "")
+
+	flags.Var((funcDurationVar)(func(d time.Duration) error {
+		c.VaultTokenRenewGrace = config.TimeDuration(d)
+		return nil
+	}), "vault-token-renew-grace", "")
+
 	flags.Var((funcBoolVar)(func(b bool) error {
 		c.Vault.UnwrapToken = config.Bool(b)
 		return nil
@@ -701,11 +950,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 // configuration is the list of overrides to apply at the very end, taking
 // precendence over any configurations that were loaded from the paths. If any
 // errors occur when reading or parsing those sub-configs, it is returned.
-func loadConfigs(paths []string, o *Config) (*Config, error) {
-	finalC := DefaultConfig()
+func loadConfigs(paths []string, o *envconsul.Config) (*envconsul.Config, error) {
+	finalC := envconsul.DefaultConfig()
 
 	for _, path := range paths {
-		c, err := FromPath(path)
+		c, err := envconsul.FromPath(path)
 		if err != nil {
 			return nil, err
 		}
@@ -718,13 +967,71 @@ func loadConfigs(paths []string, o *Config) (*Config, error) {
 	return finalC, nil
 }
 
+// newReloadedRunner creates the runner for a reloaded configuration, recording
+// the configuration files which changed between the prev and cur checksums.
+func newReloadedRunner(cfg *envconsul.Config, once bool, prev, cur map[string]string) (*envconsul.Runner, error) {
+	runner, err := envconsul.NewRunner(cfg, once)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := changedConfigs(prev, cur)
+	runner.SetReloadedFrom(changed)
+	if len(changed) > 0 {
+		log.Printf("[INFO] (cli) reloaded configuration from %s",
+			strings.Join(changed, ", "))
+	}
+	return runner, nil
+}
+
+// configChecksums returns the checksum of each configuration file in the given
+// paths, walking directories as FromPath does. Files which cannot be read are
+// left out.
+func configChecksums(paths []string) map[string]string {
+	sums := make(map[string]string)
+	for _, p := range paths {
+		filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			sum := sha256.Sum256(b)
+			sums[path] = hex.EncodeToString(sum[:])
+			return nil
+		})
+	}
+	return sums
+}
+
+// changedConfigs returns the sorted paths of the configuration files which were
+// added, changed or removed between the prev and cur checksums.
+func changedConfigs(prev, cur map[string]string) []string {
+	var changed []string
+	for path, sum := range cur {
+		if prev[path] != sum {
+			changed = append(changed, path)
+		}
+	}
+	for path := range prev {
+		if _, ok := cur[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
 // logError logs an error message and then returns the given status.
 func logError(err error, status int) int {
 	log.Printf("[ERR] (cli) %s", err)
 	return status
 }
 
-func (cli *CLI) setup(conf *Config) (*Config, error) {
+func (cli *CLI) setup(conf *envconsul.Config) (*envconsul.Config, error) {
 	if err := logging.Setup(&logging.Config{
 		Name:           version.Name,
 		Level:          config.StringVal(conf.LogLevel),
@@ -746,6 +1053,14 @@ const usage = `Usage: %s [options] <command>
 
 Options:
 
+  -annotate-sources
+      Inject a companion __ENVCONSUL_SOURCE_<key> variable holding the path of
+      the prefix, secret or service each key was read from, for debugging
+
+  -case-fold-policy=<error|first|last>
+      Sets how secret fields which collide once upcased are resolved, either
+      by failing or by keeping the first or last field in sorted order
+
   -config=<path>
       Sets the path to a configuration file or folder on disk. This can be
       specified multiple times to load multiple files or folders. If multiple
@@ -812,6 +1127,32 @@ Options:
   -consul-transport-tls-handshake-timeout=<duration>
       Sets the handshake timeout
 
+  -delta-file=<path>
+      Path to a file which is rewritten on every change to the environment,
+      listing the keys that were added (+), changed (~) or removed (-)
+
+  -dry-run
+      Resolve the environment once, print the environment the child would be
+      given to stdout, sorted by key, and exit without starting the child or
+      writing any files. Exits non-zero if Consul or Vault cannot be read
+
+  -dry-run-redact
+      Replace the values of secrets and keys matching redact_keys with "***"
+      in the output of -dry-run
+
+  -empty-env-exit-code=<code>
+      Exit with the given code in place of starting the child when the
+      environment read from Consul and Vault is empty, such as for an init
+      container. Disabled by default
+
+  -env-socket=<path>
+      Path to a Unix socket, accessible only by its owner, on which the
+      environment is written in dotenv format to each client which connects
+
+  -env-socket-redact
+      Replace the values of secrets and keys matching redact_keys with "***"
+      on the -env-socket
+
   -exec=<command>
       Enable exec mode to run as a supervisor-like process - the given command
       will receive all signals provided to the parent process and will receive a
@@ -826,12 +1167,27 @@ Options:
   -exec-reload-signal=<signal>
       Signal to send when a reload takes place
 
+  -exec-shell=<path>
+      Run the exec command with the given shell, such as /bin/sh, as
+      "<path> -c <command>", allowing variable expansion and pipes
+
   -exec-splay=<duration>
       Amount of time to wait before sending signals
 
   -kill-signal=<signal>
       Signal to listen to gracefully terminate the process
 
+  -lock-file=<path>
+      Path to a file to lock for the lifetime of the process; a second
+      instance using the same lock file exits instead of running
+
+  -lock-wait
+      Wait for the lock file to be released instead of exiting
+
+  -log-env-diff
+      Log the keys that were added (+), changed (~) or removed (-) each time
+      the environment changes, with the values of secrets redacted
+
   -log-level=<level>
       Set the logging level - values are "debug", "info", "warn", and "err"
 
@@ -845,6 +1201,47 @@ Options:
   -once
       Do not run the process as a daemon
 
+  -named-pipe=<path>
+      Path to a named pipe (FIFO) to which the environment is written in
+      dotenv format on every change, if there is a reader
+
+  -namespace-datacenters
+      Prepend the datacenter to the keys of each prefix read from more than
+      one datacenter with the "path@dc" syntax
+
+  -once-retry
+      In -once mode, retry the first fetch of the prefixes, secrets and
+      services with exponential backoff if it fails, rather than exiting.
+      Specifying any other -once-retry option also enables it
+
+  -once-retry-attempts=<int>
+      The number of retries of the first fetch before giving up. Default is 12.
+      0 means infinite
+
+  -once-retry-backoff=<duration>
+      The base amount to use for the backoff duration of the first fetch. This
+      number will be increased exponentially for each retry attempt
+
+  -once-retry-max-backoff=<duration>
+      The maximum limit of the backoff duration of the first fetch. Default is
+      one minute. 0 means infinite
+
+  -output-file=<path>
+      Path to a file to which the environment is written on every change,
+      with or without a command to execute, or "-" for stdout
+
+  -output-format=<format>
+      Format of the output file: "dotenv" (the default), "json", "export" or
+      "batch"
+
+  -output-dotenv-quoting=<style>
+      How values are quoted in the dotenv output format: "always" (the
+      default), "never" or "when-needed"
+
+  -output-dir=<path>
+      Write each secret to its own file in the given directory, setting its
+      variable to the path of the file
+
   -pid-file=<path>
       Path on disk to write the PID of the process
 
@@ -860,9 +1257,16 @@ Options:
   -reload-signal=<signal>
       Signal to listen to reload configuration
 
+  -require-utf8
+      Fail, listing the keys, if any value is not valid UTF-8
+
   -sanitize
       Replace invalid characters in keys to underscores
 
+  -sanitize-replacement=<string>
+      The string which replaces invalid characters in keys when sanitizing,
+      "_" by default
+
   -secret=<prefix>
       A secret path to watch in Vault, multiple prefixes are merged from left
       to right, with the right-most result taking precedence, including any
@@ -886,6 +1290,34 @@ Options:
   -service-format-port=<{{service}}/{{key}}>
       Format key environment for service port.
 
+  -service-format-node=<{{service}}/{{key}}>
+      Format key environment for the node name of a service instance.
+
+  -service-format-status=<{{service}}/{{key}}>
+      Format key environment for the health check status of a service
+      instance: "passing", "warning", "critical" or "maintenance". An instance
+      without checks is "passing".
+
+  -service-format-srv=<_{{service}}._tcp/{{key}}>
+      Format key environment for SRV-style priority, weight, port and target
+      of each service instance, where key is "<index>/<field>".
+
+  -service-format-tagged-address=<{{service}}/{{addr_type}}>
+      Format key environment for each tagged address of the node of a service
+      instance, such as "lan" and "wan", where addr_type is the address type.
+
+  -service-group-by-tag=<prefix>
+      Group the instances of a service by the rest of their first tag starting
+      with prefix, emitting "<group>_<index>_<field>" for each instance.
+
+  -service-instance=<first|last|index>
+      Emit only the fields of the given instance of a service, after sorting,
+      rather than every instance with the last one winning
+
+  -service-sort=<address|port|id>
+      Sort the instances of a service by the given field before selecting
+      and emitting them
+
   -syslog
       Send the output to syslog instead of standard error and standard out. The
       syslog facility defaults to LOCAL0 and can be changed using a
@@ -895,6 +1327,17 @@ Options:
       Set the facility where syslog should log - if this attribute is supplied,
       the -syslog flag must also be supplied
 
+  -telemetry-addr=<address>
+      Serve metrics in the Prometheus text format over HTTP on the given
+      address, such as "127.0.0.1:9102", at /metrics
+
+  -tolerate-stale
+      Keep the child running with the last environment when a dependency
+      can no longer be fetched or rendered, instead of exiting
+
+  -trim-key-names
+      Trim leading and trailing whitespace from key names
+
   -upcase
       Convert all environment variable keys to uppercase
 
@@ -919,6 +1362,10 @@ Options:
       The maximum limit of the retry backoff duration. Default is one minute.
       0 means infinite. The backoff will increase exponentially until given value.
 
+  -vault-sealed-interval=<duration>
+      Amount of time between reads of a secret while Vault is sealed and its
+      last value is kept - this defaults to "30s"
+
   -vault-ssl
       Specifies whether communications with Vault should be done via SSL
 
@@ -943,6 +1390,14 @@ Options:
   -vault-token=<token>
       Sets the Vault API token
 
+  -vault-token-mandatory
+      Stop the child and exit with an error if the Vault token can no longer
+      be renewed - this defaults to "true"
+
+  -vault-token-renew-grace=<duration>
+      Amount of time renewals of the Vault token may fail before it is
+      treated as expired
+
   -vault-transport-dial-keep-alive=<duration>
       Sets the amount of time to use for keep-alives
 
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/envconsul/pkg/envconsul"
 	"github.com/hashicorp/go-gatedio"
 )
 
@@ -25,7 +27,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 	cases := []struct {
 		name string
 		f    []string
-		e    *Config
+		e    *envconsul.Config
 		err  bool
 	}{
 		// Deprecations
@@ -33,7 +35,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"auth",
 			[]string{"-auth", "abcd:efgh"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Auth: &config.AuthConfig{
 						Username: config.String("abcd"),
@@ -46,7 +48,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul",
 			[]string{"-consul", "127.0.0.1:8500"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Address: config.String("127.0.0.1:8500"),
 				},
@@ -56,7 +58,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"retry",
 			[]string{"-retry", "10s"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Retry: &config.RetryConfig{
 						Backoff:    config.TimeDuration(10 * time.Second),
@@ -75,7 +77,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"splay",
 			[]string{"-splay", "10s"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					Splay: config.TimeDuration(10 * time.Second),
 				},
@@ -85,7 +87,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"ssl",
 			[]string{"-ssl"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Enabled: config.Bool(true),
@@ -102,7 +104,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"ssl_verify",
 			[]string{"-ssl-verify"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Verify: config.Bool(true),
@@ -119,7 +121,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"ssl_ca-cert",
 			[]string{"-ssl-ca-cert", "foo"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						CaCert: config.String("foo"),
@@ -136,7 +138,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"ssl_cert",
 			[]string{"-ssl-cert", "foo"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Cert: config.String("foo"),
@@ -153,7 +155,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"timeout",
 			[]string{"-timeout", "10s"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					Timeout: config.TimeDuration(10 * time.Second),
 				},
@@ -163,7 +165,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"token",
 			[]string{"-token", "abcd1234"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Token: config.String("abcd1234"),
 				},
@@ -173,10 +175,26 @@ func TestCLI_ParseFlags(t *testing.T) {
 		// End Depreations
 		// TODO remove in 0.8.0
 
+		{
+			"annotate-sources",
+			[]string{"-annotate-sources"},
+			&envconsul.Config{
+				AnnotateSources: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"case-fold-policy",
+			[]string{"-case-fold-policy", "first"},
+			&envconsul.Config{
+				CaseFoldPolicy: config.String("first"),
+			},
+			false,
+		},
 		{
 			"config",
 			[]string{"-config", f.Name()},
-			&Config{},
+			&envconsul.Config{},
 			false,
 		},
 		{
@@ -185,13 +203,13 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-config", f.Name(),
 				"-config", f.Name(),
 			},
-			&Config{},
+			&envconsul.Config{},
 			false,
 		},
 		{
 			"consul_addr",
 			[]string{"-consul-addr", "1.2.3.4"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Address: config.String("1.2.3.4"),
 				},
@@ -207,7 +225,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul_auth_username",
 			[]string{"-consul-auth", "username"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Auth: &config.AuthConfig{
 						Username: config.String("username"),
@@ -219,7 +237,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul_auth_username_password",
 			[]string{"-consul-auth", "username:password"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Auth: &config.AuthConfig{
 						Username: config.String("username"),
@@ -232,7 +250,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-retry",
 			[]string{"-consul-retry"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Retry: &config.RetryConfig{
 						Enabled: config.Bool(true),
@@ -244,7 +262,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-retry-attempts",
 			[]string{"-consul-retry-attempts", "20"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Retry: &config.RetryConfig{
 						Attempts: config.Int(20),
@@ -256,7 +274,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-retry-backoff",
 			[]string{"-consul-retry-backoff", "30s"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Retry: &config.RetryConfig{
 						Backoff: config.TimeDuration(30 * time.Second),
@@ -268,7 +286,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-retry-max-backoff",
 			[]string{"-consul-retry-max-backoff", "60s"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Retry: &config.RetryConfig{
 						MaxBackoff: config.TimeDuration(60 * time.Second),
@@ -280,7 +298,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl",
 			[]string{"-consul-ssl"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Enabled: config.Bool(true),
@@ -292,7 +310,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl-ca-cert",
 			[]string{"-consul-ssl-ca-cert", "ca_cert"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						CaCert: config.String("ca_cert"),
@@ -304,7 +322,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl-ca-path",
 			[]string{"-consul-ssl-ca-path", "ca_path"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						CaPath: config.String("ca_path"),
@@ -316,7 +334,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl-cert",
 			[]string{"-consul-ssl-cert", "cert"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Cert: config.String("cert"),
@@ -328,7 +346,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl-key",
 			[]string{"-consul-ssl-key", "key"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Key: config.String("key"),
@@ -340,7 +358,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl-server-name",
 			[]string{"-consul-ssl-server-name", "server_name"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						ServerName: config.String("server_name"),
@@ -352,7 +370,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-ssl-verify",
 			[]string{"-consul-ssl-verify"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					SSL: &config.SSLConfig{
 						Verify: config.Bool(true),
@@ -364,7 +382,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-token",
 			[]string{"-consul-token", "token"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Token: config.String("token"),
 				},
@@ -374,7 +392,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-transport-dial-keep-alive",
 			[]string{"-consul-transport-dial-keep-alive", "30s"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Transport: &config.TransportConfig{
 						DialKeepAlive: config.TimeDuration(30 * time.Second),
@@ -386,7 +404,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-transport-dial-timeout",
 			[]string{"-consul-transport-dial-timeout", "30s"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Transport: &config.TransportConfig{
 						DialTimeout: config.TimeDuration(30 * time.Second),
@@ -398,7 +416,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-transport-disable-keep-alives",
 			[]string{"-consul-transport-disable-keep-alives"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Transport: &config.TransportConfig{
 						DisableKeepAlives: config.Bool(true),
@@ -410,7 +428,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-transport-max-idle-conns-per-host",
 			[]string{"-consul-transport-max-idle-conns-per-host", "100"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Transport: &config.TransportConfig{
 						MaxIdleConnsPerHost: config.Int(100),
@@ -422,7 +440,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"consul-transport-tls-handshake-timeout",
 			[]string{"-consul-transport-tls-handshake-timeout", "30s"},
-			&Config{
+			&envconsul.Config{
 				Consul: &config.ConsulConfig{
 					Transport: &config.TransportConfig{
 						TLSHandshakeTimeout: config.TimeDuration(30 * time.Second),
@@ -431,10 +449,58 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"delta-file",
+			[]string{"-delta-file", "/tmp/delta"},
+			&envconsul.Config{
+				DeltaFile: config.String("/tmp/delta"),
+			},
+			false,
+		},
+		{
+			"dry-run",
+			[]string{"-dry-run"},
+			&envconsul.Config{
+				DryRun: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"dry-run-redact",
+			[]string{"-dry-run-redact"},
+			&envconsul.Config{
+				DryRunRedact: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"empty-env-exit-code",
+			[]string{"-empty-env-exit-code", "3"},
+			&envconsul.Config{
+				EmptyEnvExitCode: config.Int(3),
+			},
+			false,
+		},
+		{
+			"env-socket",
+			[]string{"-env-socket", "/tmp/env.sock"},
+			&envconsul.Config{
+				EnvSocket: config.String("/tmp/env.sock"),
+			},
+			false,
+		},
+		{
+			"env-socket-redact",
+			[]string{"-env-socket-redact"},
+			&envconsul.Config{
+				EnvSocketRedact: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"exec",
 			[]string{"-exec", "command"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					Enabled: config.Bool(true),
 					Command: config.String("command"),
@@ -445,7 +511,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"exec-kill-signal",
 			[]string{"-exec-kill-signal", "SIGUSR1"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					KillSignal: config.Signal(syscall.SIGUSR1),
 				},
@@ -455,17 +521,25 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"exec-kill-timeout",
 			[]string{"-exec-kill-timeout", "10s"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					KillTimeout: config.TimeDuration(10 * time.Second),
 				},
 			},
 			false,
 		},
+		{
+			"exec-shell",
+			[]string{"-exec-shell", "/bin/sh"},
+			&envconsul.Config{
+				ExecShell: config.String("/bin/sh"),
+			},
+			false,
+		},
 		{
 			"exec-splay",
 			[]string{"-exec-splay", "10s"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					Splay: config.TimeDuration(10 * time.Second),
 				},
@@ -475,31 +549,159 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"kill-signal",
 			[]string{"-kill-signal", "SIGUSR1"},
-			&Config{
+			&envconsul.Config{
 				KillSignal: config.Signal(syscall.SIGUSR1),
 			},
 			false,
 		},
+		{
+			"lock-file",
+			[]string{"-lock-file", "/tmp/envconsul.lock"},
+			&envconsul.Config{
+				LockFile: config.String("/tmp/envconsul.lock"),
+			},
+			false,
+		},
+		{
+			"lock-wait",
+			[]string{"-lock-wait"},
+			&envconsul.Config{
+				LockWait: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"log-env-diff",
+			[]string{"-log-env-diff"},
+			&envconsul.Config{
+				LogEnvDiff: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"log-level",
 			[]string{"-log-level", "DEBUG"},
-			&Config{
+			&envconsul.Config{
 				LogLevel: config.String("DEBUG"),
 			},
 			false,
 		},
+		{
+			"log-level_lowercase",
+			[]string{"-log-level", "info"},
+			&envconsul.Config{
+				LogLevel: config.String("info"),
+			},
+			false,
+		},
 		{
 			"max-stale",
 			[]string{"-max-stale", "10s"},
-			&Config{
+			&envconsul.Config{
 				MaxStale: config.TimeDuration(10 * time.Second),
 			},
 			false,
 		},
+		{
+			"named-pipe",
+			[]string{"-named-pipe", "/tmp/env.fifo"},
+			&envconsul.Config{
+				NamedPipe: config.String("/tmp/env.fifo"),
+			},
+			false,
+		},
+		{
+			"namespace-datacenters",
+			[]string{"-namespace-datacenters"},
+			&envconsul.Config{
+				NamespaceDatacenters: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"once-retry",
+			[]string{"-once-retry"},
+			&envconsul.Config{
+				OnceRetry: &config.RetryConfig{
+					Enabled: config.Bool(true),
+				},
+			},
+			false,
+		},
+		{
+			"once-retry-attempts",
+			[]string{"-once-retry-attempts", "5"},
+			&envconsul.Config{
+				OnceRetry: &config.RetryConfig{
+					Attempts: config.Int(5),
+				},
+			},
+			false,
+		},
+		{
+			"once-retry-backoff",
+			[]string{"-once-retry-backoff", "1s"},
+			&envconsul.Config{
+				OnceRetry: &config.RetryConfig{
+					Backoff: config.TimeDuration(time.Second),
+				},
+			},
+			false,
+		},
+		{
+			"once-retry-max-backoff",
+			[]string{"-once-retry-max-backoff", "10s"},
+			&envconsul.Config{
+				OnceRetry: &config.RetryConfig{
+					MaxBackoff: config.TimeDuration(10 * time.Second),
+				},
+			},
+			false,
+		},
+		{
+			"output-file",
+			[]string{"-output-file", "/tmp/env"},
+			&envconsul.Config{
+				Output: &envconsul.OutputConfig{
+					Path: config.String("/tmp/env"),
+				},
+			},
+			false,
+		},
+		{
+			"output-format",
+			[]string{"-output-format", "json"},
+			&envconsul.Config{
+				Output: &envconsul.OutputConfig{
+					Format: config.String("json"),
+				},
+			},
+			false,
+		},
+		{
+			"output-dir",
+			[]string{"-output-dir", "/run/secrets"},
+			&envconsul.Config{
+				Output: &envconsul.OutputConfig{
+					Dir: config.String("/run/secrets"),
+				},
+			},
+			false,
+		},
+		{
+			"output-dotenv-quoting",
+			[]string{"-output-dotenv-quoting", "never"},
+			&envconsul.Config{
+				Output: &envconsul.OutputConfig{
+					DotenvQuoting: config.String("never"),
+				},
+			},
+			false,
+		},
 		{
 			"pid-file",
 			[]string{"-pid-file", "/var/pid/file"},
-			&Config{
+			&envconsul.Config{
 				PidFile: config.String("/var/pid/file"),
 			},
 			false,
@@ -507,9 +709,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"prefix",
 			[]string{"-prefix", "foo/bar"},
-			&Config{
-				Prefixes: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Prefixes: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path: config.String("foo/bar"),
 					},
 				},
@@ -522,12 +724,12 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-prefix", "foo/bar",
 				"-prefix", "zip/zap",
 			},
-			&Config{
-				Prefixes: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Prefixes: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path: config.String("foo/bar"),
 					},
-					&PrefixConfig{
+					&envconsul.PrefixConfig{
 						Path: config.String("zip/zap"),
 					},
 				},
@@ -537,9 +739,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"no-prefix",
 			[]string{"-prefix", "foo/bar", "-no-prefix"},
-			&Config{
-				Prefixes: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Prefixes: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path:     config.String("foo/bar"),
 						NoPrefix: config.Bool(true),
 					},
@@ -550,9 +752,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"no-prefix",
 			[]string{"-secret", "foo/bar", "-no-prefix"},
-			&Config{
-				Secrets: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Secrets: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path:     config.String("foo/bar"),
 						NoPrefix: config.Bool(true),
 					},
@@ -563,9 +765,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"no-prefix-false",
 			[]string{"-prefix", "foo/bar", "-no-prefix=false"},
-			&Config{
-				Prefixes: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Prefixes: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path:     config.String("foo/bar"),
 						NoPrefix: config.Bool(false),
 					},
@@ -576,9 +778,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"no-prefix-nil-default",
 			[]string{"-prefix", "foo/bar"},
-			&Config{
-				Prefixes: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Prefixes: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path:     config.String("foo/bar"),
 						NoPrefix: nil,
 					},
@@ -589,7 +791,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"pristine",
 			[]string{"-pristine"},
-			&Config{
+			&envconsul.Config{
 				Pristine: config.Bool(true),
 			},
 			false,
@@ -597,25 +799,41 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"reload-signal",
 			[]string{"-reload-signal", "SIGUSR1"},
-			&Config{
+			&envconsul.Config{
 				ReloadSignal: config.Signal(syscall.SIGUSR1),
 			},
 			false,
 		},
+		{
+			"require-utf8",
+			[]string{"-require-utf8"},
+			&envconsul.Config{
+				RequireUTF8: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"sanitize",
 			[]string{"-sanitize"},
-			&Config{
+			&envconsul.Config{
 				Sanitize: config.Bool(true),
 			},
 			false,
 		},
+		{
+			"sanitize-replacement",
+			[]string{"-sanitize-replacement", "__"},
+			&envconsul.Config{
+				SanitizeReplacement: config.String("__"),
+			},
+			false,
+		},
 		{
 			"secret",
 			[]string{"-secret", "foo/bar"},
-			&Config{
-				Secrets: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Secrets: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path: config.String("foo/bar"),
 					},
 				},
@@ -628,12 +846,12 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-secret", "foo/bar",
 				"-secret", "zip/zap",
 			},
-			&Config{
-				Secrets: &PrefixConfigs{
-					&PrefixConfig{
+			&envconsul.Config{
+				Secrets: &envconsul.PrefixConfigs{
+					&envconsul.PrefixConfig{
 						Path: config.String("foo/bar"),
 					},
-					&PrefixConfig{
+					&envconsul.PrefixConfig{
 						Path: config.String("zip/zap"),
 					},
 				},
@@ -645,9 +863,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 			[]string{
 				"-query", "service",
 			},
-			&Config{
-				Services: &ServiceConfigs{
-					&ServiceConfig{
+			&envconsul.Config{
+				Services: &envconsul.ServiceConfigs{
+					&envconsul.ServiceConfig{
 						Query: config.String("service"),
 					},
 				},
@@ -661,15 +879,15 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-query", "tag.service",
 				"-query", "tag.service@datacenter",
 			},
-			&Config{
-				Services: &ServiceConfigs{
-					&ServiceConfig{
+			&envconsul.Config{
+				Services: &envconsul.ServiceConfigs{
+					&envconsul.ServiceConfig{
 						Query: config.String("service"),
 					},
-					&ServiceConfig{
+					&envconsul.ServiceConfig{
 						Query: config.String("tag.service"),
 					},
-					&ServiceConfig{
+					&envconsul.ServiceConfig{
 						Query: config.String("tag.service@datacenter"),
 					},
 				},
@@ -685,16 +903,30 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-service-format-address", "host",
 				"-service-format-tag", "tag",
 				"-service-format-port", "port",
-			},
-			&Config{
-				Services: &ServiceConfigs{
-					&ServiceConfig{
-						Query:         config.String("service"),
-						FormatId:      config.String("id"),
-						FormatName:    config.String("name"),
-						FormatAddress: config.String("host"),
-						FormatTag:     config.String("tag"),
-						FormatPort:    config.String("port"),
+				"-service-format-node", "node",
+				"-service-format-status", "status",
+				"-service-format-srv", "srv",
+				"-service-format-tagged-address", "tagged",
+				"-service-group-by-tag", "group=",
+				"-service-instance", "first",
+				"-service-sort", "port",
+			},
+			&envconsul.Config{
+				Services: &envconsul.ServiceConfigs{
+					&envconsul.ServiceConfig{
+						Query:               config.String("service"),
+						FormatId:            config.String("id"),
+						FormatName:          config.String("name"),
+						FormatAddress:       config.String("host"),
+						FormatTag:           config.String("tag"),
+						FormatPort:          config.String("port"),
+						FormatNode:          config.String("node"),
+						FormatStatus:        config.String("status"),
+						FormatSRV:           config.String("srv"),
+						FormatTaggedAddress: config.String("tagged"),
+						GroupByTag:          config.String("group="),
+						Instance:            config.String("first"),
+						Sort:                config.String("port"),
 					},
 				},
 			},
@@ -716,9 +948,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-service-format-tag", "bar/tag",
 				"-service-format-port", "bar/port",
 			},
-			&Config{
-				Services: &ServiceConfigs{
-					&ServiceConfig{
+			&envconsul.Config{
+				Services: &envconsul.ServiceConfigs{
+					&envconsul.ServiceConfig{
 						Query:         config.String("foo"),
 						FormatId:      config.String("foo/id"),
 						FormatName:    config.String("foo/name"),
@@ -726,7 +958,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 						FormatTag:     config.String("foo/tag"),
 						FormatPort:    config.String("foo/port"),
 					},
-					&ServiceConfig{
+					&envconsul.ServiceConfig{
 						Query:         config.String("bar"),
 						FormatId:      config.String("bar/id"),
 						FormatName:    config.String("bar/name"),
@@ -741,7 +973,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"syslog",
 			[]string{"-syslog"},
-			&Config{
+			&envconsul.Config{
 				Syslog: &config.SyslogConfig{
 					Enabled: config.Bool(true),
 				},
@@ -751,17 +983,41 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"syslog-facility",
 			[]string{"-syslog-facility", "LOCAL0"},
-			&Config{
+			&envconsul.Config{
 				Syslog: &config.SyslogConfig{
 					Facility: config.String("LOCAL0"),
 				},
 			},
 			false,
 		},
+		{
+			"telemetry-addr",
+			[]string{"-telemetry-addr", "127.0.0.1:9102"},
+			&envconsul.Config{
+				TelemetryAddr: config.String("127.0.0.1:9102"),
+			},
+			false,
+		},
+		{
+			"tolerate-stale",
+			[]string{"-tolerate-stale"},
+			&envconsul.Config{
+				TolerateStale: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"trim-key-names",
+			[]string{"-trim-key-names"},
+			&envconsul.Config{
+				TrimKeyNames: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"upcase",
 			[]string{"-upcase"},
-			&Config{
+			&envconsul.Config{
 				Upcase: config.Bool(true),
 			},
 			false,
@@ -769,7 +1025,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-addr",
 			[]string{"-vault-addr", "vault_addr"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Address: config.String("vault_addr"),
 				},
@@ -779,7 +1035,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-grace",
 			[]string{"-vault-grace", "10s"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Grace: config.TimeDuration(10 * time.Second),
 				},
@@ -789,7 +1045,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-retry",
 			[]string{"-vault-retry"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Retry: &config.RetryConfig{
 						Enabled: config.Bool(true),
@@ -801,7 +1057,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-retry-attempts",
 			[]string{"-vault-retry-attempts", "20"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Retry: &config.RetryConfig{
 						Attempts: config.Int(20),
@@ -813,7 +1069,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-retry-backoff",
 			[]string{"-vault-retry-backoff", "30s"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Retry: &config.RetryConfig{
 						Backoff: config.TimeDuration(30 * time.Second),
@@ -825,7 +1081,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-retry-max-backoff",
 			[]string{"-vault-retry-max-backoff", "60s"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Retry: &config.RetryConfig{
 						MaxBackoff: config.TimeDuration(60 * time.Second),
@@ -837,17 +1093,25 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-renew-token",
 			[]string{"-vault-renew-token"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					RenewToken: config.Bool(true),
 				},
 			},
 			false,
 		},
+		{
+			"vault-sealed-interval",
+			[]string{"-vault-sealed-interval", "1m"},
+			&envconsul.Config{
+				VaultSealedInterval: config.TimeDuration(1 * time.Minute),
+			},
+			false,
+		},
 		{
 			"vault-ssl",
 			[]string{"-vault-ssl"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						Enabled: config.Bool(true),
@@ -859,7 +1123,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-ssl-ca-cert",
 			[]string{"-vault-ssl-ca-cert", "ca_cert"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						CaCert: config.String("ca_cert"),
@@ -871,7 +1135,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-ssl-ca-path",
 			[]string{"-vault-ssl-ca-path", "ca_path"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						CaPath: config.String("ca_path"),
@@ -883,7 +1147,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-ssl-cert",
 			[]string{"-vault-ssl-cert", "cert"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						Cert: config.String("cert"),
@@ -895,7 +1159,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-ssl-key",
 			[]string{"-vault-ssl-key", "key"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						Key: config.String("key"),
@@ -907,7 +1171,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-ssl-server-name",
 			[]string{"-vault-ssl-server-name", "server_name"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						ServerName: config.String("server_name"),
@@ -919,7 +1183,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-ssl-verify",
 			[]string{"-vault-ssl-verify"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					SSL: &config.SSLConfig{
 						Verify: config.Bool(true),
@@ -931,17 +1195,33 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-token",
 			[]string{"-vault-token", "token"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Token: config.String("token"),
 				},
 			},
 			false,
 		},
+		{
+			"vault-token-mandatory",
+			[]string{"-vault-token-mandatory=false"},
+			&envconsul.Config{
+				VaultTokenMandatory: config.Bool(false),
+			},
+			false,
+		},
+		{
+			"vault-token-renew-grace",
+			[]string{"-vault-token-renew-grace", "5m"},
+			&envconsul.Config{
+				VaultTokenRenewGrace: config.TimeDuration(5 * time.Minute),
+			},
+			false,
+		},
 		{
 			"vault-transport-dial-keep-alive",
 			[]string{"-vault-transport-dial-keep-alive", "30s"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Transport: &config.TransportConfig{
 						DialKeepAlive: config.TimeDuration(30 * time.Second),
@@ -953,7 +1233,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-transport-dial-timeout",
 			[]string{"-vault-transport-dial-timeout", "30s"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Transport: &config.TransportConfig{
 						DialTimeout: config.TimeDuration(30 * time.Second),
@@ -965,7 +1245,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-transport-disable-keep-alives",
 			[]string{"-vault-transport-disable-keep-alives"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Transport: &config.TransportConfig{
 						DisableKeepAlives: config.Bool(true),
@@ -977,7 +1257,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-transport-max-idle-conns-per-host",
 			[]string{"-vault-transport-max-idle-conns-per-host", "100"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Transport: &config.TransportConfig{
 						MaxIdleConnsPerHost: config.Int(100),
@@ -989,7 +1269,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-transport-tls-handshake-timeout",
 			[]string{"-vault-transport-tls-handshake-timeout", "30s"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					Transport: &config.TransportConfig{
 						TLSHandshakeTimeout: config.TimeDuration(30 * time.Second),
@@ -1001,7 +1281,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"vault-unwrap-token",
 			[]string{"-vault-unwrap-token"},
-			&Config{
+			&envconsul.Config{
 				Vault: &config.VaultConfig{
 					UnwrapToken: config.Bool(true),
 				},
@@ -1011,7 +1291,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"wait_min",
 			[]string{"-wait", "10s"},
-			&Config{
+			&envconsul.Config{
 				Wait: &config.WaitConfig{
 					Min: config.TimeDuration(10 * time.Second),
 					Max: config.TimeDuration(40 * time.Second),
@@ -1022,7 +1302,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"wait_min_max",
 			[]string{"-wait", "10s:30s"},
-			&Config{
+			&envconsul.Config{
 				Wait: &config.WaitConfig{
 					Min: config.TimeDuration(10 * time.Second),
 					Max: config.TimeDuration(30 * time.Second),
@@ -1035,7 +1315,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 		{
 			"command",
 			[]string{"my", "command", "to", "run"},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					Enabled: config.Bool(true),
 					Command: config.String("my command to run"),
@@ -1049,7 +1329,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"-exec", "command 1",
 				"command", "2",
 			},
-			&Config{
+			&envconsul.Config{
 				Exec: &config.ExecConfig{
 					Enabled: config.Bool(true),
 					Command: config.String("command 1"),
@@ -1070,7 +1350,7 @@ func TestCLI_ParseFlags(t *testing.T) {
 			}
 
 			if tc.e != nil {
-				tc.e = DefaultConfig().Merge(tc.e)
+				tc.e = envconsul.DefaultConfig().Merge(tc.e)
 			}
 
 			if !reflect.DeepEqual(tc.e, a) {
@@ -1079,3 +1359,40 @@ func TestCLI_ParseFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestCLI_reloadedFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.hcl")
+	b := filepath.Join(dir, "b.hcl")
+	if err := ioutil.WriteFile(a, []byte(`upcase = true`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte(`sanitize = true`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{a, b}
+	prev := configChecksums(paths)
+
+	if err := ioutil.WriteFile(b, []byte(`sanitize = false`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfigs(paths, envconsul.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newReloadedRunner(cfg, true, prev, configChecksums(paths))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := r.ReloadedFrom(); !reflect.DeepEqual(v, []string{b}) {
+		t.Errorf("expected reloaded from %q, got %q", []string{b}, v)
+	}
+}
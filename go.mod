@@ -3,10 +3,14 @@ module github.com/hashicorp/envconsul
 go 1.12
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/hashicorp/consul-template v0.21.0
+	github.com/hashicorp/consul/api v1.1.0
 	github.com/hashicorp/go-gatedio v0.5.0
 	github.com/hashicorp/hcl v1.0.0
+	github.com/hashicorp/vault/api v1.0.5-0.20190730042357-746c0b111519
 	github.com/mattn/go-shellwords v1.0.5
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pkg/errors v0.8.1
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLockHeld is returned when the lock file is held by another process and
+// we were not asked to wait for it.
+var ErrLockHeld = errors.New("lock file is held by another process")
+
+// fileLock is an exclusive advisory lock on a file, held for the lifetime of
+// the process to prevent concurrent instances.
+type fileLock struct {
+	f *os.File
+}
+
+// acquireLock opens (creating if needed) the file at path and takes an
+// exclusive lock on it. If the lock is held elsewhere, ErrLockHeld is returned
+// unless wait is true, in which case this blocks until the lock is released.
+func acquireLock(path string, wait bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening lock file")
+	}
+
+	log.Printf("[INFO] (lock) acquiring lock on %q (wait: %t)", path, wait)
+	if err := flock(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Record the holder to help operators find the competing instance.
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d", os.Getpid())
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+// Release releases the lock. The lock file itself is left in place, since
+// removing it would race with another instance opening it.
+func (l *fileLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	log.Printf("[DEBUG] (lock) releasing lock on %q", l.f.Name())
+	return l.f.Close()
+}
@@ -0,0 +1,15 @@
+//go:build windows || solaris
+// +build windows solaris
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// flock is not supported on this platform.
+func flock(f *os.File, wait bool) error {
+	return fmt.Errorf("lock_file is not supported on %s", runtime.GOOS)
+}
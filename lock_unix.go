@@ -0,0 +1,33 @@
+//go:build !windows && !solaris
+// +build !windows,!solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// flock takes an exclusive flock(2) on the given file.
+func flock(f *os.File, wait bool) error {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return ErrLockHeld
+		default:
+			return errors.Wrap(err, "locking lock file")
+		}
+	}
+}
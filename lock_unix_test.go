@@ -0,0 +1,41 @@
+//go:build !windows && !solaris
+// +build !windows,!solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "envconsul-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "envconsul.lock")
+
+	lock, err := acquireLock(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acquireLock(path, false); err != ErrLockHeld {
+		t.Fatalf("expected %q, got %v", ErrLockHeld, err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := acquireLock(path, false)
+	if err != nil {
+		t.Fatalf("expected to acquire released lock, got %s", err)
+	}
+	again.Release()
+}
@@ -0,0 +1,1634 @@
+package envconsul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/signals"
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultLogLevel is the default logging level.
+	DefaultLogLevel = "WARN"
+
+	// DefaultEmptyEnvExitCode is the default exit code for an empty
+	// environment, which disables the check.
+	DefaultEmptyEnvExitCode = -1
+
+	// DefaultMaxStale is the default staleness permitted. This enables stale
+	// queries by default for performance reasons.
+	DefaultMaxStale = 2 * time.Second
+
+	// DefaultVaultSealedInterval is the default time between reads of a
+	// sealed Vault.
+	DefaultVaultSealedInterval = 30 * time.Second
+
+	// DefaultVaultTokenRenewGrace is the default time renewals of the Vault
+	// token may fail before the failure is terminal.
+	DefaultVaultTokenRenewGrace = 1 * time.Minute
+
+	// CaseFoldPolicyError, CaseFoldPolicyFirst and CaseFoldPolicyLast are the
+	// ways of resolving secret fields which collide once upcased: failing, or
+	// keeping the first or last field in sorted order.
+	CaseFoldPolicyError = "error"
+	CaseFoldPolicyFirst = "first"
+	CaseFoldPolicyLast  = "last"
+
+	// DefaultReloadSignal is the default signal for reload.
+	DefaultReloadSignal = syscall.SIGHUP
+
+	// DefaultKillSignal is the default signal for termination.
+	DefaultKillSignal = syscall.SIGINT
+
+	// DefaultSanitizeReplacement is the default replacement for invalid
+	// characters in keys.
+	DefaultSanitizeReplacement = "_"
+)
+
+// Config is used to configure Consul ENV
+type Config struct {
+	// AnnotateSources injects a companion "__ENVCONSUL_SOURCE_<key>" variable
+	// holding the path of the source of each key, for debugging.
+	AnnotateSources *bool `mapstructure:"annotate_sources"`
+
+	// CacheTTL is the maximum time a secret read from Vault is cached and
+	// shared between reads of the same path and version. Secrets are never
+	// cached beyond their lease. Zero disables the cache.
+	CacheTTL *time.Duration `mapstructure:"cache_ttl"`
+
+	// CaseFoldPolicy controls how secret fields which collide once upcased,
+	// such as "Bar" and "bar", are resolved. One of "error", "first" or "last".
+	CaseFoldPolicy *string `mapstructure:"case_fold_policy"`
+
+	// Consul is the configuration for connecting to a Consul cluster.
+	Consul *config.ConsulConfig `mapstructure:"consul"`
+
+	// DeltaFile is the path to a file which is rewritten on every change to
+	// the environment, listing the keys that were added, changed or removed.
+	DeltaFile *string `mapstructure:"delta_file"`
+
+	// DryRun resolves the environment once, prints it to stdout and exits,
+	// without starting the child process or writing any files.
+	DryRun *bool `mapstructure:"dry_run"`
+
+	// DryRunRedact replaces the values of secrets and keys matching RedactKeys
+	// in the output of DryRun with "***".
+	DryRunRedact *bool `mapstructure:"dry_run_redact"`
+
+	// EmitApplyOrder injects ENVCONSUL_APPLY_ORDER, the kinds of sources in
+	// the order they are applied, lowest precedence first, into the child's
+	// environment.
+	EmitApplyOrder *bool `mapstructure:"emit_apply_order"`
+
+	// EmitBanner writes a one-line summary of the configuration to stderr at
+	// startup.
+	EmitBanner *bool `mapstructure:"emit_banner"`
+
+	// EmitConfigHash injects ENVCONSUL_CONFIG_HASH, a hash of the merged
+	// configuration, into the child's environment.
+	EmitConfigHash *bool `mapstructure:"emit_config_hash"`
+
+	// EmitCounts injects ENVCONSUL_COUNTS, the number of keys from each kind of
+	// source as JSON, into the child's environment.
+	EmitCounts *bool `mapstructure:"emit_counts"`
+
+	// EmitLastFetch injects ENVCONSUL_LAST_FETCH, the time of the most recent
+	// successful render in RFC3339 format, into the child's environment.
+	EmitLastFetch *bool `mapstructure:"emit_last_fetch"`
+
+	// EmitLogLevel injects ENVCONSUL_LOG_LEVEL, the level envconsul logs at, so the
+	// child can log at the same level.
+	EmitLogLevel *bool `mapstructure:"emit_log_level"`
+
+	// EmitMode injects ENVCONSUL_MODE, "once" or "watch" depending on how
+	// envconsul was launched, into the child's environment.
+	EmitMode *bool `mapstructure:"emit_mode"`
+
+	// EmitNodeName injects ENVCONSUL_NODE, the node name of the local Consul agent,
+	// looked up when envconsul starts.
+	EmitNodeName *bool `mapstructure:"emit_node_name"`
+
+	// EmitOverrides injects ENVCONSUL_OVERRIDDEN, the keys set by more than one
+	// prefix, secret or service, into the child's environment.
+	EmitOverrides *bool `mapstructure:"emit_overrides"`
+
+	// EmitRestartCount injects ENVCONSUL_RESTART_COUNT, the number of times the
+	// child process has been restarted, into the child's environment.
+	EmitRestartCount *bool `mapstructure:"emit_restart_count"`
+
+	// EmitSecretsChecksum injects ENVCONSUL_SECRETS_CHECKSUM, a checksum of the
+	// keys and values read from Vault only, into the child's environment.
+	EmitSecretsChecksum *bool `mapstructure:"emit_secrets_checksum"`
+
+	// EmitTokenTTL injects ENVCONSUL_VAULT_TOKEN_TTL, the remaining TTL of the
+	// Vault token in seconds, into the child's environment.
+	EmitTokenTTL *bool `mapstructure:"emit_token_ttl"`
+
+	// EmitWatchPaths injects ENVCONSUL_WATCHES, the sorted paths of the
+	// prefixes, secrets and services being watched, into the child's environment.
+	EmitWatchPaths *bool `mapstructure:"emit_watch_paths"`
+
+	// EmptyEnvExitCode is the exit code with which envconsul exits, in place of
+	// starting the child, when no variables are read from any prefix, secret or
+	// service or set in the exec block. It only applies before the child first
+	// starts. A negative code disables the check.
+	EmptyEnvExitCode *int `mapstructure:"empty_env_exit_code"`
+
+	// EnvPrefix is prepended to the name of every variable read from a prefix,
+	// secret or service, after any per-source formatting.
+	EnvPrefix *string `mapstructure:"env_prefix"`
+
+	// EnvSocket is the path of a Unix socket on which the environment is served
+	// in dotenv format to each client which connects.
+	EnvSocket *string `mapstructure:"env_socket"`
+
+	// EnvSocketRedact replaces the values of secrets and keys matching
+	// RedactKeys served on EnvSocket with "***".
+	EnvSocketRedact *bool `mapstructure:"env_socket_redact"`
+
+	// EnvSuffix is appended to the name of every variable read from a prefix,
+	// secret or service, after any per-source formatting.
+	EnvSuffix *string `mapstructure:"env_suffix"`
+
+	// Exec is the configuration for exec/supervise mode.
+	Exec *config.ExecConfig `mapstructure:"exec"`
+
+	// ExecShell is the path of a shell, such as "/bin/sh", with which the exec
+	// command is run as "<shell> -c <command>", rather than being split into
+	// arguments and run directly. It is written inside the exec stanza as "shell".
+	ExecShell *string `mapstructure:"exec_shell"`
+
+	// HealthProbe is the configuration for periodically probing the health of
+	// the child process. It is written inside the exec stanza.
+	HealthProbe *HealthProbeConfig `mapstructure:"health_probe"`
+
+	// KillSignal is the signal to listen for a graceful terminate event.
+	KillSignal *os.Signal `mapstructure:"kill_signal"`
+
+	// LockFile is the path to a file which is locked for the lifetime of the
+	// process, preventing concurrent instances using the same lock file.
+	LockFile *string `mapstructure:"lock_file"`
+
+	// LockWait waits for the lock file to be released, rather than exiting, if
+	// it is held by another instance.
+	LockWait *bool `mapstructure:"lock_wait"`
+
+	// LogEnvDiff logs the keys that were added, changed or removed each time the
+	// environment changes. Values are redacted like those of DeltaFile.
+	LogEnvDiff *bool `mapstructure:"log_env_diff"`
+
+	// LogLevel is the level with which to log for this config.
+	LogLevel *string `mapstructure:"log_level"`
+
+	// MaxStale is the maximum amount of time for staleness from Consul as given
+	// by LastContact.
+	MaxStale *time.Duration `mapstructure:"max_stale"`
+
+	// NamedPipe is the path to a named pipe (FIFO) to which the environment is
+	// written in dotenv format on every change. Writes are skipped if there is
+	// no reader.
+	NamedPipe *string `mapstructure:"named_pipe"`
+
+	// NamespaceDatacenters prepends the datacenter to the keys of each prefix
+	// whose path is read from more than one datacenter, using the "path@dc"
+	// syntax, so that the keys of each datacenter do not collide.
+	NamespaceDatacenters *bool `mapstructure:"namespace_datacenters"`
+
+	// OnceRetry is the configuration for retrying the first fetch of every
+	// dependency in once mode, on top of the Consul and Vault retries.
+	OnceRetry *config.RetryConfig `mapstructure:"once_retry"`
+
+	// Output is the configuration for writing the environment to a file on
+	// every render.
+	Output *OutputConfig `mapstructure:"output"`
+
+	// PidFile is the path on disk where a PID file should be written containing
+	// this processes PID.
+	PidFile *string `mapstructure:"pid_file"`
+
+	// Prefixes is the list of all prefix dependencies (consul)
+	// in merge order.
+	Prefixes *PrefixConfigs `mapstructure:"prefix"`
+
+	// Pristine indicates that we want a clean environment only
+	// composed of consul config variables, not inheriting from exising
+	// environment
+	Pristine *bool `mapstructure:"pristine"`
+
+	// RedactKeys is a list of glob patterns for keys whose values are redacted
+	// in every log and diagnostic output, regardless of their source.
+	RedactKeys []string `mapstructure:"redact_keys"`
+
+	// ReloadSignal is the signal to listen for a reload event.
+	ReloadSignal *os.Signal `mapstructure:"reload_signal"`
+
+	// RenewThreshold controls when the leases of Vault secrets are renewed:
+	// either a fraction of the lease, such as "0.7", or a duration before the
+	// lease expires, such as "30s". Secrets which cannot be renewed are read
+	// again at the same point. Empty uses the Vault library's default.
+	RenewThreshold *string `mapstructure:"renew_threshold"`
+
+	// RequireUTF8 fails a render, listing the keys, if any value is not valid
+	// UTF-8, rather than passing the bytes to the child as is.
+	RequireUTF8 *bool `mapstructure:"require_utf8"`
+
+	// RestartCooldown is the configuration for deferring restarts of the child
+	// process after a burst of restarts.
+	RestartCooldown *RestartCooldownConfig `mapstructure:"restart_cooldown"`
+
+	// RestartCoordinationLock is the configuration for a Consul semaphore which
+	// limits how many replicas restart their child processes at once.
+	RestartCoordinationLock *RestartCoordinationLockConfig `mapstructure:"restart_coordination_lock"`
+
+	// Sanitize converts any "bad" characters in key values to underscores
+	Sanitize *bool `mapstructure:"sanitize"`
+
+	// SanitizeReplacement is the string which replaces each invalid character
+	// in keys when Sanitize is enabled.
+	SanitizeReplacement *string `mapstructure:"sanitize_replacement"`
+
+	// Secrets is the list of all secret dependencies (vault)
+	Secrets *PrefixConfigs `mapstructure:"secret"`
+
+	Services *ServiceConfigs `mapstructure:"service"`
+
+	// Syslog is the configuration for syslog.
+	Syslog *config.SyslogConfig `mapstructure:"syslog"`
+
+	// TelemetryAddr is the address of an HTTP server exposing metrics of the
+	// runner in the Prometheus text format, or empty to disable it.
+	TelemetryAddr *string `mapstructure:"telemetry_addr"`
+
+	// TimeWindows is the list of variables which are only injected during a
+	// daily window of time.
+	TimeWindows *TimeWindowConfigs `mapstructure:"time_window"`
+
+	// TolerateStale keeps the child running with the last rendered environment
+	// when fetching a dependency or rendering fails after the first successful
+	// render, instead of exiting. The error is logged and the dependency is
+	// retried until it recovers.
+	TolerateStale *bool `mapstructure:"tolerate_stale"`
+
+	// TrimKeyNames trims leading and trailing whitespace from the names of
+	// keys read from Consul and Vault.
+	TrimKeyNames *bool `mapstructure:"trim_key_names"`
+
+	// Upcase converts environment variables to uppercase
+	Upcase *bool `mapstructure:"upcase"`
+
+	// Vault is the configuration for connecting to a vault server.
+	Vault *config.VaultConfig `mapstructure:"vault"`
+
+	// VaultAuth is the configuration for logging in to Vault with an auth
+	// method to obtain the Vault token.
+	VaultAuth *VaultAuthConfig `mapstructure:"vault_auth"`
+
+	// VaultSealedInterval is how often a secret is read again while Vault is
+	// sealed and its last value is kept. Zero retries a sealed Vault like any
+	// other error.
+	VaultSealedInterval *time.Duration `mapstructure:"vault_sealed_interval"`
+
+	// VaultTokenMandatory treats a Vault token which can no longer be renewed
+	// as fatal: the child is stopped with the kill signal and envconsul exits
+	// with an error, rather than carrying on with secrets which are no longer
+	// refreshed. It has no effect unless the token is renewed.
+	VaultTokenMandatory *bool `mapstructure:"vault_token_mandatory"`
+
+	// VaultTokenRenewGrace is how long renewals of the Vault token may keep
+	// failing before VaultTokenMandatory treats the failure as terminal.
+	VaultTokenRenewGrace *time.Duration `mapstructure:"vault_token_renew_grace"`
+
+	// Wait is the quiescence timers.
+	Wait *config.WaitConfig `mapstructure:"wait"`
+
+	// WatchFiles is a list of paths of local files, such as configuration
+	// managed by another process, whose changes restart the child, or send it
+	// the exec reload signal if one is set.
+	WatchFiles []string `mapstructure:"watch_files"`
+}
+
+// Copy returns a deep copy of the current configuration. This is useful because
+// the nested data structures may be shared.
+func (c *Config) Copy() *Config {
+	var o Config
+
+	o.AnnotateSources = c.AnnotateSources
+
+	o.CacheTTL = c.CacheTTL
+
+	o.CaseFoldPolicy = c.CaseFoldPolicy
+
+	if c.Consul != nil {
+		o.Consul = c.Consul.Copy()
+	}
+
+	o.DeltaFile = c.DeltaFile
+
+	o.DryRun = c.DryRun
+
+	o.DryRunRedact = c.DryRunRedact
+
+	o.EmitApplyOrder = c.EmitApplyOrder
+
+	o.EmitBanner = c.EmitBanner
+
+	o.EmitConfigHash = c.EmitConfigHash
+
+	o.EmitCounts = c.EmitCounts
+
+	o.EmitLastFetch = c.EmitLastFetch
+
+	o.EmitLogLevel = c.EmitLogLevel
+
+	o.EmitMode = c.EmitMode
+
+	o.EmitNodeName = c.EmitNodeName
+
+	o.EmitOverrides = c.EmitOverrides
+
+	o.EmitRestartCount = c.EmitRestartCount
+
+	o.EmitSecretsChecksum = c.EmitSecretsChecksum
+
+	o.EmitTokenTTL = c.EmitTokenTTL
+
+	o.EmitWatchPaths = c.EmitWatchPaths
+
+	o.EmptyEnvExitCode = c.EmptyEnvExitCode
+
+	o.EnvPrefix = c.EnvPrefix
+
+	o.EnvSocket = c.EnvSocket
+
+	o.EnvSocketRedact = c.EnvSocketRedact
+
+	o.EnvSuffix = c.EnvSuffix
+
+	if c.Exec != nil {
+		o.Exec = c.Exec.Copy()
+	}
+
+	o.ExecShell = c.ExecShell
+
+	if c.HealthProbe != nil {
+		o.HealthProbe = c.HealthProbe.Copy()
+	}
+
+	o.KillSignal = c.KillSignal
+
+	o.LockFile = c.LockFile
+
+	o.LockWait = c.LockWait
+
+	o.LogEnvDiff = c.LogEnvDiff
+
+	o.LogLevel = c.LogLevel
+
+	o.MaxStale = c.MaxStale
+
+	o.NamedPipe = c.NamedPipe
+
+	o.NamespaceDatacenters = c.NamespaceDatacenters
+
+	if c.OnceRetry != nil {
+		o.OnceRetry = c.OnceRetry.Copy()
+	}
+
+	if c.Output != nil {
+		o.Output = c.Output.Copy()
+	}
+
+	o.PidFile = c.PidFile
+
+	if c.RedactKeys != nil {
+		o.RedactKeys = append([]string{}, c.RedactKeys...)
+	}
+
+	o.ReloadSignal = c.ReloadSignal
+
+	o.RenewThreshold = c.RenewThreshold
+
+	o.RequireUTF8 = c.RequireUTF8
+
+	if c.RestartCooldown != nil {
+		o.RestartCooldown = c.RestartCooldown.Copy()
+	}
+
+	if c.RestartCoordinationLock != nil {
+		o.RestartCoordinationLock = c.RestartCoordinationLock.Copy()
+	}
+
+	if c.Prefixes != nil {
+		o.Prefixes = c.Prefixes.Copy()
+	}
+
+	o.Services = c.Services
+
+	o.Pristine = c.Pristine
+
+	o.Sanitize = c.Sanitize
+
+	o.SanitizeReplacement = c.SanitizeReplacement
+
+	if c.Secrets != nil {
+		o.Secrets = c.Secrets.Copy()
+	}
+
+	if c.Syslog != nil {
+		o.Syslog = c.Syslog.Copy()
+	}
+
+	if c.TimeWindows != nil {
+		o.TimeWindows = c.TimeWindows.Copy()
+	}
+
+	o.TrimKeyNames = c.TrimKeyNames
+
+	o.TolerateStale = c.TolerateStale
+
+	o.TelemetryAddr = c.TelemetryAddr
+
+	o.Upcase = c.Upcase
+
+	if c.Vault != nil {
+		o.Vault = c.Vault.Copy()
+	}
+
+	if c.VaultAuth != nil {
+		o.VaultAuth = c.VaultAuth.Copy()
+	}
+
+	o.VaultTokenMandatory = c.VaultTokenMandatory
+
+	o.VaultTokenRenewGrace = c.VaultTokenRenewGrace
+
+	o.VaultSealedInterval = c.VaultSealedInterval
+
+	if c.Wait != nil {
+		o.Wait = c.Wait.Copy()
+	}
+
+	if c.WatchFiles != nil {
+		o.WatchFiles = append([]string{}, c.WatchFiles...)
+	}
+
+	return &o
+}
+
+func (c *Config) Merge(o *Config) *Config {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.AnnotateSources != nil {
+		r.AnnotateSources = o.AnnotateSources
+	}
+
+	if o.CacheTTL != nil {
+		r.CacheTTL = o.CacheTTL
+	}
+
+	if o.CaseFoldPolicy != nil {
+		r.CaseFoldPolicy = o.CaseFoldPolicy
+	}
+
+	if o.Consul != nil {
+		r.Consul = r.Consul.Merge(o.Consul)
+	}
+
+	if o.DeltaFile != nil {
+		r.DeltaFile = o.DeltaFile
+	}
+
+	if o.DryRun != nil {
+		r.DryRun = o.DryRun
+	}
+
+	if o.DryRunRedact != nil {
+		r.DryRunRedact = o.DryRunRedact
+	}
+
+	if o.EmitApplyOrder != nil {
+		r.EmitApplyOrder = o.EmitApplyOrder
+	}
+
+	if o.EmitBanner != nil {
+		r.EmitBanner = o.EmitBanner
+	}
+
+	if o.EmitConfigHash != nil {
+		r.EmitConfigHash = o.EmitConfigHash
+	}
+
+	if o.EmitCounts != nil {
+		r.EmitCounts = o.EmitCounts
+	}
+
+	if o.EmitLastFetch != nil {
+		r.EmitLastFetch = o.EmitLastFetch
+	}
+
+	if o.EmitLogLevel != nil {
+		r.EmitLogLevel = o.EmitLogLevel
+	}
+
+	if o.EmitMode != nil {
+		r.EmitMode = o.EmitMode
+	}
+
+	if o.EmitNodeName != nil {
+		r.EmitNodeName = o.EmitNodeName
+	}
+
+	if o.EmitOverrides != nil {
+		r.EmitOverrides = o.EmitOverrides
+	}
+
+	if o.EmitRestartCount != nil {
+		r.EmitRestartCount = o.EmitRestartCount
+	}
+
+	if o.EmitSecretsChecksum != nil {
+		r.EmitSecretsChecksum = o.EmitSecretsChecksum
+	}
+
+	if o.EmitTokenTTL != nil {
+		r.EmitTokenTTL = o.EmitTokenTTL
+	}
+
+	if o.EmitWatchPaths != nil {
+		r.EmitWatchPaths = o.EmitWatchPaths
+	}
+
+	if o.EmptyEnvExitCode != nil {
+		r.EmptyEnvExitCode = o.EmptyEnvExitCode
+	}
+
+	if o.EnvPrefix != nil {
+		r.EnvPrefix = o.EnvPrefix
+	}
+
+	if o.EnvSocket != nil {
+		r.EnvSocket = o.EnvSocket
+	}
+
+	if o.EnvSocketRedact != nil {
+		r.EnvSocketRedact = o.EnvSocketRedact
+	}
+
+	if o.EnvSuffix != nil {
+		r.EnvSuffix = o.EnvSuffix
+	}
+
+	if o.Exec != nil {
+		r.Exec = r.Exec.Merge(o.Exec)
+	}
+
+	if o.ExecShell != nil {
+		r.ExecShell = o.ExecShell
+	}
+
+	if o.HealthProbe != nil {
+		r.HealthProbe = r.HealthProbe.Merge(o.HealthProbe)
+	}
+
+	if o.KillSignal != nil {
+		r.KillSignal = o.KillSignal
+	}
+
+	if o.LockFile != nil {
+		r.LockFile = o.LockFile
+	}
+
+	if o.LockWait != nil {
+		r.LockWait = o.LockWait
+	}
+
+	if o.LogEnvDiff != nil {
+		r.LogEnvDiff = o.LogEnvDiff
+	}
+
+	if o.LogLevel != nil {
+		r.LogLevel = o.LogLevel
+	}
+
+	if o.MaxStale != nil {
+		r.MaxStale = o.MaxStale
+	}
+
+	if o.NamedPipe != nil {
+		r.NamedPipe = o.NamedPipe
+	}
+
+	if o.NamespaceDatacenters != nil {
+		r.NamespaceDatacenters = o.NamespaceDatacenters
+	}
+
+	if o.OnceRetry != nil {
+		r.OnceRetry = r.OnceRetry.Merge(o.OnceRetry)
+	}
+
+	if o.Output != nil {
+		r.Output = r.Output.Merge(o.Output)
+	}
+
+	if o.PidFile != nil {
+		r.PidFile = o.PidFile
+	}
+
+	if o.RedactKeys != nil {
+		r.RedactKeys = append(r.RedactKeys, o.RedactKeys...)
+	}
+
+	if o.ReloadSignal != nil {
+		r.ReloadSignal = o.ReloadSignal
+	}
+
+	if o.RenewThreshold != nil {
+		r.RenewThreshold = o.RenewThreshold
+	}
+
+	if o.RequireUTF8 != nil {
+		r.RequireUTF8 = o.RequireUTF8
+	}
+
+	if o.RestartCooldown != nil {
+		r.RestartCooldown = r.RestartCooldown.Merge(o.RestartCooldown)
+	}
+
+	if o.RestartCoordinationLock != nil {
+		r.RestartCoordinationLock = r.RestartCoordinationLock.Merge(o.RestartCoordinationLock)
+	}
+
+	if o.Prefixes != nil {
+		r.Prefixes = r.Prefixes.Merge(o.Prefixes)
+	}
+
+	if o.Services != nil {
+		r.Services = r.Services.Merge(o.Services)
+	}
+
+	if o.Pristine != nil {
+		r.Pristine = o.Pristine
+	}
+
+	if o.Sanitize != nil {
+		r.Sanitize = o.Sanitize
+	}
+
+	if o.SanitizeReplacement != nil {
+		r.SanitizeReplacement = o.SanitizeReplacement
+	}
+
+	if o.Secrets != nil {
+		r.Secrets = r.Secrets.Merge(o.Secrets)
+	}
+
+	if o.Syslog != nil {
+		r.Syslog = r.Syslog.Merge(o.Syslog)
+	}
+
+	if o.TimeWindows != nil {
+		r.TimeWindows = r.TimeWindows.Merge(o.TimeWindows)
+	}
+
+	if o.TrimKeyNames != nil {
+		r.TrimKeyNames = o.TrimKeyNames
+	}
+
+	if o.TolerateStale != nil {
+		r.TolerateStale = o.TolerateStale
+	}
+
+	if o.TelemetryAddr != nil {
+		r.TelemetryAddr = o.TelemetryAddr
+	}
+
+	if o.Upcase != nil {
+		r.Upcase = o.Upcase
+	}
+
+	if o.Vault != nil {
+		r.Vault = r.Vault.Merge(o.Vault)
+	}
+
+	if o.VaultAuth != nil {
+		r.VaultAuth = r.VaultAuth.Merge(o.VaultAuth)
+	}
+
+	if o.VaultTokenMandatory != nil {
+		r.VaultTokenMandatory = o.VaultTokenMandatory
+	}
+
+	if o.VaultTokenRenewGrace != nil {
+		r.VaultTokenRenewGrace = o.VaultTokenRenewGrace
+	}
+
+	if o.VaultSealedInterval != nil {
+		r.VaultSealedInterval = o.VaultSealedInterval
+	}
+
+	if o.Wait != nil {
+		r.Wait = r.Wait.Merge(o.Wait)
+	}
+
+	if o.WatchFiles != nil {
+		r.WatchFiles = append(r.WatchFiles, o.WatchFiles...)
+	}
+
+	return r
+}
+
+// Hash returns a hex-encoded SHA-256 hash of the configuration. Tokens,
+// passwords and Vault login parameters are excluded, so the hash is safe to
+// expose and only changes when the rest of the configuration does.
+func (c *Config) Hash() (string, error) {
+	o := c.Copy()
+
+	if o.Consul != nil {
+		o.Consul.Token = nil
+		if o.Consul.Auth != nil {
+			o.Consul.Auth.Password = nil
+		}
+	}
+
+	if o.Vault != nil {
+		o.Vault.Token = nil
+	}
+
+	if o.VaultAuth != nil {
+		o.VaultAuth.Params = nil
+	}
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", errors.Wrap(err, "hashing config")
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Parse parses the given string contents as a config
+func Parse(s string) (*Config, error) {
+	var shadow interface{}
+	if err := hcl.Decode(&shadow, s); err != nil {
+		return nil, errors.Wrap(err, "error decoding config")
+	}
+
+	// Convert to a map and flatten the keys we want to flatten
+	parsed, ok := shadow.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("error converting config")
+	}
+
+	flattenKeys(parsed, []string{
+		"consul",
+		"consul.auth",
+		"consul.retry",
+		"consul.ssl",
+		"consul.transport",
+		"exec",
+		"exec.env",
+		"exec.health_probe",
+		"once_retry",
+		"output",
+		"restart_cooldown",
+		"restart_coordination_lock",
+		"syslog",
+		"vault",
+		"vault.retry",
+		"vault.ssl",
+		"vault.transport",
+		"vault_auth",
+		"vault_auth.params",
+		"wait",
+	})
+
+	// Blocks nested in each prefix and secret are flattened the same way.
+	if prefixes, ok := parsed["prefix"].([]map[string]interface{}); ok {
+		for _, p := range prefixes {
+			flattenKeys(p, []string{"defaults", "key_retry"})
+		}
+	}
+	if secrets, ok := parsed["secret"].([]map[string]interface{}); ok {
+		for _, s := range secrets {
+			flattenKeys(s, []string{"defaults", "request_headers"})
+			if rules, ok := s["split"].([]map[string]interface{}); ok {
+				for _, rule := range rules {
+					flattenKeys(rule, []string{"keys"})
+				}
+			}
+		}
+	}
+
+	// The exec stanza is decoded by consul-template, so the health probe and
+	// shell are lifted out of it into their own top-level keys.
+	if exec, ok := parsed["exec"].(map[string]interface{}); ok {
+		if probe, ok := exec["health_probe"]; ok {
+			parsed["health_probe"] = probe
+			delete(exec, "health_probe")
+		}
+		if shell, ok := exec["shell"]; ok {
+			parsed["exec_shell"] = shell
+			delete(exec, "shell")
+		}
+	}
+
+	// Deprecations
+	// TODO remove in 0.8.0
+	flattenKeys(parsed, []string{
+		"auth",
+		"ssl",
+	})
+	if auth, ok := parsed["auth"]; ok {
+		log.Printf("[WARN] auth is now a child stanza inside consul instead of a " +
+			"top-level stanza. Update your configuration files and change auth {} " +
+			"to consul { auth { ... } } instead.")
+		consul, ok := parsed["consul"].(map[string]interface{})
+		if !ok {
+			consul = map[string]interface{}{}
+		}
+		consul["auth"] = auth
+		parsed["consul"] = consul
+		delete(parsed, "auth")
+	}
+	if _, ok := parsed["path"]; ok {
+		log.Printf("[WARN] path is no longer a key in the configuration. Please " +
+			"remove it and use the CLI option instead.")
+		delete(parsed, "path")
+	}
+	if splay, ok := parsed["splay"]; ok {
+		log.Printf("[WARN] splay is now a child stanza for exec instead of a "+
+			"top-level key. Update your configuration files and change "+
+			"splay = \"%s\" to exec { splay = \"%s\" } instead.", splay, splay)
+		exec, ok := parsed["exec"].(map[string]interface{})
+		if !ok {
+			exec = map[string]interface{}{}
+		}
+		exec["splay"] = splay
+		parsed["exec"] = exec
+		delete(parsed, "splay")
+	}
+	if retry, ok := parsed["retry"]; ok {
+		log.Printf("[WARN] retry is now a child stanza for both consul and vault " +
+			"instead of a top-level stanza. Update your configuration files and " +
+			"change retry {} to consul { retry { ... } } and vault { retry { ... } } " +
+			"instead.")
+
+		consul, ok := parsed["consul"].(map[string]interface{})
+		if !ok {
+			consul = map[string]interface{}{}
+		}
+
+		vault, ok := parsed["vault"].(map[string]interface{})
+		if !ok {
+			vault = map[string]interface{}{}
+		}
+
+		r := map[string]interface{}{
+			"backoff":     retry,
+			"max_backoff": retry,
+		}
+
+		consul["retry"] = r
+		parsed["consul"] = consul
+
+		vault["retry"] = r
+		parsed["vault"] = vault
+
+		delete(parsed, "retry")
+	}
+	if ssl, ok := parsed["ssl"]; ok {
+		log.Printf("[WARN] ssl is now a child stanza for both consul and vault " +
+			"instead of a top-level stanza. Update your configuration files and " +
+			"change ssl {} to consul { ssl { ... } } and vault { ssl { ... } } " +
+			"instead.")
+
+		consul, ok := parsed["consul"].(map[string]interface{})
+		if !ok {
+			consul = map[string]interface{}{}
+		}
+
+		vault, ok := parsed["vault"].(map[string]interface{})
+		if !ok {
+			vault = map[string]interface{}{}
+		}
+
+		consul["ssl"] = ssl
+		parsed["consul"] = consul
+
+		vault["ssl"] = ssl
+		parsed["vault"] = vault
+
+		delete(parsed, "ssl")
+	}
+	if timeout, ok := parsed["timeout"]; ok {
+		log.Printf("[WARN] timeout is now a child stanza for exec instead of a "+
+			"top-level key. Update your configuration files and change "+
+			"timeout = \"%s\" to exec { kill_timeout = \"%s\" } instead.",
+			timeout, timeout)
+		exec, ok := parsed["exec"].(map[string]interface{})
+		if !ok {
+			exec = map[string]interface{}{}
+		}
+		exec["kill_timeout"] = timeout
+		parsed["exec"] = exec
+		delete(parsed, "timeout")
+	}
+	if token, ok := parsed["token"]; ok {
+		log.Printf("[WARN] token is now a child stanza inside consul instead of a " +
+			"top-level key. Update your configuration files and change token = \"...\" " +
+			"to consul { token = \"...\" } instead.")
+		consul, ok := parsed["consul"].(map[string]interface{})
+		if !ok {
+			consul = map[string]interface{}{}
+		}
+		consul["token"] = token
+		parsed["consul"] = consul
+		delete(parsed, "token")
+	}
+
+	// Create a new, empty config
+	var c Config
+
+	// Use mapstructure to populate the basic config fields
+	var md mapstructure.Metadata
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			config.ConsulStringToStructFunc(),
+			config.StringToFileModeFunc(),
+			signals.StringToSignalFunc(),
+			config.StringToWaitDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			mapstructure.StringToTimeDurationHookFunc(),
+		),
+		ErrorUnused: true,
+		Metadata:    &md,
+		Result:      &c,
+	})
+	if err != nil {
+		log.Printf("%#v", parsed)
+		return nil, errors.Wrap(err, "mapstructure decoder creation failed")
+	}
+	if err := decoder.Decode(parsed); err != nil {
+		log.Printf("%#v", parsed)
+		return nil, errors.Wrap(err, "mapstructure decode failed")
+	}
+
+	return &c, nil
+}
+
+// Must returns a config object that must compile. If there are any errors, this
+// function will panic. This is most useful in testing or constants.
+func Must(s string) *Config {
+	c, err := Parse(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// TestConfig returuns a default, finalized config, with the provided
+// configuration taking precedence.
+func TestConfig(c *Config) *Config {
+	d := DefaultConfig().Merge(c)
+	d.Finalize()
+	return d
+}
+
+// FromFile reads the configuration file at the given path and returns a new
+// Config struct with the data populated.
+func FromFile(path string) (*Config, error) {
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "from file: "+path)
+	}
+
+	config, err := Parse(string(c))
+	if err != nil {
+		return nil, errors.Wrap(err, "from file: "+path)
+	}
+	return config, nil
+}
+
+// FromPath iterates and merges all configuration files in a given
+// directory, returning the resulting config.
+func FromPath(path string) (*Config, error) {
+	// Ensure the given filepath exists
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "missing file/folder: "+path)
+	}
+
+	// Check if a file was given or a path to a directory
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed stating file: "+path)
+	}
+
+	// Recursively parse directories, single load files
+	if stat.Mode().IsDir() {
+		// Ensure the given filepath has at least one config file
+		_, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed listing dir: "+path)
+		}
+
+		// Create a blank config to merge off of
+		var c *Config
+
+		// Potential bug: Walk does not follow symlinks!
+		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			// If WalkFunc had an error, just return it
+			if err != nil {
+				return err
+			}
+
+			// Do nothing for directories
+			if info.IsDir() {
+				return nil
+			}
+
+			// Parse and merge the config
+			newConfig, err := FromFile(path)
+			if err != nil {
+				return err
+			}
+			c = c.Merge(newConfig)
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, errors.Wrap(err, "walk error")
+		}
+
+		return c, nil
+	} else if stat.Mode().IsRegular() {
+		return FromFile(path)
+	}
+
+	return nil, fmt.Errorf("unknown filetype: %q", stat.Mode().String())
+}
+
+// GoString defines the printable version of this struct.
+func (c *Config) GoString() string {
+	if c == nil {
+		return "(*Config)(nil)"
+	}
+
+	return fmt.Sprintf("&Config{"+
+		"AnnotateSources:%s, "+
+		"CacheTTL:%s, "+
+		"CaseFoldPolicy:%s, "+
+		"Consul:%s, "+
+		"DeltaFile:%s, "+
+		"DryRun:%s, "+
+		"DryRunRedact:%s, "+
+		"EmitApplyOrder:%s, "+
+		"EmitBanner:%s, "+
+		"EmitConfigHash:%s, "+
+		"EmitCounts:%s, "+
+		"EmitLastFetch:%s, "+
+		"EmitLogLevel:%s, "+
+		"EmitMode:%s, "+
+		"EmitNodeName:%s, "+
+		"EmitOverrides:%s, "+
+		"EmitRestartCount:%s, "+
+		"EmitSecretsChecksum:%s, "+
+		"EmitTokenTTL:%s, "+
+		"EmitWatchPaths:%s, "+
+		"EmptyEnvExitCode:%s, "+
+		"EnvPrefix:%s, "+
+		"EnvSocket:%s, "+
+		"EnvSocketRedact:%s, "+
+		"EnvSuffix:%s, "+
+		"Exec:%s, "+
+		"ExecShell:%s, "+
+		"HealthProbe:%s, "+
+		"KillSignal:%s, "+
+		"LockFile:%s, "+
+		"LockWait:%s, "+
+		"LogEnvDiff:%s, "+
+		"LogLevel:%s, "+
+		"MaxStale:%s, "+
+		"NamedPipe:%s, "+
+		"NamespaceDatacenters:%s, "+
+		"OnceRetry:%s, "+
+		"Output:%s, "+
+		"PidFile:%s, "+
+		"Prefixes:%s, "+
+		"Pristine:%s, "+
+		"RedactKeys:%v, "+
+		"ReloadSignal:%s, "+
+		"RenewThreshold:%s, "+
+		"RequireUTF8:%s, "+
+		"RestartCooldown:%s, "+
+		"RestartCoordinationLock:%s, "+
+		"Sanitize:%s, "+
+		"SanitizeReplacement:%s, "+
+		"Secrets:%s, "+
+		"Services:%s, "+
+		"Syslog:%s, "+
+		"TimeWindows:%s, "+
+		"TrimKeyNames:%s, "+
+		"TolerateStale:%s, "+
+		"TelemetryAddr:%s, "+
+		"Upcase:%s, "+
+		"Vault:%s, "+
+		"VaultAuth:%s, "+
+		"VaultTokenMandatory:%s, "+
+		"VaultTokenRenewGrace:%s, "+
+		"VaultSealedInterval:%s, "+
+		"Wait:%s, "+
+		"WatchFiles:%v"+
+		"}",
+		config.BoolGoString(c.AnnotateSources),
+		config.TimeDurationGoString(c.CacheTTL),
+		config.StringGoString(c.CaseFoldPolicy),
+		c.Consul.GoString(),
+		config.StringGoString(c.DeltaFile),
+		config.BoolGoString(c.DryRun),
+		config.BoolGoString(c.DryRunRedact),
+		config.BoolGoString(c.EmitApplyOrder),
+		config.BoolGoString(c.EmitBanner),
+		config.BoolGoString(c.EmitConfigHash),
+		config.BoolGoString(c.EmitCounts),
+		config.BoolGoString(c.EmitLastFetch),
+		config.BoolGoString(c.EmitLogLevel),
+		config.BoolGoString(c.EmitMode),
+		config.BoolGoString(c.EmitNodeName),
+		config.BoolGoString(c.EmitOverrides),
+		config.BoolGoString(c.EmitRestartCount),
+		config.BoolGoString(c.EmitSecretsChecksum),
+		config.BoolGoString(c.EmitTokenTTL),
+		config.BoolGoString(c.EmitWatchPaths),
+		config.IntGoString(c.EmptyEnvExitCode),
+		config.StringGoString(c.EnvPrefix),
+		config.StringGoString(c.EnvSocket),
+		config.BoolGoString(c.EnvSocketRedact),
+		config.StringGoString(c.EnvSuffix),
+		c.Exec.GoString(),
+		config.StringGoString(c.ExecShell),
+		c.HealthProbe.GoString(),
+		config.SignalGoString(c.KillSignal),
+		config.StringGoString(c.LockFile),
+		config.BoolGoString(c.LockWait),
+		config.BoolGoString(c.LogEnvDiff),
+		config.StringGoString(c.LogLevel),
+		config.TimeDurationGoString(c.MaxStale),
+		config.StringGoString(c.NamedPipe),
+		config.BoolGoString(c.NamespaceDatacenters),
+		c.OnceRetry.GoString(),
+		c.Output.GoString(),
+		config.StringGoString(c.PidFile),
+		c.Prefixes.GoString(),
+		config.BoolGoString(c.Pristine),
+		c.RedactKeys,
+		config.SignalGoString(c.ReloadSignal),
+		config.StringGoString(c.RenewThreshold),
+		config.BoolGoString(c.RequireUTF8),
+		c.RestartCooldown.GoString(),
+		c.RestartCoordinationLock.GoString(),
+		config.BoolGoString(c.Sanitize),
+		config.StringGoString(c.SanitizeReplacement),
+		c.Secrets.GoString(),
+		c.Services.GoString(),
+		c.Syslog.GoString(),
+		c.TimeWindows.GoString(),
+		config.BoolGoString(c.TrimKeyNames),
+		config.BoolGoString(c.TolerateStale),
+		config.StringGoString(c.TelemetryAddr),
+		config.BoolGoString(c.Upcase),
+		c.Vault.GoString(),
+		c.VaultAuth.GoString(),
+		config.BoolGoString(c.VaultTokenMandatory),
+		config.TimeDurationGoString(c.VaultTokenRenewGrace),
+		config.TimeDurationGoString(c.VaultSealedInterval),
+		c.Wait.GoString(),
+		c.WatchFiles,
+	)
+}
+
+// DefaultConfig returns the default configuration struct. Certain environment
+// variables may be set which control the values for the default configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		Consul:                  config.DefaultConsulConfig(),
+		Exec:                    config.DefaultExecConfig(),
+		HealthProbe:             DefaultHealthProbeConfig(),
+		OnceRetry:               config.DefaultRetryConfig(),
+		Output:                  DefaultOutputConfig(),
+		Prefixes:                DefaultPrefixConfigs(),
+		RestartCooldown:         DefaultRestartCooldownConfig(),
+		RestartCoordinationLock: DefaultRestartCoordinationLockConfig(),
+		Secrets:                 DefaultPrefixConfigs(),
+		Services:                DefaultServiceConfigs(),
+		Syslog:                  config.DefaultSyslogConfig(),
+		TimeWindows:             DefaultTimeWindowConfigs(),
+		Vault:                   config.DefaultVaultConfig(),
+		VaultAuth:               DefaultVaultAuthConfig(),
+		Wait:                    config.DefaultWaitConfig(),
+	}
+}
+
+// Finalize ensures all configuration options have the default values, so it
+// is safe to dereference the pointers later down the line. It also
+// intelligently tries to activate stanzas that should be "enabled" because
+// data was given, but the user did not explicitly add "Enabled: true" to the
+// configuration.
+func (c *Config) Finalize() {
+	if c.AnnotateSources == nil {
+		c.AnnotateSources = config.Bool(false)
+	}
+
+	if c.CacheTTL == nil {
+		c.CacheTTL = config.TimeDuration(0)
+	}
+
+	if c.CaseFoldPolicy == nil {
+		c.CaseFoldPolicy = config.String(CaseFoldPolicyError)
+	}
+
+	if c.Consul == nil {
+		c.Consul = config.DefaultConsulConfig()
+	}
+	c.Consul.Finalize()
+
+	if c.DeltaFile == nil {
+		c.DeltaFile = config.String("")
+	}
+
+	if c.DryRun == nil {
+		c.DryRun = config.Bool(false)
+	}
+
+	if c.DryRunRedact == nil {
+		c.DryRunRedact = config.Bool(false)
+	}
+
+	if c.EmitApplyOrder == nil {
+		c.EmitApplyOrder = config.Bool(false)
+	}
+
+	if c.EmitBanner == nil {
+		c.EmitBanner = config.Bool(false)
+	}
+
+	if c.EmitConfigHash == nil {
+		c.EmitConfigHash = config.Bool(false)
+	}
+
+	if c.EmitCounts == nil {
+		c.EmitCounts = config.Bool(false)
+	}
+
+	if c.EmitLastFetch == nil {
+		c.EmitLastFetch = config.Bool(false)
+	}
+
+	if c.EmitLogLevel == nil {
+		c.EmitLogLevel = config.Bool(false)
+	}
+
+	if c.EmitMode == nil {
+		c.EmitMode = config.Bool(false)
+	}
+
+	if c.EmitNodeName == nil {
+		c.EmitNodeName = config.Bool(false)
+	}
+
+	if c.EmitOverrides == nil {
+		c.EmitOverrides = config.Bool(false)
+	}
+
+	if c.EmitRestartCount == nil {
+		c.EmitRestartCount = config.Bool(false)
+	}
+
+	if c.EmitSecretsChecksum == nil {
+		c.EmitSecretsChecksum = config.Bool(false)
+	}
+
+	if c.EmitTokenTTL == nil {
+		c.EmitTokenTTL = config.Bool(false)
+	}
+
+	if c.EmitWatchPaths == nil {
+		c.EmitWatchPaths = config.Bool(false)
+	}
+
+	if c.EmptyEnvExitCode == nil {
+		c.EmptyEnvExitCode = config.Int(DefaultEmptyEnvExitCode)
+	}
+
+	if c.EnvPrefix == nil {
+		c.EnvPrefix = config.String("")
+	}
+
+	if c.EnvSocket == nil {
+		c.EnvSocket = config.String("")
+	}
+
+	if c.EnvSocketRedact == nil {
+		c.EnvSocketRedact = config.Bool(false)
+	}
+
+	if c.EnvSuffix == nil {
+		c.EnvSuffix = config.String("")
+	}
+
+	if c.Exec == nil {
+		c.Exec = config.DefaultExecConfig()
+	}
+	c.Exec.Finalize()
+
+	if c.ExecShell == nil {
+		c.ExecShell = config.String("")
+	}
+
+	if c.HealthProbe == nil {
+		c.HealthProbe = DefaultHealthProbeConfig()
+	}
+	c.HealthProbe.Finalize()
+
+	if c.KillSignal == nil {
+		c.KillSignal = config.Signal(DefaultKillSignal)
+	}
+
+	if c.LockFile == nil {
+		c.LockFile = config.String("")
+	}
+
+	if c.LockWait == nil {
+		c.LockWait = config.Bool(false)
+	}
+
+	if c.LogEnvDiff == nil {
+		c.LogEnvDiff = config.Bool(false)
+	}
+
+	if c.LogLevel == nil {
+		c.LogLevel = stringFromEnv([]string{
+			"CT_LOG",
+			"ENVCONSUL",
+		}, DefaultLogLevel)
+	}
+
+	if c.MaxStale == nil {
+		c.MaxStale = config.TimeDuration(DefaultMaxStale)
+	}
+
+	if c.Prefixes == nil {
+		c.Prefixes = DefaultPrefixConfigs()
+	}
+	c.Prefixes.Finalize()
+
+	if c.NamedPipe == nil {
+		c.NamedPipe = config.String("")
+	}
+
+	if c.NamespaceDatacenters == nil {
+		c.NamespaceDatacenters = config.Bool(false)
+	}
+
+	// Unlike the Consul and Vault retries, retrying the first fetch is
+	// disabled unless any of its options is set.
+	if c.OnceRetry == nil {
+		c.OnceRetry = config.DefaultRetryConfig()
+	}
+	if c.OnceRetry.Enabled == nil {
+		c.OnceRetry.Enabled = config.Bool(c.OnceRetry.Attempts != nil ||
+			c.OnceRetry.Backoff != nil || c.OnceRetry.MaxBackoff != nil)
+	}
+	c.OnceRetry.Finalize()
+
+	if c.Output == nil {
+		c.Output = DefaultOutputConfig()
+	}
+	c.Output.Finalize()
+
+	if c.PidFile == nil {
+		c.PidFile = config.String("")
+	}
+
+	if c.Pristine == nil {
+		c.Pristine = config.Bool(false)
+	}
+
+	if c.RedactKeys == nil {
+		c.RedactKeys = []string{}
+	}
+
+	if c.ReloadSignal == nil {
+		c.ReloadSignal = config.Signal(DefaultReloadSignal)
+	}
+
+	if c.RenewThreshold == nil {
+		c.RenewThreshold = config.String("")
+	}
+
+	if c.RequireUTF8 == nil {
+		c.RequireUTF8 = config.Bool(false)
+	}
+
+	if c.RestartCooldown == nil {
+		c.RestartCooldown = DefaultRestartCooldownConfig()
+	}
+	c.RestartCooldown.Finalize()
+
+	if c.RestartCoordinationLock == nil {
+		c.RestartCoordinationLock = DefaultRestartCoordinationLockConfig()
+	}
+	c.RestartCoordinationLock.Finalize()
+
+	if c.Sanitize == nil {
+		c.Sanitize = config.Bool(false)
+	}
+
+	if c.SanitizeReplacement == nil {
+		c.SanitizeReplacement = config.String(DefaultSanitizeReplacement)
+	}
+
+	if c.Secrets == nil {
+		c.Secrets = DefaultPrefixConfigs()
+	}
+	c.Secrets.Finalize()
+	for _, s := range *c.Secrets {
+		if s.ListConcurrency == nil {
+			s.ListConcurrency = config.Int(DefaultListConcurrency)
+		}
+	}
+
+	if c.Services == nil {
+		c.Services = DefaultServiceConfigs()
+	}
+	c.Services.Finalize()
+
+	if c.Syslog == nil {
+		c.Syslog = config.DefaultSyslogConfig()
+	}
+	c.Syslog.Finalize()
+
+	if c.TimeWindows == nil {
+		c.TimeWindows = DefaultTimeWindowConfigs()
+	}
+	c.TimeWindows.Finalize()
+
+	if c.TrimKeyNames == nil {
+		c.TrimKeyNames = config.Bool(false)
+	}
+
+	if c.TolerateStale == nil {
+		c.TolerateStale = config.Bool(false)
+	}
+
+	if c.TelemetryAddr == nil {
+		c.TelemetryAddr = config.String("")
+	}
+
+	if c.Upcase == nil {
+		c.Upcase = config.Bool(false)
+	}
+
+	if c.Vault == nil {
+		c.Vault = config.DefaultVaultConfig()
+	}
+	c.Vault.Finalize()
+
+	if c.VaultAuth == nil {
+		c.VaultAuth = DefaultVaultAuthConfig()
+	}
+	c.VaultAuth.Finalize()
+
+	if c.VaultTokenMandatory == nil {
+		c.VaultTokenMandatory = config.Bool(true)
+	}
+
+	if c.VaultTokenRenewGrace == nil {
+		c.VaultTokenRenewGrace = config.TimeDuration(DefaultVaultTokenRenewGrace)
+	}
+
+	if c.VaultSealedInterval == nil {
+		c.VaultSealedInterval = config.TimeDuration(DefaultVaultSealedInterval)
+	}
+
+	if c.Wait == nil {
+		c.Wait = config.DefaultWaitConfig()
+	}
+	c.Wait.Finalize()
+
+	if c.WatchFiles == nil {
+		c.WatchFiles = []string{}
+	}
+}
+
+func stringFromEnv(list []string, def string) *string {
+	for _, s := range list {
+		if v := os.Getenv(s); v != "" {
+			return config.String(strings.TrimSpace(v))
+		}
+	}
+	return config.String(def)
+}
+
+func stringFromFile(list []string, def string) *string {
+	for _, s := range list {
+		c, err := ioutil.ReadFile(s)
+		if err == nil {
+			return config.String(strings.TrimSpace(string(c)))
+		}
+	}
+	return config.String(def)
+}
+
+func antiboolFromEnv(list []string, def bool) *bool {
+	for _, s := range list {
+		if v := os.Getenv(s); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err == nil {
+				return config.Bool(!b)
+			}
+		}
+	}
+	return config.Bool(def)
+}
+
+func boolFromEnv(list []string, def bool) *bool {
+	for _, s := range list {
+		if v := os.Getenv(s); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err == nil {
+				return config.Bool(b)
+			}
+		}
+	}
+	return config.Bool(def)
+}
+
+// flattenKeys is a function that takes a map[string]interface{} and recursively
+// flattens any keys that are a []map[string]interface{} where the key is in the
+// given list of keys.
+func flattenKeys(m map[string]interface{}, keys []string) {
+	keyMap := make(map[string]struct{})
+	for _, key := range keys {
+		keyMap[key] = struct{}{}
+	}
+
+	var flatten func(map[string]interface{}, string)
+	flatten = func(m map[string]interface{}, parent string) {
+		for k, v := range m {
+			// Calculate the map key, since it could include a parent.
+			mapKey := k
+			if parent != "" {
+				mapKey = parent + "." + k
+			}
+
+			if _, ok := keyMap[mapKey]; !ok {
+				continue
+			}
+
+			switch typed := v.(type) {
+			case []map[string]interface{}:
+				if len(typed) > 0 {
+					last := typed[len(typed)-1]
+					flatten(last, mapKey)
+					m[k] = last
+				} else {
+					m[k] = nil
+				}
+			case map[string]interface{}:
+				flatten(typed, mapKey)
+				m[k] = typed
+			default:
+				m[k] = v
+			}
+		}
+	}
+
+	flatten(m, "")
+}
@@ -0,0 +1,126 @@
+package envconsul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultHealthProbeInterval is the default time between health probes.
+	DefaultHealthProbeInterval = 10 * time.Second
+
+	// DefaultHealthProbeTimeout is the default time a health probe may run
+	// before it counts as a failure.
+	DefaultHealthProbeTimeout = 5 * time.Second
+
+	// DefaultHealthProbeFailureThreshold is the default number of consecutive
+	// failed probes after which the child process is restarted.
+	DefaultHealthProbeFailureThreshold = 3
+)
+
+// HealthProbeConfig is the configuration for periodically checking the health
+// of the child process.
+type HealthProbeConfig struct {
+	// Command is the command to run as the probe. A non-zero exit status, or
+	// failing to exit within the timeout, counts as a failure.
+	Command *string `mapstructure:"command"`
+
+	// Interval is the time between probes.
+	Interval *time.Duration `mapstructure:"interval"`
+
+	// Timeout is the time a probe may run before it is killed and counts as a
+	// failure.
+	Timeout *time.Duration `mapstructure:"timeout"`
+
+	// FailureThreshold is the number of consecutive failures after which the
+	// child process is restarted.
+	FailureThreshold *int `mapstructure:"failure_threshold"`
+}
+
+func DefaultHealthProbeConfig() *HealthProbeConfig {
+	return &HealthProbeConfig{}
+}
+
+func (c *HealthProbeConfig) Copy() *HealthProbeConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &HealthProbeConfig{
+		Command:          c.Command,
+		Interval:         c.Interval,
+		Timeout:          c.Timeout,
+		FailureThreshold: c.FailureThreshold,
+	}
+}
+
+func (c *HealthProbeConfig) Merge(o *HealthProbeConfig) *HealthProbeConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Command != nil {
+		r.Command = o.Command
+	}
+
+	if o.Interval != nil {
+		r.Interval = o.Interval
+	}
+
+	if o.Timeout != nil {
+		r.Timeout = o.Timeout
+	}
+
+	if o.FailureThreshold != nil {
+		r.FailureThreshold = o.FailureThreshold
+	}
+
+	return r
+}
+
+func (c *HealthProbeConfig) Finalize() {
+	if c.Command == nil {
+		c.Command = config.String("")
+	}
+
+	if c.Interval == nil {
+		c.Interval = config.TimeDuration(DefaultHealthProbeInterval)
+	}
+
+	if c.Timeout == nil {
+		c.Timeout = config.TimeDuration(DefaultHealthProbeTimeout)
+	}
+
+	if c.FailureThreshold == nil {
+		c.FailureThreshold = config.Int(DefaultHealthProbeFailureThreshold)
+	}
+}
+
+func (c *HealthProbeConfig) GoString() string {
+	if c == nil {
+		return "(*HealthProbeConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&HealthProbeConfig{"+
+		"Command:%s, "+
+		"Interval:%s, "+
+		"Timeout:%s, "+
+		"FailureThreshold:%s"+
+		"}",
+		config.StringGoString(c.Command),
+		config.TimeDurationGoString(c.Interval),
+		config.TimeDurationGoString(c.Timeout),
+		config.IntGoString(c.FailureThreshold),
+	)
+}
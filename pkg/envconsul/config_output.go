@@ -0,0 +1,201 @@
+package envconsul
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// OutputFormatDotenv, OutputFormatJSON, OutputFormatExport and
+	// OutputFormatBatch are the supported values of the output format.
+	OutputFormatDotenv = "dotenv"
+	OutputFormatJSON   = "json"
+	OutputFormatExport = "export"
+	OutputFormatBatch  = "batch"
+
+	// DefaultOutputFormat is the default output format.
+	DefaultOutputFormat = OutputFormatDotenv
+
+	// DotenvQuotingAlways, DotenvQuotingNever and DotenvQuotingWhenNeeded are
+	// the supported values of the dotenv quoting style.
+	DotenvQuotingAlways     = "always"
+	DotenvQuotingNever      = "never"
+	DotenvQuotingWhenNeeded = "when-needed"
+
+	// DefaultDotenvQuoting is the default dotenv quoting style.
+	DefaultDotenvQuoting = DotenvQuotingAlways
+
+	// OutputStdout is the output path which writes to stdout.
+	OutputStdout = "-"
+
+	// OutputDirEnvPath, OutputDirEnvValue and OutputDirEnvOmit are the
+	// supported values of the output directory's DirEnv.
+	OutputDirEnvPath  = "path"
+	OutputDirEnvValue = "value"
+	OutputDirEnvOmit  = "omit"
+
+	// DefaultOutputDirEnv is the default value of DirEnv.
+	DefaultOutputDirEnv = OutputDirEnvPath
+
+	// DefaultOutputDirMode is the default mode of the files written to the
+	// output directory.
+	DefaultOutputDirMode os.FileMode = 0600
+)
+
+// OutputConfig is the configuration for writing the environment to a file on
+// every render, in addition to or instead of running a command.
+type OutputConfig struct {
+	// Path is the path of the file to write. The file is replaced atomically.
+	// A path of "-" writes to stdout instead.
+	Path *string `mapstructure:"path"`
+
+	// Format is the format of the file: "dotenv" (KEY="value" lines), "json"
+	// (an object), "export" (lines of "export KEY='value'" for a shell) or
+	// "batch" (lines of set "KEY=value" for a Windows batch file).
+	Format *string `mapstructure:"format"`
+
+	// DotenvQuoting is how values are quoted in the dotenv format: "always"
+	// (double-quoted and escaped), "never" (written as is) or "when-needed"
+	// (double-quoted only if they contain characters other than letters,
+	// digits and "_@%+=:,./-").
+	DotenvQuoting *string `mapstructure:"dotenv_quoting"`
+
+	// LineTemplate is a Go template rendered for each key, in place of the
+	// lines of the dotenv or export format. It is given the .Key and .Value of
+	// the entry; values are shell-escaped unless piped through "raw".
+	LineTemplate *string `mapstructure:"line_template"`
+
+	// Dir is the path of a directory where each key read from Vault is
+	// written to its own file, named after the key, so secrets need not be
+	// passed in the environment. Files of keys which are no longer set are
+	// removed.
+	Dir *string `mapstructure:"dir"`
+
+	// DirMode is the mode of the files written to Dir.
+	DirMode *os.FileMode `mapstructure:"dir_mode"`
+
+	// DirEnv is what the variable of a key written to Dir is set to: the
+	// "path" of its file, its "value" as usual, or nothing if "omit"ted.
+	DirEnv *string `mapstructure:"dir_env"`
+}
+
+func DefaultOutputConfig() *OutputConfig {
+	return &OutputConfig{}
+}
+
+func (c *OutputConfig) Copy() *OutputConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &OutputConfig{
+		Path:          c.Path,
+		Format:        c.Format,
+		DotenvQuoting: c.DotenvQuoting,
+		LineTemplate:  c.LineTemplate,
+		Dir:           c.Dir,
+		DirMode:       c.DirMode,
+		DirEnv:        c.DirEnv,
+	}
+}
+
+func (c *OutputConfig) Merge(o *OutputConfig) *OutputConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.Format != nil {
+		r.Format = o.Format
+	}
+
+	if o.DotenvQuoting != nil {
+		r.DotenvQuoting = o.DotenvQuoting
+	}
+
+	if o.LineTemplate != nil {
+		r.LineTemplate = o.LineTemplate
+	}
+
+	if o.Dir != nil {
+		r.Dir = o.Dir
+	}
+
+	if o.DirMode != nil {
+		r.DirMode = o.DirMode
+	}
+
+	if o.DirEnv != nil {
+		r.DirEnv = o.DirEnv
+	}
+
+	return r
+}
+
+func (c *OutputConfig) Finalize() {
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+
+	if c.Format == nil {
+		c.Format = config.String(DefaultOutputFormat)
+	}
+
+	if c.DotenvQuoting == nil {
+		c.DotenvQuoting = config.String(DefaultDotenvQuoting)
+	}
+
+	if c.LineTemplate == nil {
+		c.LineTemplate = config.String("")
+	}
+
+	if c.Dir == nil {
+		c.Dir = config.String("")
+	}
+
+	if c.DirMode == nil {
+		c.DirMode = config.FileMode(DefaultOutputDirMode)
+	}
+
+	if c.DirEnv == nil {
+		c.DirEnv = config.String(DefaultOutputDirEnv)
+	}
+}
+
+func (c *OutputConfig) GoString() string {
+	if c == nil {
+		return "(*OutputConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&OutputConfig{"+
+		"Path:%s, "+
+		"Format:%s, "+
+		"DotenvQuoting:%s, "+
+		"LineTemplate:%s, "+
+		"Dir:%s, "+
+		"DirMode:%s, "+
+		"DirEnv:%s"+
+		"}",
+		config.StringGoString(c.Path),
+		config.StringGoString(c.Format),
+		config.StringGoString(c.DotenvQuoting),
+		config.StringGoString(c.LineTemplate),
+		config.StringGoString(c.Dir),
+		config.FileModeGoString(c.DirMode),
+		config.StringGoString(c.DirEnv),
+	)
+}
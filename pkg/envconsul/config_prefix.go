@@ -0,0 +1,931 @@
+package envconsul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// ArrayMergeReplace, ArrayMergeConcat and ArrayMergeUniqueConcat are the
+	// supported values of ArrayMergePolicy: replacing the earlier list,
+	// appending to it, or appending only the items it does not contain.
+	ArrayMergeReplace      = "replace"
+	ArrayMergeConcat       = "concat"
+	ArrayMergeUniqueConcat = "unique-concat"
+
+	// DefaultArraySeparator is the default separator of the items of list
+	// values.
+	DefaultArraySeparator = ","
+
+	// KeyCaseUpper, KeyCaseLower and KeyCasePreserve are the supported values
+	// of KeyCase.
+	KeyCaseUpper    = "upper"
+	KeyCaseLower    = "lower"
+	KeyCasePreserve = "preserve"
+
+	// KeyStyleSnake, KeyStyleKebab, KeyStyleCamel and KeyStylePascal are the
+	// supported values of KeyStyle.
+	KeyStyleSnake  = "snake"
+	KeyStyleKebab  = "kebab"
+	KeyStyleCamel  = "camel"
+	KeyStylePascal = "pascal"
+
+	// KVVersionAuto, KVVersion1 and KVVersion2 are the supported values of
+	// KVVersion. Auto detects the version from the shape of the secret.
+	KVVersionAuto = "auto"
+	KVVersion1    = "1"
+	KVVersion2    = "2"
+)
+
+// PrefixConfig is a wrapper around some common options for Consul and Vault
+// prefixes.
+type PrefixConfig struct {
+	// ArrayMergePolicy is how a value of this prefix or secret is merged with the
+	// value of an earlier source it overrides, both being lists joined with
+	// ArraySeparator: "replace", "concat" or "unique-concat".
+	ArrayMergePolicy *string `mapstructure:"array_merge_policy"`
+
+	// ArraySeparator is the separator of the items of list values, used by
+	// ArrayMergePolicy.
+	ArraySeparator *string `mapstructure:"array_separator"`
+
+	// Base64Decode decodes each string value of a secret from standard base64.
+	// Values which are not valid base64 are exported as is, with a warning.
+	Base64Decode *bool `mapstructure:"base64_decode"`
+
+	// Consistent reads a Consul prefix in the consistent mode, so that a stale
+	// value is never served by a follower, at the cost of a round trip to the leader.
+	Consistent *bool `mapstructure:"consistent"`
+
+	// ConvertValues exports integer, float and boolean secret values as
+	// strings, rather than skipping them.
+	ConvertValues *bool `mapstructure:"convert_values"`
+
+	// Defaults are the values of keys which this prefix or secret emits when
+	// they are not found in Consul or Vault. The keys are named as emitted,
+	// before the global env_prefix and env_suffix. A value which is found is
+	// never overridden.
+	Defaults map[string]string `mapstructure:"defaults"`
+
+	// EmitCreateIndex emits the Consul CreateIndex of each key as a companion
+	// "<key>_CREATE_INDEX" variable.
+	EmitCreateIndex *bool `mapstructure:"emit_create_index"`
+
+	// EmitMountAccessor emits the accessor of the Vault mount a secret is read
+	// from as a companion "<prefix>_MOUNT_ACCESSOR" variable.
+	EmitMountAccessor *bool `mapstructure:"emit_mount_accessor"`
+
+	// Exclude is a list of glob patterns for the final names of keys which are
+	// not exported. It takes precedence over Include.
+	Exclude []string `mapstructure:"exclude"`
+
+	// Field is the single field of a secret to export, under the name given by
+	// Key. It must be set together with Key.
+	Field *string `mapstructure:"field"`
+
+	// Format is a template for the name of each key. The "key" function is the
+	// key as prefixed, and the .Path, .Key and .NoPrefixPath fields are the
+	// sanitized path, the bare key and the path the key is prefixed with.
+	Format *string `mapstructure:"format"`
+
+	// Include is a list of glob patterns for the final names of keys which are
+	// exported. If empty, every key is exported.
+	Include []string `mapstructure:"include"`
+
+	// Key is the exact name of the environment variable holding the secret's
+	// Field, or the value of a SingleKey prefix. No prefix, format or case
+	// conversion is applied to it.
+	Key *string `mapstructure:"key"`
+
+	// KeyCase converts the keys from this prefix or secret to "upper" or "lower"
+	// case, or "preserve"s them, as the last step before they are set. Unset,
+	// the upcase settings apply.
+	KeyCase *string `mapstructure:"key_case"`
+
+	// KeyRetry is the configuration for reading a single key of a Consul
+	// prefix again when its value cannot be transformed, such as a value read
+	// while it was being written, before the whole read fails. It is disabled
+	// unless any of its options is set.
+	KeyRetry *config.RetryConfig `mapstructure:"key_retry"`
+
+	// KeyStyle is the style the keys from this prefix or secret are written in
+	// to the output file: "snake", "kebab", "camel" or "pascal". Unset, they are
+	// written as they are set in the environment, which is never affected. The
+	// kebab style requires the JSON output format.
+	KeyStyle *string `mapstructure:"key_style"`
+
+	// KVVersion is the version of the KV secrets engine a secret is read from:
+	// "auto", "1" or "2". Auto detects the version from the shape of the
+	// secret, which misfires for version 1 secrets with a "metadata" field.
+	KVVersion *string `mapstructure:"kv_version"`
+
+	// LeafPrefixOnly prefixes the keys of a secret with only the final segment
+	// of its path, rather than the whole path. It cannot be combined with
+	// NoPrefix.
+	LeafPrefixOnly *bool `mapstructure:"leaf_prefix_only"`
+
+	// ListConcurrency is the maximum number of secrets read in parallel when
+	// a secret path ends in a wildcard ("/*").
+	ListConcurrency *int `mapstructure:"list_concurrency"`
+
+	// MaxStale is the maximum staleness of the data read from a Consul prefix,
+	// overriding the top-level MaxStale for this prefix. Zero disables stale
+	// reads.
+	MaxStale *time.Duration `mapstructure:"max_stale"`
+
+	// NestedSeparator flattens each field of a secret which is itself a map into
+	// one key per nested value, joining the nested keys with this separator rather
+	// than the underscore used for the path. Empty skips nested maps.
+	NestedSeparator *string `mapstructure:"nested_separator"`
+
+	NoPrefix *bool   `mapstructure:"no_prefix"`
+	Path     *string `mapstructure:"path"`
+
+	// ParseYAML flattens each Consul value which is a YAML mapping into one key
+	// per nested value, joined with underscores. Other values, including
+	// invalid YAML, are used unchanged.
+	ParseYAML *bool `mapstructure:"parse_yaml"`
+
+	// PollInterval reads a Consul prefix again at this interval, rather than with
+	// blocking queries which return as soon as it changes. Zero uses blocking
+	// queries.
+	PollInterval *time.Duration `mapstructure:"poll_interval"`
+
+	// Priority resolves keys set by more than one prefix or secret: the value
+	// with the higher priority wins, and ties are won by the one listed last.
+	// A prefix never overrides a secret, whatever its priority.
+	Priority *int `mapstructure:"priority"`
+
+	// ReloadSignal is the signal sent to the child when this prefix or secret
+	// changes, in place of restarting it. Nil restarts the child.
+	ReloadSignal *os.Signal `mapstructure:"reload_signal"`
+
+	// Rename is an ordered list of regular expression substitutions applied
+	// to each computed key name of a Consul prefix.
+	Rename []*RenameRule `mapstructure:"rename"`
+
+	// RequestHeaders are additional HTTP headers sent with each read of a
+	// secret, for secrets engines which require them.
+	RequestHeaders map[string]string `mapstructure:"request_headers"`
+
+	// Required fails the run with an error, rather than exporting nothing, if
+	// the prefix or secret has no keys, including a destroyed secret.
+	Required *bool `mapstructure:"required"`
+
+	// SingleKey reads the prefix's Path as a single Consul key, rather than
+	// listing it as a folder, and exports its value under the name given by Key,
+	// or the sanitized path if Key is not set.
+	SingleKey *bool `mapstructure:"single_key"`
+
+	// Split is a list of rules, each splitting one field of a secret into
+	// several keys with the named groups of a regular expression.
+	Split []*SplitRule `mapstructure:"split"`
+
+	// Transforms is an ordered list of transforms, such as "trim" and
+	// "base64-decode", applied to each value.
+	Transforms []string `mapstructure:"transforms"`
+
+	// TrimSpace trims leading and trailing whitespace from each value, such as
+	// a trailing newline, before any transforms.
+	TrimSpace *bool `mapstructure:"trim_whitespace"`
+
+	// Upcase converts the keys from this prefix to uppercase, overriding the
+	// top-level upcase setting.
+	Upcase *bool `mapstructure:"upcase"`
+
+	// Version pins a secret in a KV version 2 secrets engine to the given
+	// version, rather than the latest. Zero reads the latest version.
+	Version *int `mapstructure:"version"`
+}
+
+func ParsePrefixConfig(s string) (*PrefixConfig, error) {
+	s = strings.TrimPrefix(s, "/")
+	return &PrefixConfig{
+		Path: config.String(s),
+	}, nil
+}
+
+func DefaultPrefixConfig() *PrefixConfig {
+	return &PrefixConfig{}
+}
+
+func (c *PrefixConfig) Copy() *PrefixConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o PrefixConfig
+
+	o.ArrayMergePolicy = c.ArrayMergePolicy
+
+	o.ArraySeparator = c.ArraySeparator
+
+	o.Base64Decode = c.Base64Decode
+
+	o.Consistent = c.Consistent
+
+	o.ConvertValues = c.ConvertValues
+
+	if c.Defaults != nil {
+		o.Defaults = make(map[string]string, len(c.Defaults))
+		for k, v := range c.Defaults {
+			o.Defaults[k] = v
+		}
+	}
+
+	o.EmitCreateIndex = c.EmitCreateIndex
+
+	o.EmitMountAccessor = c.EmitMountAccessor
+
+	if c.Exclude != nil {
+		o.Exclude = append([]string{}, c.Exclude...)
+	}
+
+	o.Field = c.Field
+
+	o.Format = c.Format
+
+	if c.Include != nil {
+		o.Include = append([]string{}, c.Include...)
+	}
+
+	o.Key = c.Key
+
+	o.KeyCase = c.KeyCase
+
+	if c.KeyRetry != nil {
+		o.KeyRetry = c.KeyRetry.Copy()
+	}
+
+	o.KeyStyle = c.KeyStyle
+
+	o.KVVersion = c.KVVersion
+
+	o.LeafPrefixOnly = c.LeafPrefixOnly
+
+	o.ListConcurrency = c.ListConcurrency
+
+	o.MaxStale = c.MaxStale
+
+	o.NestedSeparator = c.NestedSeparator
+
+	o.NoPrefix = c.NoPrefix
+
+	o.ParseYAML = c.ParseYAML
+
+	o.Path = c.Path
+
+	o.PollInterval = c.PollInterval
+
+	o.Priority = c.Priority
+
+	o.ReloadSignal = c.ReloadSignal
+
+	if c.Rename != nil {
+		o.Rename = make([]*RenameRule, len(c.Rename))
+		for i, rule := range c.Rename {
+			o.Rename[i] = rule.Copy()
+		}
+	}
+
+	if c.RequestHeaders != nil {
+		o.RequestHeaders = make(map[string]string, len(c.RequestHeaders))
+		for k, v := range c.RequestHeaders {
+			o.RequestHeaders[k] = v
+		}
+	}
+
+	o.SingleKey = c.SingleKey
+
+	if c.Split != nil {
+		o.Split = make([]*SplitRule, len(c.Split))
+		for i, rule := range c.Split {
+			o.Split[i] = rule.Copy()
+		}
+	}
+
+	o.Required = c.Required
+
+	if c.Transforms != nil {
+		o.Transforms = append([]string{}, c.Transforms...)
+	}
+
+	o.TrimSpace = c.TrimSpace
+
+	o.Upcase = c.Upcase
+
+	o.Version = c.Version
+
+	return &o
+}
+
+func (c *PrefixConfig) Merge(o *PrefixConfig) *PrefixConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.ArrayMergePolicy != nil {
+		r.ArrayMergePolicy = o.ArrayMergePolicy
+	}
+
+	if o.ArraySeparator != nil {
+		r.ArraySeparator = o.ArraySeparator
+	}
+
+	if o.Base64Decode != nil {
+		r.Base64Decode = o.Base64Decode
+	}
+
+	if o.Consistent != nil {
+		r.Consistent = o.Consistent
+	}
+
+	if o.ConvertValues != nil {
+		r.ConvertValues = o.ConvertValues
+	}
+
+	if o.Defaults != nil {
+		if r.Defaults == nil {
+			r.Defaults = make(map[string]string, len(o.Defaults))
+		}
+		for k, v := range o.Defaults {
+			r.Defaults[k] = v
+		}
+	}
+
+	if o.EmitCreateIndex != nil {
+		r.EmitCreateIndex = o.EmitCreateIndex
+	}
+
+	if o.EmitMountAccessor != nil {
+		r.EmitMountAccessor = o.EmitMountAccessor
+	}
+
+	if o.Exclude != nil {
+		r.Exclude = append([]string{}, o.Exclude...)
+	}
+
+	if o.Field != nil {
+		r.Field = o.Field
+	}
+
+	if o.Format != nil {
+		r.Format = o.Format
+	}
+
+	if o.Include != nil {
+		r.Include = append([]string{}, o.Include...)
+	}
+
+	if o.Key != nil {
+		r.Key = o.Key
+	}
+
+	if o.KeyCase != nil {
+		r.KeyCase = o.KeyCase
+	}
+
+	if o.KeyRetry != nil {
+		r.KeyRetry = r.KeyRetry.Merge(o.KeyRetry)
+	}
+
+	if o.KeyStyle != nil {
+		r.KeyStyle = o.KeyStyle
+	}
+
+	if o.KVVersion != nil {
+		r.KVVersion = o.KVVersion
+	}
+
+	if o.LeafPrefixOnly != nil {
+		r.LeafPrefixOnly = o.LeafPrefixOnly
+	}
+
+	if o.ListConcurrency != nil {
+		r.ListConcurrency = o.ListConcurrency
+	}
+
+	if o.MaxStale != nil {
+		r.MaxStale = o.MaxStale
+	}
+
+	if o.NestedSeparator != nil {
+		r.NestedSeparator = o.NestedSeparator
+	}
+
+	if o.NoPrefix != nil {
+		r.NoPrefix = o.NoPrefix
+	}
+
+	if o.ParseYAML != nil {
+		r.ParseYAML = o.ParseYAML
+	}
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.PollInterval != nil {
+		r.PollInterval = o.PollInterval
+	}
+
+	if o.Priority != nil {
+		r.Priority = o.Priority
+	}
+
+	if o.ReloadSignal != nil {
+		r.ReloadSignal = o.ReloadSignal
+	}
+
+	// The rename rules and transforms are pipelines, so they are replaced
+	// rather than appended.
+	if o.Rename != nil {
+		r.Rename = make([]*RenameRule, len(o.Rename))
+		for i, rule := range o.Rename {
+			r.Rename[i] = rule.Copy()
+		}
+	}
+
+	if o.Required != nil {
+		r.Required = o.Required
+	}
+
+	if o.SingleKey != nil {
+		r.SingleKey = o.SingleKey
+	}
+
+	if o.Split != nil {
+		r.Split = make([]*SplitRule, len(o.Split))
+		for i, rule := range o.Split {
+			r.Split[i] = rule.Copy()
+		}
+	}
+
+	if o.Transforms != nil {
+		r.Transforms = append([]string{}, o.Transforms...)
+	}
+
+	if o.RequestHeaders != nil {
+		if r.RequestHeaders == nil {
+			r.RequestHeaders = make(map[string]string, len(o.RequestHeaders))
+		}
+		for k, v := range o.RequestHeaders {
+			r.RequestHeaders[k] = v
+		}
+	}
+
+	if o.TrimSpace != nil {
+		r.TrimSpace = o.TrimSpace
+	}
+
+	if o.Upcase != nil {
+		r.Upcase = o.Upcase
+	}
+
+	if o.Version != nil {
+		r.Version = o.Version
+	}
+
+	return r
+}
+
+func (c *PrefixConfig) Finalize() {
+	if c.ArrayMergePolicy == nil {
+		c.ArrayMergePolicy = config.String(ArrayMergeReplace)
+	}
+
+	if c.ArraySeparator == nil {
+		c.ArraySeparator = config.String(DefaultArraySeparator)
+	}
+
+	if c.Base64Decode == nil {
+		c.Base64Decode = config.Bool(false)
+	}
+
+	if c.Consistent == nil {
+		c.Consistent = config.Bool(false)
+	}
+
+	if c.ConvertValues == nil {
+		c.ConvertValues = config.Bool(true)
+	}
+
+	if c.Defaults == nil {
+		c.Defaults = map[string]string{}
+	}
+
+	if c.EmitCreateIndex == nil {
+		c.EmitCreateIndex = config.Bool(false)
+	}
+
+	if c.EmitMountAccessor == nil {
+		c.EmitMountAccessor = config.Bool(false)
+	}
+
+	if c.Exclude == nil {
+		c.Exclude = []string{}
+	}
+
+	if c.Field == nil {
+		c.Field = config.String("")
+	}
+
+	if c.Format == nil {
+		c.Format = config.String("")
+	}
+
+	if c.Include == nil {
+		c.Include = []string{}
+	}
+
+	if c.Key == nil {
+		c.Key = config.String("")
+	}
+
+	if c.KeyCase == nil {
+		// Do not set a default value so the upcase settings apply.
+	}
+
+	if c.KeyRetry == nil {
+		c.KeyRetry = config.DefaultRetryConfig()
+	}
+	if c.KeyRetry.Enabled == nil {
+		c.KeyRetry.Enabled = config.Bool(c.KeyRetry.Attempts != nil ||
+			c.KeyRetry.Backoff != nil || c.KeyRetry.MaxBackoff != nil)
+	}
+	c.KeyRetry.Finalize()
+
+	if c.KeyStyle == nil {
+		c.KeyStyle = config.String("")
+	}
+
+	if c.KVVersion == nil {
+		c.KVVersion = config.String(KVVersionAuto)
+	}
+
+	if c.LeafPrefixOnly == nil {
+		c.LeafPrefixOnly = config.Bool(false)
+	}
+
+	if c.ListConcurrency == nil {
+		// Do not set a default value here; it only applies to secrets, and is
+		// set for them by the top-level config.
+	}
+
+	if c.MaxStale == nil {
+		// Do not set a default value so the top-level max_stale applies.
+	}
+
+	if c.NestedSeparator == nil {
+		c.NestedSeparator = config.String("")
+	}
+
+	if c.NoPrefix == nil {
+		// Do not set a default value to allow differing defaults for Vault and Consul.
+		// Vault secrets include prefix by default while Consul keys exclude it.
+	}
+
+	if c.ParseYAML == nil {
+		c.ParseYAML = config.Bool(false)
+	}
+
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+
+	if c.PollInterval == nil {
+		c.PollInterval = config.TimeDuration(0)
+	}
+
+	if c.Priority == nil {
+		c.Priority = config.Int(0)
+	}
+
+	if c.ReloadSignal == nil {
+		// Do not set a default value so a change restarts the child.
+	}
+
+	if c.Rename == nil {
+		c.Rename = []*RenameRule{}
+	}
+	for _, rule := range c.Rename {
+		rule.Finalize()
+	}
+
+	if c.RequestHeaders == nil {
+		c.RequestHeaders = map[string]string{}
+	}
+
+	if c.Required == nil {
+		c.Required = config.Bool(false)
+	}
+
+	if c.SingleKey == nil {
+		c.SingleKey = config.Bool(false)
+	}
+
+	if c.Split == nil {
+		c.Split = []*SplitRule{}
+	}
+	for _, rule := range c.Split {
+		rule.Finalize()
+	}
+
+	if c.Transforms == nil {
+		c.Transforms = []string{}
+	}
+
+	if c.TrimSpace == nil {
+		c.TrimSpace = config.Bool(false)
+	}
+
+	if c.Upcase == nil {
+		// Do not set a default value so the top-level upcase setting applies.
+	}
+
+	if c.Version == nil {
+		c.Version = config.Int(0)
+	}
+}
+
+func (c *PrefixConfig) GoString() string {
+	if c == nil {
+		return "(*PrefixConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&PrefixConfig{"+
+		"ArrayMergePolicy:%s, "+
+		"ArraySeparator:%s, "+
+		"Base64Decode:%s, "+
+		"Consistent:%s, "+
+		"ConvertValues:%s, "+
+		"Defaults:%v, "+
+		"EmitCreateIndex:%s, "+
+		"EmitMountAccessor:%s, "+
+		"Exclude:%v, "+
+		"Field:%s, "+
+		"Format:%s, "+
+		"Include:%v, "+
+		"Key:%s, "+
+		"KeyCase:%s, "+
+		"KeyRetry:%s, "+
+		"KeyStyle:%s, "+
+		"KVVersion:%s, "+
+		"LeafPrefixOnly:%s, "+
+		"ListConcurrency:%s, "+
+		"MaxStale:%s, "+
+		"NestedSeparator:%s, "+
+		"NoPrefix:%s, "+
+		"ParseYAML:%s, "+
+		"Path:%s, "+
+		"PollInterval:%s, "+
+		"Priority:%s, "+
+		"ReloadSignal:%s, "+
+		"Rename:%s, "+
+		"RequestHeaders:%v, "+
+		"Required:%s, "+
+		"SingleKey:%s, "+
+		"Split:%s, "+
+		"Transforms:%v, "+
+		"TrimSpace:%s, "+
+		"Upcase:%s, "+
+		"Version:%s"+
+		"}",
+		config.StringGoString(c.ArrayMergePolicy),
+		config.StringGoString(c.ArraySeparator),
+		config.BoolGoString(c.Base64Decode),
+		config.BoolGoString(c.Consistent),
+		config.BoolGoString(c.ConvertValues),
+		c.Defaults,
+		config.BoolGoString(c.EmitCreateIndex),
+		config.BoolGoString(c.EmitMountAccessor),
+		c.Exclude,
+		config.StringGoString(c.Field),
+		config.StringGoString(c.Format),
+		c.Include,
+		config.StringGoString(c.Key),
+		config.StringGoString(c.KeyCase),
+		c.KeyRetry.GoString(),
+		config.StringGoString(c.KeyStyle),
+		config.StringGoString(c.KVVersion),
+		config.BoolGoString(c.LeafPrefixOnly),
+		config.IntGoString(c.ListConcurrency),
+		config.TimeDurationGoString(c.MaxStale),
+		config.StringGoString(c.NestedSeparator),
+		config.BoolGoString(c.NoPrefix),
+		config.BoolGoString(c.ParseYAML),
+		config.StringGoString(c.Path),
+		config.TimeDurationGoString(c.PollInterval),
+		config.IntGoString(c.Priority),
+		config.SignalGoString(c.ReloadSignal),
+		renameRulesGoString(c.Rename),
+		c.RequestHeaders,
+		config.BoolGoString(c.Required),
+		config.BoolGoString(c.SingleKey),
+		splitRulesGoString(c.Split),
+		c.Transforms,
+		config.BoolGoString(c.TrimSpace),
+		config.BoolGoString(c.Upcase),
+		config.IntGoString(c.Version),
+	)
+}
+
+type PrefixConfigs []*PrefixConfig
+
+func DefaultPrefixConfigs() *PrefixConfigs {
+	return &PrefixConfigs{}
+}
+
+func (c *PrefixConfigs) Copy() *PrefixConfigs {
+	if c == nil {
+		return nil
+	}
+
+	o := make(PrefixConfigs, len(*c))
+	for i, t := range *c {
+		o[i] = t.Copy()
+	}
+	return &o
+}
+
+func (c *PrefixConfigs) Merge(o *PrefixConfigs) *PrefixConfigs {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	*r = append(*r, *o...)
+
+	return r
+}
+
+func (c *PrefixConfigs) Finalize() {
+	if c == nil {
+		*c = *DefaultPrefixConfigs()
+	}
+
+	for _, t := range *c {
+		t.Finalize()
+	}
+}
+
+func (c *PrefixConfigs) GoString() string {
+	if c == nil {
+		return "(*PrefixConfigs)(nil)"
+	}
+
+	s := make([]string, len(*c))
+	for i, t := range *c {
+		s[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(s, ", ") + "}"
+}
+
+// RenameRule is a regular expression substitution applied to key names.
+type RenameRule struct {
+	// Match is the regular expression to match.
+	Match *string `mapstructure:"match"`
+
+	// Replace is the replacement for each match, which may refer to submatches
+	// as in regexp.ReplaceAllString.
+	Replace *string `mapstructure:"replace"`
+}
+
+func (r *RenameRule) Copy() *RenameRule {
+	if r == nil {
+		return nil
+	}
+
+	return &RenameRule{
+		Match:   r.Match,
+		Replace: r.Replace,
+	}
+}
+
+func (r *RenameRule) Finalize() {
+	if r.Match == nil {
+		r.Match = config.String("")
+	}
+
+	if r.Replace == nil {
+		r.Replace = config.String("")
+	}
+}
+
+func (r *RenameRule) GoString() string {
+	if r == nil {
+		return "(*RenameRule)(nil)"
+	}
+
+	return fmt.Sprintf("&RenameRule{"+
+		"Match:%s, "+
+		"Replace:%s"+
+		"}",
+		config.StringGoString(r.Match),
+		config.StringGoString(r.Replace),
+	)
+}
+
+func renameRulesGoString(rules []*RenameRule) string {
+	s := make([]string, len(rules))
+	for i, rule := range rules {
+		s[i] = rule.GoString()
+	}
+
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+// SplitRule splits one field of a secret into several keys, with the named
+// groups of a regular expression matched against its value.
+type SplitRule struct {
+	// Field is the field of the secret to split.
+	Field *string `mapstructure:"field"`
+
+	// Match is the regular expression matched against the field's value.
+	Match *string `mapstructure:"match"`
+
+	// Keys maps the name of each group of Match to the exact name of the
+	// environment variable holding its value.
+	Keys map[string]string `mapstructure:"keys"`
+}
+
+func (r *SplitRule) Copy() *SplitRule {
+	if r == nil {
+		return nil
+	}
+
+	o := &SplitRule{
+		Field: r.Field,
+		Match: r.Match,
+	}
+
+	if r.Keys != nil {
+		o.Keys = make(map[string]string, len(r.Keys))
+		for k, v := range r.Keys {
+			o.Keys[k] = v
+		}
+	}
+
+	return o
+}
+
+func (r *SplitRule) Finalize() {
+	if r.Field == nil {
+		r.Field = config.String("")
+	}
+
+	if r.Match == nil {
+		r.Match = config.String("")
+	}
+
+	if r.Keys == nil {
+		r.Keys = map[string]string{}
+	}
+}
+
+func (r *SplitRule) GoString() string {
+	if r == nil {
+		return "(*SplitRule)(nil)"
+	}
+
+	return fmt.Sprintf("&SplitRule{"+
+		"Field:%s, "+
+		"Match:%s, "+
+		"Keys:%v"+
+		"}",
+		config.StringGoString(r.Field),
+		config.StringGoString(r.Match),
+		r.Keys,
+	)
+}
+
+func splitRulesGoString(rules []*SplitRule) string {
+	s := make([]string, len(rules))
+	for i, rule := range rules {
+		s[i] = rule.GoString()
+	}
+
+	return "[" + strings.Join(s, ", ") + "]"
+}
@@ -0,0 +1,109 @@
+package envconsul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultRestartCooldownWindow is the default period in which restarts
+	// are counted towards the cooldown.
+	DefaultRestartCooldownWindow = 1 * time.Minute
+
+	// DefaultRestartCooldownPeriod is the default time further restarts are
+	// deferred once the cooldown is triggered.
+	DefaultRestartCooldownPeriod = 1 * time.Minute
+)
+
+// RestartCooldownConfig is the configuration for limiting the rate of restarts
+// of the child process. Once the child has been restarted the given number of
+// times within the window, further restarts are deferred until the cooldown
+// ends, when the changes made in the meantime are applied in one restart.
+type RestartCooldownConfig struct {
+	// Restarts is the number of restarts within the window which triggers the
+	// cooldown. Zero disables the cooldown.
+	Restarts *int `mapstructure:"restarts"`
+
+	// Window is the period in which restarts are counted.
+	Window *time.Duration `mapstructure:"window"`
+
+	// Cooldown is the time further restarts are deferred.
+	Cooldown *time.Duration `mapstructure:"cooldown"`
+}
+
+func DefaultRestartCooldownConfig() *RestartCooldownConfig {
+	return &RestartCooldownConfig{}
+}
+
+func (c *RestartCooldownConfig) Copy() *RestartCooldownConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &RestartCooldownConfig{
+		Restarts: c.Restarts,
+		Window:   c.Window,
+		Cooldown: c.Cooldown,
+	}
+}
+
+func (c *RestartCooldownConfig) Merge(o *RestartCooldownConfig) *RestartCooldownConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Restarts != nil {
+		r.Restarts = o.Restarts
+	}
+
+	if o.Window != nil {
+		r.Window = o.Window
+	}
+
+	if o.Cooldown != nil {
+		r.Cooldown = o.Cooldown
+	}
+
+	return r
+}
+
+func (c *RestartCooldownConfig) Finalize() {
+	if c.Restarts == nil {
+		c.Restarts = config.Int(0)
+	}
+
+	if c.Window == nil {
+		c.Window = config.TimeDuration(DefaultRestartCooldownWindow)
+	}
+
+	if c.Cooldown == nil {
+		c.Cooldown = config.TimeDuration(DefaultRestartCooldownPeriod)
+	}
+}
+
+func (c *RestartCooldownConfig) GoString() string {
+	if c == nil {
+		return "(*RestartCooldownConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&RestartCooldownConfig{"+
+		"Restarts:%s, "+
+		"Window:%s, "+
+		"Cooldown:%s"+
+		"}",
+		config.IntGoString(c.Restarts),
+		config.TimeDurationGoString(c.Window),
+		config.TimeDurationGoString(c.Cooldown),
+	)
+}
@@ -0,0 +1,106 @@
+package envconsul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultRestartCoordinationLockLimit is the default number of children
+	// which may restart at once.
+	DefaultRestartCoordinationLockLimit = 1
+)
+
+// RestartCoordinationLockConfig is the configuration for a Consul semaphore
+// which gates restarts of the child process, so that only a limited number of
+// replicas sharing the semaphore restart their children at once.
+type RestartCoordinationLockConfig struct {
+	// Prefix is the Consul KV prefix of the semaphore. An empty prefix
+	// disables coordination.
+	Prefix *string `mapstructure:"prefix"`
+
+	// Limit is the number of children which may restart at once. Every replica
+	// sharing the prefix must use the same limit.
+	Limit *int `mapstructure:"limit"`
+
+	// Hold is the time a slot is held after the child has restarted, so that
+	// at most Limit children restart in each period.
+	Hold *time.Duration `mapstructure:"hold"`
+}
+
+func DefaultRestartCoordinationLockConfig() *RestartCoordinationLockConfig {
+	return &RestartCoordinationLockConfig{}
+}
+
+func (c *RestartCoordinationLockConfig) Copy() *RestartCoordinationLockConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &RestartCoordinationLockConfig{
+		Prefix: c.Prefix,
+		Limit:  c.Limit,
+		Hold:   c.Hold,
+	}
+}
+
+func (c *RestartCoordinationLockConfig) Merge(o *RestartCoordinationLockConfig) *RestartCoordinationLockConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Prefix != nil {
+		r.Prefix = o.Prefix
+	}
+
+	if o.Limit != nil {
+		r.Limit = o.Limit
+	}
+
+	if o.Hold != nil {
+		r.Hold = o.Hold
+	}
+
+	return r
+}
+
+func (c *RestartCoordinationLockConfig) Finalize() {
+	if c.Prefix == nil {
+		c.Prefix = config.String("")
+	}
+
+	if c.Limit == nil {
+		c.Limit = config.Int(DefaultRestartCoordinationLockLimit)
+	}
+
+	if c.Hold == nil {
+		c.Hold = config.TimeDuration(0)
+	}
+}
+
+func (c *RestartCoordinationLockConfig) GoString() string {
+	if c == nil {
+		return "(*RestartCoordinationLockConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&RestartCoordinationLockConfig{"+
+		"Prefix:%s, "+
+		"Limit:%s, "+
+		"Hold:%s"+
+		"}",
+		config.StringGoString(c.Prefix),
+		config.IntGoString(c.Limit),
+		config.TimeDurationGoString(c.Hold),
+	)
+}
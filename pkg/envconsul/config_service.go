@@ -0,0 +1,452 @@
+package envconsul
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// ServiceInstanceFirst and ServiceInstanceLast select the first or the last
+	// instance of a service. An instance may also be selected by its index.
+	ServiceInstanceFirst = "first"
+	ServiceInstanceLast  = "last"
+
+	// ServiceSortAddress, ServiceSortPort and ServiceSortID are the fields by
+	// which the instances of a service may be sorted.
+	ServiceSortAddress = "address"
+	ServiceSortPort    = "port"
+	ServiceSortID      = "id"
+)
+
+type ServiceConfig struct {
+	Query *string `mapstructure:"query"`
+
+	// PreparedQuery, when set, is the name or ID of a Consul prepared query
+	// whose instances are emitted in place of those of Query. The instances
+	// are formatted like those of a service query.
+	PreparedQuery *string `mapstructure:"prepared_query"`
+
+	FormatId      *string `mapstructure:"format_id"`
+	FormatName    *string `mapstructure:"format_name"`
+	FormatAddress *string `mapstructure:"format_address"`
+	FormatTag     *string `mapstructure:"format_tag"`
+	FormatPort    *string `mapstructure:"format_port"`
+
+	// FormatNode, when set, emits the name of the node each instance is
+	// registered on.
+	FormatNode *string `mapstructure:"format_node"`
+
+	// FormatStatus, when set, emits the aggregated health check status of each
+	// instance: "passing", "warning", "critical" or "maintenance". An instance
+	// without checks is "passing". The status is read from an additional
+	// health watch of the service.
+	FormatStatus *string `mapstructure:"format_status"`
+
+	// FormatSRV, when set, emits SRV-record-style priority, weight, port and
+	// target variables for each instance. The key is "<index>/<field>".
+	FormatSRV *string `mapstructure:"format_srv"`
+
+	// FormatTaggedAddress, when set, emits one variable for each tagged
+	// address of the node, such as "lan" and "wan". The key is the address
+	// type, also available as "{{ addr_type }}".
+	FormatTaggedAddress *string `mapstructure:"format_tagged_address"`
+
+	// GroupByTag, when set, is a tag prefix such as "group=" by which the
+	// instances are bucketed. Each instance with a tag starting with the prefix
+	// is emitted as "<group>_<index>_<field>", where the group is the rest of
+	// its first such tag and the index counts the instances in the group.
+	GroupByTag *string `mapstructure:"group_by_tag"`
+
+	// TagFilter, when set, is a glob such as "version=*" which the tags of an
+	// instance must match to be included in its tag value. An instance without
+	// matching tags has an empty tag value.
+	TagFilter *string `mapstructure:"tag_filter"`
+
+	// TagExplode emits each tag of an instance as its own variable, with the
+	// index of the tag appended to the tag key, such as "<service>/tag_0", in
+	// place of a single comma-separated value.
+	TagExplode *bool `mapstructure:"tag_explode"`
+
+	// Instance selects the single instance whose fields are emitted: "first",
+	// "last" or an index, after sorting. When empty, every instance is
+	// emitted, and of instances which set the same key, the last one wins.
+	Instance *string `mapstructure:"instance"`
+
+	// Sort orders the instances by "address", "port" or "id" before they are
+	// selected and emitted. When empty, the order is the one Consul returns.
+	Sort *string `mapstructure:"sort"`
+
+	// StickyInstances, when positive, keeps the last non-empty set of
+	// instances in place of an empty one for up to this long after the
+	// service went empty, so a service which briefly has no instances does not
+	// restart the child.
+	StickyInstances *time.Duration `mapstructure:"sticky_instances"`
+
+	// ReloadSignal is the signal sent to the child when this service changes,
+	// in place of restarting it. Nil restarts the child.
+	ReloadSignal *os.Signal `mapstructure:"reload_signal"`
+
+	// Upcase converts the keys from this service to uppercase, overriding the
+	// top-level upcase setting.
+	Upcase *bool `mapstructure:"upcase"`
+
+	// KeyCase converts the keys from this service to "upper" or "lower" case,
+	// or "preserve"s them, as the last step before they are set. Unset, the
+	// upcase settings apply.
+	KeyCase *string `mapstructure:"key_case"`
+}
+
+func ParseServiceConfig(s string) (*ServiceConfig, error) {
+	return &ServiceConfig{
+		Query: config.String(s),
+	}, nil
+}
+
+func DefaultServiceConfig() *ServiceConfig {
+	return &ServiceConfig{
+		FormatId:            config.String(""),
+		FormatName:          config.String(""),
+		FormatAddress:       config.String(""),
+		FormatTag:           config.String(""),
+		FormatPort:          config.String(""),
+		FormatNode:          config.String(""),
+		FormatStatus:        config.String(""),
+		FormatSRV:           config.String(""),
+		FormatTaggedAddress: config.String(""),
+		GroupByTag:          config.String(""),
+		TagFilter:           config.String(""),
+		TagExplode:          config.Bool(false),
+		Instance:            config.String(""),
+		Sort:                config.String(""),
+		StickyInstances:     config.TimeDuration(0),
+	}
+}
+
+func (s *ServiceConfig) Copy() *ServiceConfig {
+	if s == nil {
+		return nil
+	}
+	return &ServiceConfig{
+		Query:               s.Query,
+		PreparedQuery:       s.PreparedQuery,
+		FormatId:            s.FormatId,
+		FormatName:          s.FormatName,
+		FormatAddress:       s.FormatAddress,
+		FormatTag:           s.FormatTag,
+		FormatPort:          s.FormatPort,
+		FormatNode:          s.FormatNode,
+		FormatStatus:        s.FormatStatus,
+		FormatSRV:           s.FormatSRV,
+		FormatTaggedAddress: s.FormatTaggedAddress,
+		GroupByTag:          s.GroupByTag,
+		TagFilter:           s.TagFilter,
+		TagExplode:          s.TagExplode,
+		Instance:            s.Instance,
+		Sort:                s.Sort,
+		StickyInstances:     s.StickyInstances,
+		ReloadSignal:        s.ReloadSignal,
+		Upcase:              s.Upcase,
+		KeyCase:             s.KeyCase,
+	}
+}
+
+func (s *ServiceConfig) Merge(o *ServiceConfig) *ServiceConfig {
+	if s == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return s.Copy()
+	}
+
+	r := s.Copy()
+
+	if o.Query != nil {
+		r.Query = o.Query
+	}
+
+	if o.PreparedQuery != nil {
+		r.PreparedQuery = o.PreparedQuery
+	}
+
+	if o.FormatId != nil {
+		r.FormatId = o.FormatId
+	}
+
+	if o.FormatName != nil {
+		r.FormatName = o.FormatName
+	}
+
+	if o.FormatAddress != nil {
+		r.FormatAddress = o.FormatAddress
+	}
+
+	if o.FormatTag != nil {
+		r.FormatTag = o.FormatTag
+	}
+
+	if o.FormatPort != nil {
+		r.FormatPort = o.FormatPort
+	}
+
+	if o.FormatNode != nil {
+		r.FormatNode = o.FormatNode
+	}
+
+	if o.FormatStatus != nil {
+		r.FormatStatus = o.FormatStatus
+	}
+
+	if o.FormatSRV != nil {
+		r.FormatSRV = o.FormatSRV
+	}
+
+	if o.FormatTaggedAddress != nil {
+		r.FormatTaggedAddress = o.FormatTaggedAddress
+	}
+
+	if o.GroupByTag != nil {
+		r.GroupByTag = o.GroupByTag
+	}
+
+	if o.TagFilter != nil {
+		r.TagFilter = o.TagFilter
+	}
+
+	if o.TagExplode != nil {
+		r.TagExplode = o.TagExplode
+	}
+
+	if o.Instance != nil {
+		r.Instance = o.Instance
+	}
+
+	if o.Sort != nil {
+		r.Sort = o.Sort
+	}
+
+	if o.StickyInstances != nil {
+		r.StickyInstances = o.StickyInstances
+	}
+
+	if o.ReloadSignal != nil {
+		r.ReloadSignal = o.ReloadSignal
+	}
+
+	if o.Upcase != nil {
+		r.Upcase = o.Upcase
+	}
+
+	if o.KeyCase != nil {
+		r.KeyCase = o.KeyCase
+	}
+
+	return r
+}
+
+func (s *ServiceConfig) Finalize() {
+	if s.Query == nil {
+		s.Query = config.String("")
+	}
+
+	if s.PreparedQuery == nil {
+		s.PreparedQuery = config.String("")
+	}
+
+	if s.FormatId == nil {
+		s.FormatId = config.String("")
+	}
+
+	if s.FormatName == nil {
+		s.FormatName = config.String("")
+	}
+
+	if s.FormatAddress == nil {
+		s.FormatAddress = config.String("")
+	}
+
+	if s.FormatTag == nil {
+		s.FormatTag = config.String("")
+	}
+
+	if s.FormatPort == nil {
+		s.FormatPort = config.String("")
+	}
+
+	if s.FormatNode == nil {
+		s.FormatNode = config.String("")
+	}
+
+	if s.FormatStatus == nil {
+		s.FormatStatus = config.String("")
+	}
+
+	if s.FormatSRV == nil {
+		s.FormatSRV = config.String("")
+	}
+
+	if s.FormatTaggedAddress == nil {
+		s.FormatTaggedAddress = config.String("")
+	}
+
+	if s.GroupByTag == nil {
+		s.GroupByTag = config.String("")
+	}
+
+	if s.TagFilter == nil {
+		s.TagFilter = config.String("")
+	}
+
+	if s.TagExplode == nil {
+		s.TagExplode = config.Bool(false)
+	}
+
+	if s.Instance == nil {
+		s.Instance = config.String("")
+	}
+
+	if s.Sort == nil {
+		s.Sort = config.String("")
+	}
+
+	if s.StickyInstances == nil {
+		s.StickyInstances = config.TimeDuration(0)
+	}
+
+	if s.ReloadSignal == nil {
+		// Do not set a default value so a change restarts the child.
+	}
+
+	if s.Upcase == nil {
+		// Do not set a default value so the top-level upcase setting applies.
+	}
+
+	if s.KeyCase == nil {
+		// Do not set a default value so the upcase settings apply.
+	}
+}
+
+func (s *ServiceConfig) GoString() string {
+	if s == nil {
+		return "(*ServiceConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&ServiceConfig{"+
+		"Query:%s, "+
+		"PreparedQuery:%s, "+
+		"FormatId:%s, "+
+		"FormatName:%s, "+
+		"FormatAddress:%s, "+
+		"FormatTag:%s, "+
+		"FormatPort:%s, "+
+		"FormatNode:%s, "+
+		"FormatStatus:%s, "+
+		"FormatSRV:%s, "+
+		"FormatTaggedAddress:%s, "+
+		"GroupByTag:%s, "+
+		"TagFilter:%s, "+
+		"TagExplode:%s, "+
+		"Instance:%s, "+
+		"Sort:%s, "+
+		"StickyInstances:%s, "+
+		"ReloadSignal:%s, "+
+		"Upcase:%s, "+
+		"KeyCase:%s"+
+		"}",
+		config.StringGoString(s.Query),
+		config.StringGoString(s.PreparedQuery),
+		config.StringGoString(s.FormatId),
+		config.StringGoString(s.FormatName),
+		config.StringGoString(s.FormatAddress),
+		config.StringGoString(s.FormatTag),
+		config.StringGoString(s.FormatPort),
+		config.StringGoString(s.FormatNode),
+		config.StringGoString(s.FormatStatus),
+		config.StringGoString(s.FormatSRV),
+		config.StringGoString(s.FormatTaggedAddress),
+		config.StringGoString(s.GroupByTag),
+		config.StringGoString(s.TagFilter),
+		config.BoolGoString(s.TagExplode),
+		config.StringGoString(s.Instance),
+		config.StringGoString(s.Sort),
+		config.TimeDurationGoString(s.StickyInstances),
+		config.SignalGoString(s.ReloadSignal),
+		config.BoolGoString(s.Upcase),
+		config.StringGoString(s.KeyCase),
+	)
+}
+
+type ServiceConfigs []*ServiceConfig
+
+func DefaultServiceConfigs() *ServiceConfigs {
+	return &ServiceConfigs{}
+}
+
+func (s *ServiceConfigs) LastSeviceConfig() *ServiceConfig {
+	if s == nil {
+		return nil
+	}
+
+	return []*ServiceConfig(*s)[len([]*ServiceConfig(*s))-1]
+}
+
+func (s *ServiceConfigs) Copy() *ServiceConfigs {
+	if s == nil {
+		return nil
+	}
+
+	o := make(ServiceConfigs, len(*s))
+	for i, t := range *s {
+		o[i] = t.Copy()
+	}
+	return &o
+}
+
+func (s *ServiceConfigs) Merge(o *ServiceConfigs) *ServiceConfigs {
+	if s == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return s.Copy()
+	}
+
+	r := s.Copy()
+
+	*r = append(*r, *o...)
+
+	return r
+}
+
+func (s *ServiceConfigs) Finalize() {
+	if s == nil {
+		*s = *DefaultServiceConfigs()
+	}
+
+	for _, t := range *s {
+		t.Finalize()
+	}
+}
+
+func (s *ServiceConfigs) GoString() string {
+	if s == nil {
+		return "(*ServiceConfigs)(nil)"
+	}
+
+	ss := make([]string, len(*s))
+	for i, t := range *s {
+		ss[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(ss, ", ") + "}"
+}
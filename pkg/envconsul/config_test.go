@@ -1,4 +1,4 @@
-package main
+package envconsul
 
 import (
 	"fmt"
@@ -157,6 +157,30 @@ func TestParse(t *testing.T) {
 		// End Depreations
 		// TODO remove in 0.8.0
 
+		{
+			"annotate_sources",
+			`annotate_sources = true`,
+			&Config{
+				AnnotateSources: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"cache_ttl",
+			`cache_ttl = "30s"`,
+			&Config{
+				CacheTTL: config.TimeDuration(30 * time.Second),
+			},
+			false,
+		},
+		{
+			"case_fold_policy",
+			`case_fold_policy = "last"`,
+			&Config{
+				CaseFoldPolicy: config.String("last"),
+			},
+			false,
+		},
 		{
 			"consul_address",
 			`consul {
@@ -421,6 +445,174 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"delta_file",
+			`delta_file = "/tmp/delta"`,
+			&Config{
+				DeltaFile: config.String("/tmp/delta"),
+			},
+			false,
+		},
+		{
+			"dry_run",
+			`dry_run = true`,
+			&Config{
+				DryRun: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"dry_run_redact",
+			`dry_run_redact = true`,
+			&Config{
+				DryRunRedact: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_apply_order",
+			`emit_apply_order = true`,
+			&Config{
+				EmitApplyOrder: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_banner",
+			`emit_banner = true`,
+			&Config{
+				EmitBanner: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_config_hash",
+			`emit_config_hash = true`,
+			&Config{
+				EmitConfigHash: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_counts",
+			`emit_counts = true`,
+			&Config{
+				EmitCounts: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_last_fetch",
+			`emit_last_fetch = true`,
+			&Config{
+				EmitLastFetch: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_log_level",
+			`emit_log_level = true`,
+			&Config{
+				EmitLogLevel: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_node_name",
+			`emit_node_name = true`,
+			&Config{
+				EmitNodeName: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_mode",
+			`emit_mode = true`,
+			&Config{
+				EmitMode: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_overrides",
+			`emit_overrides = true`,
+			&Config{
+				EmitOverrides: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_restart_count",
+			`emit_restart_count = true`,
+			&Config{
+				EmitRestartCount: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_secrets_checksum",
+			`emit_secrets_checksum = true`,
+			&Config{
+				EmitSecretsChecksum: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_token_ttl",
+			`emit_token_ttl = true`,
+			&Config{
+				EmitTokenTTL: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"emit_watch_paths",
+			`emit_watch_paths = true`,
+			&Config{
+				EmitWatchPaths: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"empty_env_exit_code",
+			`empty_env_exit_code = 3`,
+			&Config{
+				EmptyEnvExitCode: config.Int(3),
+			},
+			false,
+		},
+		{
+			"env_prefix",
+			`env_prefix = "APP1_"`,
+			&Config{
+				EnvPrefix: config.String("APP1_"),
+			},
+			false,
+		},
+		{
+			"env_socket",
+			`env_socket = "/tmp/env.sock"`,
+			&Config{
+				EnvSocket: config.String("/tmp/env.sock"),
+			},
+			false,
+		},
+		{
+			"env_socket_redact",
+			`env_socket_redact = true`,
+			&Config{
+				EnvSocketRedact: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"env_suffix",
+			`env_suffix = "_V1"`,
+			&Config{
+				EnvSuffix: config.String("_V1"),
+			},
+			false,
+		},
 		{
 			"exec",
 			`exec {}`,
@@ -565,6 +757,17 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"exec_shell",
+			`exec {
+				shell = "/bin/sh"
+			}`,
+			&Config{
+				Exec:      &config.ExecConfig{},
+				ExecShell: config.String("/bin/sh"),
+			},
+			false,
+		},
 		{
 			"exec_splay",
 			`exec {
@@ -589,6 +792,27 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"exec_health_probe",
+			`exec {
+				health_probe {
+					command           = "curl -f localhost:8080"
+					interval          = "5s"
+					timeout           = "2s"
+					failure_threshold = 2
+				}
+			}`,
+			&Config{
+				Exec: &config.ExecConfig{},
+				HealthProbe: &HealthProbeConfig{
+					Command:          config.String("curl -f localhost:8080"),
+					Interval:         config.TimeDuration(5 * time.Second),
+					Timeout:          config.TimeDuration(2 * time.Second),
+					FailureThreshold: config.Int(2),
+				},
+			},
+			false,
+		},
 		{
 			"kill_signal",
 			`kill_signal = "SIGUSR1"`,
@@ -597,6 +821,24 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"lock_file",
+			`lock_file = "/tmp/envconsul.lock"
+			lock_wait = true`,
+			&Config{
+				LockFile: config.String("/tmp/envconsul.lock"),
+				LockWait: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"log_env_diff",
+			`log_env_diff = true`,
+			&Config{
+				LogEnvDiff: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"log_level",
 			`log_level = "WARN"`,
@@ -613,6 +855,92 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"named_pipe",
+			`named_pipe = "/tmp/env.fifo"`,
+			&Config{
+				NamedPipe: config.String("/tmp/env.fifo"),
+			},
+			false,
+		},
+		{
+			"namespace_datacenters",
+			`namespace_datacenters = true`,
+			&Config{
+				NamespaceDatacenters: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"once_retry",
+			`once_retry {
+				attempts = 5
+				backoff = "1s"
+				max_backoff = "10s"
+			}`,
+			&Config{
+				OnceRetry: &config.RetryConfig{
+					Attempts:   config.Int(5),
+					Backoff:    config.TimeDuration(time.Second),
+					MaxBackoff: config.TimeDuration(10 * time.Second),
+				},
+			},
+			false,
+		},
+		{
+			"output",
+			`output {
+				path = "/tmp/env"
+				format = "export"
+			}`,
+			&Config{
+				Output: &OutputConfig{
+					Path:   config.String("/tmp/env"),
+					Format: config.String("export"),
+				},
+			},
+			false,
+		},
+		{
+			"output_dir",
+			`output {
+				dir = "/run/secrets"
+				dir_mode = "0640"
+				dir_env = "omit"
+			}`,
+			&Config{
+				Output: &OutputConfig{
+					Dir:     config.String("/run/secrets"),
+					DirMode: config.FileMode(0640),
+					DirEnv:  config.String("omit"),
+				},
+			},
+			false,
+		},
+		{
+			"output_dotenv_quoting",
+			`output {
+				dotenv_quoting = "when-needed"
+			}`,
+			&Config{
+				Output: &OutputConfig{
+					DotenvQuoting: config.String("when-needed"),
+				},
+			},
+			false,
+		},
+		{
+			"output_line_template",
+			`output {
+				line_template = "{{ .Key }}: {{ .Value }}"
+			}`,
+			&Config{
+				Output: &OutputConfig{
+					LineTemplate: config.String("{{ .Key }}: {{ .Value }}"),
+				},
+			},
+			false,
+		},
 		{
 			"pid_file",
 			`pid_file = "/var/pid"`,
@@ -643,6 +971,36 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"prefix_emit_create_index",
+			`prefix {
+				emit_create_index = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						EmitCreateIndex: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_include_exclude",
+			`prefix {
+				include = ["APP_*"]
+				exclude = ["*_DEBUG"]
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Include: []string{"APP_*"},
+						Exclude: []string{"*_DEBUG"},
+					},
+				},
+			},
+			false,
+		},
 		{
 			"prefix_format",
 			`prefix {
@@ -658,116 +1016,649 @@ func TestParse(t *testing.T) {
 			false,
 		},
 		{
-			"prefix_no_prefix",
+			"prefix_array_merge_policy",
 			`prefix {
-				no_prefix = true
+				array_merge_policy = "unique-concat"
+				array_separator = ":"
 			}`,
 			&Config{
 				Prefixes: &PrefixConfigs{
 					&PrefixConfig{
-						NoPrefix: config.Bool(true),
+						ArrayMergePolicy: config.String("unique-concat"),
+						ArraySeparator:   config.String(":"),
 					},
 				},
 			},
 			false,
 		},
 		{
-			"prefix_path",
+			"prefix_consistent",
 			`prefix {
-				path = "foo/bar/baz"
+				consistent = true
 			}`,
 			&Config{
 				Prefixes: &PrefixConfigs{
 					&PrefixConfig{
-						Path: config.String("foo/bar/baz"),
+						Consistent: config.Bool(true),
 					},
 				},
 			},
 			false,
 		},
 		{
-			"pristine",
-			`pristine = true`,
+			"prefix_convert_values",
+			`secret {
+				convert_values = false
+			}`,
 			&Config{
-				Pristine: config.Bool(true),
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						ConvertValues: config.Bool(false),
+					},
+				},
 			},
 			false,
 		},
 		{
-			"reload_signal",
-			`reload_signal = "SIGUSR1"`,
+			"prefix_kv_version",
+			`secret {
+				kv_version = "1"
+			}`,
 			&Config{
-				ReloadSignal: config.Signal(syscall.SIGUSR1),
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						KVVersion: config.String("1"),
+					},
+				},
 			},
 			false,
 		},
 		{
-			"sanitize",
-			`sanitize = true`,
+			"prefix_leaf_prefix_only",
+			`prefix {
+				leaf_prefix_only = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						LeafPrefixOnly: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_list_concurrency",
+			`prefix {
+				list_concurrency = 8
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						ListConcurrency: config.Int(8),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_nested_separator",
+			`prefix {
+				nested_separator = "__"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						NestedSeparator: config.String("__"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_no_prefix",
+			`prefix {
+				no_prefix = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						NoPrefix: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_path",
+			`prefix {
+				path = "foo/bar/baz"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("foo/bar/baz"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_parse_yaml",
+			`prefix {
+				parse_yaml = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						ParseYAML: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_priority",
+			`prefix {
+				priority = 10
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Priority: config.Int(10),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_reload_signal",
+			`prefix {
+				reload_signal = "SIGUSR1"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						ReloadSignal: config.Signal(syscall.SIGUSR1),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_required",
+			`prefix {
+				required = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Required: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_single_key",
+			`prefix {
+				path = "config/db/host"
+				single_key = true
+				key = "DB_HOST"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("config/db/host"),
+						SingleKey: config.Bool(true),
+						Key:       config.String("DB_HOST"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_rename",
+			`prefix {
+				rename {
+					match = "^app_"
+					replace = ""
+				}
+				rename {
+					match = "[.-]"
+					replace = "_"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Rename: []*RenameRule{
+							&RenameRule{
+								Match:   config.String("^app_"),
+								Replace: config.String(""),
+							},
+							&RenameRule{
+								Match:   config.String("[.-]"),
+								Replace: config.String("_"),
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_transforms",
+			`prefix {
+				transforms = ["trim", "base64-decode"]
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Transforms: []string{"trim", "base64-decode"},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_trim_whitespace",
+			`prefix {
+				trim_whitespace = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						TrimSpace: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_upcase",
+			`prefix {
+				upcase = true
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Upcase: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_max_stale",
+			`prefix {
+				max_stale = "1m"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						MaxStale: config.TimeDuration(time.Minute),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_poll_interval",
+			`prefix {
+				poll_interval = "5m"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						PollInterval: config.TimeDuration(5 * time.Minute),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_key_retry",
+			`prefix {
+				key_retry {
+					attempts = 3
+					backoff = "250ms"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						KeyRetry: &config.RetryConfig{
+							Attempts: config.Int(3),
+							Backoff:  config.TimeDuration(250 * time.Millisecond),
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_key_style",
+			`prefix {
+				key_style = "camel"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						KeyStyle: config.String("camel"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_key_case",
+			`prefix {
+				key_case = "lower"
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						KeyCase: config.String("lower"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"pristine",
+			`pristine = true`,
+			&Config{
+				Pristine: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"redact_keys",
+			`redact_keys = ["*_PASSWORD", "*_TOKEN"]`,
+			&Config{
+				RedactKeys: []string{"*_PASSWORD", "*_TOKEN"},
+			},
+			false,
+		},
+		{
+			"reload_signal",
+			`reload_signal = "SIGUSR1"`,
+			&Config{
+				ReloadSignal: config.Signal(syscall.SIGUSR1),
+			},
+			false,
+		},
+		{
+			"renew_threshold",
+			`renew_threshold = "0.7"`,
+			&Config{
+				RenewThreshold: config.String("0.7"),
+			},
+			false,
+		},
+		{
+			"require_utf8",
+			`require_utf8 = true`,
+			&Config{
+				RequireUTF8: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"restart_cooldown",
+			`restart_cooldown {
+				restarts = 3
+				window   = "1m"
+				cooldown = "5m"
+			}`,
+			&Config{
+				RestartCooldown: &RestartCooldownConfig{
+					Restarts: config.Int(3),
+					Window:   config.TimeDuration(1 * time.Minute),
+					Cooldown: config.TimeDuration(5 * time.Minute),
+				},
+			},
+			false,
+		},
+		{
+			"restart_coordination_lock",
+			`restart_coordination_lock {
+				prefix = "service/app/restart"
+				limit  = 2
+				hold   = "30s"
+			}`,
+			&Config{
+				RestartCoordinationLock: &RestartCoordinationLockConfig{
+					Prefix: config.String("service/app/restart"),
+					Limit:  config.Int(2),
+					Hold:   config.TimeDuration(30 * time.Second),
+				},
+			},
+			false,
+		},
+		{
+			"sanitize",
+			`sanitize = true`,
+			&Config{
+				Sanitize: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"sanitize_replacement",
+			`sanitize_replacement = "__"`,
+			&Config{
+				SanitizeReplacement: config.String("__"),
+			},
+			false,
+		},
+		{
+			"secret",
+			`secret {}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{},
+				},
+			},
+			false,
+		},
+		{
+			"secret_multi",
+			`secret {}
+			secret{}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{},
+					&PrefixConfig{},
+				},
+			},
+			false,
+		},
+		{
+			"secret_base64_decode",
+			`secret {
+				base64_decode = true
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Base64Decode: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"secret_emit_mount_accessor",
+			`secret {
+				emit_mount_accessor = true
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						EmitMountAccessor: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"secret_field",
+			`secret {
+				key = "DATABASE_PASSWORD"
+				field = "password"
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Key:   config.String("DATABASE_PASSWORD"),
+						Field: config.String("password"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"secret_format",
+			`secret {
+				format = "foo_%s"
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Format: config.String("foo_%s"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"secret_no_prefix",
+			`secret {
+				no_prefix = true
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						NoPrefix: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"secret_path",
+			`secret {
+				path = "foo/bar/baz"
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("foo/bar/baz"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_defaults",
+			`prefix {
+				defaults {
+					"log_level" = "info"
+				}
+			}`,
 			&Config{
-				Sanitize: config.Bool(true),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Defaults: map[string]string{"log_level": "info"},
+					},
+				},
 			},
 			false,
 		},
 		{
-			"secret",
-			`secret {}`,
+			"secret_defaults",
+			`secret {
+				defaults {
+					"secret_app_feature_x" = "off"
+				}
+			}`,
 			&Config{
 				Secrets: &PrefixConfigs{
-					&PrefixConfig{},
+					&PrefixConfig{
+						Defaults: map[string]string{"secret_app_feature_x": "off"},
+					},
 				},
 			},
 			false,
 		},
 		{
-			"secret_multi",
-			`secret {}
-			secret{}`,
+			"secret_request_headers",
+			`secret {
+				request_headers {
+					"X-Api-Version" = "2"
+				}
+			}`,
 			&Config{
 				Secrets: &PrefixConfigs{
-					&PrefixConfig{},
-					&PrefixConfig{},
+					&PrefixConfig{
+						RequestHeaders: map[string]string{"X-Api-Version": "2"},
+					},
 				},
 			},
 			false,
 		},
 		{
-			"secret_format",
+			"secret_split",
 			`secret {
-				format = "foo_%s"
+				split {
+					field = "url"
+					match = "^(?P<host>[^:]+):(?P<port>[0-9]+)$"
+					keys {
+						host = "DB_HOST"
+						port = "DB_PORT"
+					}
+				}
 			}`,
 			&Config{
 				Secrets: &PrefixConfigs{
 					&PrefixConfig{
-						Format: config.String("foo_%s"),
+						Split: []*SplitRule{
+							&SplitRule{
+								Field: config.String("url"),
+								Match: config.String("^(?P<host>[^:]+):(?P<port>[0-9]+)$"),
+								Keys:  map[string]string{"host": "DB_HOST", "port": "DB_PORT"},
+							},
+						},
 					},
 				},
 			},
 			false,
 		},
 		{
-			"secret_no_prefix",
+			"secret_trim_whitespace",
 			`secret {
-				no_prefix = true
+				trim_whitespace = true
 			}`,
 			&Config{
 				Secrets: &PrefixConfigs{
 					&PrefixConfig{
-						NoPrefix: config.Bool(true),
+						TrimSpace: config.Bool(true),
 					},
 				},
 			},
 			false,
 		},
 		{
-			"secret_path",
+			"secret_version",
 			`secret {
-				path = "foo/bar/baz"
+				version = 3
 			}`,
 			&Config{
 				Secrets: &PrefixConfigs{
 					&PrefixConfig{
-						Path: config.String("foo/bar/baz"),
+						Version: config.Int(3),
 					},
 				},
 			},
@@ -787,6 +1678,20 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"service_prepared_query",
+			`service {
+				prepared_query = "foo-failover"
+			}`,
+			&Config{
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						PreparedQuery: config.String("foo-failover"),
+					},
+				},
+			},
+			false,
+		},
 		{
 			"service_multi",
 			`service {}
@@ -799,6 +1704,48 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"service_reload_signal",
+			`service {
+				reload_signal = "SIGUSR1"
+			}`,
+			&Config{
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						ReloadSignal: config.Signal(syscall.SIGUSR1),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"service_upcase",
+			`service {
+				upcase = true
+			}`,
+			&Config{
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						Upcase: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"service_key_case",
+			`service {
+				key_case = "preserve"
+			}`,
+			&Config{
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						KeyCase: config.String("preserve"),
+					},
+				},
+			},
+			false,
+		},
 		{
 			"service format",
 			`service {
@@ -808,16 +1755,36 @@ func TestParse(t *testing.T) {
 				format_address = "{{ service }}/{{ key }}"
 				format_tag = "{{ service }}/{{ key }}"
 				format_port = "{{ service }}/{{ key }}"
+				format_node = "{{ service }}/{{ key }}"
+				format_status = "{{ service }}/{{ key }}"
+				format_srv = "_{{ service }}._tcp/{{ key }}"
+				format_tagged_address = "{{ service }}/{{ addr_type }}"
+				group_by_tag = "group="
+				tag_filter = "version=*"
+				tag_explode = true
+				instance = "first"
+				sort = "port"
+				sticky_instances = "30s"
 			}`,
 			&Config{
 				Services: &ServiceConfigs{
 					&ServiceConfig{
-						Query:         config.String("foo.bar"),
-						FormatId:      config.String("{{ service }}/{{ key }}"),
-						FormatName:    config.String("{{ service }}/{{ key }}"),
-						FormatAddress: config.String("{{ service }}/{{ key }}"),
-						FormatTag:     config.String("{{ service }}/{{ key }}"),
-						FormatPort:    config.String("{{ service }}/{{ key }}"),
+						Query:               config.String("foo.bar"),
+						FormatId:            config.String("{{ service }}/{{ key }}"),
+						FormatName:          config.String("{{ service }}/{{ key }}"),
+						FormatAddress:       config.String("{{ service }}/{{ key }}"),
+						FormatTag:           config.String("{{ service }}/{{ key }}"),
+						FormatPort:          config.String("{{ service }}/{{ key }}"),
+						FormatNode:          config.String("{{ service }}/{{ key }}"),
+						FormatStatus:        config.String("{{ service }}/{{ key }}"),
+						FormatSRV:           config.String("_{{ service }}._tcp/{{ key }}"),
+						FormatTaggedAddress: config.String("{{ service }}/{{ addr_type }}"),
+						GroupByTag:          config.String("group="),
+						TagFilter:           config.String("version=*"),
+						TagExplode:          config.Bool(true),
+						Instance:            config.String("first"),
+						Sort:                config.String("port"),
+						StickyInstances:     config.TimeDuration(30 * time.Second),
 					},
 				},
 			},
@@ -855,6 +1822,56 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"time_window",
+			`time_window {
+				key = "FEATURE_X"
+				value = "on"
+				start = "22:00"
+				end = "06:00"
+			}
+			time_window {
+				key = "FEATURE_Y"
+			}`,
+			&Config{
+				TimeWindows: &TimeWindowConfigs{
+					&TimeWindowConfig{
+						Key:   config.String("FEATURE_X"),
+						Value: config.String("on"),
+						Start: config.String("22:00"),
+						End:   config.String("06:00"),
+					},
+					&TimeWindowConfig{
+						Key: config.String("FEATURE_Y"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"telemetry_addr",
+			`telemetry_addr = "127.0.0.1:9102"`,
+			&Config{
+				TelemetryAddr: config.String("127.0.0.1:9102"),
+			},
+			false,
+		},
+		{
+			"tolerate_stale",
+			`tolerate_stale = true`,
+			&Config{
+				TolerateStale: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"trim_key_names",
+			`trim_key_names = true`,
+			&Config{
+				TrimKeyNames: config.Bool(true),
+			},
+			false,
+		},
 		{
 			"upcase",
 			`upcase = true`,
@@ -1211,6 +2228,72 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"vault_auth",
+			`vault_auth {
+				method = "approle"
+				mount  = "apps"
+				params {
+					role_id   = "role"
+					secret_id = "secret"
+				}
+			}`,
+			&Config{
+				VaultAuth: &VaultAuthConfig{
+					Method: config.String("approle"),
+					Mount:  config.String("apps"),
+					Params: map[string]string{
+						"role_id":   "role",
+						"secret_id": "secret",
+					},
+				},
+			},
+			false,
+		},
+		{
+			"vault_auth_kubernetes",
+			`vault_auth {
+				method   = "kubernetes"
+				jwt_path = "/tmp/token"
+				params {
+					role = "app"
+				}
+			}`,
+			&Config{
+				VaultAuth: &VaultAuthConfig{
+					Method:  config.String("kubernetes"),
+					JWTPath: config.String("/tmp/token"),
+					Params: map[string]string{
+						"role": "app",
+					},
+				},
+			},
+			false,
+		},
+		{
+			"vault_sealed_interval",
+			`vault_sealed_interval = "1m"`,
+			&Config{
+				VaultSealedInterval: config.TimeDuration(1 * time.Minute),
+			},
+			false,
+		},
+		{
+			"vault_token_mandatory",
+			`vault_token_mandatory = false`,
+			&Config{
+				VaultTokenMandatory: config.Bool(false),
+			},
+			false,
+		},
+		{
+			"vault_token_renew_grace",
+			`vault_token_renew_grace = "5m"`,
+			&Config{
+				VaultTokenRenewGrace: config.TimeDuration(5 * time.Minute),
+			},
+			false,
+		},
 		{
 			"wait",
 			`wait {
@@ -1238,6 +2321,14 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"watch_files",
+			`watch_files = ["/etc/app.conf", "/etc/app.d/tls.pem"]`,
+			&Config{
+				WatchFiles: []string{"/etc/app.conf", "/etc/app.d/tls.pem"},
+			},
+			false,
+		},
 
 		// General validation
 		{
@@ -1306,6 +2397,18 @@ func TestConfig_Merge(t *testing.T) {
 			&Config{},
 			&Config{},
 		},
+		{
+			"cache_ttl",
+			&Config{
+				CacheTTL: config.TimeDuration(10 * time.Second),
+			},
+			&Config{
+				CacheTTL: config.TimeDuration(20 * time.Second),
+			},
+			&Config{
+				CacheTTL: config.TimeDuration(20 * time.Second),
+			},
+		},
 		{
 			"consul",
 			&Config{
@@ -1324,6 +2427,30 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"delta_file",
+			&Config{
+				DeltaFile: config.String("delta"),
+			},
+			&Config{
+				DeltaFile: config.String("delta-diff"),
+			},
+			&Config{
+				DeltaFile: config.String("delta-diff"),
+			},
+		},
+		{
+			"emit_config_hash",
+			&Config{
+				EmitConfigHash: config.Bool(true),
+			},
+			&Config{
+				EmitConfigHash: config.Bool(false),
+			},
+			&Config{
+				EmitConfigHash: config.Bool(false),
+			},
+		},
 		{
 			"exec",
 			&Config{
@@ -1342,6 +2469,66 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"health_probe",
+			&Config{
+				HealthProbe: &HealthProbeConfig{
+					Command:          config.String("command"),
+					FailureThreshold: config.Int(3),
+				},
+			},
+			&Config{
+				HealthProbe: &HealthProbeConfig{
+					Command: config.String("command-diff"),
+				},
+			},
+			&Config{
+				HealthProbe: &HealthProbeConfig{
+					Command:          config.String("command-diff"),
+					FailureThreshold: config.Int(3),
+				},
+			},
+		},
+		{
+			"restart_cooldown",
+			&Config{
+				RestartCooldown: &RestartCooldownConfig{
+					Restarts: config.Int(3),
+					Cooldown: config.TimeDuration(5 * time.Minute),
+				},
+			},
+			&Config{
+				RestartCooldown: &RestartCooldownConfig{
+					Restarts: config.Int(5),
+				},
+			},
+			&Config{
+				RestartCooldown: &RestartCooldownConfig{
+					Restarts: config.Int(5),
+					Cooldown: config.TimeDuration(5 * time.Minute),
+				},
+			},
+		},
+		{
+			"restart_coordination_lock",
+			&Config{
+				RestartCoordinationLock: &RestartCoordinationLockConfig{
+					Prefix: config.String("service/app/restart"),
+					Limit:  config.Int(2),
+				},
+			},
+			&Config{
+				RestartCoordinationLock: &RestartCoordinationLockConfig{
+					Limit: config.Int(3),
+				},
+			},
+			&Config{
+				RestartCoordinationLock: &RestartCoordinationLockConfig{
+					Prefix: config.String("service/app/restart"),
+					Limit:  config.Int(3),
+				},
+			},
+		},
 		{
 			"kill_signal",
 			&Config{
@@ -1429,6 +2616,18 @@ func TestConfig_Merge(t *testing.T) {
 				Pristine: config.Bool(false),
 			},
 		},
+		{
+			"redact_keys",
+			&Config{
+				RedactKeys: []string{"*_PASSWORD"},
+			},
+			&Config{
+				RedactKeys: []string{"*_TOKEN"},
+			},
+			&Config{
+				RedactKeys: []string{"*_PASSWORD", "*_TOKEN"},
+			},
+		},
 		{
 			"reload_signal",
 			&Config{
@@ -1528,6 +2727,29 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"vault_auth",
+			&Config{
+				VaultAuth: &VaultAuthConfig{
+					Method: config.String("approle"),
+					Params: map[string]string{"role_id": "role"},
+				},
+			},
+			&Config{
+				VaultAuth: &VaultAuthConfig{
+					Params: map[string]string{"secret_id": "secret"},
+				},
+			},
+			&Config{
+				VaultAuth: &VaultAuthConfig{
+					Method: config.String("approle"),
+					Params: map[string]string{
+						"role_id":   "role",
+						"secret_id": "secret",
+					},
+				},
+			},
+		},
 		{
 			"wait",
 			&Config{
@@ -1784,3 +3006,82 @@ func TestDefaultConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_Hash(t *testing.T) {
+	newConfig := func() *Config {
+		return TestConfig(&Config{
+			Consul: &config.ConsulConfig{
+				Address: config.String("1.2.3.4"),
+				Token:   config.String("consul-token"),
+			},
+			Prefixes: &PrefixConfigs{
+				&PrefixConfig{
+					Path: config.String("foo/bar"),
+				},
+			},
+			Vault: &config.VaultConfig{
+				Token: config.String("vault-token"),
+			},
+			VaultAuth: &VaultAuthConfig{
+				Method: config.String("approle"),
+				Params: map[string]string{
+					"role_id":   "role",
+					"secret_id": "secret",
+				},
+			},
+		})
+	}
+
+	a, err := newConfig().Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newConfig().Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("expected identical configs to hash the same: %q != %q", a, b)
+	}
+
+	tokens := newConfig()
+	tokens.Consul.Token = config.String("other-consul-token")
+	tokens.Vault.Token = config.String("other-vault-token")
+	tokens.VaultAuth.Params["secret_id"] = "other-secret"
+	if h, err := tokens.Hash(); err != nil {
+		t.Fatal(err)
+	} else if h != a {
+		t.Errorf("expected tokens to be excluded from the hash")
+	}
+
+	changed := newConfig()
+	changed.Consul.Address = config.String("5.6.7.8")
+	if h, err := changed.Hash(); err != nil {
+		t.Fatal(err)
+	} else if h == a {
+		t.Errorf("expected a changed field to change the hash")
+	}
+}
+
+func TestConfig_FinalizeListConcurrency(t *testing.T) {
+	t.Parallel()
+
+	c := DefaultConfig().Merge(&Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("secret/app/*")},
+		},
+	})
+	c.Finalize()
+
+	if p := (*c.Prefixes)[0]; p.ListConcurrency != nil {
+		t.Errorf("expected no list_concurrency for a prefix, got %d", *p.ListConcurrency)
+	}
+	if s := (*c.Secrets)[0]; config.IntVal(s.ListConcurrency) != DefaultListConcurrency {
+		t.Errorf("expected list_concurrency %d for a secret, got %s",
+			DefaultListConcurrency, config.IntGoString(s.ListConcurrency))
+	}
+}
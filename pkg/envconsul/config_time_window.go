@@ -0,0 +1,177 @@
+package envconsul
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultTimeWindowValue is the default value of a time window's variable.
+	DefaultTimeWindowValue = "1"
+
+	// TimeWindowLayout is the layout of the start and end of a time window.
+	TimeWindowLayout = "15:04"
+)
+
+// TimeWindowConfig is a variable which is only injected into the environment
+// during a daily window of local time, such as a flag for a scheduled feature.
+type TimeWindowConfig struct {
+	// Key is the name of the variable.
+	Key *string `mapstructure:"key"`
+
+	// Value is the value of the variable while the window is open.
+	Value *string `mapstructure:"value"`
+
+	// Start and End are the times of day, such as "09:30", at which the window
+	// opens and closes. A window whose end is before its start spans midnight.
+	Start *string `mapstructure:"start"`
+	End   *string `mapstructure:"end"`
+}
+
+func DefaultTimeWindowConfig() *TimeWindowConfig {
+	return &TimeWindowConfig{}
+}
+
+func (c *TimeWindowConfig) Copy() *TimeWindowConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &TimeWindowConfig{
+		Key:   c.Key,
+		Value: c.Value,
+		Start: c.Start,
+		End:   c.End,
+	}
+}
+
+func (c *TimeWindowConfig) Merge(o *TimeWindowConfig) *TimeWindowConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Key != nil {
+		r.Key = o.Key
+	}
+
+	if o.Value != nil {
+		r.Value = o.Value
+	}
+
+	if o.Start != nil {
+		r.Start = o.Start
+	}
+
+	if o.End != nil {
+		r.End = o.End
+	}
+
+	return r
+}
+
+func (c *TimeWindowConfig) Finalize() {
+	if c.Key == nil {
+		c.Key = config.String("")
+	}
+
+	if c.Value == nil {
+		c.Value = config.String(DefaultTimeWindowValue)
+	}
+
+	if c.Start == nil {
+		c.Start = config.String("")
+	}
+
+	if c.End == nil {
+		c.End = config.String("")
+	}
+}
+
+func (c *TimeWindowConfig) GoString() string {
+	if c == nil {
+		return "(*TimeWindowConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&TimeWindowConfig{"+
+		"Key:%s, "+
+		"Value:%s, "+
+		"Start:%s, "+
+		"End:%s"+
+		"}",
+		config.StringGoString(c.Key),
+		config.StringGoString(c.Value),
+		config.StringGoString(c.Start),
+		config.StringGoString(c.End),
+	)
+}
+
+type TimeWindowConfigs []*TimeWindowConfig
+
+func DefaultTimeWindowConfigs() *TimeWindowConfigs {
+	return &TimeWindowConfigs{}
+}
+
+func (c *TimeWindowConfigs) Copy() *TimeWindowConfigs {
+	if c == nil {
+		return nil
+	}
+
+	o := make(TimeWindowConfigs, len(*c))
+	for i, t := range *c {
+		o[i] = t.Copy()
+	}
+	return &o
+}
+
+func (c *TimeWindowConfigs) Merge(o *TimeWindowConfigs) *TimeWindowConfigs {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	*r = append(*r, *o...)
+
+	return r
+}
+
+func (c *TimeWindowConfigs) Finalize() {
+	if c == nil {
+		*c = *DefaultTimeWindowConfigs()
+	}
+
+	for _, t := range *c {
+		t.Finalize()
+	}
+}
+
+func (c *TimeWindowConfigs) GoString() string {
+	if c == nil {
+		return "(*TimeWindowConfigs)(nil)"
+	}
+
+	s := make([]string, len(*c))
+	for i, t := range *c {
+		s[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(s, ", ") + "}"
+}
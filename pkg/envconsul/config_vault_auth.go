@@ -0,0 +1,143 @@
+package envconsul
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultVaultAuthJWTPath is the default path of the service account token
+	// used by the kubernetes auth method.
+	DefaultVaultAuthJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// VaultAuthConfig is the configuration for logging in to Vault with an auth
+// method, such as AppRole or Kubernetes, to obtain the Vault token in place of
+// a pre-provisioned one.
+type VaultAuthConfig struct {
+	// Method is the auth method to log in with, such as "approle" or
+	// "kubernetes". An empty method disables the login.
+	Method *string `mapstructure:"method"`
+
+	// Mount is the path the auth method is mounted at. Empty uses the method.
+	Mount *string `mapstructure:"mount"`
+
+	// Params are the parameters of the login request, such as the role_id and
+	// secret_id of the approle method or the role of the kubernetes method.
+	Params map[string]string `mapstructure:"params"`
+
+	// JWTPath is the path of the service account token sent as the jwt
+	// parameter by the kubernetes method, unless Params sets it.
+	JWTPath *string `mapstructure:"jwt_path"`
+}
+
+func DefaultVaultAuthConfig() *VaultAuthConfig {
+	return &VaultAuthConfig{}
+}
+
+func (c *VaultAuthConfig) Copy() *VaultAuthConfig {
+	if c == nil {
+		return nil
+	}
+
+	var o VaultAuthConfig
+
+	o.Method = c.Method
+
+	o.Mount = c.Mount
+
+	if c.Params != nil {
+		o.Params = make(map[string]string, len(c.Params))
+		for k, v := range c.Params {
+			o.Params[k] = v
+		}
+	}
+
+	o.JWTPath = c.JWTPath
+
+	return &o
+}
+
+func (c *VaultAuthConfig) Merge(o *VaultAuthConfig) *VaultAuthConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Method != nil {
+		r.Method = o.Method
+	}
+
+	if o.Mount != nil {
+		r.Mount = o.Mount
+	}
+
+	if o.Params != nil {
+		if r.Params == nil {
+			r.Params = make(map[string]string, len(o.Params))
+		}
+		for k, v := range o.Params {
+			r.Params[k] = v
+		}
+	}
+
+	if o.JWTPath != nil {
+		r.JWTPath = o.JWTPath
+	}
+
+	return r
+}
+
+func (c *VaultAuthConfig) Finalize() {
+	if c.Method == nil {
+		c.Method = config.String("")
+	}
+
+	if c.Mount == nil {
+		c.Mount = config.String(config.StringVal(c.Method))
+	}
+
+	if c.Params == nil {
+		c.Params = map[string]string{}
+	}
+
+	if c.JWTPath == nil {
+		c.JWTPath = config.String(DefaultVaultAuthJWTPath)
+	}
+}
+
+func (c *VaultAuthConfig) GoString() string {
+	if c == nil {
+		return "(*VaultAuthConfig)(nil)"
+	}
+
+	// Params hold secrets such as the secret_id, so only their names are
+	// printed.
+	var params []string
+	for k := range c.Params {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+
+	return fmt.Sprintf("&VaultAuthConfig{"+
+		"Method:%s, "+
+		"Mount:%s, "+
+		"Params:%v, "+
+		"JWTPath:%s"+
+		"}",
+		config.StringGoString(c.Method),
+		config.StringGoString(c.Mount),
+		params,
+		config.StringGoString(c.JWTPath),
+	)
+}
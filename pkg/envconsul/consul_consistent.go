@@ -0,0 +1,43 @@
+package envconsul
+
+import (
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+var (
+	// Ensure implements
+	_ dep.Dependency = (*consistentQuery)(nil)
+)
+
+// consistentQuery wraps a Consul KV dependency so that every read uses the
+// consistent mode, rather than being answered by a possibly stale follower.
+// It behaves like the wrapped dependency in every other way.
+type consistentQuery struct {
+	dep.Dependency
+}
+
+// Fetch queries the wrapped dependency with stale reads disabled and
+// consistent reads required.
+func (d *consistentQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	opts = opts.Merge(&dep.QueryOptions{
+		RequireConsistent: true,
+	})
+	opts.AllowStale = false
+
+	return d.Dependency.Fetch(clients, opts)
+}
+
+// unwrapQuery returns the dependency wrapped by a consistentQuery or a
+// tunedQuery, or d itself if it is not wrapped.
+func unwrapQuery(d dep.Dependency) dep.Dependency {
+	for {
+		switch typed := d.(type) {
+		case *consistentQuery:
+			d = typed.Dependency
+		case *tunedQuery:
+			d = typed.Dependency
+		default:
+			return d
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package envconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestConsistentQuery_Fetch(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		query = r.URL.Query()
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Key": "app/foo", "Value": "YmFy"},
+		})
+	}))
+	defer ts.Close()
+
+	clients := dep.NewClientSet()
+	if err := clients.CreateConsulClient(&dep.CreateConsulClientInput{
+		Address: strings.TrimPrefix(ts.URL, "http://"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		consistent bool
+		expected   string
+	}{
+		{
+			"stale",
+			false,
+			"stale",
+		},
+		{
+			"consistent",
+			true,
+			"consistent",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:       config.String("app"),
+						Consistent: config.Bool(tc.consistent),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := r.dependencies[0]
+			data, _, err := d.Fetch(clients, &dep.QueryOptions{AllowStale: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			q := query
+			mu.Unlock()
+			for _, mode := range []string{"stale", "consistent"} {
+				if _, ok := q[mode]; ok != (mode == tc.expected) {
+					t.Errorf("expected only %q in query, got %q", tc.expected, q.Encode())
+				}
+			}
+
+			r.Receive(d, data)
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if r.env["foo"] != "bar" {
+				t.Errorf("expected foo=bar, got %v", r.env)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package envconsul
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+// DefaultPreparedQueryInterval is how often a prepared query is executed
+// again. Prepared queries do not support blocking queries, so they are
+// polled.
+const DefaultPreparedQueryInterval = 30 * time.Second
+
+var (
+	// Ensure implements
+	_ dep.Dependency = (*preparedQuery)(nil)
+)
+
+// preparedQuery executes a Consul prepared query and returns the instances it
+// resolves to as catalog services, so they are formatted like those of a
+// plain service query. The query may fail over to another datacenter; the
+// datacenter of each instance is the one that answered.
+type preparedQuery struct {
+	stopCh chan struct{}
+
+	name     string
+	interval time.Duration
+}
+
+// newPreparedQuery creates a new dependency for the prepared query with the
+// given name or ID.
+func newPreparedQuery(s string) (*preparedQuery, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.Contains(s, "/") {
+		return nil, fmt.Errorf("prepared_query: invalid format: %q", s)
+	}
+
+	return &preparedQuery{
+		stopCh:   make(chan struct{}, 1),
+		name:     s,
+		interval: DefaultPreparedQueryInterval,
+	}, nil
+}
+
+// Fetch executes the prepared query.
+func (d *preparedQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	opts = opts.Merge(&dep.QueryOptions{})
+
+	// If this is not the first query, poll to simulate blocking-queries.
+	if opts.WaitIndex != 0 {
+		log.Printf("[TRACE] %s: polling in %s", d, d.interval)
+
+		select {
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		case <-time.After(d.interval):
+		}
+	}
+
+	log.Printf("[TRACE] %s: GET %s", d, &url.URL{
+		Path:     "/v1/query/" + d.name + "/execute",
+		RawQuery: opts.String(),
+	})
+
+	resp, qm, err := clients.Consul().PreparedQuery().Execute(d.name, &api.QueryOptions{
+		AllowStale:        opts.AllowStale,
+		RequireConsistent: opts.RequireConsistent,
+		Datacenter:        opts.Datacenter,
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	var list []*dep.CatalogService
+	if resp != nil {
+		log.Printf("[TRACE] %s: returned %d results from %s (%d failovers)",
+			d, len(resp.Nodes), resp.Datacenter, resp.Failovers)
+
+		for _, entry := range resp.Nodes {
+			tags := append([]string(nil), entry.Service.Tags...)
+			sort.Strings(tags)
+
+			list = append(list, &dep.CatalogService{
+				ID:              entry.Node.ID,
+				Node:            entry.Node.Node,
+				Address:         entry.Node.Address,
+				Datacenter:      resp.Datacenter,
+				TaggedAddresses: entry.Node.TaggedAddresses,
+				NodeMeta:        entry.Node.Meta,
+				ServiceID:       entry.Service.ID,
+				ServiceName:     entry.Service.Service,
+				ServiceAddress:  entry.Service.Address,
+				ServiceTags:     dep.ServiceTags(tags),
+				ServiceMeta:     entry.Service.Meta,
+				ServicePort:     entry.Service.Port,
+			})
+		}
+	}
+
+	rm := &dep.ResponseMetadata{
+		LastIndex:   uint64(time.Now().Unix()),
+		LastContact: qm.LastContact,
+	}
+
+	return list, rm, nil
+}
+
+// CanShare returns if this dependency is shareable.
+func (d *preparedQuery) CanShare() bool {
+	return true
+}
+
+// Stop halts the given dependency's fetch.
+func (d *preparedQuery) Stop() {
+	close(d.stopCh)
+}
+
+// String returns the human-friendly version of this dependency.
+func (d *preparedQuery) String() string {
+	return fmt.Sprintf("prepared_query(%s)", d.name)
+}
+
+// Type returns the type of this dependency.
+func (d *preparedQuery) Type() dep.Type {
+	return dep.TypeConsul
+}
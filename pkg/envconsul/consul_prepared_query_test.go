@@ -0,0 +1,134 @@
+package envconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+func TestPreparedQuery_Fetch(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/query/web-failover/execute" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Service":    "web",
+			"Datacenter": "dc2",
+			"Failovers":  1,
+			"Nodes": []map[string]interface{}{
+				{
+					"Node": map[string]interface{}{
+						"Node":    "node1",
+						"Address": "10.0.0.1",
+					},
+					"Service": map[string]interface{}{
+						"ID":      "web1",
+						"Service": "web",
+						"Address": "10.0.1.1",
+						"Port":    8080,
+						"Tags":    []string{"v2", "primary"},
+					},
+				},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	clients := dep.NewClientSet()
+	if err := clients.CreateConsulClient(&dep.CreateConsulClientInput{
+		Address: strings.TrimPrefix(ts.URL, "http://"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Upcase:   config.Bool(true),
+		Sanitize: config.Bool(true),
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				PreparedQuery: config.String("web-failover"),
+				FormatNode:    config.String("{{ service }}/{{ key }}"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := r.dependencies[0]
+	if _, ok := d.(*preparedQuery); !ok {
+		t.Fatalf("expected a prepared query, got %T", d)
+	}
+	data, _, err := d.Fetch(clients, &dep.QueryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Receive(d, data)
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"WEB_ID":      "web1",
+		"WEB_NAME":    "web",
+		"WEB_ADDRESS": "10.0.1.1",
+		"WEB_PORT":    "8080",
+		"WEB_TAG":     "primary,v2",
+		"WEB_NODE":    "node1",
+	}
+	for k, v := range expected {
+		if r.env[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, r.env[k])
+		}
+	}
+}
+
+func TestPreparedQuery_invalid(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		service *ServiceConfig
+	}{
+		{
+			"with_query",
+			&ServiceConfig{
+				Query:         config.String("web"),
+				PreparedQuery: config.String("web-failover"),
+			},
+		},
+		{
+			"with_format_status",
+			&ServiceConfig{
+				PreparedQuery: config.String("web-failover"),
+				FormatStatus:  config.String("{{ service }}/{{ key }}"),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				Services: &ServiceConfigs{tc.service},
+			}
+			if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package envconsul
+
+import (
+	"log"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+var (
+	// Ensure implements
+	_ dep.Dependency = (*tunedQuery)(nil)
+)
+
+// tunedQuery wraps a Consul KV dependency to read it with the max_stale and
+// poll_interval of its prefix, rather than the settings shared by every
+// dependency. It behaves like the wrapped dependency in every other way.
+type tunedQuery struct {
+	dep.Dependency
+	stopCh chan struct{}
+
+	// maxStale is the maximum staleness of the data, or nil to use the
+	// staleness the watcher asks for.
+	maxStale *time.Duration
+
+	// pollInterval is how often the dependency is read again, or zero to use
+	// blocking queries.
+	pollInterval time.Duration
+}
+
+// newTunedQuery wraps d with the given max staleness and poll interval.
+func newTunedQuery(d dep.Dependency, maxStale *time.Duration, pollInterval time.Duration) *tunedQuery {
+	return &tunedQuery{
+		Dependency:   d,
+		stopCh:       make(chan struct{}, 1),
+		maxStale:     maxStale,
+		pollInterval: pollInterval,
+	}
+}
+
+// Fetch queries the wrapped dependency. With a poll interval, every query
+// after the first waits for the interval and then reads the current data
+// without blocking. With a max staleness, a stale read whose data is older is
+// made again in the consistent mode.
+func (d *tunedQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	opts = opts.Merge(&dep.QueryOptions{})
+
+	if d.pollInterval > 0 && opts.WaitIndex != 0 {
+		log.Printf("[TRACE] %s: polling in %s", d, d.pollInterval)
+
+		select {
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		case <-time.After(d.pollInterval):
+		}
+
+		opts.WaitIndex = 0
+		opts.WaitTime = 0
+	}
+
+	if d.maxStale == nil {
+		return d.Dependency.Fetch(clients, opts)
+	}
+
+	opts.AllowStale = *d.maxStale > 0
+	data, rm, err := d.Dependency.Fetch(clients, opts)
+	if err != nil || !opts.AllowStale {
+		return data, rm, err
+	}
+
+	if rm.LastContact > *d.maxStale {
+		log.Printf("[TRACE] %s: stale data (last contact exceeded max_stale)", d)
+		opts.AllowStale = false
+		if data, rm, err = d.Dependency.Fetch(clients, opts); err != nil {
+			return data, rm, err
+		}
+	}
+
+	// The staleness was checked against the max_stale of this dependency, so
+	// it must not be checked again against the watcher's.
+	fresh := *rm
+	fresh.LastContact = 0
+	return data, &fresh, nil
+}
+
+// Stop halts the wrapped dependency and any poll in progress.
+func (d *tunedQuery) Stop() {
+	close(d.stopCh)
+	d.Dependency.Stop()
+}
@@ -0,0 +1,245 @@
+package envconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+// testTunedQuery returns a runner with a single prefix, configured by the
+// given function, and a Consul client whose stale reads report the given last
+// contact. The returned function lists the queries made so far.
+func testTunedQuery(t *testing.T, lastContact time.Duration, configure func(*PrefixConfig)) (*Runner, *dep.ClientSet, func() []url.Values, func()) {
+	var mu sync.Mutex
+	var queries []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+
+		var contact time.Duration
+		if _, ok := r.URL.Query()["stale"]; ok {
+			contact = lastContact
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Consul-Index", "7")
+		w.Header().Set("X-Consul-LastContact", strconv.FormatInt(int64(contact/time.Millisecond), 10))
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Key": "app/foo", "Value": "YmFy"},
+		})
+	}))
+
+	clients := dep.NewClientSet()
+	if err := clients.CreateConsulClient(&dep.CreateConsulClientInput{
+		Address: strings.TrimPrefix(ts.URL, "http://"),
+	}); err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	p := &PrefixConfig{Path: config.String("app")}
+	configure(p)
+	cfg := Config{
+		Prefixes: &PrefixConfigs{p},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	return r, clients, func() []url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]url.Values(nil), queries...)
+	}, ts.Close
+}
+
+func TestTunedQuery_maxStale(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		maxStale time.Duration
+		expected []string
+	}{
+		{
+			"within",
+			10 * time.Second,
+			[]string{"stale"},
+		},
+		{
+			"exceeded",
+			time.Second,
+			[]string{"stale", ""},
+		},
+		{
+			"disabled",
+			0,
+			[]string{""},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, clients, queries, stop := testTunedQuery(t, 5*time.Second, func(p *PrefixConfig) {
+				p.MaxStale = config.TimeDuration(tc.maxStale)
+			})
+			defer stop()
+
+			d := r.dependencies[0]
+			if _, ok := d.(*tunedQuery); !ok {
+				t.Fatalf("expected a tuned query, got %T", d)
+			}
+
+			// The watcher's own staleness is ignored.
+			data, rm, err := d.Fetch(clients, &dep.QueryOptions{AllowStale: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rm.LastContact != 0 {
+				t.Errorf("expected no last contact to be reported, got %s", rm.LastContact)
+			}
+
+			var modes []string
+			for _, q := range queries() {
+				if _, ok := q["stale"]; ok {
+					modes = append(modes, "stale")
+				} else {
+					modes = append(modes, "")
+				}
+			}
+			if strings.Join(modes, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected queries %q, got %q", tc.expected, modes)
+			}
+
+			r.Receive(d, data)
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if r.env["foo"] != "bar" {
+				t.Errorf("expected foo=bar, got %v", r.env)
+			}
+		})
+	}
+}
+
+func TestTunedQuery_pollInterval(t *testing.T) {
+	t.Parallel()
+
+	interval := 50 * time.Millisecond
+	r, clients, queries, stop := testTunedQuery(t, 0, func(p *PrefixConfig) {
+		p.PollInterval = config.TimeDuration(interval)
+	})
+	defer stop()
+
+	d := r.dependencies[0]
+	defer d.Stop()
+
+	start := time.Now()
+	if _, _, err := d.Fetch(clients, &dep.QueryOptions{WaitIndex: 7, WaitTime: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("expected the query to wait %s, returned after %s", interval, elapsed)
+	}
+
+	// The query does not block on the index.
+	q := queries()
+	if len(q) != 1 {
+		t.Fatalf("expected 1 query, got %d", len(q))
+	}
+	if _, ok := q[0]["index"]; ok {
+		t.Errorf("expected a non-blocking query, got %q", q[0].Encode())
+	}
+}
+
+func TestTunedQuery_consistent(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path:       config.String("app"),
+				Consistent: config.Bool(true),
+				MaxStale:   config.TimeDuration(time.Minute),
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestTunedQuery_samePath(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		second *PrefixConfig
+		err    bool
+	}{
+		{
+			"same",
+			&PrefixConfig{
+				PollInterval: config.TimeDuration(time.Minute),
+			},
+			false,
+		},
+		{
+			"poll_interval",
+			&PrefixConfig{
+				PollInterval: config.TimeDuration(time.Second),
+			},
+			true,
+		},
+		{
+			"max_stale",
+			&PrefixConfig{
+				MaxStale:     config.TimeDuration(time.Second),
+				PollInterval: config.TimeDuration(time.Minute),
+			},
+			true,
+		},
+		{
+			"consistent",
+			&PrefixConfig{
+				Consistent:   config.Bool(true),
+				PollInterval: config.TimeDuration(time.Minute),
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.second.Path = config.String("app")
+			tc.second.Format = config.String("second_{{ key }}")
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:         config.String("app"),
+						PollInterval: config.TimeDuration(time.Minute),
+					},
+					tc.second,
+				},
+			}
+			_, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+		})
+	}
+}
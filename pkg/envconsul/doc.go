@@ -0,0 +1,5 @@
+// Package envconsul renders an environment from prefixes in Consul, secrets
+// in Vault and Consul services, and runs a child process with it, restarting
+// the child when the environment changes. It is the library behind the
+// envconsul command, for programs which embed it.
+package envconsul
@@ -0,0 +1,106 @@
+package envconsul
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/pkg/errors"
+)
+
+// envSocketWriteTimeout bounds how long a client of the environment socket
+// may take to read the environment before it is disconnected.
+const envSocketWriteTimeout = 5 * time.Second
+
+// listenEnvSocket starts serving the environment on the Unix socket at the
+// configured path, replacing a socket left behind by an earlier run. The socket
+// is only accessible by its owner.
+func (r *Runner) listenEnvSocket() error {
+	path := config.StringVal(r.config.EnvSocket)
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		log.Printf("[DEBUG] (runner) removing stale environment socket %q", path)
+		os.Remove(path)
+	}
+
+	// Create the socket in a private directory and move it into place once
+	// its permissions are restricted, so it is never reachable by others.
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".envconsul-socket")
+	if err != nil {
+		return errors.Wrap(err, "creating environment socket")
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "env.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return errors.Wrap(err, "listening on environment socket")
+	}
+	// The socket is renamed, so it is removed by closeEnvSocket instead.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return errors.Wrap(err, "creating environment socket")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return errors.Wrap(err, "creating environment socket")
+	}
+
+	log.Printf("[INFO] (runner) serving environment on %q", path)
+	r.envSocket = l
+	go r.serveEnvSocket(l)
+	return nil
+}
+
+// serveEnvSocket writes the environment to each client of the listener until
+// it is closed.
+func (r *Runner) serveEnvSocket(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("[DEBUG] (runner) environment socket closed: %s", err)
+			return
+		}
+		go r.writeEnvSocket(conn)
+	}
+}
+
+// writeEnvSocket writes the last compiled environment to conn in dotenv
+// format and closes it. With EnvSocketRedact, the values of secrets and keys
+// matching RedactKeys are redacted. Before the first render, nothing is
+// written.
+func (r *Runner) writeEnvSocket(conn net.Conn) {
+	defer conn.Close()
+
+	r.dependenciesLock.Lock()
+	env := r.env
+	if config.BoolVal(r.config.EnvSocketRedact) {
+		env = r.redactedEnv(env)
+	}
+	contents := formatDotenv(env)
+	r.dependenciesLock.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(envSocketWriteTimeout))
+	if _, err := conn.Write(contents); err != nil {
+		log.Printf("[WARN] (runner) writing environment socket: %s", err)
+	}
+}
+
+// closeEnvSocket stops serving the environment and removes the socket.
+func (r *Runner) closeEnvSocket() {
+	if r.envSocket == nil {
+		return
+	}
+
+	r.envSocket.Close()
+	if err := os.Remove(config.StringVal(r.config.EnvSocket)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[WARN] (runner) could not remove environment socket: %s", err)
+	}
+	r.envSocket = nil
+}
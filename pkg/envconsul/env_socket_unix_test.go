@@ -0,0 +1,90 @@
+//go:build !windows
+// +build !windows
+
+package envconsul
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/dependency"
+)
+
+func TestRunner_envSocket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "envconsul-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "env.sock")
+	cfg := Config{
+		EnvSocket:       config.String(path),
+		EnvSocketRedact: config.Bool(true),
+		Prefixes: &PrefixConfigs{
+			{Path: config.String("app")},
+		},
+		Secrets: &PrefixConfigs{
+			{Path: config.String("secret/db"), NoPrefix: config.Bool(true)},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	for _, d := range r.dependencies {
+		switch d.(type) {
+		case *dependency.KVListQuery:
+			r.Receive(d, []*dependency.KeyPair{
+				{Key: "db_host", Value: "db.internal"},
+			})
+		case *vaultReadQuery:
+			r.Receive(d, &dependency.Secret{
+				Data: map[string]interface{}{"password": "hunter2"},
+			})
+		}
+	}
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.listenEnvSocket(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected mode 0600, got %o", perm)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	contents, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "db_host=\"db.internal\"\npassword=\"***\"\n"
+	if string(contents) != expected {
+		t.Errorf("expected %q, got %q", expected, contents)
+	}
+
+	r.Stop()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package envconsul
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// fileChangeDelay is how long a watched file must be left alone before a
+// change is reported, so that a file written in several steps is reported
+// once.
+const fileChangeDelay = 250 * time.Millisecond
+
+// fileWatcher reports changes to a set of local files. The directory of each
+// file is watched rather than the file itself, so that a file which is
+// replaced by renaming another over it is still noticed.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+
+	// paths is the set of absolute paths being watched.
+	paths map[string]struct{}
+
+	// changeCh receives the path of a file each time it changes.
+	changeCh chan string
+	stopCh   chan struct{}
+}
+
+// newFileWatcher starts watching the given paths. The files need not exist
+// yet, but their directories must.
+func newFileWatcher(paths []string) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "watch files")
+	}
+
+	w := &fileWatcher{
+		watcher:  watcher,
+		paths:    make(map[string]struct{}, len(paths)),
+		changeCh: make(chan string),
+		stopCh:   make(chan struct{}),
+	}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			watcher.Close()
+			return nil, errors.Wrapf(err, "watch files: %s", path)
+		}
+		if err := watcher.Add(filepath.Dir(abs)); err != nil {
+			watcher.Close()
+			return nil, errors.Wrapf(err, "watch files: %s", path)
+		}
+		w.paths[abs] = struct{}{}
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// run reports the changes to the watched files on changeCh until stopped.
+func (w *fileWatcher) run() {
+	var changed string
+	var delay <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if _, watched := w.paths[filepath.Clean(event.Name)]; !watched || event.Op == fsnotify.Chmod {
+				continue
+			}
+			log.Printf("[DEBUG] (runner) watched file %s", event)
+			changed = event.Name
+			delay = time.After(fileChangeDelay)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("[WARN] (runner) watching files: %s", err)
+		case <-delay:
+			delay = nil
+			select {
+			case w.changeCh <- changed:
+			case <-w.stopCh:
+				return
+			}
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// stop stops watching the files.
+func (w *fileWatcher) stop() {
+	close(w.stopCh)
+	w.watcher.Close()
+}
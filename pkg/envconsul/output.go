@@ -0,0 +1,517 @@
+package envconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/pkg/errors"
+)
+
+// shellUnsafeRegexp matches characters which must be quoted in a shell word.
+var shellUnsafeRegexp = regexp.MustCompile(`[^a-zA-Z0-9_@%+=:,./-]`)
+
+// redactedValue replaces values that must not be written to diagnostic
+// outputs, such as values read from Vault.
+const redactedValue = "***"
+
+// writeDelta writes the keys that were added (+), changed (~) or removed (-)
+// between the previous and the current environment to the given path. Values
+// of keys sourced from Vault or matching RedactKeys are redacted.
+func (r *Runner) writeDelta(path string, prev, cur map[string]string,
+	sources map[string]dep.Dependency) error {
+
+	var buf bytes.Buffer
+	for _, line := range envDelta(prev, cur, func(k string) bool {
+		return r.redacted(k, sources[k])
+	}) {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	log.Printf("[DEBUG] (runner) writing delta to %q", path)
+	if err := atomicWriteFile(path, buf.Bytes(), 0600); err != nil {
+		return errors.Wrap(err, "writing delta file")
+	}
+	return nil
+}
+
+// logDelta logs the keys that were added, changed or removed between the
+// previous and the current environment, redacted like writeDelta.
+func (r *Runner) logDelta(prev, cur map[string]string, sources map[string]dep.Dependency) {
+	lines := envDelta(prev, cur, func(k string) bool {
+		return r.redacted(k, sources[k])
+	})
+	log.Printf("[INFO] (runner) environment changed (%d keys)", len(lines))
+	for _, line := range lines {
+		log.Printf("[INFO] (runner)   %s", line)
+	}
+}
+
+// writeNamedPipe writes the environment in dotenv format to the named pipe
+// (FIFO) at path. The pipe is opened without blocking; if no process has it
+// open for reading, or the reader is not keeping up, the write is skipped.
+func writeNamedPipe(path string, env map[string]string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			log.Printf("[DEBUG] (runner) no reader on named pipe %q, skipping", path)
+			return nil
+		}
+		return errors.Wrap(err, "opening named pipe")
+	}
+	defer f.Close()
+
+	log.Printf("[DEBUG] (runner) writing environment to named pipe %q", path)
+	if _, err := f.Write(formatDotenv(env)); err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EAGAIN {
+			log.Printf("[WARN] (runner) named pipe %q is full, skipping", path)
+			return nil
+		}
+		return errors.Wrap(err, "writing named pipe")
+	}
+	return nil
+}
+
+// printDryRun writes the environment the child would be given to stdout in
+// dotenv format, sorted by key. With DryRunRedact, the values of secrets and
+// keys matching RedactKeys are redacted.
+func (r *Runner) printDryRun() error {
+	env := r.childEnv()
+	if config.BoolVal(r.config.DryRunRedact) {
+		env = r.redactedEnv(env)
+	}
+
+	log.Printf("[DEBUG] (runner) dry run, writing environment to stdout")
+	if _, err := r.outStream.Write(formatDotenv(env)); err != nil {
+		return errors.Wrap(err, "writing dry run")
+	}
+	return nil
+}
+
+// writeOutput writes the environment in the configured format to the output
+// file, replacing it atomically, or to stdout if the path is "-".
+func (r *Runner) writeOutput(env map[string]string) error {
+	env, err := r.styledEnv(env)
+	if err != nil {
+		return errors.Wrap(err, "formatting output")
+	}
+
+	var contents []byte
+	if r.lineTemplate != nil {
+		contents, err = formatLines(r.lineTemplate, env)
+	} else {
+		contents, err = formatOutput(config.StringVal(r.config.Output.Format),
+			config.StringVal(r.config.Output.DotenvQuoting), env, r.ports)
+	}
+	if err != nil {
+		return errors.Wrap(err, "formatting output")
+	}
+
+	path := config.StringVal(r.config.Output.Path)
+	if path == OutputStdout {
+		log.Printf("[DEBUG] (runner) writing environment to stdout")
+		if _, err := r.outStream.Write(contents); err != nil {
+			return errors.Wrap(err, "writing output")
+		}
+		return nil
+	}
+
+	log.Printf("[DEBUG] (runner) writing environment to %q", path)
+	if err := atomicWriteFile(path, contents, 0600); err != nil {
+		return errors.Wrap(err, "writing output file")
+	}
+	return nil
+}
+
+// styledEnv returns a copy of env with the keys of each prefix and secret
+// converted to its key style, for writing to the output file. It is an error
+// for two keys to have the same name once converted.
+func (r *Runner) styledEnv(env map[string]string) (map[string]string, error) {
+	styled := make(map[string]string, len(env))
+	from := make(map[string]string, len(env))
+	for k, v := range env {
+		key := k
+		if d, ok := r.sources[k]; ok {
+			if cp, ok := r.configPrefixMap[d.String()]; ok {
+				key = styleKey(config.StringVal(cp.KeyStyle), k)
+			}
+		}
+		if prev, ok := from[key]; ok {
+			keys := []string{prev, k}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("keys %s and %s are both styled %s", keys[0], keys[1], key)
+		}
+		styled[key] = v
+		from[key] = k
+	}
+	return styled, nil
+}
+
+// formatOutput returns the environment in the given format, quoting the values
+// of the dotenv format in the given style. The JSON format writes the values of
+// the given port keys as numbers.
+func formatOutput(format, quoting string, env map[string]string, ports map[string]struct{}) ([]byte, error) {
+	switch format {
+	case OutputFormatJSON:
+		return formatJSON(env, ports)
+	case OutputFormatExport:
+		return formatExport(env), nil
+	case OutputFormatBatch:
+		return formatBatch(env)
+	default:
+		return formatDotenvQuoted(env, quoting)
+	}
+}
+
+// outputLine is the data given to the output line template for each key.
+type outputLine struct {
+	Key   string
+	Value outputValue
+}
+
+// outputValue is a value given to the output line template. It is
+// shell-escaped when printed, unless it is passed through the "raw" function.
+type outputValue string
+
+func (v outputValue) String() string {
+	return shellQuote(string(v))
+}
+
+// lineTemplate is a parsed output line template.
+type lineTemplate struct {
+	*template.Template
+}
+
+// parseLineTemplate parses an output line template.
+func parseLineTemplate(s string) (*lineTemplate, error) {
+	tmpl, err := template.New("line_template").Funcs(template.FuncMap{
+		"raw": func(v outputValue) string {
+			return string(v)
+		},
+	}).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &lineTemplate{tmpl}, nil
+}
+
+// formatLines returns the environment rendered with the line template, one
+// line per key in sorted order. An error rendering any key fails the whole
+// output, so partial output is never written.
+func formatLines(tmpl *lineTemplate, env map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		if err := tmpl.Execute(&buf, &outputLine{Key: k, Value: outputValue(env[k])}); err != nil {
+			return nil, errors.Wrapf(err, "rendering %s", k)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// shellQuote returns s single-quoted for a POSIX shell, unless it consists only
+// of characters which never need quoting.
+func shellQuote(s string) string {
+	if s != "" && !shellUnsafeRegexp.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// formatJSON returns the environment as an indented JSON object. Keys are
+// sorted, so the output is stable between renders, and values are escaped but
+// otherwise written as-is. The values of the given port keys are written as
+// numbers.
+func formatJSON(env map[string]string, ports map[string]struct{}) ([]byte, error) {
+	values := make(map[string]interface{}, len(env))
+	for k, v := range env {
+		values[k] = v
+		if _, ok := ports[k]; ok {
+			if port, err := strconv.Atoi(v); err == nil {
+				values[k] = port
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatDotenv returns the environment as sorted KEY="value" lines.
+func formatDotenv(env map[string]string) []byte {
+	b, _ := formatDotenvQuoted(env, DotenvQuotingAlways)
+	return b
+}
+
+// formatDotenvQuoted returns the environment as sorted KEY=value lines, with
+// the values quoted in the given style. Values with line breaks cannot be
+// written unquoted.
+func formatDotenvQuoted(env map[string]string, quoting string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := env[k]
+		switch {
+		case quoting == DotenvQuotingNever:
+			if strings.ContainsAny(v, "\r\n") {
+				return nil, fmt.Errorf("value of %s contains a line break, which "+
+					"cannot be written unquoted", k)
+			}
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+		case quoting == DotenvQuotingWhenNeeded && !shellUnsafeRegexp.MatchString(v):
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+		default:
+			fmt.Fprintf(&buf, "%s=\"%s\"\n", k, dotenvEscaper.Replace(v))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// dotenvEscaper escapes a value for a double-quoted dotenv string. Only the
+// characters dotenv parsers decode are escaped, so other bytes, such as
+// non-ASCII text, are written as-is, and "$" is escaped so that the value is
+// not expanded by parsers such as docker-compose and python-dotenv.
+var dotenvEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	`$`, `\$`,
+	"\n", `\n`,
+)
+
+// formatExport returns the environment as sorted "export KEY='value'" lines,
+// which may be sourced by a POSIX shell. Values are single-quoted, so they are
+// not subject to expansion.
+func formatExport(env map[string]string) []byte {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "export %s='%s'\n", k, strings.Replace(env[k], "'", `'\''`, -1))
+	}
+	return buf.Bytes()
+}
+
+// formatBatch returns the environment as sorted set "KEY=value" lines, with
+// CRLF line endings, which may be called from a Windows batch file. Quoting the
+// whole assignment keeps spaces and characters such as "&" literal; "%" is
+// doubled so it is not expanded. A batch file cannot represent line breaks, so
+// values containing them are an error.
+func formatBatch(env map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := env[k]
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("value of %s contains a line break, which "+
+				"cannot be written to a batch file", k)
+		}
+		fmt.Fprintf(&buf, "set \"%s=%s\"\r\n", k, strings.Replace(v, "%", "%%", -1))
+	}
+	return buf.Bytes(), nil
+}
+
+// envDelta returns the sorted list of differences between prev and cur, one
+// per line, marked with "+" (added), "~" (changed) or "-" (removed). Values of
+// keys for which redact returns true are replaced.
+func envDelta(prev, cur map[string]string, redact func(string) bool) []string {
+	keys := make([]string, 0, len(prev)+len(cur))
+	for k := range cur {
+		keys = append(keys, k)
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, ok := cur[k]
+		if ok && redact(k) {
+			v = redactedValue
+		}
+
+		old, existed := prev[k]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("-%s", k))
+		case !existed:
+			lines = append(lines, fmt.Sprintf("+%s=%s", k, v))
+		case old != cur[k]:
+			lines = append(lines, fmt.Sprintf("~%s=%s", k, v))
+		}
+	}
+	return lines
+}
+
+// redacted returns true if the value of key, produced by source, must not be
+// written to outputs: values read from Vault and keys matching RedactKeys.
+func (r *Runner) redacted(key string, source dep.Dependency) bool {
+	return isSecretSource(source) || r.redactKey(key)
+}
+
+// redactedEnv returns a copy of env in which the values of keys read from Vault
+// or matching RedactKeys are redacted.
+func (r *Runner) redactedEnv(env map[string]string) map[string]string {
+	redacted := make(map[string]string, len(env))
+	for k, v := range env {
+		if r.redacted(k, r.sources[k]) {
+			v = redactedValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// redactKey returns true if key matches any of the RedactKeys patterns.
+func (r *Runner) redactKey(key string) bool {
+	for _, pattern := range r.config.RedactKeys {
+		if matched, _ := filepath.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// logValue returns the value to log for key, which is redacted if the key
+// matches RedactKeys.
+func (r *Runner) logValue(key string, value interface{}) interface{} {
+	if r.redactKey(key) {
+		return redactedValue
+	}
+	return value
+}
+
+// writeSecretFiles writes each key read from Vault to its own file in the
+// output directory, replacing only the files whose value changed and removing
+// those of keys which are no longer set. The variable of each key written is
+// then set in env according to DirEnv. A dry run writes and removes no files.
+func (r *Runner) writeSecretFiles(env map[string]string, sources map[string]dep.Dependency) error {
+	dir := config.StringVal(r.config.Output.Dir)
+	mode := config.FileModeVal(r.config.Output.DirMode)
+	dryRun := config.BoolVal(r.config.DryRun)
+
+	if !dryRun {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return errors.Wrap(err, "creating output dir")
+		}
+	}
+
+	written := make(map[string]string)
+	for k, d := range sources {
+		if !isSecretSource(d) {
+			continue
+		}
+		if k == "." || k == ".." || strings.ContainsAny(k, `/\`) {
+			return fmt.Errorf("writing output dir: %s is not a valid file name", k)
+		}
+
+		path := filepath.Join(dir, k)
+		v := env[k]
+		if prev, ok := r.secretFiles[k]; !dryRun && (!ok || prev != v) {
+			log.Printf("[DEBUG] (runner) writing %s to %q", k, path)
+			if err := atomicWriteFile(path, []byte(v), mode); err != nil {
+				return errors.Wrap(err, "writing output dir")
+			}
+		}
+		written[k] = v
+
+		switch config.StringVal(r.config.Output.DirEnv) {
+		case OutputDirEnvPath:
+			env[k] = path
+		case OutputDirEnvOmit:
+			delete(env, k)
+			delete(sources, k)
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	for k := range r.secretFiles {
+		if _, ok := written[k]; ok {
+			continue
+		}
+		path := filepath.Join(dir, k)
+		log.Printf("[DEBUG] (runner) removing %q", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "writing output dir")
+		}
+	}
+	r.secretFiles = written
+	return nil
+}
+
+// isSecretSource returns true if the given dependency reads from Vault.
+func isSecretSource(d dep.Dependency) bool {
+	return d != nil && d.Type() == dep.TypeVault
+}
+
+// atomicWriteFile writes the contents to a temporary file in the same
+// directory as path and renames it into place, so readers never observe a
+// partially-written file.
+func atomicWriteFile(path string, contents []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
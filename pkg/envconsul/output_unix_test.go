@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package envconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteNamedPipe(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "envconsul-pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "env.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"foo": "bar",
+		"zip": "with \"quotes\"",
+	}
+
+	// Without a reader, the write is skipped rather than blocking.
+	if err := writeNamedPipe(path, env); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := writeNamedPipe(path, env); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "foo=\"bar\"\nzip=\"with \\\"quotes\\\"\"\n"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, string(b))
+	}
+}
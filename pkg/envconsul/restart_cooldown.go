@@ -0,0 +1,83 @@
+package envconsul
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// deferRestart records a restart of the child process caused by a change,
+// returning true if it must instead be deferred until the restart cooldown
+// ends. Once the configured number of restarts happen within the window, a
+// cooldown starts, during which restarts are only marked as pending.
+func (r *Runner) deferRestart() bool {
+	c := r.config.RestartCooldown
+	limit := config.IntVal(c.Restarts)
+	if limit <= 0 {
+		return false
+	}
+
+	now := r.now()
+	if now.Before(r.cooldownEnd) {
+		if !r.restartPending {
+			log.Printf("[INFO] (runner) deferring restart of child process "+
+				"until the restart cooldown ends at %s", r.cooldownEnd.Format(time.RFC3339))
+		}
+		r.restartPending = true
+		return true
+	}
+
+	// Only keep the restarts within the window.
+	since := now.Add(-config.TimeDurationVal(c.Window))
+	recent := r.recentRestarts[:0]
+	for _, t := range r.recentRestarts {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	r.recentRestarts = append(recent, now)
+
+	if len(r.recentRestarts) >= limit {
+		cooldown := config.TimeDurationVal(c.Cooldown)
+		log.Printf("[INFO] (runner) child process restarted %d times within %s, "+
+			"deferring further restarts for %s", len(r.recentRestarts),
+			config.TimeDurationVal(c.Window), cooldown)
+
+		r.recentRestarts = nil
+		r.cooldownEnd = now.Add(cooldown)
+		r.cooldownTimer = time.AfterFunc(cooldown, func() {
+			select {
+			case r.cooldownCh <- struct{}{}:
+			default:
+			}
+		})
+	}
+	return false
+}
+
+// endRestartCooldown restarts the child process once, if any restart was
+// deferred during the cooldown which just ended.
+func (r *Runner) endRestartCooldown() (<-chan int, error) {
+	r.cooldownTimer = nil
+	if !r.restartPending {
+		return nil, nil
+	}
+	r.restartPending = false
+
+	if r.child == nil || r.deferRestart() {
+		return nil, nil
+	}
+
+	log.Printf("[INFO] (runner) restart cooldown ended, applying deferred changes")
+	return r.restartChild()
+}
+
+// stopRestartCooldown stops the timer of the restart cooldown, if one is
+// running.
+func (r *Runner) stopRestartCooldown() {
+	if r.cooldownTimer != nil {
+		r.cooldownTimer.Stop()
+		r.cooldownTimer = nil
+	}
+}
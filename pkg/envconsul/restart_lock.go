@@ -0,0 +1,174 @@
+package envconsul
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul/api"
+)
+
+// restartLock gates restarts of the child process, so that only a limited
+// number of envconsul instances restart their children at once.
+type restartLock interface {
+	// acquire blocks until a slot is held, returning false if stopCh is
+	// closed first.
+	acquire(stopCh <-chan struct{}) (bool, error)
+
+	// release gives up the held slot.
+	release() error
+}
+
+// consulRestartLock is a restartLock backed by a Consul semaphore.
+type consulRestartLock struct {
+	sem *api.Semaphore
+}
+
+// newConsulRestartLock returns a restartLock using the semaphore at the given
+// Consul KV prefix, with the given number of slots.
+func newConsulRestartLock(client *api.Client, prefix string, limit int) (*consulRestartLock, error) {
+	sem, err := client.SemaphoreOpts(&api.SemaphoreOptions{
+		Prefix:      prefix,
+		Limit:       limit,
+		SessionName: "envconsul restart coordination",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &consulRestartLock{sem: sem}, nil
+}
+
+func (l *consulRestartLock) acquire(stopCh <-chan struct{}) (bool, error) {
+	lostCh, err := l.sem.Acquire(stopCh)
+	if err != nil {
+		return false, err
+	}
+	return lostCh != nil, nil
+}
+
+func (l *consulRestartLock) release() error {
+	return l.sem.Release()
+}
+
+// restartChild stops the child process and starts it again. If a restart
+// coordination lock is configured, the child is only restarted while holding
+// one of its slots. Without one, a slot is waited for in the background and
+// the child keeps running until the Start loop restarts it once one is held.
+func (r *Runner) restartChild() (<-chan int, error) {
+	if r.restartLock != nil {
+		if !r.takeRestartLock() {
+			return nil, nil
+		}
+		defer r.holdRestartLock()
+	}
+
+	log.Printf("[INFO] (runner) stopping existing child process")
+	r.stopChild()
+	return r.startChild()
+}
+
+// takeRestartLock returns whether a slot of the restart coordination lock is
+// held, taking over the slot of a recent restart. Otherwise, it starts
+// waiting for a slot in the background, unless it already is, and the result
+// is sent on restartLockCh.
+func (r *Runner) takeRestartLock() bool {
+	r.restartLockMu.Lock()
+	defer r.restartLockMu.Unlock()
+
+	if r.restartLockHeld {
+		if r.restartLockTimer != nil {
+			r.restartLockTimer.Stop()
+			r.restartLockTimer = nil
+		}
+		return true
+	}
+	if r.restartLockWaiting {
+		return false
+	}
+
+	log.Printf("[INFO] (runner) waiting for a restart coordination slot")
+	r.restartLockWaiting = true
+	go r.acquireRestartLock()
+	return false
+}
+
+// acquireRestartLock waits for a slot of the restart coordination lock, and
+// sends the result on restartLockCh once one is held or acquiring it failed.
+// Nothing is sent if the runner is stopped first.
+func (r *Runner) acquireRestartLock() {
+	ok, err := r.restartLock.acquire(r.DoneCh)
+
+	r.restartLockMu.Lock()
+	r.restartLockWaiting = false
+	if ok && err == nil {
+		if r.restartLockStopped {
+			// The runner stopped as the slot was acquired.
+			r.releaseRestartLock()
+			ok = false
+		} else {
+			r.restartLockHeld = true
+		}
+	}
+	r.restartLockMu.Unlock()
+
+	if err != nil || ok {
+		select {
+		case r.restartLockCh <- err:
+		case <-r.DoneCh:
+		}
+	}
+}
+
+// holdRestartLock releases the slot of the restart coordination lock once the
+// configured hold has passed, so that restarts across the fleet are spaced
+// out.
+func (r *Runner) holdRestartLock() {
+	r.restartLockMu.Lock()
+	defer r.restartLockMu.Unlock()
+
+	hold := config.TimeDurationVal(r.config.RestartCoordinationLock.Hold)
+	if hold <= 0 {
+		r.releaseRestartLock()
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(hold, func() {
+		r.restartLockMu.Lock()
+		defer r.restartLockMu.Unlock()
+
+		// A later restart may have taken over the slot.
+		if r.restartLockTimer == timer {
+			r.releaseRestartLock()
+		}
+	})
+	r.restartLockTimer = timer
+}
+
+// stopRestartLock releases the slot of the restart coordination lock, if one
+// is held.
+func (r *Runner) stopRestartLock() {
+	r.restartLockMu.Lock()
+	defer r.restartLockMu.Unlock()
+
+	r.restartLockStopped = true
+
+	if r.restartLockTimer != nil {
+		r.restartLockTimer.Stop()
+	}
+	if r.restartLockHeld {
+		r.releaseRestartLock()
+	}
+}
+
+// releaseRestartLock gives up the held slot. The caller must hold
+// restartLockMu.
+func (r *Runner) releaseRestartLock() {
+	r.restartLockHeld = false
+	r.restartLockTimer = nil
+
+	log.Printf("[DEBUG] (runner) releasing restart coordination slot")
+	if err := r.restartLock.release(); err != nil {
+		log.Printf("[WARN] (runner) releasing restart coordination slot: %s", err)
+	}
+}
@@ -0,0 +1,4077 @@
+package envconsul
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/consul-template/child"
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/manager"
+	"github.com/hashicorp/consul-template/signals"
+	"github.com/hashicorp/consul-template/watch"
+	"github.com/hashicorp/envconsul/version"
+	shellwords "github.com/mattn/go-shellwords"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// InvalidRegexp is a regexp for invalid characters in keys
+var InvalidRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+const (
+	// envconsulEnvPrefix is the prefix of the variables envconsul injects about
+	// itself.
+	envconsulEnvPrefix = "ENVCONSUL_"
+
+	// EnvSourcePrefix is the prefix of the companion variables holding the
+	// path of the source of each key, injected when AnnotateSources is
+	// enabled.
+	EnvSourcePrefix = "__ENVCONSUL_SOURCE_"
+
+	// EnvApplyOrder is the environment variable listing the kinds of sources
+	// in the order they are applied, injected when EmitApplyOrder is enabled.
+	EnvApplyOrder = "ENVCONSUL_APPLY_ORDER"
+
+	// EnvConfigHash is the environment variable holding the hash of the
+	// configuration, injected when EmitConfigHash is enabled.
+	EnvConfigHash = "ENVCONSUL_CONFIG_HASH"
+
+	// EnvCounts is the environment variable holding the number of keys from
+	// each kind of source as JSON, injected when EmitCounts is enabled.
+	EnvCounts = "ENVCONSUL_COUNTS"
+
+	// EnvLastFetch is the environment variable holding the time of the most
+	// recent successful render in RFC3339 format, injected when EmitLastFetch
+	// is enabled.
+	EnvLastFetch = "ENVCONSUL_LAST_FETCH"
+
+	// EnvLogLevel is the environment variable holding the level envconsul
+	// logs at, injected when EmitLogLevel is enabled.
+	EnvLogLevel = "ENVCONSUL_LOG_LEVEL"
+
+	// EnvMode is the environment variable holding the mode envconsul runs in,
+	// "once" or "watch", injected when EmitMode is enabled.
+	EnvMode = "ENVCONSUL_MODE"
+
+	// EnvNode is the environment variable holding the node name of the local
+	// Consul agent, injected when EmitNodeName is enabled.
+	EnvNode = "ENVCONSUL_NODE"
+
+	// EnvOverridden is the environment variable listing the keys set by more
+	// than one source, injected when EmitOverrides is enabled.
+	EnvOverridden = "ENVCONSUL_OVERRIDDEN"
+
+	// EnvRestartCount is the environment variable holding the number of times
+	// the child process has been restarted, injected when EmitRestartCount is
+	// enabled.
+	EnvRestartCount = "ENVCONSUL_RESTART_COUNT"
+
+	// EnvSecretsChecksum is the environment variable holding a checksum of
+	// the keys and values read from Vault, injected when EmitSecretsChecksum
+	// is enabled.
+	EnvSecretsChecksum = "ENVCONSUL_SECRETS_CHECKSUM"
+
+	// EnvWatches is the environment variable listing the paths of the
+	// prefixes, secrets and services being watched, injected when
+	// EmitWatchPaths is enabled.
+	EnvWatches = "ENVCONSUL_WATCHES"
+
+	// EnvErrored is the environment variable listing the paths of the sources
+	// whose watch is currently failing, injected when there are any.
+	EnvErrored = "ENVCONSUL_ERRORED"
+
+	// EnvReloadedFrom is the environment variable listing the configuration
+	// files whose change caused the most recent reload, injected after a
+	// reload.
+	EnvReloadedFrom = "ENVCONSUL_RELOADED_FROM"
+
+	// EnvVaultTokenTTL is the environment variable holding the remaining TTL
+	// of the Vault token in seconds, injected when EmitTokenTTL is enabled.
+	EnvVaultTokenTTL = "ENVCONSUL_VAULT_TOKEN_TTL"
+)
+
+// Runner executes a given child process with configuration
+type Runner struct {
+	// ErrCh and DoneCh are channels where errors and finish notifications occur.
+	ErrCh  chan error
+	DoneCh chan struct{}
+
+	// ExitCh is a channel for parent processes to read exit status values from
+	// the child processes.
+	ExitCh chan int
+
+	// child is the child process under management. This may be nil if not running
+	// in exec mode.
+	child *child.Child
+
+	// clients is the set of API clients the dependencies are fetched with.
+	clients *dep.ClientSet
+
+	// childLock is the internal lock around the child process.
+	childLock sync.RWMutex
+
+	// config is the Config that created this Runner. It is used internally to
+	// construct other objects and pass data.
+	config *Config
+
+	// configHash is the hash of config, computed once at creation.
+	configHash string
+
+	// configPrefixMap is a map of a dependency's hashcode back to the config
+	// prefix that created it.
+	configPrefixMap map[string]*PrefixConfig
+
+	// configServiceMap is a map of a dependency's hashcode back to the service
+	// configs that use it. Configs with identical queries share a dependency.
+	configServiceMap map[string][]*ServiceConfig
+
+	// healthQueries is a map of a service dependency's hashcode to the health
+	// dependency watched alongside it, for services which emit their status.
+	healthQueries map[string]*dep.HealthServiceQuery
+
+	// stickyInstances is the last non-empty set of instances of each service
+	// config with sticky_instances set.
+	stickyInstances map[*ServiceConfig]*stickyInstances
+
+	// datacenters is a map of a prefix dependency's hashcode to the datacenter
+	// its keys are namespaced with, when namespacing datacenters.
+	datacenters map[string]string
+
+	// renameRules is a map of a prefix dependency's hashcode to its compiled
+	// rename rules.
+	renameRules map[string][]*renameRule
+
+	// splitRules is a map of a secret dependency's hashcode to its compiled
+	// split rules.
+	splitRules map[string][]*splitRule
+
+	// data is the latest representation of the data from Consul.
+	data map[string]interface{}
+
+	// dependencies is the list of dependencies this runner is watching.
+	dependencies []dep.Dependency
+
+	// dependenciesLock is a lock around touching the dependencies map.
+	dependenciesLock sync.Mutex
+
+	// env is the last compiled environment.
+	env map[string]string
+
+	// errored is the set of dependencies whose most recent fetch failed, mapped
+	// to the path of the source which created them.
+	errored     map[string]string
+	erroredLock sync.Mutex
+
+	// sources maps each key in env to the dependency that produced it.
+	sources map[string]dep.Dependency
+
+	// ports is the set of keys in env holding the port of a service, which
+	// structured outputs write as numbers.
+	ports map[string]struct{}
+
+	// once indicates the runner should get data exactly one time and then stop.
+	once bool
+
+	// probeFailures is the number of consecutive failed health probes of the
+	// current child process.
+	probeFailures int
+
+	// childGeneration is incremented each time a child process is started, so
+	// the result of a probe of an earlier child can be told apart.
+	childGeneration int
+
+	// restarts is the number of times the child process has been restarted.
+	restarts int
+
+	// restartLock gates restarts of the child process, if configured. While
+	// restartLockHeld, a slot is held until restartLockTimer fires. A slot is
+	// waited for in the background while restartLockWaiting, and the result
+	// is sent on restartLockCh, so the restart resumes from the Start loop.
+	restartLock        restartLock
+	restartLockHeld    bool
+	restartLockWaiting bool
+	restartLockStopped bool
+	restartLockTimer   *time.Timer
+	restartLockMu      sync.Mutex
+	restartLockCh      chan error
+
+	// recentRestarts are the times of the restarts of the child process within
+	// the restart cooldown window. Once the cooldown is triggered, restarts are
+	// deferred until cooldownEnd, restartPending is set if any was, and
+	// cooldownTimer signals cooldownCh when the cooldown ends.
+	recentRestarts []time.Time
+	cooldownEnd    time.Time
+	restartPending bool
+	cooldownTimer  *time.Timer
+	cooldownCh     chan struct{}
+
+	// lastFetch is the time of the most recent successful render.
+	lastFetch time.Time
+
+	// overridden is the sorted list of keys set by more than one source in the
+	// most recent render.
+	overridden []string
+
+	// lineTemplate is the parsed output line template, if any.
+	lineTemplate *lineTemplate
+
+	// secretFiles maps the keys written to the output directory to the values
+	// last written, so only changed files are replaced and the files of keys
+	// which are no longer set are removed.
+	secretFiles map[string]string
+
+	// tokenTTL is the remaining TTL of the Vault token as of its last lookup.
+	tokenTTL time.Duration
+
+	// nodeName is the node name of the local Consul agent, looked up at
+	// startup.
+	nodeName string
+
+	// refetchCh holds a pending request to re-fetch every dependency. It has
+	// a buffer of one, so requests made while one is pending are coalesced.
+	refetchCh chan struct{}
+
+	// renderCh holds a pending request to render the environment again, such
+	// as when a sticky set of instances expires. Like refetchCh, it has a
+	// buffer of one.
+	renderCh chan struct{}
+
+	// keyRetries are the retries in progress of keys of prefixes whose values
+	// failed to be transformed, by dependency and key.
+	keyRetries map[string]*keyRetry
+
+	// reloadedFrom is the sorted list of configuration files which changed
+	// before the reload that created this runner, if any.
+	reloadedFrom []string
+
+	// envSocket is the listener serving the environment, if configured.
+	envSocket net.Listener
+
+	// metrics are the counters served by telemetryServer, if configured.
+	metrics         telemetry
+	telemetryServer *http.Server
+
+	// timeWindows are the parsed time windows, in configuration order.
+	timeWindows []*timeWindow
+
+	// clock returns the current time, or nil to use time.Now. It is only
+	// replaced in tests.
+	clock func() time.Time
+
+	// outStream and errStream are the io.Writer streams where the runner will
+	// write information.
+	//
+	// inStream is the ioReader where the runner will read information.
+	outStream, errStream io.Writer
+	inStream             io.Reader
+
+	// minTimer and maxTimer are used for quiescence.
+	minTimer, maxTimer <-chan time.Time
+
+	// stopLock is the lock around checking if the runner can be stopped
+	stopLock sync.Mutex
+
+	// stopped is a boolean of whether the runner is stopped
+	stopped bool
+
+	// watcher is the watcher this runner is using.
+	watcher *watch.Watcher
+}
+
+// NewRunner accepts a config, command, and boolean value for once mode.
+func NewRunner(config *Config, once bool) (*Runner, error) {
+	log.Printf("[INFO] (runner) creating new runner (once: %v)", once)
+
+	runner := &Runner{
+		config: config,
+		once:   once,
+	}
+
+	if err := runner.init(); err != nil {
+		return nil, err
+	}
+
+	return runner, nil
+}
+
+// SetReloadedFrom records the configuration files which changed before the
+// reload that created this runner, to be emitted to the child process.
+func (r *Runner) SetReloadedFrom(paths []string) {
+	r.reloadedFrom = paths
+}
+
+// ReloadedFrom returns the configuration files recorded by SetReloadedFrom.
+func (r *Runner) ReloadedFrom() []string {
+	return r.reloadedFrom
+}
+
+// Start creates a new runner and begins watching dependencies and quiescence
+// timers. This is the main event loop and will block until finished.
+func (r *Runner) Start() {
+	log.Printf("[INFO] (runner) starting")
+
+	// Create the pid before doing anything. A dry run writes no files.
+	if !config.BoolVal(r.config.DryRun) {
+		if err := r.storePid(); err != nil {
+			r.ErrCh <- err
+			return
+		}
+
+		if config.StringPresent(r.config.EnvSocket) {
+			if err := r.listenEnvSocket(); err != nil {
+				r.ErrCh <- err
+				return
+			}
+		}
+
+		if config.StringPresent(r.config.TelemetryAddr) {
+			if err := r.listenTelemetry(); err != nil {
+				r.ErrCh <- err
+				return
+			}
+		}
+	}
+
+	if config.BoolVal(r.config.EmitBanner) {
+		r.emitBanner()
+	}
+
+	if config.BoolVal(r.config.EmitNodeName) {
+		if err := r.lookupNodeName(); err != nil {
+			r.ErrCh <- err
+			return
+		}
+	}
+
+	// Log in to Vault before any secret is read.
+	if err := r.loginVault(); err != nil {
+		r.ErrCh <- err
+		return
+	}
+
+	// Add each dependency to the watcher
+	for _, d := range r.dependencies {
+		r.watcher.Add(&trackedDependency{Dependency: d, runner: r})
+	}
+
+	// A mandatory token is renewed by envconsul rather than the watcher, so
+	// that a terminal renewal failure is reported. So is a token from the auth
+	// method, which is replaced by logging in again when it cannot be renewed.
+	if config.StringPresent(r.config.VaultAuth.Method) {
+		r.watcher.Add(r.newVaultLoginRenewQuery())
+	} else if renewVaultToken(r.config) && config.BoolVal(r.config.VaultTokenMandatory) {
+		r.watcher.Add(newVaultTokenRenewQuery(
+			config.TimeDurationVal(r.config.VaultTokenRenewGrace)))
+	}
+
+	var exitCh <-chan int
+
+	// Render again whenever a time window opens or closes.
+	var windowCh <-chan time.Time
+	if len(r.timeWindows) > 0 {
+		windowCh = time.After(r.nextWindowChange().Sub(r.now()))
+	}
+
+	// Restart or reload the child whenever a watched file changes.
+	var fileCh <-chan string
+	if len(r.config.WatchFiles) > 0 {
+		files, err := newFileWatcher(r.config.WatchFiles)
+		if err != nil {
+			r.ErrCh <- err
+			return
+		}
+		defer files.stop()
+		fileCh = files.changeCh
+	}
+
+	// Probe the health of the child periodically, if configured. Probes run in
+	// the background, so a slow probe does not hold up the loop, and a tick is
+	// skipped while the previous probe is still running.
+	var probeCh <-chan time.Time
+	probeResultCh := make(chan probeOutcome, 1)
+	probing := false
+	if config.StringVal(r.config.HealthProbe.Command) != "" {
+		ticker := time.NewTicker(config.TimeDurationVal(r.config.HealthProbe.Interval))
+		defer ticker.Stop()
+		probeCh = ticker.C
+	}
+
+	for {
+		select {
+		case data := <-r.watcher.DataCh():
+			r.Receive(data.Dependency(), data.Data())
+
+			// Drain all views that have data
+		OUTER:
+			for {
+				select {
+				case data = <-r.watcher.DataCh():
+					r.Receive(data.Dependency(), data.Data())
+				default:
+					break OUTER
+				}
+			}
+
+			// If we are waiting for quiescence, setup the timers
+			if config.BoolVal(r.config.Wait.Enabled) {
+				log.Printf("[INFO] (runner) quiescence timers starting")
+				r.minTimer = time.After(config.TimeDurationVal(r.config.Wait.Min))
+				if r.maxTimer == nil {
+					r.maxTimer = time.After(config.TimeDurationVal(r.config.Wait.Max))
+				}
+				continue
+			}
+		case <-r.minTimer:
+			log.Printf("[INFO] (runner) quiescence minTimer fired")
+			r.minTimer, r.maxTimer = nil, nil
+		case <-r.maxTimer:
+			log.Printf("[INFO] (runner) quiescence maxTimer fired")
+			r.minTimer, r.maxTimer = nil, nil
+		case err := <-r.watcher.ErrCh():
+			// Intentionally do not send the error back up to the runner. Eventually,
+			// once Consul API implements errwrap and multierror, we can check the
+			// "type" of error and conditionally alert back.
+			//
+			// if err.Contains(Something) {
+			//   errCh <- err
+			// }
+			log.Printf("[ERR] (runner) watcher reported error: %s", err)
+			if typed, ok := err.(*errVaultTokenRenewal); ok {
+				log.Printf("[ERR] (runner) vault token is mandatory, stopping child")
+				r.stopChild()
+				r.ErrCh <- typed
+				return
+			}
+			if r.once {
+				if err := r.retryFirstFetch(err); err != nil {
+					r.ErrCh <- err
+					return
+				}
+			}
+		case <-r.refetchCh:
+			log.Printf("[INFO] (runner) re-fetching all dependencies")
+			r.refetch()
+		case <-r.renderCh:
+			log.Printf("[INFO] (runner) rendering again")
+		case <-windowCh:
+			log.Printf("[INFO] (runner) a time window opened or closed")
+			windowCh = time.After(r.nextWindowChange().Sub(r.now()))
+		case code := <-exitCh:
+			// The child exited on its own, so its exit status is passed on as is.
+			// Rendering again could start another child in its place.
+			log.Printf("[INFO] (runner) child process exited with status %d", code)
+			exitCh = nil
+			r.ExitCh <- code
+			continue
+		case path := <-fileCh:
+			log.Printf("[INFO] (runner) watched file %s changed", path)
+			nexitCh, err := r.reloadChild()
+			if err != nil {
+				r.ErrCh <- err
+				return
+			}
+			if nexitCh != nil {
+				exitCh = nexitCh
+			}
+			continue
+		case err := <-r.restartLockCh:
+			if err != nil {
+				r.ErrCh <- errors.Wrap(err, "acquiring restart coordination lock")
+				return
+			}
+			nexitCh, err := r.restartChild()
+			if err != nil {
+				r.ErrCh <- err
+				return
+			}
+			if nexitCh != nil {
+				exitCh = nexitCh
+			}
+			continue
+		case <-r.cooldownCh:
+			nexitCh, err := r.endRestartCooldown()
+			if err != nil {
+				r.ErrCh <- err
+				return
+			}
+			if nexitCh != nil {
+				exitCh = nexitCh
+			}
+			continue
+		case <-probeCh:
+			if r.child == nil || probing {
+				continue
+			}
+			probing = true
+			go func(generation int, command string, timeout time.Duration) {
+				probeResultCh <- probeOutcome{generation, runProbe(command, timeout)}
+			}(r.childGeneration, config.StringVal(r.config.HealthProbe.Command),
+				config.TimeDurationVal(r.config.HealthProbe.Timeout))
+			continue
+		case outcome := <-probeResultCh:
+			probing = false
+			nexitCh, err := r.probeResult(outcome.generation, outcome.err)
+			if err != nil {
+				r.ErrCh <- err
+				return
+			}
+			if nexitCh != nil {
+				exitCh = nexitCh
+			}
+			continue
+		case <-r.DoneCh:
+			log.Printf("[INFO] (runner) received finish")
+			return
+		}
+
+		// If we got this far, that means we got new data or one of the timers
+		// fired, so attempt to re-process the environment.
+		nexitCh, err := r.Run()
+		if err != nil {
+			r.ErrCh <- err
+			return
+		}
+
+		// Without a command there is no child process to wait for, so in once
+		// mode the runner is done after the first render, as is a dry run.
+		if r.once && r.env != nil &&
+			(!config.StringPresent(r.config.Exec.Command) || config.BoolVal(r.config.DryRun)) {
+			r.Stop()
+			return
+		}
+
+		// It's possible that we didn't start a process, in which case no exitCh
+		// is returned. In this case, we should assume our current process is still
+		// running and chug along. If we did get a new exitCh, that means a new
+		// process is spawned, so we need to watch a new exitCh.
+		if nexitCh != nil {
+			exitCh = nexitCh
+		}
+	}
+}
+
+// Stop halts the execution of this runner and its subprocesses.
+func (r *Runner) Stop() {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+
+	if r.stopped {
+		return
+	}
+
+	log.Printf("[INFO] (runner) stopping")
+	r.stopWatcher()
+	r.stopChild()
+	r.stopRestartLock()
+	r.stopRestartCooldown()
+	r.closeEnvSocket()
+	r.closeTelemetry()
+
+	if err := r.deletePid(); err != nil {
+		log.Printf("[WARN] (runner) could not remove pid at %#v: %s",
+			r.config.PidFile, err)
+	}
+
+	r.stopped = true
+
+	close(r.DoneCh)
+
+	// A render blocked until the runner stops may hold the dependencies lock,
+	// so the retries of keys are stopped last.
+	r.stopKeyRetries()
+}
+
+// Receive accepts data from and maps that data to the prefix.
+func (r *Runner) Receive(d dep.Dependency, data interface{}) {
+	r.dependenciesLock.Lock()
+	defer r.dependenciesLock.Unlock()
+	log.Printf("[DEBUG] (runner) receiving dependency %s", d)
+	r.data[d.String()] = data
+}
+
+// Refetch requests that every prefix, secret and service is read again,
+// outside of the watches, and the environment re-rendered as for any other
+// change. It does not block: a request made while another is pending is
+// coalesced with it, so a burst of requests during a render results in at
+// most one more re-fetch.
+func (r *Runner) Refetch() {
+	select {
+	case r.refetchCh <- struct{}{}:
+	default:
+		log.Printf("[DEBUG] (runner) re-fetch already pending")
+	}
+}
+
+// refetch reads each dependency once using a fresh instance, so blocking
+// queries return immediately and cached secrets are bypassed. A dependency
+// which fails to be read keeps its previous data.
+func (r *Runner) refetch() {
+	for _, d := range r.dependencies {
+		fresh, err := r.freshDependency(d)
+		if err != nil {
+			log.Printf("[WARN] (runner) re-fetching %s: %s", d, err)
+			continue
+		}
+
+		data, _, err := fresh.Fetch(r.clients, &dep.QueryOptions{})
+		fresh.Stop()
+		if err != nil {
+			log.Printf("[WARN] (runner) re-fetching %s: %s", d, err)
+			continue
+		}
+		r.Receive(d, data)
+	}
+}
+
+// retryFirstFetch retries fetching the dependencies which have no data yet,
+// with exponential backoff, after the watcher failed to fetch one of them in
+// once mode. It returns the last error, with the number of attempts made, if
+// retries are disabled or exhausted.
+func (r *Runner) retryFirstFetch(err error) error {
+	if !config.BoolVal(r.config.OnceRetry.Enabled) {
+		return err
+	}
+
+	retry := r.config.OnceRetry.RetryFunc()
+	attempts := 1
+	for {
+		ok, sleep := retry(attempts - 1)
+		if !ok {
+			return errors.Wrapf(err, "runner: giving up after %d attempts", attempts)
+		}
+
+		log.Printf("[WARN] (runner) first fetch failed (attempt %d), retrying in %s: %s",
+			attempts, sleep, err)
+		select {
+		case <-time.After(sleep):
+		case <-r.DoneCh:
+			return nil
+		}
+		attempts++
+
+		if err = r.fetchMissing(); err == nil {
+			return nil
+		}
+	}
+}
+
+// fetchMissing fetches each dependency which has no data yet, returning the
+// first error.
+func (r *Runner) fetchMissing() error {
+	r.dependenciesLock.Lock()
+	var missing []dep.Dependency
+	for _, d := range r.dependencies {
+		if _, ok := r.data[d.String()]; !ok {
+			missing = append(missing, d)
+		}
+	}
+	r.dependenciesLock.Unlock()
+
+	return r.fetchAll(missing)
+}
+
+// fetchAll fetches each of the given dependencies once, without blocking, and
+// receives its data, returning the first error.
+func (r *Runner) fetchAll(deps []dep.Dependency) error {
+	for _, d := range deps {
+		fresh, err := r.freshDependency(d)
+		if err != nil {
+			return err
+		}
+
+		data, _, err := fresh.Fetch(r.clients, &dep.QueryOptions{})
+		fresh.Stop()
+		if err != nil {
+			return err
+		}
+		r.Receive(d, data)
+	}
+	return nil
+}
+
+// freshDependency returns a new instance of the given dependency, with none
+// of its state from previous fetches.
+func (r *Runner) freshDependency(d dep.Dependency) (dep.Dependency, error) {
+	if typed, ok := d.(*consistentQuery); ok {
+		fresh, err := r.freshDependency(typed.Dependency)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentQuery{fresh}, nil
+	}
+	if typed, ok := d.(*tunedQuery); ok {
+		fresh, err := r.freshDependency(typed.Dependency)
+		if err != nil {
+			return nil, err
+		}
+		return newTunedQuery(fresh, typed.maxStale, typed.pollInterval), nil
+	}
+
+	switch typed := d.(type) {
+	case *dep.KVListQuery:
+		return dep.NewKVListQuery(config.StringVal(r.configPrefixMap[d.String()].Path))
+	case *dep.KVGetQuery:
+		return dep.NewKVGetQuery(config.StringVal(r.configPrefixMap[d.String()].Path))
+	case *dep.CatalogServiceQuery, *preparedQuery:
+		return r.serviceDependency(r.configServiceMap[d.String()][0])
+	case *dep.HealthServiceQuery:
+		for id, h := range r.healthQueries {
+			if h == typed {
+				return newHealthQuery(config.StringVal(r.configServiceMap[id][0].Query))
+			}
+		}
+		return nil, fmt.Errorf("missing dependency %s", d)
+	case *vaultReadQuery:
+		return &vaultReadQuery{
+			stopCh:      make(chan struct{}, 1),
+			rawPath:     typed.rawPath,
+			queryValues: typed.queryValues,
+			headers:     typed.headers,
+		}, nil
+	case *vaultListReadQuery:
+		fresh, err := newVaultListReadQuery(typed.rawPath, typed.concurrency, nil)
+		if err != nil {
+			return nil, err
+		}
+		fresh.headers = typed.headers
+		return fresh, nil
+	case *vaultTokenTTLQuery:
+		return newVaultTokenTTLQuery(), nil
+	default:
+		return nil, fmt.Errorf("unknown dependency type %T", d)
+	}
+}
+
+// Signal sends a signal to the child process, if it exists. Any errors that
+// occur are returned.
+func (r *Runner) Signal(s os.Signal) error {
+	r.childLock.RLock()
+	defer r.childLock.RUnlock()
+	if r.child == nil {
+		return nil
+	}
+	return r.child.Signal(s)
+}
+
+var _ manager.ErrExitable = new(ErrEmptyEnv)
+
+// ErrEmptyEnv is the error returned when the environment is empty and an exit
+// code is configured for that case.
+type ErrEmptyEnv struct {
+	code int
+}
+
+// Error implements the error interface.
+func (e *ErrEmptyEnv) Error() string {
+	return "runner: the environment is empty"
+}
+
+// ExitStatus implements the ErrExitable interface.
+func (e *ErrEmptyEnv) ExitStatus() int {
+	return e.code
+}
+
+// managedEnvEmpty returns whether the given environment, once filtered and
+// merged with the custom variables of the exec block, is empty. Inherited
+// variables and those envconsul emits about itself are not counted.
+func (r *Runner) managedEnvEmpty(env map[string]string) bool {
+	managed := make(map[string]string, len(env))
+	for k, v := range env {
+		managed[k] = v
+	}
+	return len(r.applyConfigEnv(managed)) == 0
+}
+
+// Run executes and manages the child process with the correct environment. The
+// current environment is also copied into the child process environment.
+func (r *Runner) Run() (<-chan int, error) {
+	log.Printf("[INFO] (runner) running")
+
+	r.dependenciesLock.Lock()
+	defer r.dependenciesLock.Unlock()
+	res, err := r.resolve()
+	if err != nil {
+		return nil, r.tolerateStale(err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	env, sources, overridden, counts := res.env, res.sources, res.overridden, res.counts
+
+	// Secrets written to the output directory are replaced in the environment
+	// before it is compared, so a changed secret need not restart the child.
+	if config.StringPresent(r.config.Output.Dir) {
+		if err := r.writeSecretFiles(env, sources); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every dependency has been resolved, whether or not anything changed.
+	r.lastFetch = time.Now()
+	atomic.AddUint64(&r.metrics.renders, 1)
+	atomic.StoreInt64(&r.metrics.lastRender, r.lastFetch.UnixNano())
+
+	r.overridden = make([]string, 0, len(overridden))
+	for k := range overridden {
+		r.overridden = append(r.overridden, k)
+	}
+	sort.Strings(r.overridden)
+
+	// Report the number of variables each source exported. A dry run writes
+	// the summary with the environment instead, whatever the log level.
+	summary := sourceSummary(counts, len(sources))
+	if !config.BoolVal(r.config.DryRun) {
+		log.Printf("[INFO] (runner) exported %s", summary)
+	}
+
+	// Print the final environment
+	log.Printf("[TRACE] Environment:")
+	for k, v := range env {
+		log.Printf("[TRACE]   %s=%q", k, r.logValue(k, v))
+	}
+
+	// If the resulting map is the same, do not do anything. We use a length
+	// check first to get a small performance increase if something has changed
+	// so we don't immediately delegate to reflect which is slow.
+	if len(r.env) == len(env) && reflect.DeepEqual(r.env, env) {
+		log.Printf("[INFO] (runner) environment was the same")
+		return nil, nil
+	}
+
+	// A dry run prints the environment the child would be given, in place of
+	// writing any files or starting the child.
+	if config.BoolVal(r.config.DryRun) {
+		r.env = env
+		r.sources = sources
+		r.ports = res.ports
+		fmt.Fprintf(r.errStream, "exported %s\n", summary)
+		return nil, r.printDryRun()
+	}
+
+	// An empty environment may be a signal to exit, in place of starting the
+	// child. Once the child is running, an environment which empties in watch
+	// mode is passed on to it like any other change.
+	if code := config.IntVal(r.config.EmptyEnvExitCode); code >= 0 && r.child == nil && r.managedEnvEmpty(env) {
+		return nil, &ErrEmptyEnv{code: code}
+	}
+
+	// Record what changed since the last render before replacing it.
+	if path := config.StringVal(r.config.DeltaFile); path != "" {
+		if err := r.writeDelta(path, r.env, env, sources); err != nil {
+			return nil, err
+		}
+	}
+	if config.BoolVal(r.config.LogEnvDiff) {
+		r.logDelta(r.env, env, sources)
+	}
+
+	// Decide how the child learns of the change before replacing the
+	// environment it was started with.
+	signal := r.reloadSignal(r.env, env, sources)
+
+	// Update the environment
+	r.env = env
+	r.sources = sources
+	r.ports = res.ports
+
+	if path := config.StringVal(r.config.NamedPipe); path != "" {
+		if err := writeNamedPipe(path, r.env); err != nil {
+			log.Printf("[WARN] (runner) %s", err)
+		}
+	}
+
+	if config.StringPresent(r.config.Output.Path) {
+		if err := r.writeOutput(r.env); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without a command, the environment is only written to the output file.
+	if !config.StringPresent(r.config.Exec.Command) {
+		return nil, nil
+	}
+
+	if r.child != nil {
+		if signal != nil {
+			log.Printf("[INFO] (runner) sending %s to child process", signal)
+			if err := r.Signal(signal); err != nil {
+				return nil, errors.Wrap(err, "sending reload signal")
+			}
+			return nil, nil
+		}
+
+		if r.deferRestart() {
+			return nil, nil
+		}
+		return r.restartChild()
+	}
+
+	return r.startChild()
+}
+
+// Resolve reads every prefix, secret and service once and returns the
+// environment rendered from them, without starting the child process or
+// writing any output. The runner need not be started; Resolve may be called
+// on its own by programs which embed envconsul and manage the environment
+// themselves. If a Vault auth method is configured, it logs in first.
+func (r *Runner) Resolve() (map[string]string, error) {
+	if err := r.loginVault(); err != nil {
+		return nil, err
+	}
+
+	if err := r.fetchAll(r.dependencies); err != nil {
+		return nil, errors.Wrap(err, "runner: fetching")
+	}
+
+	for {
+		r.dependenciesLock.Lock()
+		res, err := r.resolve()
+		pending := r.keyRetryPending()
+		r.dependenciesLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if res != nil {
+			return res.env, nil
+		}
+		if !pending {
+			return nil, fmt.Errorf("runner: missing data")
+		}
+
+		// Wait for the keys being retried to be read again.
+		select {
+		case <-r.renderCh:
+		case <-r.DoneCh:
+			return nil, fmt.Errorf("runner: stopped")
+		}
+	}
+}
+
+// resolution is the environment rendered from the data of every dependency.
+type resolution struct {
+	env     map[string]string
+	sources map[string]dep.Dependency
+
+	// ports is the set of keys holding the port of a service.
+	ports map[string]struct{}
+
+	// overridden is the set of keys set by more than one source.
+	overridden map[string]struct{}
+
+	// counts is the number of variables each source exported.
+	counts []sourceCount
+}
+
+// resolve renders the environment from the data of every dependency, without
+// acting on it. It returns nil if any dependency has no data yet. The caller
+// must hold dependenciesLock.
+func (r *Runner) resolve() (*resolution, error) {
+	env := make(map[string]string)
+	sources := make(map[string]dep.Dependency)
+	ports := make(map[string]struct{})
+	overridden := make(map[string]struct{})
+	var counts []sourceCount
+
+	// Iterate over each dependency and pull out its data. If any dependencies do
+	// not have data yet, this function will immediately return because we cannot
+	// safely continue until all dependencies have received data at least once.
+	//
+	// We iterate over the list of config prefixes so that order is maintained,
+	// since order in a map is not deterministic. When two sources supply the
+	// same key, the one with the higher priority wins, or of equal priorities,
+	// the one listed later in the configuration, whatever their paths.
+	for _, d := range r.dependencies {
+		data, ok := r.data[d.String()]
+		if !ok {
+			log.Printf("[INFO] (runner) missing data for %s", d)
+			return nil, nil
+		}
+
+		// Each dependency is rendered into its own map first so we know which
+		// dependency each key came from.
+		depEnv := make(map[string]string)
+		depPorts := make(map[string]struct{})
+
+		var err error
+		switch typed := unwrapQuery(d).(type) {
+		case *dep.KVListQuery:
+			err = r.appendPrefixes(depEnv, typed, data)
+		case *dep.KVGetQuery:
+			err = r.appendKey(depEnv, typed, data)
+		case *vaultReadQuery:
+			err = r.appendSecrets(depEnv, typed, data)
+		case *vaultListReadQuery:
+			err = r.appendListedSecrets(depEnv, typed, data)
+		case *dep.CatalogServiceQuery:
+			err = r.appendServices(depEnv, depPorts, typed, data)
+		case *preparedQuery:
+			err = r.appendServices(depEnv, depPorts, typed, data)
+		case *dep.HealthServiceQuery:
+			// The status of each instance is looked up while appending its
+			// service.
+		case *vaultTokenTTLQuery:
+			// The token TTL is injected with the other emitted variables.
+			r.tokenTTL, _ = data.(time.Duration)
+		default:
+			return nil, fmt.Errorf("unknown dependency type %T", typed)
+		}
+		if err == errKeyRetryPending {
+			log.Printf("[INFO] (runner) waiting for keys of %s to be read again", d)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if cp, ok := r.configPrefixMap[d.String()]; ok {
+			filterKeys(depEnv, cp.Include, cp.Exclude)
+
+			// A required prefix or secret with no keys is most likely a
+			// mistyped path, so the child is not started with a partial
+			// environment.
+			if config.BoolVal(cp.Required) && len(depEnv) == 0 {
+				return nil, fmt.Errorf("runner: %s is required, but has no keys", d)
+			}
+
+			for k, v := range cp.Defaults {
+				if _, ok := depEnv[k]; !ok {
+					log.Printf("[DEBUG] (runner) setting %s=%q from the defaults of %s",
+						k, r.logValue(k, v), d)
+					depEnv[k] = v
+				}
+			}
+
+			if dc, ok := r.datacenters[d.String()]; ok {
+				depEnv = namespaceDatacenter(depEnv, r.keyCase(cp.KeyCase, cp.Upcase), dc)
+			}
+		}
+
+		switch unwrapQuery(d).(type) {
+		case *dep.HealthServiceQuery, *vaultTokenTTLQuery:
+		default:
+			counts = append(counts, sourceCount{name: r.sourceName(d), vars: len(depEnv)})
+		}
+
+		// The global prefix and suffix wrap the final name of every key read
+		// from a dependency, but not the custom exec variables.
+		envPrefix := config.StringVal(r.config.EnvPrefix)
+		envSuffix := config.StringVal(r.config.EnvSuffix)
+		for name, v := range depEnv {
+			k := envPrefix + name + envSuffix
+			if prev, ok := sources[k]; ok {
+				overridden[k] = struct{}{}
+				if r.outranks(prev, d) {
+					log.Printf("[DEBUG] (runner) dropping %s from %s, which has a lower priority than %s", k, d, prev)
+					continue
+				}
+				log.Printf("[DEBUG] (runner) %s from %s overwrites value from %s", k, d, prev)
+				v = r.mergeArray(d, env[k], v)
+			}
+			env[k] = v
+			sources[k] = d
+			if _, ok := depPorts[name]; ok {
+				ports[k] = struct{}{}
+			} else {
+				delete(ports, k)
+			}
+		}
+	}
+
+	// Variables in an open time window are set last, overriding any source.
+	now := r.now()
+	for _, w := range r.timeWindows {
+		if !w.open(now) {
+			continue
+		}
+		if _, ok := env[w.key]; ok {
+			log.Printf("[DEBUG] (runner) %s from time window overwrites value from %s", w.key, sources[w.key])
+			overridden[w.key] = struct{}{}
+		}
+		env[w.key] = w.value
+		delete(sources, w.key)
+		delete(ports, w.key)
+	}
+
+	if config.BoolVal(r.config.RequireUTF8) {
+		if err := requireUTF8(env); err != nil {
+			return nil, err
+		}
+	}
+
+	return &resolution{
+		env:        env,
+		sources:    sources,
+		ports:      ports,
+		overridden: overridden,
+		counts:     counts,
+	}, nil
+}
+
+// tolerateStale returns the given error from resolving the environment, or
+// logs it and returns nil if stale values are tolerated and an environment
+// has already been rendered, so that the child keeps running with it.
+func (r *Runner) tolerateStale(err error) error {
+	if !config.BoolVal(r.config.TolerateStale) || r.once || r.env == nil {
+		return err
+	}
+	log.Printf("[ERR] (runner) keeping the last environment: %s", err)
+	return nil
+}
+
+// now returns the current time, according to the runner's clock.
+func (r *Runner) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// nextWindowChange returns the next time at which any time window opens or
+// closes.
+func (r *Runner) nextWindowChange() time.Time {
+	now := r.now()
+	var next time.Time
+	for _, w := range r.timeWindows {
+		if t := w.nextChange(now); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// reloadSignal returns the signal to send to the child in place of restarting
+// it, given the previous and the current environment. A signal is only
+// returned if every source whose keys changed has the same reload signal;
+// otherwise, restarting is the stronger action and nil is returned.
+func (r *Runner) reloadSignal(prev, cur map[string]string,
+	sources map[string]dep.Dependency) os.Signal {
+
+	changed := make(map[string]dep.Dependency)
+	for k, v := range cur {
+		if old, ok := prev[k]; !ok || old != v {
+			// Keys without a source, such as those of time windows, always
+			// restart the child.
+			d, ok := sources[k]
+			if !ok {
+				return nil
+			}
+			changed[d.String()] = d
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			d, ok := r.sources[k]
+			if !ok {
+				return nil
+			}
+			changed[d.String()] = d
+		}
+	}
+
+	var signal os.Signal
+	for id := range changed {
+		var configured []*os.Signal
+		if cs, ok := r.configServiceMap[id]; ok {
+			for _, c := range cs {
+				configured = append(configured, c.ReloadSignal)
+			}
+		} else if p, ok := r.configPrefixMap[id]; ok {
+			configured = append(configured, p.ReloadSignal)
+		}
+		if len(configured) == 0 {
+			return nil
+		}
+
+		for _, s := range configured {
+			if s == nil || *s == nil || *s == signals.SIGNIL {
+				return nil
+			}
+			if signal != nil && signal != *s {
+				log.Printf("[DEBUG] (runner) sources with different reload signals changed")
+				return nil
+			}
+			signal = *s
+		}
+	}
+	return signal
+}
+
+// startChild spawns a new child process with the last compiled environment
+// and returns its exit channel.
+func (r *Runner) startChild() (<-chan int, error) {
+	if r.child != nil {
+		r.restarts++
+		atomic.AddUint64(&r.metrics.restarts, 1)
+	}
+
+	filteredEnv := r.childEnv()
+
+	// Prepare the final environment. Note that it's CRUCIAL for us to
+	// initialize this slice to an empty one vs. a nil one, since that's
+	// how the child process class decides whether to pull in the parent's
+	// environment or not, and we control that via -pristine.
+	cmdEnv := make([]string, 0)
+	for k, v := range filteredEnv {
+		cmdEnv = append(cmdEnv, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	args, err := r.childArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	child, err := child.New(&child.NewInput{
+		Stdin:        r.inStream,
+		Stdout:       r.outStream,
+		Stderr:       r.errStream,
+		Command:      args[0],
+		Args:         args[1:],
+		Env:          cmdEnv,
+		Timeout:      0, // Allow running indefinitely
+		ReloadSignal: config.SignalVal(r.config.Exec.ReloadSignal),
+		KillSignal:   config.SignalVal(r.config.Exec.KillSignal),
+		KillTimeout:  config.TimeDurationVal(r.config.Exec.KillTimeout),
+		Splay:        config.TimeDurationVal(r.config.Exec.Splay),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "spawning child")
+	}
+	if err := child.Start(); err != nil {
+		return nil, errors.Wrap(err, "starting child")
+	}
+	r.child = child
+	r.childGeneration++
+	r.probeFailures = 0
+
+	return child.ExitCh(), nil
+}
+
+// childArgs returns the command and arguments of the child process. With a
+// shell configured, the command is passed to it unparsed, so that it may use
+// variable expansion and pipes; otherwise it is split into arguments.
+func (r *Runner) childArgs() ([]string, error) {
+	command := config.StringVal(r.config.Exec.Command)
+	if shell := config.StringVal(r.config.ExecShell); shell != "" {
+		return []string{shell, "-c", command}, nil
+	}
+
+	p := shellwords.NewParser()
+	args, err := p.Parse(command)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing command")
+	}
+	return args, nil
+}
+
+// childEnv returns the environment the child process is given: the parent's
+// environment unless pristine, the last compiled environment and the values
+// envconsul emits about itself, filtered by the exec env configuration.
+func (r *Runner) childEnv() map[string]string {
+	// Create a new environment
+	newEnv := make(map[string]string)
+
+	// If we are not pristine, copy over all values in the current env.
+	if !config.BoolVal(r.config.Pristine) {
+		for _, v := range os.Environ() {
+			list := strings.SplitN(v, "=", 2)
+			newEnv[list[0]] = list[1]
+		}
+	}
+
+	// Add our custom values, overwriting any existing ones.
+	for k, v := range r.env {
+		newEnv[k] = v
+	}
+
+	// Add the values envconsul emits about itself.
+	for k, v := range r.emittedEnv() {
+		newEnv[k] = v
+	}
+
+	return r.applyConfigEnv(newEnv)
+}
+
+// reloadChild sends the exec reload signal to the child process, or restarts
+// it if no reload signal is set.
+func (r *Runner) reloadChild() (<-chan int, error) {
+	if r.child == nil {
+		return nil, nil
+	}
+
+	if signal := config.SignalVal(r.config.Exec.ReloadSignal); signal != nil {
+		log.Printf("[INFO] (runner) sending %s to child process", signal)
+		if err := r.Signal(signal); err != nil {
+			return nil, errors.Wrap(err, "sending reload signal")
+		}
+		return nil, nil
+	}
+
+	if r.deferRestart() {
+		return nil, nil
+	}
+	return r.restartChild()
+}
+
+// probeOutcome is the result of a health probe of the child process of the
+// given generation.
+type probeOutcome struct {
+	generation int
+	err        error
+}
+
+// probeResult records the result of a health probe of the child process of the
+// given generation. When the probe has failed the configured number of
+// consecutive times, the child process is restarted and the new exit channel is
+// returned. The results of probes of an earlier child are dropped.
+func (r *Runner) probeResult(generation int, err error) (<-chan int, error) {
+	if r.child == nil {
+		return nil, nil
+	}
+	if generation != r.childGeneration {
+		log.Printf("[DEBUG] (runner) dropping health probe result of a previous child process")
+		return nil, nil
+	}
+
+	probe := r.config.HealthProbe
+	if err != nil {
+		r.probeFailures++
+		log.Printf("[WARN] (runner) health probe failed (%d/%d): %s",
+			r.probeFailures, config.IntVal(probe.FailureThreshold), err)
+	} else {
+		r.probeFailures = 0
+	}
+
+	if r.probeFailures < config.IntVal(probe.FailureThreshold) {
+		return nil, nil
+	}
+
+	log.Printf("[INFO] (runner) restarting child process after failed health probes")
+	return r.restartChild()
+}
+
+// runProbe runs the given command, returning an error if it exits with a
+// non-zero status or does not exit within the timeout.
+func runProbe(command string, timeout time.Duration) error {
+	p := shellwords.NewParser()
+	args, err := p.Parse(command)
+	if err != nil {
+		return errors.Wrap(err, "failed parsing probe command")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("empty probe command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return exec.CommandContext(ctx, args[0], args[1:]...).Run()
+}
+
+// emittedEnv returns the variables envconsul injects about itself, according
+// to the Emit* options. These are added after the environment comparison, so
+// they never trigger a restart on their own.
+func (r *Runner) emittedEnv() map[string]string {
+	env := make(map[string]string)
+
+	if config.BoolVal(r.config.EmitApplyOrder) {
+		env[EnvApplyOrder] = strings.Join(r.applyOrder(), ",")
+	}
+
+	if config.BoolVal(r.config.EmitConfigHash) {
+		env[EnvConfigHash] = r.configHash
+	}
+
+	if config.BoolVal(r.config.EmitCounts) {
+		env[EnvCounts] = r.sourceCounts()
+	}
+
+	if config.BoolVal(r.config.EmitLastFetch) {
+		env[EnvLastFetch] = r.lastFetch.UTC().Format(time.RFC3339)
+	}
+
+	if config.BoolVal(r.config.EmitLogLevel) {
+		// The level is matched case-insensitively when logging is set up.
+		env[EnvLogLevel] = strings.ToUpper(config.StringVal(r.config.LogLevel))
+	}
+
+	if config.BoolVal(r.config.EmitMode) {
+		env[EnvMode] = "watch"
+		if r.once {
+			env[EnvMode] = "once"
+		}
+	}
+
+	if config.BoolVal(r.config.EmitNodeName) {
+		env[EnvNode] = r.nodeName
+	}
+
+	if config.BoolVal(r.config.EmitOverrides) {
+		env[EnvOverridden] = strings.Join(r.overridden, ",")
+	}
+
+	if config.BoolVal(r.config.EmitRestartCount) {
+		env[EnvRestartCount] = strconv.Itoa(r.restarts)
+	}
+
+	if config.BoolVal(r.config.EmitSecretsChecksum) {
+		env[EnvSecretsChecksum] = r.secretsChecksum()
+	}
+
+	if config.BoolVal(r.config.EmitTokenTTL) {
+		env[EnvVaultTokenTTL] = strconv.Itoa(int(r.tokenTTL.Seconds()))
+	}
+
+	if config.BoolVal(r.config.EmitWatchPaths) {
+		env[EnvWatches] = strings.Join(r.watchPaths(), ",")
+	}
+
+	if errored := r.erroredPaths(); len(errored) > 0 {
+		env[EnvErrored] = strings.Join(errored, ",")
+	}
+
+	if len(r.reloadedFrom) > 0 {
+		env[EnvReloadedFrom] = strings.Join(r.reloadedFrom, ",")
+	}
+
+	if config.BoolVal(r.config.AnnotateSources) {
+		for k, d := range r.sources {
+			path := r.sourcePath(d)
+			if v, ok := d.(*vaultReadQuery); ok && v.secretPath != "" {
+				// Use the path the secret was actually read from, such as
+				// "secret/data/db" in a KV version 2 secrets engine.
+				path = v.secretPath
+			}
+			env[EnvSourcePrefix+k] = path
+		}
+	}
+
+	return env
+}
+
+// lookupNodeName looks up the node name of the local Consul agent from its
+// self endpoint.
+func (r *Runner) lookupNodeName() error {
+	name, err := r.clients.Consul().Agent().NodeName()
+	if err != nil {
+		return errors.Wrap(err, "runner: looking up the consul node name")
+	}
+	log.Printf("[DEBUG] (runner) consul node name is %q", name)
+	r.nodeName = name
+	return nil
+}
+
+// applyOrder returns the kinds of sources which make up the child's
+// environment, in the order they are applied, so each overrides the ones
+// before it: the parent's environment, then prefixes and services by
+// priority, then secrets, then time windows, then the custom variables of the
+// exec block. A kind is listed again each time sources of another kind come
+// between its sources, such as a prefix with a priority above services.
+func (r *Runner) applyOrder() []string {
+	var order []string
+	add := func(kind string) {
+		if len(order) == 0 || order[len(order)-1] != kind {
+			order = append(order, kind)
+		}
+	}
+
+	// A pristine exec environment is made of the custom variables alone.
+	if config.BoolVal(r.config.Exec.Env.Pristine) {
+		if len(r.config.Exec.Env.Custom) > 0 {
+			add("custom")
+		}
+		return order
+	}
+
+	if !config.BoolVal(r.config.Pristine) {
+		add("parent")
+	}
+
+	// Sources are applied in configuration order, but one with a higher
+	// priority is kept over a later one, and secrets always come last.
+	var consul, vault []dep.Dependency
+	for _, d := range r.dependencies {
+		switch unwrapQuery(d).(type) {
+		case *dep.KVListQuery, *dep.KVGetQuery, *dep.CatalogServiceQuery, *preparedQuery:
+			consul = append(consul, d)
+		case *vaultReadQuery, *vaultListReadQuery:
+			vault = append(vault, d)
+		}
+	}
+	for _, sources := range [][]dep.Dependency{consul, vault} {
+		sort.SliceStable(sources, func(i, j int) bool {
+			return r.priority(sources[i]) < r.priority(sources[j])
+		})
+		for _, d := range sources {
+			switch unwrapQuery(d).(type) {
+			case *dep.KVListQuery, *dep.KVGetQuery:
+				add("prefixes")
+			case *dep.CatalogServiceQuery, *preparedQuery:
+				add("services")
+			default:
+				add("secrets")
+			}
+		}
+	}
+
+	if len(r.timeWindows) > 0 {
+		add("time_windows")
+	}
+	if len(r.config.Exec.Env.Custom) > 0 {
+		add("custom")
+	}
+	return order
+}
+
+// secretsChecksum returns the hex-encoded SHA-256 checksum of the keys and
+// values in the environment which were read from Vault, so it changes only
+// when a secret changes.
+func (r *Runner) secretsChecksum() string {
+	secrets := make(map[string]string)
+	for k, d := range r.sources {
+		if isSecretSource(d) {
+			secrets[k] = r.env[k]
+		}
+	}
+
+	// Maps are marshaled with sorted keys, so the checksum is stable.
+	b, _ := json.Marshal(secrets)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// sourceCounts returns the number of keys in the environment from prefixes,
+// secrets and services as a JSON object. A key set by more than one source is
+// counted once, for the source whose value was used.
+func (r *Runner) sourceCounts() string {
+	counts := map[string]int{
+		"prefixes": 0,
+		"secrets":  0,
+		"services": 0,
+	}
+	for _, d := range r.sources {
+		switch unwrapQuery(d).(type) {
+		case *dep.KVListQuery, *dep.KVGetQuery:
+			counts["prefixes"]++
+		case *dep.CatalogServiceQuery, *preparedQuery:
+			counts["services"]++
+		default:
+			if isSecretSource(d) {
+				counts["secrets"]++
+			}
+		}
+	}
+
+	// Maps are marshaled with sorted keys, so the value is stable.
+	b, _ := json.Marshal(counts)
+	return string(b)
+}
+
+// emitBanner writes the banner to the error stream.
+func (r *Runner) emitBanner() {
+	fmt.Fprintln(r.errStream, r.banner())
+}
+
+// banner returns a one-line summary of the configuration: the number of
+// sources, the backends in use and the restart policy. It never includes
+// values.
+func (r *Runner) banner() string {
+	prefixes, secrets, services := len(*r.config.Prefixes),
+		len(*r.config.Secrets), len(*r.config.Services)
+
+	var backends []string
+	if prefixes > 0 || services > 0 {
+		backends = append(backends, "consul")
+	}
+	if secrets > 0 {
+		backends = append(backends, "vault")
+	}
+	if len(backends) == 0 {
+		backends = append(backends, "none")
+	}
+
+	restart := "on change"
+	if probe := r.config.HealthProbe; config.StringPresent(probe.Command) {
+		restart += fmt.Sprintf(" or after %d failed health probes every %s",
+			config.IntVal(probe.FailureThreshold), config.TimeDurationVal(probe.Interval))
+	}
+	if splay := config.TimeDurationVal(r.config.Exec.Splay); splay > 0 {
+		restart += fmt.Sprintf(", splay %s", splay)
+	}
+
+	return fmt.Sprintf("%s: sources: %d prefixes, %d secrets, %d services; "+
+		"backends: %s; restart: %s",
+		version.Name, prefixes, secrets, services,
+		strings.Join(backends, ", "), restart)
+}
+
+// trackedDependency wraps a dependency added to the watcher, recording whether
+// its most recent fetch failed.
+type trackedDependency struct {
+	dep.Dependency
+	runner *Runner
+}
+
+// Fetch fetches the wrapped dependency and records the outcome. If stale
+// values are tolerated, a dependency which already has data is retried for as
+// long as it fails, rather than the watcher giving up on it, and its last
+// data is used meanwhile. A secret is read again every VaultSealedInterval
+// while Vault is sealed.
+func (d *trackedDependency) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	sealed := false
+	for attempt := 0; ; attempt++ {
+		data, rm, err := d.Dependency.Fetch(clients, opts)
+		if err != dep.ErrStopped {
+			d.runner.setErrored(d.Dependency, err != nil)
+		}
+		if err != nil && err != dep.ErrStopped {
+			if d.Type() == dep.TypeVault {
+				atomic.AddUint64(&d.runner.metrics.vaultErrors, 1)
+			} else {
+				atomic.AddUint64(&d.runner.metrics.consulErrors, 1)
+			}
+		}
+		if err == nil && sealed {
+			log.Printf("[INFO] (runner) %s: vault is unsealed", d.Dependency)
+		}
+		if err == nil || err == dep.ErrStopped || !d.runner.hasStaleData(d.Dependency) {
+			return data, rm, err
+		}
+
+		// A sealed Vault is read again at a steady interval, logging only
+		// when it seals, rather than failing noisily until it is unsealed.
+		sleep := d.runner.sealedRetry(d.Dependency, err)
+		if sleep > 0 {
+			if !sealed {
+				log.Printf("[WARN] (runner) %s: vault is sealed, keeping the last value "+
+					"and retrying every %s", d.Dependency, sleep)
+			} else {
+				log.Printf("[DEBUG] (runner) %s: vault is still sealed", d.Dependency)
+			}
+			sealed = true
+		} else {
+			sealed = false
+			sleep = d.runner.staleRetry(d.Dependency, attempt)
+			log.Printf("[ERR] (runner) %s: keeping the last value, retrying in %s: %s",
+				d.Dependency, sleep, err)
+		}
+		select {
+		case <-time.After(sleep):
+		case <-d.runner.DoneCh:
+			return nil, nil, dep.ErrStopped
+		}
+	}
+}
+
+// hasStaleData returns whether the last data of the given dependency is kept
+// when fetching it fails.
+func (r *Runner) hasStaleData(d dep.Dependency) bool {
+	if !config.BoolVal(r.config.TolerateStale) || r.once {
+		return false
+	}
+
+	r.dependenciesLock.Lock()
+	defer r.dependenciesLock.Unlock()
+	_, ok := r.data[d.String()]
+	return ok
+}
+
+// staleRetry returns how long to wait before fetching a failed dependency
+// again, using the retry settings of its backend. Once those retries are
+// exhausted, it is fetched again after the maximum backoff.
+func (r *Runner) staleRetry(d dep.Dependency, attempt int) time.Duration {
+	retry := r.config.Consul.Retry
+	if d.Type() == dep.TypeVault {
+		retry = r.config.Vault.Retry
+	}
+
+	if ok, sleep := retry.RetryFunc()(attempt); ok {
+		return sleep
+	}
+	if max := config.TimeDurationVal(retry.MaxBackoff); max > 0 {
+		return max
+	}
+	return config.DefaultRetryMaxBackoff
+}
+
+// sealedRetry returns how long to wait before fetching a dependency which
+// failed because Vault is sealed, or zero if it failed for another reason or
+// sealed Vaults are retried like any other error.
+func (r *Runner) sealedRetry(d dep.Dependency, err error) time.Duration {
+	if d.Type() != dep.TypeVault || !vaultSealed(err) {
+		return 0
+	}
+	return config.TimeDurationVal(r.config.VaultSealedInterval)
+}
+
+// setErrored adds or removes the given dependency from the errored set.
+func (r *Runner) setErrored(d dep.Dependency, errored bool) {
+	r.erroredLock.Lock()
+	defer r.erroredLock.Unlock()
+
+	if !errored {
+		delete(r.errored, d.String())
+		return
+	}
+
+	r.errored[d.String()] = r.sourcePath(d)
+}
+
+// outranks returns whether the value of a key from prev is kept over the value
+// from d, which comes later in the configuration. Only prefixes, or only
+// secrets, are compared by priority; a prefix never overrides a secret, and
+// secrets always come after prefixes.
+func (r *Runner) outranks(prev, d dep.Dependency) bool {
+	if isSecretSource(prev) != isSecretSource(d) {
+		return false
+	}
+	return r.priority(prev) > r.priority(d)
+}
+
+// priority returns the priority of the prefix or secret which created the
+// given dependency, or zero for a service.
+func (r *Runner) priority(d dep.Dependency) int {
+	if cp, ok := r.configPrefixMap[d.String()]; ok {
+		return config.IntVal(cp.Priority)
+	}
+	return 0
+}
+
+// mergeArray returns the value v of a key from the given dependency merged
+// with the value prev it overrides, according to the array merge policy of the
+// prefix or secret which created the dependency.
+func (r *Runner) mergeArray(d dep.Dependency, prev, v string) string {
+	cp, ok := r.configPrefixMap[d.String()]
+	if !ok {
+		return v
+	}
+
+	policy := config.StringVal(cp.ArrayMergePolicy)
+	if policy == ArrayMergeReplace {
+		return v
+	}
+
+	// An empty value is an empty list, rather than a list of one empty item.
+	sep := config.StringVal(cp.ArraySeparator)
+	var items []string
+	for _, list := range []string{prev, v} {
+		if list != "" {
+			items = append(items, strings.Split(list, sep)...)
+		}
+	}
+	if policy == ArrayMergeUniqueConcat {
+		seen := make(map[string]struct{}, len(items))
+		unique := items[:0]
+		for _, item := range items {
+			if _, ok := seen[item]; ok {
+				continue
+			}
+			seen[item] = struct{}{}
+			unique = append(unique, item)
+		}
+		items = unique
+	}
+	return strings.Join(items, sep)
+}
+
+// validateArrayMerge returns an error if the array merge policy or separator
+// of the given prefix or secret is invalid.
+func validateArrayMerge(cp *PrefixConfig) error {
+	switch policy := config.StringVal(cp.ArrayMergePolicy); policy {
+	case ArrayMergeReplace:
+	case ArrayMergeConcat, ArrayMergeUniqueConcat:
+		if config.StringVal(cp.ArraySeparator) == "" {
+			return fmt.Errorf("array_merge_policy %q requires an array_separator", policy)
+		}
+	default:
+		return fmt.Errorf("invalid array_merge_policy %q", policy)
+	}
+	return nil
+}
+
+// sourcePath returns the configured path of the prefix or secret, or the
+// query of the service, which created the given dependency.
+func (r *Runner) sourcePath(d dep.Dependency) string {
+	if cp, ok := r.configPrefixMap[d.String()]; ok {
+		return config.StringVal(cp.Path)
+	} else if cs, ok := r.configServiceMap[d.String()]; ok {
+		if config.StringPresent(cs[0].PreparedQuery) {
+			return config.StringVal(cs[0].PreparedQuery)
+		}
+		return config.StringVal(cs[0].Query)
+	}
+	return d.String()
+}
+
+// sourceName returns the name of the source which created d in a summary: its
+// path, or for a service, "service" and its query.
+func (r *Runner) sourceName(d dep.Dependency) string {
+	if _, ok := r.configServiceMap[d.String()]; ok {
+		return "service " + r.sourcePath(d)
+	}
+	return r.sourcePath(d)
+}
+
+// sourceCount is the number of variables a source exported in a render.
+type sourceCount struct {
+	name string
+	vars int
+}
+
+// sourceSummary returns a summary of the number of variables exported by each
+// source, in the order they are read, followed by the number of distinct variables
+// exported in total, as keys set by several sources are counted for each.
+func sourceSummary(counts []sourceCount, total int) string {
+	parts := make([]string, 0, len(counts)+1)
+	for _, c := range counts {
+		parts = append(parts, fmt.Sprintf("%s -> %d vars", c.name, c.vars))
+	}
+	parts = append(parts, fmt.Sprintf("%d vars in total", total))
+	return strings.Join(parts, ", ")
+}
+
+// watchPaths returns the sorted, distinct paths of the prefixes, secrets and
+// services being watched. Dependencies envconsul watches for itself, such as
+// the Vault token, are not included.
+func (r *Runner) watchPaths() []string {
+	seen := make(map[string]struct{})
+	paths := make([]string, 0, len(r.dependencies))
+	for _, d := range r.dependencies {
+		_, isPrefix := r.configPrefixMap[d.String()]
+		_, isService := r.configServiceMap[d.String()]
+		if !isPrefix && !isService {
+			continue
+		}
+
+		path := r.sourcePath(d)
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// erroredPaths returns the sorted paths of the sources currently in error.
+func (r *Runner) erroredPaths() []string {
+	r.erroredLock.Lock()
+	defer r.erroredLock.Unlock()
+
+	paths := make([]string, 0, len(r.errored))
+	for _, p := range r.errored {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// trimKeyName trims the whitespace around key. Trimmed keys are recorded in
+// seen, so that distinct keys which collide once trimmed return an error.
+func trimKeyName(key string, seen map[string]string) (string, error) {
+	trimmed := strings.TrimSpace(key)
+	if other, ok := seen[trimmed]; ok && other != key {
+		return "", fmt.Errorf("keys %q and %q are the same once trimmed", other, key)
+	}
+	seen[trimmed] = key
+	return trimmed, nil
+}
+
+// srvRecord returns the SRV-record-style fields of a service instance. Consul
+// does not have a notion of priority or weight in the catalog, so these are
+// always 1, matching the SRV records served by Consul's DNS interface.
+func srvRecord(s *dep.CatalogService) map[string]string {
+	target := s.ServiceAddress
+	if target == "" {
+		target = s.Address
+	}
+
+	return map[string]string{
+		"priority": "1",
+		"weight":   "1",
+		"port":     strconv.Itoa(s.ServicePort),
+		"target":   target,
+	}
+}
+
+// serviceGroup returns the group of the given service instance: the rest of
+// its first tag which starts with prefix.
+func serviceGroup(s *dep.CatalogService, prefix string) (string, bool) {
+	for _, tag := range s.ServiceTags {
+		if strings.HasPrefix(tag, prefix) && len(tag) > len(prefix) {
+			return strings.TrimPrefix(tag, prefix), true
+		}
+	}
+	return "", false
+}
+
+// formatData is the data available to the format template of a prefix or
+// secret.
+type formatData struct {
+	// Path is the path of the prefix or secret, with invalid characters
+	// replaced by underscores.
+	Path string
+
+	// Key is the name of the key or field, without any prefix.
+	Key string
+
+	// NoPrefixPath is the path the key is prefixed with, which is empty when
+	// no_prefix is set and only the final segment with leaf_prefix_only.
+	NoPrefixPath string
+
+	// prefixed is the key prefixed as configured, returned by the key function.
+	prefixed string
+}
+
+// parseFormat parses the format template of a prefix or secret, whose key
+// function returns the given key.
+func parseFormat(contents, key string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"key": func() (string, error) {
+			return key, nil
+		},
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+
+	return template.New("filter").Funcs(funcs).Parse(contents)
+}
+
+// validateFormat returns an error if the format template of a prefix or secret
+// cannot be parsed, or cannot be executed, such as for an unknown field.
+func validateFormat(contents string) error {
+	tmpl, err := parseFormat(contents, "")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(ioutil.Discard, &formatData{})
+}
+
+func applyTemplate(contents string, data *formatData) (string, error) {
+	tmpl, err := parseFormat(contents, data.prefixed)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// newHealthQuery returns the health dependency of the given service query,
+// which reads every instance, whatever its status.
+func newHealthQuery(query string) (*dep.HealthServiceQuery, error) {
+	return dep.NewHealthServiceQuery(query + "|" + dep.HealthAny)
+}
+
+// serviceDependency returns the dependency which reads the instances of the
+// service: its prepared query if it has one, or its service query.
+func (r *Runner) serviceDependency(s *ServiceConfig) (dep.Dependency, error) {
+	if config.StringPresent(s.PreparedQuery) {
+		if config.StringPresent(s.Query) {
+			return nil, fmt.Errorf("runner: service %s: query and prepared_query are exclusive",
+				config.StringVal(s.PreparedQuery))
+		}
+		if config.StringPresent(s.FormatStatus) {
+			return nil, fmt.Errorf("runner: service %s: format_status is not supported with prepared_query",
+				config.StringVal(s.PreparedQuery))
+		}
+		return newPreparedQuery(config.StringVal(s.PreparedQuery))
+	}
+	return dep.NewCatalogServiceQuery(config.StringVal(s.Query))
+}
+
+// serviceStatus returns the aggregated health check status of an instance of
+// the service, as last read by the service's health dependency. An instance
+// the health dependency has not seen yet has an empty status.
+func (r *Runner) serviceStatus(d dep.Dependency, ser *dep.CatalogService) string {
+	h, ok := r.healthQueries[d.String()]
+	if !ok {
+		return ""
+	}
+
+	entries, _ := r.data[h.String()].([]*dep.HealthService)
+	for _, e := range entries {
+		if e.ID == ser.ServiceID && e.Node == ser.Node {
+			return e.Status
+		}
+	}
+	return ""
+}
+
+func applyServiceTemplate(contents, service, key string) (string, error) {
+	funcs := template.FuncMap{
+		"service": func() (string, error) {
+			return service, nil
+		},
+		"key": func() (string, error) {
+			return key, nil
+		},
+	}
+
+	tmpl, err := template.New("filter").Funcs(funcs).Parse(contents)
+	if err != nil {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// applyTaggedAddressTemplate is like applyServiceTemplate, where the key is the
+// type of the tagged address, also available as addr_type.
+func applyTaggedAddressTemplate(contents, service, addrType string) (string, error) {
+	funcs := template.FuncMap{
+		"service": func() (string, error) {
+			return service, nil
+		},
+		"key": func() (string, error) {
+			return addrType, nil
+		},
+		"addr_type": func() (string, error) {
+			return addrType, nil
+		},
+	}
+
+	tmpl, err := template.New("filter").Funcs(funcs).Parse(contents)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// appendServices adds the instances of a service, read by a service query or
+// a prepared query, to env, and the keys holding their ports to ports, if it
+// is not nil.
+func (r *Runner) appendServices(env map[string]string, ports map[string]struct{},
+	d dep.Dependency, data interface{}) error {
+	typed, ok := data.([]*dep.CatalogService)
+	if !ok {
+		return fmt.Errorf("error converting to service %s", d)
+	}
+
+	// A single query feeds every service config with the same query, each
+	// applying its own formatting.
+	configs, ok := r.configServiceMap[d.String()]
+	if !ok {
+		return r.appendService(env, ports, d, nil, typed)
+	}
+	for _, cs := range configs {
+		if err := r.appendService(env, ports, d, cs, typed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendService adds the instances of a service to env, formatted according
+// to the given config, which may be nil, and the keys holding their ports to
+// ports, if it is not nil.
+func (r *Runner) appendService(env map[string]string, ports map[string]struct{},
+	d dep.Dependency, cs *ServiceConfig, typed []*dep.CatalogService) (err error) {
+
+	keyCase := r.keyCase(nil, nil)
+	if cs != nil {
+		keyCase = r.keyCase(cs.KeyCase, cs.Upcase)
+	}
+
+	// folded maps each upcased key to the key it was generated from.
+	folded := make(map[string]string)
+
+	// groups counts the instances in each group, when grouping by tag.
+	groups := make(map[string]int)
+
+	// owners maps each key to the index of the instance which set it, so
+	// instances which overwrite each other's keys are reported.
+	owners := make(map[string]int)
+	collided := make(map[string]struct{})
+
+	if cs != nil {
+		typed = r.sticky(d, cs, typed)
+
+		selected := selectInstances(cs, typed)
+		if len(selected) == 0 && len(typed) > 0 {
+			log.Printf("[WARN] (runner) %s: no instance %q of %d instances",
+				d, config.StringVal(cs.Instance), len(typed))
+		}
+		typed = selected
+	}
+
+	for i, ser := range typed {
+		serKV := make(map[string]string)
+
+		// serPorts is the set of keys in serKV holding the port.
+		serPorts := make(map[string]struct{})
+
+		keyFormat := ser.ServiceName + "/id"
+		if cs != nil && config.StringPresent(cs.FormatId) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatId), ser.ServiceName, "id")
+			if err != nil {
+				return err
+			}
+		}
+		serKV[keyFormat] = ser.ServiceID
+
+		keyFormat = ser.ServiceName + "/name"
+		if cs != nil && config.StringPresent(cs.FormatName) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatName), ser.ServiceName, "name")
+			if err != nil {
+				return err
+			}
+		}
+		serKV[keyFormat] = ser.ServiceName
+
+		keyFormat = ser.ServiceName + "/address"
+		if cs != nil && config.StringPresent(cs.FormatAddress) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatAddress), ser.ServiceName, "address")
+			if err != nil {
+				return err
+			}
+		}
+		serKV[keyFormat] = ser.ServiceAddress
+
+		keyFormat = ser.ServiceName + "/tag"
+		if cs != nil && config.StringPresent(cs.FormatTag) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatTag), ser.ServiceName, "tag")
+			if err != nil {
+				return err
+			}
+		}
+		tags := []string(ser.ServiceTags)
+		if cs != nil && config.StringPresent(cs.TagFilter) {
+			tags = filterTags(tags, config.StringVal(cs.TagFilter))
+		}
+		if cs != nil && config.BoolVal(cs.TagExplode) {
+			for j, tag := range tags {
+				serKV[fmt.Sprintf("%s_%d", keyFormat, j)] = tag
+			}
+		} else {
+			serKV[keyFormat] = strings.Join(tags, ",")
+		}
+
+		keyFormat = ser.ServiceName + "/port"
+		if cs != nil && config.StringPresent(cs.FormatPort) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatPort), ser.ServiceName, "port")
+			if err != nil {
+				return err
+			}
+		}
+		serKV[keyFormat] = strconv.Itoa(ser.ServicePort)
+		serPorts[keyFormat] = struct{}{}
+
+		if cs != nil && config.StringPresent(cs.FormatNode) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatNode), ser.ServiceName, "node")
+			if err != nil {
+				return err
+			}
+			serKV[keyFormat] = ser.Node
+		}
+
+		if cs != nil && config.StringPresent(cs.FormatStatus) {
+			keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatStatus), ser.ServiceName, "status")
+			if err != nil {
+				return err
+			}
+			serKV[keyFormat] = r.serviceStatus(d, ser)
+		}
+
+		if cs != nil && config.StringPresent(cs.FormatSRV) {
+			for field, value := range srvRecord(ser) {
+				keyFormat, err = applyServiceTemplate(config.StringVal(cs.FormatSRV),
+					ser.ServiceName, fmt.Sprintf("%d/%s", i, field))
+				if err != nil {
+					return err
+				}
+				serKV[keyFormat] = value
+				if field == "port" {
+					serPorts[keyFormat] = struct{}{}
+				}
+			}
+		}
+
+		if cs != nil && config.StringPresent(cs.FormatTaggedAddress) {
+			for addrType, addr := range ser.TaggedAddresses {
+				keyFormat, err = applyTaggedAddressTemplate(config.StringVal(cs.FormatTaggedAddress),
+					ser.ServiceName, addrType)
+				if err != nil {
+					return err
+				}
+				serKV[keyFormat] = addr
+			}
+		}
+
+		if cs != nil && config.StringPresent(cs.GroupByTag) {
+			if group, ok := serviceGroup(ser, config.StringVal(cs.GroupByTag)); ok {
+				index := groups[group]
+				groups[group]++
+				for field, value := range map[string]string{
+					"id":      ser.ServiceID,
+					"address": ser.ServiceAddress,
+					"port":    strconv.Itoa(ser.ServicePort),
+				} {
+					key := fmt.Sprintf("%s_%d_%s", group, index, field)
+					serKV[key] = value
+					if field == "port" {
+						serPorts[key] = struct{}{}
+					}
+				}
+			}
+		}
+
+		// Apply the keys in sorted order, so keys which collide once upcased
+		// are resolved deterministically.
+		keys := make([]string, 0, len(serKV))
+		for key := range serKV {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, name := range keys {
+			key, value := name, serKV[name]
+
+			if config.BoolVal(r.config.Sanitize) {
+				key = r.sanitizeKey(key)
+			}
+
+			if keyCase != KeyCasePreserve {
+				key = convertKeyCase(keyCase, key)
+				if other, ok := folded[key]; ok && other != name {
+					log.Printf("[WARN] (runner) keys %q and %q from %s both set %s, using %q",
+						other, name, d, key, name)
+				}
+				folded[key] = name
+			}
+
+			if owner, ok := owners[key]; ok && owner != i {
+				collided[key] = struct{}{}
+			}
+			owners[key] = i
+			env[key] = value
+			if ports != nil {
+				if _, ok := serPorts[name]; ok {
+					ports[key] = struct{}{}
+				} else {
+					delete(ports, key)
+				}
+			}
+		}
+	}
+
+	if len(collided) > 0 {
+		keys := make([]string, 0, len(collided))
+		for key := range collided {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		log.Printf("[WARN] (runner) %s: %d instances set %s, using the last one; "+
+			"set instance to choose which", d, len(typed), strings.Join(keys, ", "))
+	}
+
+	return
+}
+
+// filterTags returns the tags which match the glob, in order.
+func filterTags(tags []string, pattern string) []string {
+	var matched []string
+	for _, tag := range tags {
+		if anyGlobMatch(tag, []string{pattern}) {
+			matched = append(matched, tag)
+		}
+	}
+	return matched
+}
+
+// stickyInstances is the last non-empty set of instances of a service, and
+// when the service went empty, or zero while it has instances.
+type stickyInstances struct {
+	instances  []*dep.CatalogService
+	emptySince time.Time
+
+	// expiry renders the environment again once the instances expire.
+	expiry *time.Timer
+}
+
+// sticky returns the instances of a service to use in place of the given ones.
+// If the service has sticky_instances set and has no instances, the last
+// non-empty set is returned until sticky_instances has passed since the
+// service went empty, after which the environment is rendered again without
+// it.
+func (r *Runner) sticky(d dep.Dependency, cs *ServiceConfig, instances []*dep.CatalogService) []*dep.CatalogService {
+	ttl := config.TimeDurationVal(cs.StickyInstances)
+	if ttl <= 0 {
+		return instances
+	}
+
+	last := r.stickyInstances[cs]
+	if len(instances) > 0 {
+		if last != nil && last.expiry != nil {
+			last.expiry.Stop()
+		}
+		r.stickyInstances[cs] = &stickyInstances{instances: instances}
+		return instances
+	}
+	if last == nil {
+		return instances
+	}
+
+	// The window starts when the service went empty, however long it had
+	// been stable before.
+	if last.emptySince.IsZero() {
+		last.emptySince = r.now()
+	}
+	remaining := ttl - r.now().Sub(last.emptySince)
+	if remaining <= 0 {
+		log.Printf("[INFO] (runner) %s: no instances, last instances expired", d)
+		delete(r.stickyInstances, cs)
+		return instances
+	}
+
+	log.Printf("[INFO] (runner) %s: no instances, keeping the last %d for %s",
+		d, len(last.instances), remaining)
+	if last.expiry == nil {
+		last.expiry = time.AfterFunc(remaining, r.render)
+	}
+	return last.instances
+}
+
+// render requests that the environment is rendered again, without re-fetching
+// any dependency. Like Refetch, it does not block.
+func (r *Runner) render() {
+	select {
+	case r.renderCh <- struct{}{}:
+	default:
+	}
+}
+
+// selectInstances returns the instances of a service to emit, sorted and
+// selected according to the config. An index past the last instance selects
+// none.
+func selectInstances(cs *ServiceConfig, instances []*dep.CatalogService) []*dep.CatalogService {
+	sorted := append([]*dep.CatalogService(nil), instances...)
+	switch config.StringVal(cs.Sort) {
+	case ServiceSortAddress:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].ServiceAddress < sorted[j].ServiceAddress
+		})
+	case ServiceSortPort:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].ServicePort < sorted[j].ServicePort
+		})
+	case ServiceSortID:
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].ServiceID < sorted[j].ServiceID
+		})
+	}
+
+	if len(sorted) == 0 {
+		return sorted
+	}
+	switch instance := config.StringVal(cs.Instance); instance {
+	case "":
+		return sorted
+	case ServiceInstanceFirst:
+		return sorted[:1]
+	case ServiceInstanceLast:
+		return sorted[len(sorted)-1:]
+	default:
+		n, _ := strconv.Atoi(instance)
+		if n >= len(sorted) {
+			return nil
+		}
+		return sorted[n : n+1]
+	}
+}
+
+func (r *Runner) appendPrefixes(
+	env map[string]string, d *dep.KVListQuery, data interface{}) error {
+	var err error
+
+	typed, ok := data.([]*dep.KeyPair)
+	if !ok {
+		return fmt.Errorf("error converting to keypair %s", d)
+	}
+
+	// Get the PrefixConfig so we can get configuration from it.
+	cp := r.configPrefixMap[d.String()]
+
+	// trimmed maps each trimmed key to the key it was trimmed from.
+	trimmed := make(map[string]string)
+
+	// folded maps each case-converted key to the key it was generated from.
+	folded := make(map[string]string)
+
+	keyCase := r.keyCase(cp.KeyCase, cp.Upcase)
+
+	// For each pair, update the environment hash. Subsequent runs could
+	// overwrite an existing key.
+	for _, pair := range typed {
+		key, value := pair.Key, string(pair.Value)
+
+		if config.BoolVal(r.config.TrimKeyNames) {
+			if key, err = trimKeyName(key, trimmed); err != nil {
+				return errors.Wrap(err, d.String())
+			}
+		}
+
+		// It is not possible to have an environment variable that is blank, but
+		// it is possible to have an environment variable _value_ that is blank.
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+
+		name := key
+		if key, err = r.prefixKey(d, cp, name); err != nil {
+			return err
+		}
+		if key == "" {
+			log.Printf("[WARN] (runner) skipping %q from %s, renamed to an empty key", pair.Key, d)
+			continue
+		}
+
+		if keyCase != KeyCasePreserve {
+			if other, ok := folded[key]; ok && other != pair.Key {
+				log.Printf("[WARN] (runner) keys %q and %q from %s both set %s, using %q",
+					other, pair.Key, d, key, pair.Key)
+			}
+			folded[key] = pair.Key
+		}
+
+		if transformed, err := transformValue(cp, value); err == nil {
+			value = transformed
+			r.stopKeyRetry(d, pair.Key)
+		} else {
+			var ok bool
+			if value, ok, err = r.retryKey(d, cp, pair, err); err == errKeyRetryPending {
+				return err
+			} else if err != nil {
+				return errors.Wrapf(err, "%s: %s", d, key)
+			}
+			if !ok {
+				log.Printf("[WARN] (runner) skipping %q from %s, which no longer exists", pair.Key, d)
+				continue
+			}
+		}
+
+		values := map[string]string{key: value}
+		if config.BoolVal(cp.ParseYAML) {
+			if flat, ok := flattenYAML(d, key, value); ok {
+				values = make(map[string]string, len(flat))
+				for k, v := range flat {
+					if config.BoolVal(r.config.Sanitize) {
+						k = r.sanitizeKey(k)
+					}
+					k = convertKeyCase(keyCase, k)
+					values[k] = v
+				}
+			}
+		}
+
+		for key, value := range values {
+			if current, ok := env[key]; ok {
+				log.Printf("[DEBUG] (runner) overwriting %s=%q (was %q) from %s",
+					key, r.logValue(key, value), r.logValue(key, current), d)
+				env[key] = value
+			} else {
+				log.Printf("[DEBUG] (runner) setting %s=%q from %s", key, r.logValue(key, value), d)
+				env[key] = value
+			}
+		}
+
+		// The create index is emitted once per pair, even if its value was
+		// flattened into several keys, and named like any other key.
+		if config.BoolVal(cp.EmitCreateIndex) {
+			indexKey, err := r.prefixKey(d, cp, name+"_CREATE_INDEX")
+			if err != nil {
+				return err
+			}
+			if indexKey != "" {
+				env[indexKey] = strconv.FormatUint(pair.CreateIndex, 10)
+			}
+		}
+	}
+
+	return nil
+}
+
+// prefixKey returns the name of the variable set from the key with the given
+// name read by the prefix dependency d, with the prefix, format, sanitization,
+// renames and key case of its PrefixConfig applied. It returns an empty name if
+// the key is renamed to one.
+func (r *Runner) prefixKey(d dep.Dependency, cp *PrefixConfig, name string) (string, error) {
+	key := name
+
+	// Replace the invalid path chars such as slashes with underscores
+	data := &formatData{
+		Path: InvalidRegexp.ReplaceAllString(config.StringVal(cp.Path), "_"),
+		Key:  key,
+	}
+
+	// NoPrefix is nil when not set in config. Default to excluding prefix for Consul keys.
+	if cp.NoPrefix != nil && !config.BoolVal(cp.NoPrefix) {
+		// Prefix the key value with the path value.
+		data.NoPrefixPath = data.Path
+		key = fmt.Sprintf("%s_%s", data.Path, key)
+	}
+
+	// If the user specified a custom format, apply that here.
+	if config.StringPresent(cp.Format) {
+		data.prefixed = key
+		var err error
+		if key, err = applyTemplate(config.StringVal(cp.Format), data); err != nil {
+			return "", err
+		}
+	}
+
+	if config.BoolVal(r.config.Sanitize) {
+		key = r.sanitizeKey(key)
+	}
+
+	for _, rule := range r.renameRules[d.String()] {
+		key = rule.match.ReplaceAllString(key, rule.replace)
+	}
+	if strings.TrimSpace(key) == "" {
+		return "", nil
+	}
+
+	return convertKeyCase(r.keyCase(cp.KeyCase, cp.Upcase), key), nil
+}
+
+// errKeyRetryPending is returned while a key of a prefix is waiting to be
+// read again, so the environment is rendered once it has been.
+var errKeyRetryPending = errors.New("key retry pending")
+
+// keyRetry is the state of the retries of a single key of a prefix. Once the
+// backoff has passed, the key is read again without holding the dependencies
+// lock, and the environment is rendered again.
+type keyRetry struct {
+	// attempt is the number of retries scheduled so far.
+	attempt int
+
+	// timer reads the key again once the backoff has passed. It is nil once
+	// the key has been read.
+	timer *time.Timer
+
+	// read is whether the key has been read again since the last attempt was
+	// scheduled, with its value, whether it exists and the error, if any.
+	read   bool
+	value  string
+	exists bool
+	err    error
+}
+
+// retryKey reads a single key of a prefix again, with the backoff of the
+// prefix's key_retry, after its value failed to be transformed with the given
+// error. Rather than waiting for the backoff, it returns errKeyRetryPending
+// and renders the environment again once the key has been read. It returns
+// the transformed value once it succeeds, or whether the key no longer
+// exists. The last error is returned if retries are disabled or exhausted.
+// The caller must hold dependenciesLock.
+func (r *Runner) retryKey(d *dep.KVListQuery, cp *PrefixConfig, pair *dep.KeyPair, err error) (string, bool, error) {
+	id := d.String() + "/" + pair.Key
+	kr, ok := r.keyRetries[id]
+	if !ok {
+		kr = &keyRetry{}
+		r.keyRetries[id] = kr
+	}
+	if kr.timer != nil {
+		return "", false, errKeyRetryPending
+	}
+
+	if kr.read {
+		kr.read = false
+		switch {
+		case kr.err != nil:
+			err = kr.err
+		case !kr.exists:
+			delete(r.keyRetries, id)
+			return "", false, nil
+		default:
+			value, terr := transformValue(cp, kr.value)
+			if terr == nil {
+				delete(r.keyRetries, id)
+				return value, true, nil
+			}
+			err = terr
+		}
+	}
+
+	ok, sleep := cp.KeyRetry.RetryFunc()(kr.attempt)
+	if !ok {
+		delete(r.keyRetries, id)
+		if kr.attempt > 0 {
+			return "", false, errors.Wrapf(err, "giving up after %d retries", kr.attempt)
+		}
+		return "", false, err
+	}
+
+	kr.attempt++
+	log.Printf("[WARN] (runner) %s: key %s failed (attempt %d), retrying in %s: %s",
+		d, pair.Key, kr.attempt, sleep, err)
+
+	path, dc := splitDatacenter(config.StringVal(cp.Path))
+	path = strings.TrimSuffix(path, "/") + "/" + pair.Key
+	if dc != "" {
+		path += "@" + dc
+	}
+	kr.timer = time.AfterFunc(sleep, func() { r.readKeyAgain(kr, path) })
+	return "", false, errKeyRetryPending
+}
+
+// readKeyAgain reads the key at the given path for a retry, then renders the
+// environment again.
+func (r *Runner) readKeyAgain(kr *keyRetry, path string) {
+	var value string
+	var exists bool
+	q, err := dep.NewKVGetQuery(path)
+	if err == nil {
+		var data interface{}
+		data, _, err = q.Fetch(r.clients, &dep.QueryOptions{})
+		q.Stop()
+		value, exists = data.(string)
+	}
+
+	r.dependenciesLock.Lock()
+	kr.timer = nil
+	kr.read, kr.value, kr.exists, kr.err = true, value, exists, err
+	r.dependenciesLock.Unlock()
+
+	r.render()
+}
+
+// keyRetryPending returns whether any key is waiting to be read again. The
+// caller must hold dependenciesLock.
+func (r *Runner) keyRetryPending() bool {
+	for _, kr := range r.keyRetries {
+		if kr.timer != nil || kr.read {
+			return true
+		}
+	}
+	return false
+}
+
+// stopKeyRetries stops every pending retry of a key.
+func (r *Runner) stopKeyRetries() {
+	r.dependenciesLock.Lock()
+	defer r.dependenciesLock.Unlock()
+
+	for id, kr := range r.keyRetries {
+		if kr.timer != nil {
+			kr.timer.Stop()
+		}
+		delete(r.keyRetries, id)
+	}
+}
+
+// stopKeyRetry forgets the retries of a key of a prefix, such as once a new
+// value of it could be transformed. The caller must hold dependenciesLock.
+func (r *Runner) stopKeyRetry(d dep.Dependency, key string) {
+	if len(r.keyRetries) == 0 {
+		return
+	}
+	id := d.String() + "/" + key
+	if kr, ok := r.keyRetries[id]; ok {
+		if kr.timer != nil {
+			kr.timer.Stop()
+		}
+		delete(r.keyRetries, id)
+	}
+}
+
+// appendKey appends the value of the single Consul key read by the given
+// dependency to env, under the configured key or the sanitized path. A missing
+// key appends nothing.
+func (r *Runner) appendKey(env map[string]string, d *dep.KVGetQuery, data interface{}) error {
+	if data == nil {
+		log.Printf("[DEBUG] (runner) %s does not exist", d)
+		return nil
+	}
+
+	value, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("error converting to string %s", d)
+	}
+
+	cp, ok := r.configPrefixMap[d.String()]
+	if !ok {
+		return fmt.Errorf("missing dependency %s", d)
+	}
+
+	key := config.StringVal(cp.Key)
+	if key == "" {
+		key = InvalidRegexp.ReplaceAllString(strings.Trim(config.StringVal(cp.Path), "/"), "_")
+		key = convertKeyCase(r.keyCase(cp.KeyCase, cp.Upcase), key)
+	}
+
+	value, err := transformValue(cp, value)
+	if err != nil {
+		return errors.Wrapf(err, "%s: %s", d, key)
+	}
+
+	log.Printf("[DEBUG] (runner) setting %s=%q from %s", key, r.logValue(key, value), d)
+	env[key] = value
+	return nil
+}
+
+// flattenYAML parses value as YAML and, if it is a non-empty mapping, returns
+// one entry per nested scalar, keyed by key and the path of mapping keys
+// joined with underscores. Lists cannot be represented and are skipped. Any
+// other value, including invalid YAML, is reported as not ok.
+func flattenYAML(d dep.Dependency, key, value string) (map[string]string, bool) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+		return nil, false
+	}
+	m, ok := parsed.(map[interface{}]interface{})
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+
+	flat := make(map[string]string)
+	var flatten func(string, map[interface{}]interface{})
+	flatten = func(parent string, m map[interface{}]interface{}) {
+		for k, v := range m {
+			name := fmt.Sprintf("%s_%v", parent, k)
+			switch typed := v.(type) {
+			case map[interface{}]interface{}:
+				flatten(name, typed)
+			case nil:
+				flat[name] = ""
+			default:
+				s, ok := secretValueString(typed)
+				if !ok {
+					log.Printf("[WARN] (runner) %s: skipping %s, invalid type %v in YAML",
+						d, name, reflect.TypeOf(v))
+					continue
+				}
+				flat[name] = s
+			}
+		}
+	}
+	flatten(key, m)
+	return flat, true
+}
+
+// sanitizeKey replaces each character of key which is not valid in an
+// environment variable name with the sanitize replacement. A key beginning with
+// a digit is prefixed with an underscore.
+func (r *Runner) sanitizeKey(key string) string {
+	key = InvalidRegexp.ReplaceAllString(key, config.StringVal(r.config.SanitizeReplacement))
+	if key != "" && key[0] >= '0' && key[0] <= '9' {
+		key = "_" + key
+	}
+	return key
+}
+
+// appendSecretField adds the single configured field of a secret to env, under
+// the configured key. Unlike the other fields of a secret, a missing field is
+// an error.
+func (r *Runner) appendSecretField(env map[string]string, d dep.Dependency,
+	cp *PrefixConfig, valueMap map[string]interface{}) error {
+
+	field, key := config.StringVal(cp.Field), config.StringVal(cp.Key)
+
+	value, ok := valueMap[field]
+	if !ok || value == nil {
+		return fmt.Errorf("%s: field %q not found", d, field)
+	}
+
+	val, ok := value.(string)
+	if ok && config.BoolVal(cp.Base64Decode) {
+		val = decodeSecretValue(d, key, val)
+	}
+	if !ok && config.BoolVal(cp.ConvertValues) {
+		val, ok = secretValueString(value)
+	}
+	if !ok {
+		return fmt.Errorf("%s: field %q has invalid type %v, not string",
+			d, field, reflect.TypeOf(value))
+	}
+
+	val, err := transformValue(cp, val)
+	if err != nil {
+		return errors.Wrapf(err, "%s: %s", d, key)
+	}
+
+	log.Printf("[DEBUG] (runner) setting %s=%q from %s", key, r.logValue(key, val), d)
+	env[key] = val
+	return nil
+}
+
+// appendSplitFields adds the keys captured by each split rule of a secret to
+// env. A field which is missing or does not match is an error if the secret
+// is required, and is otherwise skipped with a warning.
+func (r *Runner) appendSplitFields(env map[string]string, d dep.Dependency,
+	cp *PrefixConfig, valueMap map[string]interface{}) error {
+
+	for _, rule := range r.splitRules[d.String()] {
+		var err error
+		value, ok := valueMap[rule.field]
+		val, isString := value.(string)
+		switch {
+		case !ok || value == nil:
+			err = fmt.Errorf("%s: split: field %q not found", d, rule.field)
+		case !isString:
+			err = fmt.Errorf("%s: split: field %q has invalid type %v, not string",
+				d, rule.field, reflect.TypeOf(value))
+		}
+
+		var match []string
+		if err == nil {
+			if match = rule.match.FindStringSubmatch(val); match == nil {
+				err = fmt.Errorf("%s: split: field %q does not match %q",
+					d, rule.field, rule.match)
+			}
+		}
+
+		if err != nil {
+			if config.BoolVal(cp.Required) {
+				return err
+			}
+			log.Printf("[WARN] (runner) %s", err)
+			continue
+		}
+
+		for i, name := range rule.match.SubexpNames() {
+			key, ok := rule.keys[name]
+			if !ok {
+				continue
+			}
+			log.Printf("[DEBUG] (runner) setting %s=%q from %s", key, r.logValue(key, match[i]), d)
+			env[key] = match[i]
+		}
+	}
+
+	return nil
+}
+
+// splitRule is a compiled SplitRule.
+type splitRule struct {
+	field string
+	match *regexp.Regexp
+	keys  map[string]string
+}
+
+// compileSplitRules compiles and validates the split rules of a secret. Each
+// key must name a group of the rule's regular expression.
+func compileSplitRules(rules []*SplitRule) ([]*splitRule, error) {
+	compiled := make([]*splitRule, 0, len(rules))
+	for i, rule := range rules {
+		field := config.StringVal(rule.Field)
+		if field == "" {
+			return nil, fmt.Errorf("split rule %d: missing field", i+1)
+		}
+
+		re, err := regexp.Compile(config.StringVal(rule.Match))
+		if err != nil {
+			return nil, fmt.Errorf("split rule %d: invalid match %q: %s",
+				i+1, config.StringVal(rule.Match), err)
+		}
+
+		if len(rule.Keys) == 0 {
+			return nil, fmt.Errorf("split rule %d: missing keys", i+1)
+		}
+		groups := make(map[string]bool)
+		for _, name := range re.SubexpNames() {
+			groups[name] = name != ""
+		}
+		for group, key := range rule.Keys {
+			if !groups[group] {
+				return nil, fmt.Errorf("split rule %d: %q is not a group of %q",
+					i+1, group, re)
+			}
+			if strings.TrimSpace(key) == "" {
+				return nil, fmt.Errorf("split rule %d: missing key for group %q",
+					i+1, group)
+			}
+		}
+
+		compiled = append(compiled, &splitRule{field: field, match: re, keys: rule.Keys})
+	}
+	return compiled, nil
+}
+
+// renameRule is a compiled RenameRule.
+type renameRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// requireUTF8 returns an error listing the keys of env whose values are not
+// valid UTF-8, if there are any.
+func requireUTF8(env map[string]string) error {
+	var invalid []string
+	for k, v := range env {
+		if !utf8.ValidString(v) {
+			invalid = append(invalid, k)
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	sort.Strings(invalid)
+	return fmt.Errorf("runner: values of %s are not valid UTF-8",
+		strings.Join(invalid, ", "))
+}
+
+// namespacedDatacenters returns a map of the hashcode of each prefix to the
+// datacenter its keys are namespaced with. Only prefixes whose path is read
+// from more than one datacenter are namespaced, and of those, a prefix read
+// from the local datacenter is not.
+func namespacedDatacenters(prefixes map[string]*PrefixConfig) map[string]string {
+	// paths maps the path of each prefix, without its datacenter, to the
+	// datacenters it is read from.
+	paths := make(map[string]map[string]struct{})
+	for _, p := range prefixes {
+		path, dc := splitDatacenter(config.StringVal(p.Path))
+		if paths[path] == nil {
+			paths[path] = make(map[string]struct{})
+		}
+		paths[path][dc] = struct{}{}
+	}
+
+	datacenters := make(map[string]string)
+	for id, p := range prefixes {
+		path, dc := splitDatacenter(config.StringVal(p.Path))
+		if dc != "" && len(paths[path]) > 1 {
+			datacenters[id] = dc
+		}
+	}
+	return datacenters
+}
+
+// splitDatacenter splits a Consul path in the "path@dc" syntax into its path
+// and datacenter, which is empty for the local datacenter.
+func splitDatacenter(path string) (string, string) {
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// namespaceDatacenter returns env with the sanitized datacenter prepended to
+// each key, converted to the given case.
+func namespaceDatacenter(env map[string]string, keyCase, dc string) map[string]string {
+	namespace := convertKeyCase(keyCase, InvalidRegexp.ReplaceAllString(dc, "_"))
+	namespaced := make(map[string]string, len(env))
+	for k, v := range env {
+		namespaced[namespace+"_"+k] = v
+	}
+	return namespaced
+}
+
+// upcase returns whether keys are converted to uppercase, given the setting
+// of a prefix, secret or service. Unset, the top-level setting applies.
+func (r *Runner) upcase(override *bool) bool {
+	if override != nil {
+		return *override
+	}
+	return config.BoolVal(r.config.Upcase)
+}
+
+// keyCase returns the case keys are converted to, given the key_case and
+// upcase settings of a prefix, secret or service. Unset, key_case follows the
+// upcase settings.
+func (r *Runner) keyCase(keyCase *string, upcase *bool) string {
+	if config.StringPresent(keyCase) {
+		return config.StringVal(keyCase)
+	}
+	if r.upcase(upcase) {
+		return KeyCaseUpper
+	}
+	return KeyCasePreserve
+}
+
+// convertKeyCase converts key to the given case.
+func convertKeyCase(keyCase, key string) string {
+	switch keyCase {
+	case KeyCaseUpper:
+		return strings.ToUpper(key)
+	case KeyCaseLower:
+		return strings.ToLower(key)
+	default:
+		return key
+	}
+}
+
+// validateKeyCase returns an error if keyCase is set to an unknown case.
+func validateKeyCase(keyCase *string) error {
+	switch c := config.StringVal(keyCase); c {
+	case "", KeyCaseUpper, KeyCaseLower, KeyCasePreserve:
+		return nil
+	default:
+		return fmt.Errorf("invalid key_case %q", c)
+	}
+}
+
+// prefixTuning describes how the Consul KV dependency of the given prefix is
+// read, for comparing prefixes on the same path.
+func prefixTuning(p *PrefixConfig) string {
+	maxStale := "default"
+	if p.MaxStale != nil {
+		maxStale = p.MaxStale.String()
+	}
+	return fmt.Sprintf("consistent=%t, max_stale=%s, poll_interval=%s",
+		config.BoolVal(p.Consistent), maxStale, config.TimeDurationVal(p.PollInterval))
+}
+
+// validateKeyStyle returns an error if style is set to an unknown key style, or
+// to the kebab style while the output file is written in a format other than
+// JSON, in which a name such as foo-bar is not a valid variable.
+func (r *Runner) validateKeyStyle(style *string) error {
+	switch s := config.StringVal(style); s {
+	case "", KeyStyleSnake, KeyStyleCamel, KeyStylePascal:
+		return nil
+	case KeyStyleKebab:
+		format := config.StringVal(r.config.Output.Format)
+		if config.StringPresent(r.config.Output.Path) && format != OutputFormatJSON {
+			return fmt.Errorf("key_style %q cannot be used with the %s output format", s, format)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid key_style %q", s)
+	}
+}
+
+// secretValueString returns the string representation of a scalar secret
+// value. Floats are never formatted in scientific notation. Nested maps and
+// slices cannot be represented and are reported as not ok.
+func secretValueString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		if strings.ContainsAny(v.String(), "eE") {
+			if f, err := v.Float64(); err == nil {
+				return strconv.FormatFloat(f, 'f', -1, 64), true
+			}
+		}
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// flattenSecretData returns the data of a secret with each field which is a
+// map replaced by one field per nested value, named by the path of nested
+// keys joined with sep.
+func flattenSecretData(data map[string]interface{}, sep string) map[string]interface{} {
+	flat := make(map[string]interface{}, len(data))
+	var flatten func(string, map[string]interface{})
+	flatten = func(parent string, m map[string]interface{}) {
+		for k, v := range m {
+			name := k
+			if parent != "" {
+				name = parent + sep + k
+			}
+			if typed, ok := v.(map[string]interface{}); ok {
+				flatten(name, typed)
+				continue
+			}
+			flat[name] = v
+		}
+	}
+	flatten("", data)
+	return flat
+}
+
+// decodeSecretValue decodes a secret's string value from standard base64.
+// Unlike the base64-decode transform, a value which is not valid base64 is
+// returned unchanged, with a warning.
+func decodeSecretValue(d dep.Dependency, key, value string) string {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		log.Printf("[WARN] (runner) %s: %s is not valid base64, leaving it undecoded: %s", d, key, err)
+		return value
+	}
+	return string(b)
+}
+
+// secretIsKVv2 returns whether the secret has the KV version 2 shape, as
+// configured by the prefix's KVVersion or detected from the data. A secret
+// read from a mount known to be KV version 2 has the shape even if its
+// metadata is missing from the response.
+func secretIsKVv2(d dep.Dependency, cp *PrefixConfig, data map[string]interface{}) bool {
+	switch config.StringVal(cp.KVVersion) {
+	case KVVersion1:
+		return false
+	case KVVersion2:
+		return true
+	default:
+		return isVaultKv2(data) || readFromKVv2Mount(d)
+	}
+}
+
+// readFromKVv2Mount returns whether the dependency has looked up its mount
+// and found a KV version 2 secrets engine.
+func readFromKVv2Mount(d dep.Dependency) bool {
+	switch typed := d.(type) {
+	case *vaultReadQuery:
+		return typed.isKVv2 != nil && *typed.isKVv2
+	case *vaultListReadQuery:
+		return typed.isKVv2 != nil && *typed.isKVv2
+	default:
+		return false
+	}
+}
+
+// checkKVv2Envelope returns an error if the given secret data is not wrapped in
+// the "data" and "metadata" envelope of KV version 2. The data of a deleted or
+// destroyed version is null. Either half of the envelope may be missing from
+// a partial response, but not both.
+func checkKVv2Envelope(data map[string]interface{}) error {
+	v, hasData := data["data"]
+	_, hasMetadata := data["metadata"].(map[string]interface{})
+	if !hasData && !hasMetadata {
+		return fmt.Errorf("the secret has no data or metadata")
+	}
+	if v != nil {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return fmt.Errorf("the secret's data is not an object")
+		}
+	}
+	return nil
+}
+
+func isVaultKv2(data map[string]interface{}) bool {
+	// check for presence of "metadata.version", indicating this value came from Vault
+	// kv version 2
+	if metadata, ok := data["metadata"].(map[string]interface{}); ok {
+		return metadata["version"] != nil
+	}
+
+	return false
+}
+
+func (r *Runner) appendSecrets(
+	env map[string]string, d dep.Dependency, data interface{}) error {
+	typed, ok := data.(*dep.Secret)
+	if !ok {
+		return fmt.Errorf("error converting to secret %s", d)
+	}
+
+	// Get the PrefixConfig so we can get configuration from it.
+	cp, ok := r.configPrefixMap[d.String()]
+	if !ok {
+		return fmt.Errorf("missing dependency %s", d)
+	}
+
+	return r.appendSecret(env, d, cp, config.StringVal(cp.Path), typed)
+}
+
+// appendListedSecrets appends each of the secrets read while expanding a
+// wildcard path. The secrets are already sorted by path, so later paths
+// deterministically take precedence over earlier ones.
+func (r *Runner) appendListedSecrets(
+	env map[string]string, d *vaultListReadQuery, data interface{}) error {
+	typed, ok := data.([]*listedSecret)
+	if !ok {
+		return fmt.Errorf("error converting to listed secrets %s", d)
+	}
+
+	cp, ok := r.configPrefixMap[d.String()]
+	if !ok {
+		return fmt.Errorf("missing dependency %s", d)
+	}
+
+	for _, s := range typed {
+		if err := r.appendSecret(env, d, cp, s.Path, s.Secret); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendMountAccessor appends the accessor of the mount the secret at the
+// given path was read from as "<prefix>_MOUNT_ACCESSOR", named like the fields
+// of the secret. Nothing is appended if the mount could not be looked up.
+func (r *Runner) appendMountAccessor(env map[string]string, d dep.Dependency,
+	cp *PrefixConfig, secretPath string) error {
+	var accessor string
+	switch typed := d.(type) {
+	case *vaultReadQuery:
+		accessor = typed.mountAccessor
+	case *vaultListReadQuery:
+		accessor = typed.mountAccessor
+	}
+	if accessor == "" {
+		log.Printf("[WARN] (runner) %s: mount accessor of %s is unknown", d, secretPath)
+		return nil
+	}
+
+	key, err := r.secretKey(cp, secretPath, "MOUNT_ACCESSOR")
+	if err != nil {
+		return err
+	}
+
+	env[key] = accessor
+	return nil
+}
+
+// secretKey returns the name of the variable set from the given field of the
+// secret read from secretPath, with the prefix, format, sanitization and key
+// case of the given PrefixConfig applied.
+func (r *Runner) secretKey(cp *PrefixConfig, secretPath, field string) (string, error) {
+	key := field
+
+	// Replace the path slashes with an underscore.
+	data := &formatData{
+		Path: InvalidRegexp.ReplaceAllString(secretPath, "_"),
+		Key:  key,
+	}
+
+	// NoPrefix is nil when not set in config. Default to including prefix for Vault secrets.
+	if cp.NoPrefix == nil || !config.BoolVal(cp.NoPrefix) {
+		// Vault paths always use forward slashes, whatever the platform.
+		prefix := secretPath
+		if config.BoolVal(cp.LeafPrefixOnly) {
+			prefix = path.Base(prefix)
+		}
+
+		// Replace the path slashes with an underscore.
+		prefix = InvalidRegexp.ReplaceAllString(prefix, "_")
+
+		// Prefix the key value with the path value.
+		data.NoPrefixPath = prefix
+		key = fmt.Sprintf("%s_%s", prefix, key)
+	}
+
+	// If the user specified a custom format, apply that here.
+	if config.StringPresent(cp.Format) {
+		data.prefixed = key
+		var err error
+		if key, err = applyTemplate(config.StringVal(cp.Format), data); err != nil {
+			return "", err
+		}
+	}
+
+	if config.BoolVal(r.config.Sanitize) {
+		key = r.sanitizeKey(key)
+	}
+
+	return convertKeyCase(r.keyCase(cp.KeyCase, cp.Upcase), key), nil
+}
+
+// appendSecret appends the data of a single secret read from the given path
+// using the options of the given PrefixConfig.
+func (r *Runner) appendSecret(env map[string]string, d dep.Dependency,
+	cp *PrefixConfig, secretPath string, typed *dep.Secret) error {
+	var err error
+
+	valueMap := typed.Data
+	if config.StringVal(cp.KVVersion) == KVVersion2 {
+		if err := checkKVv2Envelope(valueMap); err != nil {
+			return fmt.Errorf("secret %s: kv_version is 2, but %s", secretPath, err)
+		}
+	}
+	if secretIsKVv2(d, cp, valueMap) {
+		// Vault Secrets KV1 and KV2 return different formats. Here we check the key
+		// value, and if we've found another key called "data" that is of type
+		// map[string]interface, we assume it's KV2 and use the key/value pair from
+		// it, otherwise we assume it's KV1
+		//
+		// In KV1, the JSON looks like
+		// {
+		//		"secretKey1": "value1",
+		//		"secretKey2", "value2"
+		// }
+		//
+		// In KV2, the JSON looks like
+		// {
+		//		"data": {
+		//			"secretKey1": "value1",
+		//			"secretKey2", "value2"
+		//		},
+		//		"metadata" : {
+		//			...
+		// 		}
+		// }
+		log.Printf("[DEBUG] Found KV2 secret")
+
+		// A partial response may be missing its metadata, in which case the
+		// secret cannot be known to be destroyed, and its data is used.
+		metadata, ok := valueMap["metadata"].(map[string]interface{})
+		if !ok {
+			log.Printf("[WARN] (runner) %s: secret has no metadata, assuming it was not destroyed", d)
+		}
+
+		if valueMap["data"] == nil {
+			if ok && metadata["destroyed"] == true {
+				log.Printf("[WARN] (runner) %s: secret version %v was destroyed, skipping",
+					d, metadata["version"])
+			} else {
+				log.Printf("[DEBUG] KV2 secret is nil or was deleted")
+			}
+			valueMap = nil
+		} else {
+			valueMap, _ = valueMap["data"].(map[string]interface{})
+		}
+	}
+
+	if config.BoolVal(cp.EmitMountAccessor) {
+		if err := r.appendMountAccessor(env, d, cp, secretPath); err != nil {
+			return err
+		}
+	}
+
+	if err := r.appendSplitFields(env, d, cp, valueMap); err != nil {
+		return err
+	}
+
+	if config.StringPresent(cp.Field) {
+		return r.appendSecretField(env, d, cp, valueMap)
+	}
+
+	if sep := config.StringVal(cp.NestedSeparator); sep != "" {
+		valueMap = flattenSecretData(valueMap, sep)
+	}
+
+	// Iterate over the fields in sorted order, so fields which collide once
+	// case-folded are resolved deterministically.
+	fields := make([]string, 0, len(valueMap))
+	for field := range valueMap {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	// folded maps each case-converted key to the field it was generated from.
+	folded := make(map[string]string)
+
+	keyCase := r.keyCase(cp.KeyCase, cp.Upcase)
+
+	// trimmed maps each trimmed field to the field it was trimmed from.
+	trimmed := make(map[string]string)
+
+	for _, field := range fields {
+		key, value := field, valueMap[field]
+
+		if config.BoolVal(r.config.TrimKeyNames) {
+			if key, err = trimKeyName(key, trimmed); err != nil {
+				return errors.Wrap(err, d.String())
+			}
+		}
+
+		// Ignore any keys that are empty (not sure if this is even possible in
+		// Vault, but I play defense).
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+
+		// Ignore any keys in which value is nil
+		if value == nil {
+			continue
+		}
+
+		if key, err = r.secretKey(cp, secretPath, key); err != nil {
+			return err
+		}
+
+		if current, ok := env[key]; ok {
+			log.Printf("[DEBUG] (runner) overwriting %s=%q (was %q) from %s",
+				key, r.logValue(key, value), r.logValue(key, current), d)
+		} else {
+			log.Printf("[DEBUG] (runner) setting %s=%q from %s", key, r.logValue(key, value), d)
+		}
+
+		val, ok := value.(string)
+		if ok && config.BoolVal(cp.Base64Decode) {
+			val = decodeSecretValue(d, key, val)
+		}
+		if !ok && config.BoolVal(cp.ConvertValues) {
+			val, ok = secretValueString(value)
+		}
+		if !ok {
+			log.Printf("[WARN] (runner) skipping key '%s', invalid type for value. got %v, not string", key, reflect.TypeOf(value))
+			continue
+		}
+
+		if val, err = transformValue(cp, val); err != nil {
+			return errors.Wrapf(err, "%s: %s", d, key)
+		}
+
+		if keyCase != KeyCasePreserve {
+			if other, ok := folded[key]; ok {
+				switch config.StringVal(r.config.CaseFoldPolicy) {
+				case CaseFoldPolicyFirst:
+					log.Printf("[WARN] (runner) skipping field %q from %s, %q already set %s", field, d, other, key)
+					continue
+				case CaseFoldPolicyLast:
+					log.Printf("[WARN] (runner) field %q from %s replaces %q as %s", field, d, other, key)
+				default:
+					return fmt.Errorf("fields %q and %q from %s both set %s", other, field, d, key)
+				}
+			}
+			folded[key] = field
+		}
+
+		env[key] = val
+	}
+
+	return nil
+}
+
+// init creates the Runner's underlying data structures and returns an error if
+// any problems occur.
+func (r *Runner) init() error {
+	// Ensure default configuration values
+	r.config = DefaultConfig().Merge(r.config)
+	r.config.Finalize()
+
+	// A dry run resolves the environment exactly once.
+	if config.BoolVal(r.config.DryRun) {
+		r.once = true
+	}
+
+	switch policy := config.StringVal(r.config.CaseFoldPolicy); policy {
+	case CaseFoldPolicyError, CaseFoldPolicyFirst, CaseFoldPolicyLast:
+	default:
+		return fmt.Errorf("runner: invalid case_fold_policy %q", policy)
+	}
+
+	if repl := config.StringVal(r.config.SanitizeReplacement); InvalidRegexp.MatchString(repl) {
+		return fmt.Errorf("runner: invalid sanitize_replacement %q", repl)
+	}
+
+	switch format := config.StringVal(r.config.Output.Format); format {
+	case OutputFormatDotenv, OutputFormatJSON, OutputFormatExport, OutputFormatBatch:
+	default:
+		return fmt.Errorf("runner: invalid output format %q", format)
+	}
+
+	switch quoting := config.StringVal(r.config.Output.DotenvQuoting); quoting {
+	case DotenvQuotingAlways, DotenvQuotingNever, DotenvQuotingWhenNeeded:
+	default:
+		return fmt.Errorf("runner: invalid output dotenv_quoting %q", quoting)
+	}
+
+	switch dirEnv := config.StringVal(r.config.Output.DirEnv); dirEnv {
+	case OutputDirEnvPath, OutputDirEnvValue, OutputDirEnvOmit:
+	default:
+		return fmt.Errorf("runner: invalid output dir_env %q", dirEnv)
+	}
+
+	if line := config.StringVal(r.config.Output.LineTemplate); line != "" {
+		switch format := config.StringVal(r.config.Output.Format); format {
+		case OutputFormatDotenv, OutputFormatExport:
+		default:
+			return fmt.Errorf("runner: output line_template cannot be used with "+
+				"the %s format", format)
+		}
+		tmpl, err := parseLineTemplate(line)
+		if err != nil {
+			return fmt.Errorf("runner: output line_template: %s", err)
+		}
+		r.lineTemplate = tmpl
+	}
+
+	if config.StringPresent(r.config.VaultAuth.Method) {
+		if err := validateVaultAuth(r.config.VaultAuth); err != nil {
+			return fmt.Errorf("runner: vault_auth: %s", err)
+		}
+	}
+
+	threshold, err := parseRenewThreshold(config.StringVal(r.config.RenewThreshold))
+	if err != nil {
+		return fmt.Errorf("runner: invalid renew_threshold: %s", err)
+	}
+	if threshold != nil && r.once {
+		// Each dependency is fetched exactly once, so leases are never renewed.
+		log.Printf("[DEBUG] (runner) once mode: secret leases will not be renewed")
+	}
+
+	// Print the final config for debugging
+	result, err := json.Marshal(r.config)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] (runner) final config: %s", result)
+
+	if config.BoolVal(r.config.EmitConfigHash) {
+		if r.configHash, err = r.config.Hash(); err != nil {
+			return err
+		}
+	}
+
+	// Create the clientset
+	clients, err := newClientSet(r.config)
+	if err != nil {
+		return fmt.Errorf("runner: %s", err)
+	}
+
+	// Create the watcher
+	watcher, err := newWatcher(r.config, clients, r.once)
+	if err != nil {
+		return fmt.Errorf("runner: %s", err)
+	}
+	r.watcher = watcher
+	r.clients = clients
+
+	if prefix := config.StringVal(r.config.RestartCoordinationLock.Prefix); prefix != "" {
+		lock, err := newConsulRestartLock(clients.Consul(), prefix,
+			config.IntVal(r.config.RestartCoordinationLock.Limit))
+		if err != nil {
+			return fmt.Errorf("runner: restart_coordination_lock: %s", err)
+		}
+		r.restartLock = lock
+	}
+
+	r.data = make(map[string]interface{})
+	r.errored = make(map[string]string)
+	r.configPrefixMap = make(map[string]*PrefixConfig)
+	r.configServiceMap = make(map[string][]*ServiceConfig)
+	r.healthQueries = make(map[string]*dep.HealthServiceQuery)
+	r.stickyInstances = make(map[*ServiceConfig]*stickyInstances)
+	r.keyRetries = make(map[string]*keyRetry)
+	r.renameRules = make(map[string][]*renameRule)
+	r.splitRules = make(map[string][]*splitRule)
+
+	r.inStream = os.Stdin
+	r.outStream = os.Stdout
+	r.errStream = os.Stderr
+
+	r.ErrCh = make(chan error)
+	r.DoneCh = make(chan struct{})
+	r.ExitCh = make(chan int, 1)
+	r.refetchCh = make(chan struct{}, 1)
+	r.renderCh = make(chan struct{}, 1)
+	r.cooldownCh = make(chan struct{}, 1)
+	r.restartLockCh = make(chan error, 1)
+
+	for _, c := range *r.config.TimeWindows {
+		w, err := parseTimeWindow(c)
+		if err != nil {
+			return fmt.Errorf("runner: time_window: %s", err)
+		}
+		r.timeWindows = append(r.timeWindows, w)
+	}
+
+	// Parse and add consul dependencies. The watcher runs a single query for
+	// each path, so prefixes on the same path must read it the same way.
+	tunings := make(map[string]string)
+	for _, p := range *r.config.Prefixes {
+		if err := validateTransforms(p.Transforms); err != nil {
+			return fmt.Errorf("runner: prefix %s: %s", config.StringVal(p.Path), err)
+		}
+		if err := validateGlobs(p.Include, p.Exclude); err != nil {
+			return fmt.Errorf("runner: prefix %s: %s", config.StringVal(p.Path), err)
+		}
+		if err := validateFormat(config.StringVal(p.Format)); err != nil {
+			return fmt.Errorf("runner: prefix %s: invalid format: %s", config.StringVal(p.Path), err)
+		}
+		if err := validateArrayMerge(p); err != nil {
+			return fmt.Errorf("runner: prefix %s: %s", config.StringVal(p.Path), err)
+		}
+		if err := validateKeyCase(p.KeyCase); err != nil {
+			return fmt.Errorf("runner: prefix %s: %s", config.StringVal(p.Path), err)
+		}
+		if err := r.validateKeyStyle(p.KeyStyle); err != nil {
+			return fmt.Errorf("runner: prefix %s: %s", config.StringVal(p.Path), err)
+		}
+
+		if config.StringPresent(p.Key) && !config.BoolVal(p.SingleKey) {
+			return fmt.Errorf("runner: prefix %s: key requires single_key",
+				config.StringVal(p.Path))
+		}
+
+		var d dep.Dependency
+		if config.BoolVal(p.SingleKey) {
+			d, err = dep.NewKVGetQuery(config.StringVal(p.Path))
+		} else {
+			d, err = dep.NewKVListQuery(config.StringVal(p.Path))
+		}
+		if err != nil {
+			return err
+		}
+		tuning := prefixTuning(p)
+		if prev, ok := tunings[d.String()]; ok && prev != tuning {
+			return fmt.Errorf("runner: prefix %s: consistent, max_stale and "+
+				"poll_interval must match the other prefixes on the same path "+
+				"(%s, not %s)", config.StringVal(p.Path), prev, tuning)
+		}
+		tunings[d.String()] = tuning
+		if config.BoolVal(p.Consistent) {
+			if config.TimeDurationVal(p.MaxStale) > 0 {
+				return fmt.Errorf("runner: prefix %s: max_stale cannot be used "+
+					"with consistent", config.StringVal(p.Path))
+			}
+			d = &consistentQuery{d}
+		}
+		if p.MaxStale != nil || config.TimeDurationVal(p.PollInterval) > 0 {
+			d = newTunedQuery(d, p.MaxStale, config.TimeDurationVal(p.PollInterval))
+		}
+
+		for i, rule := range p.Rename {
+			re, err := regexp.Compile(config.StringVal(rule.Match))
+			if err != nil {
+				return fmt.Errorf("runner: prefix %s: rename rule %d: invalid match %q: %s",
+					config.StringVal(p.Path), i+1, config.StringVal(rule.Match), err)
+			}
+			r.renameRules[d.String()] = append(r.renameRules[d.String()],
+				&renameRule{match: re, replace: config.StringVal(rule.Replace)})
+		}
+		r.dependencies = append(r.dependencies, d)
+		r.configPrefixMap[d.String()] = p
+	}
+	if config.BoolVal(r.config.NamespaceDatacenters) {
+		r.datacenters = namespacedDatacenters(r.configPrefixMap)
+	}
+
+	// Parse and add consul services
+	for _, s := range *r.config.Services {
+		d, err := r.serviceDependency(s)
+		if err != nil {
+			return err
+		}
+
+		switch sortBy := config.StringVal(s.Sort); sortBy {
+		case "", ServiceSortAddress, ServiceSortPort, ServiceSortID:
+		default:
+			return fmt.Errorf("runner: service %s: invalid sort %q",
+				config.StringVal(s.Query), sortBy)
+		}
+		if err := validateKeyCase(s.KeyCase); err != nil {
+			return fmt.Errorf("runner: service %s: %s", config.StringVal(s.Query), err)
+		}
+		if err := validateGlobs([]string{config.StringVal(s.TagFilter)}); err != nil {
+			return fmt.Errorf("runner: service %s: tag_filter: %s",
+				config.StringVal(s.Query), err)
+		}
+		switch instance := config.StringVal(s.Instance); instance {
+		case "", ServiceInstanceFirst, ServiceInstanceLast:
+		default:
+			if n, err := strconv.Atoi(instance); err != nil || n < 0 {
+				return fmt.Errorf("runner: service %s: invalid instance %q",
+					config.StringVal(s.Query), instance)
+			}
+		}
+
+		// Only query each service once, however many configs use it.
+		if _, ok := r.configServiceMap[d.String()]; !ok {
+			r.dependencies = append(r.dependencies, d)
+		}
+		r.configServiceMap[d.String()] = append(r.configServiceMap[d.String()], s)
+
+		// The catalog has no health information, so the status is read from
+		// the health of every instance, whatever its status.
+		if _, ok := r.healthQueries[d.String()]; !ok && config.StringPresent(s.FormatStatus) {
+			h, err := newHealthQuery(config.StringVal(s.Query))
+			if err != nil {
+				return err
+			}
+			r.dependencies = append(r.dependencies, h)
+			r.healthQueries[d.String()] = h
+		}
+	}
+
+	// Parse and add vault dependencies - it is important that this come after
+	// consul, because consul should never be permitted to overwrite values from
+	// vault; that would expose a security hole since access to consul is
+	// typically less controlled than access to vault.
+	cache := newSecretCache(config.TimeDurationVal(r.config.CacheTTL))
+	for _, s := range *r.config.Secrets {
+		path := config.StringVal(s.Path)
+		log.Printf("[INFO] looking at vault %s", path)
+
+		switch v := config.StringVal(s.KVVersion); v {
+		case KVVersionAuto, KVVersion1, KVVersion2:
+		default:
+			return fmt.Errorf("runner: secret %s: invalid kv_version %q", path, v)
+		}
+
+		if err := validateTransforms(s.Transforms); err != nil {
+			return fmt.Errorf("runner: secret %s: %s", path, err)
+		}
+		if err := validateGlobs(s.Include, s.Exclude); err != nil {
+			return fmt.Errorf("runner: secret %s: %s", path, err)
+		}
+		if err := validateFormat(config.StringVal(s.Format)); err != nil {
+			return fmt.Errorf("runner: secret %s: invalid format: %s", path, err)
+		}
+		if err := validateArrayMerge(s); err != nil {
+			return fmt.Errorf("runner: secret %s: %s", path, err)
+		}
+		if err := validateKeyCase(s.KeyCase); err != nil {
+			return fmt.Errorf("runner: secret %s: %s", path, err)
+		}
+		if err := r.validateKeyStyle(s.KeyStyle); err != nil {
+			return fmt.Errorf("runner: secret %s: %s", path, err)
+		}
+
+		if config.StringPresent(s.Key) != config.StringPresent(s.Field) {
+			return fmt.Errorf("runner: secret %s: key and field must be set "+
+				"together", path)
+		}
+		if config.StringPresent(s.Field) && strings.HasSuffix(path, wildcardSuffix) {
+			return fmt.Errorf("runner: secret %s: field cannot be set for a "+
+				"wildcard path", path)
+		}
+
+		splits, err := compileSplitRules(s.Split)
+		if err != nil {
+			return fmt.Errorf("runner: secret %s: %s", path, err)
+		}
+		if len(splits) > 0 && strings.HasSuffix(path, wildcardSuffix) {
+			return fmt.Errorf("runner: secret %s: split cannot be set for a "+
+				"wildcard path", path)
+		}
+
+		headers := make(http.Header, len(s.RequestHeaders))
+		for k, v := range s.RequestHeaders {
+			if k == "" || strings.ContainsAny(k, " \t\r\n:") || strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("runner: secret %s: invalid request header %q", path, k)
+			}
+			headers.Set(k, v)
+		}
+
+		if config.BoolVal(s.NoPrefix) && config.BoolVal(s.LeafPrefixOnly) {
+			return fmt.Errorf("runner: secret %s: no_prefix and leaf_prefix_only "+
+				"cannot both be set", path)
+		}
+
+		version := config.IntVal(s.Version)
+		switch {
+		case version < 0:
+			return fmt.Errorf("runner: secret %s: invalid version %d", path, version)
+		case version > 0 && strings.HasSuffix(path, wildcardSuffix):
+			return fmt.Errorf("runner: secret %s: version cannot be set for a "+
+				"wildcard path", path)
+		case version > 0 && config.StringVal(s.KVVersion) == KVVersion1:
+			return fmt.Errorf("runner: secret %s: version requires a KV version 2 "+
+				"secret", path)
+		}
+
+		var d dep.Dependency
+		switch {
+		case strings.HasSuffix(path, wildcardSuffix):
+			d, err = newVaultListReadQuery(strings.TrimSuffix(path, wildcardSuffix),
+				config.IntVal(s.ListConcurrency), cache)
+		case version > 0:
+			d, err = newVaultReadQuery(fmt.Sprintf("%s?version=%d", path, version), cache)
+		default:
+			d, err = newVaultReadQuery(path, cache)
+		}
+		if err != nil {
+			return err
+		}
+		switch q := d.(type) {
+		case *vaultReadQuery:
+			q.threshold = threshold
+			q.headers = headers
+			q.renewed = r.metrics.secretRenewed
+		case *vaultListReadQuery:
+			q.headers = headers
+		}
+		r.dependencies = append(r.dependencies, d)
+		r.configPrefixMap[d.String()] = s
+		r.splitRules[d.String()] = splits
+	}
+
+	if config.BoolVal(r.config.EmitTokenTTL) {
+		r.dependencies = append(r.dependencies, newVaultTokenTTLQuery())
+	}
+
+	return nil
+}
+
+func (r *Runner) stopWatcher() {
+	if r.watcher != nil {
+		log.Printf("[DEBUG] (runner) stopping watcher")
+		r.watcher.Stop()
+	}
+}
+
+func (r *Runner) stopChild() {
+	r.childLock.RLock()
+	defer r.childLock.RUnlock()
+
+	if r.child != nil {
+		log.Printf("[DEBUG] (runner) stopping child process")
+		r.child.Stop()
+	}
+}
+
+// storePid is used to write out a PID file to disk.
+func (r *Runner) storePid() error {
+	path := config.StringVal(r.config.PidFile)
+	if path == "" {
+		return nil
+	}
+
+	log.Printf("[INFO] creating pid file at %q", path)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("runner: could not open pid file: %s", err)
+	}
+	defer f.Close()
+
+	pid := os.Getpid()
+	_, err = f.WriteString(fmt.Sprintf("%d", pid))
+	if err != nil {
+		return fmt.Errorf("runner: could not write to pid file: %s", err)
+	}
+	return nil
+}
+
+// deletePid is used to remove the PID on exit.
+func (r *Runner) deletePid() error {
+	path := config.StringVal(r.config.PidFile)
+	if path == "" {
+		return nil
+	}
+
+	log.Printf("[DEBUG] removing pid file at %q", path)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("runner: could not remove pid file: %s", err)
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("runner: specified pid file path is directory")
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("runner: could not remove pid file: %s", err)
+	}
+	return nil
+}
+
+// newClientSet creates a new client set from the given config.
+func newClientSet(c *Config) (*dep.ClientSet, error) {
+	clients := dep.NewClientSet()
+
+	if err := clients.CreateConsulClient(&dep.CreateConsulClientInput{
+		Address:                      config.StringVal(c.Consul.Address),
+		Token:                        config.StringVal(c.Consul.Token),
+		AuthEnabled:                  config.BoolVal(c.Consul.Auth.Enabled),
+		AuthUsername:                 config.StringVal(c.Consul.Auth.Username),
+		AuthPassword:                 config.StringVal(c.Consul.Auth.Password),
+		SSLEnabled:                   config.BoolVal(c.Consul.SSL.Enabled),
+		SSLVerify:                    config.BoolVal(c.Consul.SSL.Verify),
+		SSLCert:                      config.StringVal(c.Consul.SSL.Cert),
+		SSLKey:                       config.StringVal(c.Consul.SSL.Key),
+		SSLCACert:                    config.StringVal(c.Consul.SSL.CaCert),
+		SSLCAPath:                    config.StringVal(c.Consul.SSL.CaPath),
+		ServerName:                   config.StringVal(c.Consul.SSL.ServerName),
+		TransportDialKeepAlive:       config.TimeDurationVal(c.Consul.Transport.DialKeepAlive),
+		TransportDialTimeout:         config.TimeDurationVal(c.Consul.Transport.DialTimeout),
+		TransportDisableKeepAlives:   config.BoolVal(c.Consul.Transport.DisableKeepAlives),
+		TransportIdleConnTimeout:     config.TimeDurationVal(c.Consul.Transport.IdleConnTimeout),
+		TransportMaxIdleConns:        config.IntVal(c.Consul.Transport.MaxIdleConns),
+		TransportMaxIdleConnsPerHost: config.IntVal(c.Consul.Transport.MaxIdleConnsPerHost),
+		TransportTLSHandshakeTimeout: config.TimeDurationVal(c.Consul.Transport.TLSHandshakeTimeout),
+	}); err != nil {
+		return nil, fmt.Errorf("runner: %s", err)
+	}
+
+	if err := clients.CreateVaultClient(&dep.CreateVaultClientInput{
+		Address:                      config.StringVal(c.Vault.Address),
+		Token:                        config.StringVal(c.Vault.Token),
+		UnwrapToken:                  config.BoolVal(c.Vault.UnwrapToken),
+		SSLEnabled:                   config.BoolVal(c.Vault.SSL.Enabled),
+		SSLVerify:                    config.BoolVal(c.Vault.SSL.Verify),
+		SSLCert:                      config.StringVal(c.Vault.SSL.Cert),
+		SSLKey:                       config.StringVal(c.Vault.SSL.Key),
+		SSLCACert:                    config.StringVal(c.Vault.SSL.CaCert),
+		SSLCAPath:                    config.StringVal(c.Vault.SSL.CaPath),
+		ServerName:                   config.StringVal(c.Vault.SSL.ServerName),
+		TransportDialKeepAlive:       config.TimeDurationVal(c.Vault.Transport.DialKeepAlive),
+		TransportDialTimeout:         config.TimeDurationVal(c.Vault.Transport.DialTimeout),
+		TransportDisableKeepAlives:   config.BoolVal(c.Vault.Transport.DisableKeepAlives),
+		TransportIdleConnTimeout:     config.TimeDurationVal(c.Vault.Transport.IdleConnTimeout),
+		TransportMaxIdleConns:        config.IntVal(c.Vault.Transport.MaxIdleConns),
+		TransportMaxIdleConnsPerHost: config.IntVal(c.Vault.Transport.MaxIdleConnsPerHost),
+		TransportTLSHandshakeTimeout: config.TimeDurationVal(c.Vault.Transport.TLSHandshakeTimeout),
+	}); err != nil {
+		return nil, fmt.Errorf("runner: %s", err)
+	}
+
+	return clients, nil
+}
+
+// newWatcher creates a new watcher.
+func newWatcher(c *Config, clients *dep.ClientSet, once bool) (*watch.Watcher, error) {
+	log.Printf("[INFO] (runner) creating watcher")
+
+	w, err := watch.NewWatcher(&watch.NewWatcherInput{
+		Clients:         clients,
+		MaxStale:        config.TimeDurationVal(c.MaxStale),
+		Once:            once,
+		RenewVault:      renewVaultToken(c) && !config.BoolVal(c.VaultTokenMandatory),
+		RetryFuncConsul: watch.RetryFunc(c.Consul.Retry.RetryFunc()),
+		// TODO: Add a sane default retry - right now this only affects "local"
+		// dependencies like reading a file from disk.
+		RetryFuncDefault: nil,
+		RetryFuncVault:   watch.RetryFunc(c.Vault.Retry.RetryFunc()),
+		VaultGrace:       config.TimeDurationVal(c.Vault.Grace),
+		VaultToken:       config.StringVal(c.Vault.Token),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "runner")
+	}
+	return w, nil
+}
+
+// renewVaultToken returns whether the Vault token is renewed.
+func renewVaultToken(c *Config) bool {
+	return config.StringPresent(c.Vault.Token) && config.BoolVal(c.Vault.RenewToken)
+}
+
+// anyGlobMatch checks if any of the given globs match the string.
+func anyGlobMatch(s string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// filterKeys removes the keys of env which do not match any of the include
+// globs, if there are any, or which match any of the exclude globs. Exclude
+// takes precedence over include, like the exec whitelist and blacklist.
+func filterKeys(env map[string]string, include, exclude []string) {
+	for k := range env {
+		if len(include) > 0 && !anyGlobMatch(k, include) {
+			delete(env, k)
+		} else if anyGlobMatch(k, exclude) {
+			delete(env, k)
+		}
+	}
+}
+
+// validateGlobs returns an error if any glob in the given lists is malformed.
+func validateGlobs(lists ...[]string) error {
+	for _, patterns := range lists {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyConfigEnv applies custom env variables and whitelist/blacklist rules from config
+func (r *Runner) applyConfigEnv(env map[string]string) map[string]string {
+	// Parse custom environment variables
+	custom := make(map[string]string, len(r.config.Exec.Env.Custom))
+	for _, v := range r.config.Exec.Env.Custom {
+		list := strings.SplitN(v, "=", 2)
+		custom[list[0]] = list[1]
+	}
+
+	// In pristine mode, just return the custom environment. If the user did not
+	// specify a custom environment, just return the empty slice to force an
+	// empty environment. We cannot return nil here because the later call to
+	// os/exec will think we want to inherit the parent.
+	if config.BoolVal(r.config.Exec.Env.Pristine) {
+		if len(custom) > 0 {
+			return custom
+		}
+		return make(map[string]string)
+	}
+
+	keys := make(map[string]bool, len(env))
+	for k, _ := range env {
+		keys[k] = true
+	}
+
+	// Remove envconsul's own variables, which may be inherited from an
+	// envconsul further up the process tree, unless this envconsul emitted them
+	// or they were read from a prefix, secret or service.
+	emitted := r.emittedEnv()
+	for k, _ := range keys {
+		if !strings.HasPrefix(k, envconsulEnvPrefix) && !strings.HasPrefix(k, EnvSourcePrefix) {
+			continue
+		}
+		_, isEmitted := emitted[k]
+		_, isSourced := r.env[k]
+		if !isEmitted && !isSourced {
+			delete(keys, k)
+		}
+	}
+
+	// Filter to envvars that match the whitelist
+	if n := len(r.config.Exec.Env.Whitelist); n > 0 {
+		include := make(map[string]bool, n)
+		for k, _ := range keys {
+			if anyGlobMatch(k, r.config.Exec.Env.Whitelist) {
+				include[k] = true
+			}
+		}
+		keys = include
+	}
+
+	// Remove any env vars that match the blacklist
+	// Blacklist takes precedence over whitelist
+	if len(r.config.Exec.Env.Blacklist) > 0 {
+		for k, _ := range keys {
+			if anyGlobMatch(k, r.config.Exec.Env.Blacklist) {
+				delete(keys, k)
+			}
+		}
+	}
+
+	// Filter env to allowed keys
+	for k, _ := range env {
+		if _, ok := keys[k]; !ok {
+			delete(env, k)
+		}
+	}
+
+	// Add custom env to final map
+	// Custom variables take precedence over whitelist and blacklist
+	for k, v := range custom {
+		env[k] = v
+	}
+
+	return env
+}
@@ -0,0 +1,6301 @@
+package envconsul
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/consul-template/manager"
+)
+
+func TestRunner_appendSecrets(t *testing.T) {
+	t.Parallel()
+
+	secrets := []string{"somevalue1", "somevalue2"}
+
+	tt := []struct {
+		name           string
+		path           string
+		noPrefix       *bool
+		leafPrefixOnly *bool
+		convertValues  *bool
+		data           *dependency.Secret
+		keyNames       []string
+		notFound       bool
+	}{
+		{
+			name:     "kv1 secret",
+			path:     "kv/foo",
+			noPrefix: config.Bool(false),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"bar": secrets[0],
+					"zed": secrets[1],
+				},
+			},
+			keyNames: []string{"kv_foo_bar", "kv_foo_zed"},
+			notFound: false,
+		},
+		{
+			name:     "kv2 secret",
+			path:     "secret/data/foo",
+			noPrefix: config.Bool(false),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"destroyed": bool(false),
+						"version":   "1",
+					},
+					"data": map[string]interface{}{
+						"bar": secrets[0],
+						"zed": secrets[1],
+					},
+				},
+			},
+			keyNames: []string{"secret_data_foo_bar", "secret_data_foo_zed"},
+			notFound: false,
+		},
+		{
+			name:     "kv2 secret destroyed",
+			path:     "secret/data/foo",
+			noPrefix: config.Bool(false),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"destroyed": bool(true),
+						"version":   "2",
+					},
+					"data": nil,
+				},
+			},
+			keyNames: []string{},
+			notFound: true,
+		},
+		{
+			name:     "kv2 secret noprefix excludes path",
+			path:     "secret/data/foo",
+			noPrefix: config.Bool(true),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"destroyed": bool(false),
+						"version":   "1",
+					},
+					"data": map[string]interface{}{
+						"bar": secrets[0],
+						"zed": secrets[1],
+					},
+				},
+			},
+			keyNames: []string{"bar", "zed"},
+			notFound: false,
+		},
+		{
+			name:     "kv2 secret false noprefix includes path",
+			path:     "secret/data/foo",
+			noPrefix: config.Bool(false),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"destroyed": bool(false),
+						"version":   "1",
+					},
+					"data": map[string]interface{}{
+						"bar": secrets[0],
+						"zed": secrets[1],
+					},
+				},
+			},
+			keyNames: []string{"secret_data_foo_bar", "secret_data_foo_zed"},
+			notFound: false,
+		},
+		{
+			name:     "kv2 secret default noprefix includes path",
+			path:     "secret/data/foo",
+			noPrefix: nil,
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"destroyed": bool(false),
+						"version":   "1",
+					},
+					"data": map[string]interface{}{
+						"bar": secrets[0],
+						"zed": secrets[1],
+					},
+				},
+			},
+			keyNames: []string{"secret_data_foo_bar", "secret_data_foo_zed"},
+			notFound: false,
+		},
+		{
+			name:          "int secret skipped without convert values",
+			path:          "kv/foo",
+			noPrefix:      config.Bool(false),
+			convertValues: config.Bool(false),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"bar": 1,
+					"zed": 1,
+				},
+			},
+			notFound: true,
+		},
+		{
+			name:           "leaf prefix only",
+			path:           "secret/data/apps/billing",
+			leafPrefixOnly: config.Bool(true),
+			data: &dependency.Secret{
+				Data: map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"version": "1",
+					},
+					"data": map[string]interface{}{
+						"bar": secrets[0],
+						"zed": secrets[1],
+					},
+				},
+			},
+			keyNames: []string{"billing_bar", "billing_zed"},
+			notFound: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%s", tc.name), func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:           config.String(tc.path),
+						NoPrefix:       tc.noPrefix,
+						LeafPrefixOnly: tc.leafPrefixOnly,
+						ConvertValues:  tc.convertValues,
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vrq, err := dependency.NewVaultReadQuery(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := make(map[string]string)
+			appendError := r.appendSecrets(env, vrq, tc.data)
+			if appendError != nil {
+				t.Fatalf("got err: %s", appendError)
+			}
+
+			if len(env) > 2 {
+				t.Fatalf("Expected only 2 values in this test")
+			}
+
+			for i, keyName := range tc.keyNames {
+				secretValue := secrets[i]
+
+				var value string
+				value, ok := env[keyName]
+				if !ok && !tc.notFound {
+					t.Fatalf("expected (%s) key, but was not found", keyName)
+				}
+				if ok && tc.notFound {
+					t.Fatalf("expected to not find key, but (%s) was found",
+						keyName)
+				}
+				if ok && value != secretValue {
+					t.Fatalf("values didn't match, expected (%s), got (%s)",
+						secretValue, value)
+				}
+			}
+		})
+	}
+}
+
+func TestRunner_leafPrefixOnlyWithNoPrefix(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:           config.String("secret/data/apps/billing"),
+				NoPrefix:       config.Bool(true),
+				LeafPrefixOnly: config.Bool(true),
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Fatal("expected an error combining no_prefix and leaf_prefix_only")
+	}
+}
+
+func TestRunner_appendSecrets_caseFold(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		policy string
+		env    map[string]string
+		err    bool
+	}{
+		{
+			CaseFoldPolicyError,
+			nil,
+			true,
+		},
+		{
+			CaseFoldPolicyFirst,
+			map[string]string{"BAR": "upper"},
+			false,
+		},
+		{
+			CaseFoldPolicyLast,
+			map[string]string{"BAR": "lower"},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			cfg := Config{
+				CaseFoldPolicy: config.String(tc.policy),
+				Upcase:         config.Bool(true),
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String("kv/foo"),
+						NoPrefix: config.Bool(true),
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vrq, err := dependency.NewVaultReadQuery("kv/foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			err = r.appendSecrets(env, vrq, &dependency.Secret{
+				Data: map[string]interface{}{
+					"Bar": "upper",
+					"bar": "lower",
+				},
+			})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+			if !tc.err && !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendSecrets_convertValues(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:     config.String("kv/foo"),
+				NoPrefix: config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vrq, err := dependency.NewVaultReadQuery("kv/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendSecrets(env, vrq, &dependency.Secret{
+		Data: map[string]interface{}{
+			"enabled":   true,
+			"disabled":  false,
+			"max_conns": 1,
+			"big":       int64(9223372036854775807),
+			"ratio":     float64(0.000001),
+			"huge":      float64(1e21),
+			"number":    json.Number("12345678901234567890"),
+			"exponent":  json.Number("1.5e3"),
+			"nested":    map[string]interface{}{"a": "b"},
+			"list":      []interface{}{"a", "b"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"enabled":   "true",
+		"disabled":  "false",
+		"max_conns": "1",
+		"big":       "9223372036854775807",
+		"ratio":     "0.000001",
+		"huge":      "1000000000000000000000",
+		"number":    "12345678901234567890",
+		"exponent":  "1500",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestRunner_appendSecrets_nestedSeparator(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:            config.String("kv/app/config"),
+				NestedSeparator: config.String("__"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vrq, err := dependency.NewVaultReadQuery("kv/app/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendSecrets(env, vrq, &dependency.Secret{
+		Data: map[string]interface{}{
+			"name": "app",
+			"db": map[string]interface{}{
+				"primary": map[string]interface{}{
+					"host": "db1",
+					"port": "5432",
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"kv_app_config_name":              "app",
+		"kv_app_config_db__primary__host": "db1",
+		"kv_app_config_db__primary__port": "5432",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestRunner_appendSecrets_base64Decode(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:         config.String("kv/foo"),
+				NoPrefix:     config.Bool(true),
+				Base64Decode: config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vrq, err := dependency.NewVaultReadQuery("kv/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendSecrets(env, vrq, &dependency.Secret{
+		Data: map[string]interface{}{
+			"cert":    "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0t",
+			"invalid": "not base64!",
+			"port":    json.Number("8080"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Numbers are converted to strings, but never decoded.
+	expected := map[string]string{
+		"cert":    "-----BEGIN CERTIFICATE-----",
+		"invalid": "not base64!",
+		"port":    "8080",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestRunner_appendSecrets_kvVersion(t *testing.T) {
+	t.Parallel()
+
+	// A KV version 1 secret that happens to have the shape of a version 2 one.
+	shaped := map[string]interface{}{
+		"data": map[string]interface{}{
+			"password": "nested",
+		},
+		"metadata": map[string]interface{}{
+			"version": "3",
+		},
+		"user": "admin",
+	}
+
+	// A KV version 1 secret with a literal "data" key.
+	literal := map[string]interface{}{
+		"data": "literal",
+		"user": "admin",
+	}
+
+	cases := []struct {
+		name    string
+		version string
+		data    map[string]interface{}
+		env     map[string]string
+		err     bool
+	}{
+		{
+			"auto",
+			KVVersionAuto,
+			shaped,
+			map[string]string{"kv_foo_password": "nested"},
+			false,
+		},
+		{
+			"v1",
+			KVVersion1,
+			shaped,
+			map[string]string{"kv_foo_user": "admin"},
+			false,
+		},
+		{
+			"v1_literal_data",
+			KVVersion1,
+			literal,
+			map[string]string{"kv_foo_data": "literal", "kv_foo_user": "admin"},
+			false,
+		},
+		{
+			"auto_literal_data",
+			KVVersionAuto,
+			literal,
+			map[string]string{"kv_foo_data": "literal", "kv_foo_user": "admin"},
+			false,
+		},
+		{
+			"v2_without_envelope",
+			KVVersion2,
+			literal,
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("kv/foo"),
+						KVVersion: config.String(tc.version),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vrq, err := dependency.NewVaultReadQuery("kv/foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			err = r.appendSecrets(env, vrq, &dependency.Secret{Data: tc.data})
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if tc.err {
+				return
+			}
+			if !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendSecrets_field(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		field string
+		env   map[string]string
+		err   bool
+	}{
+		{
+			"found",
+			"password",
+			map[string]string{"DATABASE_PASSWORD": "hunter2"},
+			false,
+		},
+		{
+			"missing",
+			"passwd",
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:  config.String("secret/data/db"),
+						Key:   config.String("DATABASE_PASSWORD"),
+						Field: config.String(tc.field),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vrq, err := dependency.NewVaultReadQuery("secret/data/db")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			err = r.appendSecrets(env, vrq, &dependency.Secret{
+				Data: map[string]interface{}{
+					"data": map[string]interface{}{
+						"username": "admin",
+						"password": "hunter2",
+					},
+					"metadata": map[string]interface{}{
+						"version": "1",
+					},
+				},
+			})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+			if !tc.err && !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/data/db"),
+				Key:  config.String("DATABASE_PASSWORD"),
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Fatal("expected an error setting key without field")
+	}
+}
+
+func TestRunner_appendSecrets_split(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		url      string
+		required bool
+		env      map[string]string
+		err      bool
+	}{
+		{
+			"match",
+			"db.internal:5432",
+			false,
+			map[string]string{"url": "db.internal:5432", "DB_HOST": "db.internal", "DB_PORT": "5432"},
+			false,
+		},
+		{
+			"no_match",
+			"db.internal",
+			false,
+			map[string]string{"url": "db.internal"},
+			false,
+		},
+		{
+			"no_match_required",
+			"db.internal",
+			true,
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String("secret/db"),
+						NoPrefix: config.Bool(true),
+						Required: config.Bool(tc.required),
+						Split: []*SplitRule{
+							{
+								Field: config.String("url"),
+								Match: config.String(`^(?P<host>[^:]+):(?P<port>\d+)$`),
+								Keys:  map[string]string{"host": "DB_HOST", "port": "DB_PORT"},
+							},
+						},
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			err = r.appendSecrets(env, r.dependencies[0], &dependency.Secret{
+				Data: map[string]interface{}{"url": tc.url},
+			})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+			if !tc.err && !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/db"),
+				Split: []*SplitRule{
+					{
+						Field: config.String("url"),
+						Match: config.String(`^(?P<host>[^:]+)$`),
+						Keys:  map[string]string{"port": "DB_PORT"},
+					},
+				},
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Fatal("expected an error for a key which is not a group")
+	}
+}
+
+func TestRunner_appendSecrets_version(t *testing.T) {
+	t.Parallel()
+
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/sys/internal/ui/mounts/secret/foo":
+			writeVaultData(w, map[string]interface{}{
+				"path":    "secret/",
+				"type":    "kv",
+				"options": map[string]interface{}{"version": "2"},
+			})
+		case r.URL.Path == "/v1/secret/data/foo" && r.URL.Query().Get("version") == "3":
+			writeVaultData(w, map[string]interface{}{
+				"data":     map[string]interface{}{"bar": "v3"},
+				"metadata": map[string]interface{}{"version": 3},
+			})
+		case r.URL.Path == "/v1/secret/data/foo" && r.URL.Query().Get("version") == "2":
+			// Vault responds to reads of destroyed versions with a 404, but
+			// still includes the metadata.
+			w.WriteHeader(http.StatusNotFound)
+			writeVaultData(w, map[string]interface{}{
+				"data": nil,
+				"metadata": map[string]interface{}{
+					"destroyed": true,
+					"version":   2,
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer stop()
+
+	cases := []struct {
+		name    string
+		version int
+		env     map[string]string
+	}{
+		{
+			"pinned",
+			3,
+			map[string]string{"secret_foo_bar": "v3"},
+		},
+		{
+			"destroyed",
+			2,
+			map[string]string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:    config.String("secret/foo"),
+						Version: config.Int(tc.version),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := r.dependencies[0]
+			expected := fmt.Sprintf("vault.read(secret/foo?version=%d)", tc.version)
+			if d.String() != expected {
+				t.Fatalf("expected %s, got %s", expected, d)
+			}
+
+			data, _, err := d.Fetch(clients, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendSecrets(env, d, data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendSecrets_mountAccessor(t *testing.T) {
+	t.Parallel()
+
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/internal/ui/mounts/secret/foo":
+			writeVaultData(w, map[string]interface{}{
+				"accessor": "kv_1234abcd",
+				"path":     "secret/",
+				"type":     "kv",
+				"options":  map[string]interface{}{"version": "2"},
+			})
+		case "/v1/secret/data/foo":
+			writeVaultData(w, map[string]interface{}{
+				"data":     map[string]interface{}{"bar": "baz"},
+				"metadata": map[string]interface{}{"version": 1},
+			})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer stop()
+
+	cases := []struct {
+		name   string
+		format *string
+		upcase *bool
+		env    map[string]string
+	}{
+		{
+			"default",
+			nil,
+			nil,
+			map[string]string{
+				"secret_foo_bar":            "baz",
+				"secret_foo_MOUNT_ACCESSOR": "kv_1234abcd",
+			},
+		},
+		{
+			"format",
+			config.String("app_{{ key }}"),
+			nil,
+			map[string]string{
+				"app_secret_foo_bar":            "baz",
+				"app_secret_foo_MOUNT_ACCESSOR": "kv_1234abcd",
+			},
+		},
+		{
+			"upcase",
+			nil,
+			config.Bool(true),
+			map[string]string{
+				"SECRET_FOO_BAR":            "baz",
+				"SECRET_FOO_MOUNT_ACCESSOR": "kv_1234abcd",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:              config.String("secret/foo"),
+						EmitMountAccessor: config.Bool(true),
+						Format:            tc.format,
+						Upcase:            tc.upcase,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := r.dependencies[0]
+			data, _, err := d.Fetch(clients, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendSecrets(env, d, data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendSecrets_kv2MissingMetadata(t *testing.T) {
+	t.Parallel()
+
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/internal/ui/mounts/secret/foo":
+			writeVaultData(w, map[string]interface{}{
+				"path":    "secret/",
+				"type":    "kv",
+				"options": map[string]interface{}{"version": "2"},
+			})
+		case "/v1/secret/data/foo":
+			writeVaultData(w, map[string]interface{}{
+				"data": map[string]interface{}{"bar": "baz"},
+			})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer stop()
+
+	for _, version := range []string{KVVersionAuto, KVVersion2} {
+		t.Run(version, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("secret/foo"),
+						KVVersion: config.String(version),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := r.dependencies[0]
+			data, _, err := d.Fetch(clients, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendSecrets(env, d, data); err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]string{"secret_foo_bar": "baz"}
+			if !reflect.DeepEqual(env, expected) {
+				t.Fatalf("expected %v, got %v", expected, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendKey(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		key      *string
+		upcase   bool
+		data     interface{}
+		expected map[string]string
+	}{
+		{
+			"sanitized_path",
+			nil,
+			false,
+			"db.internal",
+			map[string]string{"config_db_host": "db.internal"},
+		},
+		{
+			"upcased_path",
+			nil,
+			true,
+			"db.internal",
+			map[string]string{"CONFIG_DB_HOST": "db.internal"},
+		},
+		{
+			"key",
+			config.String("database_host"),
+			true,
+			"db.internal",
+			map[string]string{"database_host": "db.internal"},
+		},
+		{
+			"missing",
+			nil,
+			false,
+			nil,
+			map[string]string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Upcase: config.Bool(tc.upcase),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("config/db/host"),
+						SingleKey: config.Bool(true),
+						Key:       tc.key,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, ok := r.dependencies[0].(*dependency.KVGetQuery)
+			if !ok {
+				t.Fatalf("expected a key query, got %T", r.dependencies[0])
+			}
+
+			env := make(map[string]string)
+			if err := r.appendKey(env, d, tc.data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, env)
+			}
+		})
+	}
+}
+
+func TestRunner_keyWithoutSingleKey(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("config/db"),
+				Key:  config.String("DB_HOST"),
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRunner_appendPrefixes(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		path     string
+		noPrefix *bool
+		data     []*dependency.KeyPair
+		keyName  string
+	}{
+		{
+			name:     "false noprefix appends path",
+			path:     "app/my_service",
+			noPrefix: config.Bool(false),
+			data: []*dependency.KeyPair{
+				&dependency.KeyPair{
+					Key:   "mykey",
+					Value: "myValue",
+				},
+			},
+			keyName: "app_my_service_mykey",
+		},
+		{
+			name:     "true noprefix excludes path",
+			path:     "app/my_service",
+			noPrefix: config.Bool(true),
+			data: []*dependency.KeyPair{
+				&dependency.KeyPair{
+					Key:   "mykey",
+					Value: "myValue",
+				},
+			},
+			keyName: "mykey",
+		},
+		{
+			name:     "null noprefix excludes path",
+			path:     "app/my_service",
+			noPrefix: nil,
+			data: []*dependency.KeyPair{
+				&dependency.KeyPair{
+					Key:   "mykey",
+					Value: "myValue",
+				},
+			},
+			keyName: "mykey",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String(tc.path),
+						NoPrefix: tc.noPrefix,
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvq, err := dependency.NewKVListQuery(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := make(map[string]string)
+			appendError := r.appendPrefixes(env, kvq, tc.data)
+			if appendError != nil {
+				t.Fatalf("got err: %s", appendError)
+			}
+
+			if len(env) > 1 {
+				t.Fatalf("Expected only 1 value in this test")
+			}
+
+			var value string
+			value, ok := env[tc.keyName]
+			if !ok {
+				t.Fatalf("expected (%s) key, but was not found", tc.keyName)
+			}
+			if ok && value != tc.data[0].Value {
+				t.Fatalf("values didn't match, expected (%s), got (%s)", tc.data[0].Value, value)
+			}
+		})
+	}
+}
+
+func TestRunner_appendPrefixes_createIndex(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		prefix   *PrefixConfig
+		value    string
+		expected map[string]string
+	}{
+		{
+			"default",
+			&PrefixConfig{},
+			"myValue",
+			map[string]string{
+				"mykey":              "myValue",
+				"mykey_CREATE_INDEX": "42",
+			},
+		},
+		{
+			"key_case",
+			&PrefixConfig{KeyCase: config.String(KeyCaseLower)},
+			"myValue",
+			map[string]string{
+				"mykey":              "myValue",
+				"mykey_create_index": "42",
+			},
+		},
+		{
+			"format",
+			&PrefixConfig{Format: config.String("app_{{ key }}")},
+			"myValue",
+			map[string]string{
+				"app_mykey":              "myValue",
+				"app_mykey_CREATE_INDEX": "42",
+			},
+		},
+		{
+			"parse_yaml",
+			&PrefixConfig{ParseYAML: config.Bool(true)},
+			"a: 1\nb: 2\n",
+			map[string]string{
+				"mykey_a":            "1",
+				"mykey_b":            "2",
+				"mykey_CREATE_INDEX": "42",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.prefix.Path = config.String("app/my_service")
+			tc.prefix.EmitCreateIndex = config.Bool(true)
+			cfg := Config{
+				Prefixes: &PrefixConfigs{tc.prefix},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendPrefixes(env, r.dependencies[0].(*dependency.KVListQuery), []*dependency.KeyPair{
+				&dependency.KeyPair{
+					Key:         "mykey",
+					Value:       tc.value,
+					CreateIndex: 42,
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(env, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendPrefixes_upcase(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		global bool
+		prefix *bool
+		env    map[string]string
+	}{
+		{
+			"global",
+			true,
+			nil,
+			map[string]string{"FOO": "second", "BAR": "bar"},
+		},
+		{
+			"prefix",
+			false,
+			config.Bool(true),
+			map[string]string{"FOO": "second", "BAR": "bar"},
+		},
+		{
+			"prefix overrides global",
+			true,
+			config.Bool(false),
+			map[string]string{"Foo": "first", "foo": "second", "bar": "bar"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Upcase: config.Bool(tc.global),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:   config.String("app"),
+						Upcase: tc.prefix,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvq, err := dependency.NewKVListQuery("app")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendPrefixes(env, kvq, []*dependency.KeyPair{
+				&dependency.KeyPair{Key: "Foo", Value: "first"},
+				&dependency.KeyPair{Key: "foo", Value: "second"},
+				&dependency.KeyPair{Key: "bar", Value: "bar"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendPrefixes_sanitize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		replacement *string
+		key         string
+		expected    string
+	}{
+		{
+			"unicode",
+			nil,
+			"café:latte",
+			"caf__latte",
+		},
+		{
+			"leading_digit",
+			nil,
+			"1password",
+			"_1password",
+		},
+		{
+			"replacement",
+			config.String("x"),
+			"café:latte",
+			"cafxxlatte",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Sanitize:            config.Bool(true),
+				SanitizeReplacement: tc.replacement,
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app"),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvq, err := dependency.NewKVListQuery("app")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendPrefixes(env, kvq, []*dependency.KeyPair{
+				&dependency.KeyPair{Key: tc.key, Value: "value"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]string{tc.expected: "value"}
+			if !reflect.DeepEqual(env, expected) {
+				t.Fatalf("expected %v, got %v", expected, env)
+			}
+		})
+	}
+}
+
+func TestRunner_keyCase(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		keyCase  string
+		upcase   bool
+		expected []string
+	}{
+		{
+			"unset",
+			"",
+			false,
+			[]string{"MixedKey", "Web_address", "secret_App_MixedField"},
+		},
+		{
+			"unset_upcase",
+			"",
+			true,
+			[]string{"MIXEDKEY", "WEB_ADDRESS", "SECRET_APP_MIXEDFIELD"},
+		},
+		{
+			"preserve",
+			"preserve",
+			true,
+			[]string{"MixedKey", "Web_address", "secret_App_MixedField"},
+		},
+		{
+			"upper",
+			"upper",
+			false,
+			[]string{"MIXEDKEY", "WEB_ADDRESS", "SECRET_APP_MIXEDFIELD"},
+		},
+		{
+			"lower",
+			"lower",
+			true,
+			[]string{"mixedkey", "web_address", "secret_app_mixedfield"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			keyCase := config.String(tc.keyCase)
+			cfg := Config{
+				Sanitize: config.Bool(true),
+				Upcase:   config.Bool(tc.upcase),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:    config.String("app"),
+						KeyCase: keyCase,
+					},
+				},
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:    config.String("secret/App"),
+						KeyCase: keyCase,
+					},
+				},
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						Query:   config.String("Web"),
+						KeyCase: keyCase,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, d := range r.dependencies {
+				switch d.(type) {
+				case *dependency.KVListQuery:
+					r.Receive(d, []*dependency.KeyPair{
+						{Key: "MixedKey", Value: "a"},
+					})
+				case *dependency.CatalogServiceQuery:
+					r.Receive(d, []*dependency.CatalogService{
+						{ServiceID: "web1", ServiceName: "Web", ServiceAddress: "10.0.0.1"},
+					})
+				default:
+					r.Receive(d, &dependency.Secret{
+						Data: map[string]interface{}{"MixedField": "b"},
+					})
+				}
+			}
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range tc.expected {
+				if _, ok := r.env[key]; !ok {
+					t.Errorf("expected %s in %v", key, r.env)
+				}
+			}
+		})
+	}
+}
+
+func TestRunner_keyCase_invalid(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path:    config.String("app"),
+				KeyCase: config.String("title"),
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRunner_appendServices_upcase(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:  config.String("web"),
+				Upcase: config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csq, err := dependency.NewCatalogServiceQuery("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+		&dependency.CatalogService{
+			ServiceAddress: "10.0.0.1",
+			ServiceID:      "web1",
+			ServiceName:    "web",
+			ServicePort:    8080,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"WEB/ID":      "web1",
+		"WEB/NAME":    "web",
+		"WEB/ADDRESS": "10.0.0.1",
+		"WEB/TAG":     "",
+		"WEB/PORT":    "8080",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestRunner_transforms(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		transforms []string
+		value      string
+		expected   string
+		err        bool
+	}{
+		{
+			"trim then decode",
+			[]string{"trim", "base64-decode"},
+			"  aGVsbG8=\n",
+			"hello",
+			false,
+		},
+		{
+			"decode then normalize",
+			[]string{"base64-decode", "normalize-newlines"},
+			"YQ0KYg1j",
+			"a\nb\nc",
+			false,
+		},
+		{
+			"decode untrimmed",
+			[]string{"base64-decode", "trim"},
+			"  aGVsbG8=\n",
+			"",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:       config.String("app"),
+						Transforms: tc.transforms,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvq, err := dependency.NewKVListQuery("app")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			err = r.appendPrefixes(env, kvq, []*dependency.KeyPair{
+				&dependency.KeyPair{Key: "key", Value: tc.value},
+			})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+			if !tc.err && env["key"] != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, env["key"])
+			}
+		})
+	}
+}
+
+func TestRunner_trimSpace(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		trim     *bool
+		expected map[string]string
+	}{
+		{
+			"disabled",
+			nil,
+			map[string]string{
+				"newline":          "bar\n",
+				"spaces":           "  baz  ",
+				"multiline":        "\n a\n b \n",
+				"secret_app_token": " s3cr3t\r\n",
+			},
+		},
+		{
+			"enabled",
+			config.Bool(true),
+			map[string]string{
+				"newline":          "bar",
+				"spaces":           "baz",
+				"multiline":        "a\n b",
+				"secret_app_token": "s3cr3t",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("app"),
+						TrimSpace: tc.trim,
+					},
+				},
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("secret/app"),
+						TrimSpace: tc.trim,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "newline", Value: "bar\n"},
+				{Key: "spaces", Value: "  baz  "},
+				{Key: "multiline", Value: "\n a\n b \n"},
+			})
+			r.Receive(r.dependencies[1], &dependency.Secret{
+				Data: map[string]interface{}{"token": " s3cr3t\r\n"},
+			})
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(r.env, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, r.env)
+			}
+		})
+	}
+}
+
+func TestRunner_keyRetry(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		retry *config.RetryConfig
+		reads int32
+		err   bool
+	}{
+		{
+			"disabled",
+			nil,
+			0,
+			true,
+		},
+		{
+			"recovers",
+			&config.RetryConfig{
+				Backoff: config.TimeDuration(time.Millisecond),
+			},
+			2,
+			false,
+		},
+		{
+			"exhausted",
+			&config.RetryConfig{
+				Attempts: config.Int(1),
+				Backoff:  config.TimeDuration(time.Millisecond),
+			},
+			1,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The key is still being written on the first read again.
+			var reads int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/kv/app/foo" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				value := "YmFy"
+				if atomic.AddInt32(&reads, 1) == 1 {
+					value = "YmF"
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode([]map[string]interface{}{
+					{"Key": "app/foo", "Value": base64.StdEncoding.EncodeToString([]byte(value))},
+				})
+			}))
+			defer ts.Close()
+
+			clients := dependency.NewClientSet()
+			if err := clients.CreateConsulClient(&dependency.CreateConsulClientInput{
+				Address: strings.TrimPrefix(ts.URL, "http://"),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:       config.String("app"),
+						Transforms: []string{"base64-decode"},
+						KeyRetry:   tc.retry,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.clients = clients
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "foo", Value: "Ym"},
+				{Key: "baz", Value: "cXV4"},
+			})
+
+			// The render does not wait for the backoff, but is requested again
+			// once the key has been read again.
+			for i := 0; ; i++ {
+				_, err = r.Run()
+				if err != nil || r.env != nil {
+					break
+				}
+				if i == 10 {
+					t.Fatal("expected the render to finish")
+				}
+				select {
+				case <-r.renderCh:
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the key to be read again")
+				}
+			}
+			if n := atomic.LoadInt32(&reads); n != tc.reads {
+				t.Errorf("expected %d reads, got %d", tc.reads, n)
+			}
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]string{"foo": "bar", "baz": "qux"}
+			if !reflect.DeepEqual(r.env, expected) {
+				t.Errorf("expected %v, got %v", expected, r.env)
+			}
+		})
+	}
+}
+
+func TestRunner_unknownTransform(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:       config.String("secret/foo"),
+				Transforms: []string{"trim", "rot13"},
+			},
+		},
+	}
+	if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+		t.Fatal("expected an error for an unknown transform")
+	}
+}
+
+func TestRunner_appendPrefixes_rename(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path:     config.String("app/my_service"),
+				NoPrefix: config.Bool(false),
+				Rename: []*RenameRule{
+					&RenameRule{
+						Match:   config.String("^app_my_service_"),
+						Replace: config.String(""),
+					},
+					&RenameRule{
+						Match:   config.String("[.-]"),
+						Replace: config.String("_"),
+					},
+				},
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvq, err := dependency.NewKVListQuery("app/my_service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendPrefixes(env, kvq, []*dependency.KeyPair{
+		&dependency.KeyPair{Key: "db.host", Value: "localhost"},
+		&dependency.KeyPair{Key: "max-conns", Value: "10"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"db_host":   "localhost",
+		"max_conns": "10",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
+
+func TestRunner_renameInvalidMatch(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/my_service"),
+				Rename: []*RenameRule{
+					&RenameRule{
+						Match: config.String("(unclosed"),
+					},
+				},
+			},
+		},
+	}
+	_, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err == nil {
+		t.Fatal("expected an error for an invalid match")
+	}
+	if !strings.Contains(err.Error(), "app/my_service") {
+		t.Errorf("expected the error to name the prefix, got %q", err)
+	}
+}
+
+func TestRunner_trimKeyNames(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		data []*dependency.KeyPair
+		env  map[string]string
+		err  bool
+	}{
+		{
+			"padded",
+			[]*dependency.KeyPair{
+				{Key: " foo  ", Value: "bar"},
+			},
+			map[string]string{"foo": "bar"},
+			false,
+		},
+		{
+			"collision",
+			[]*dependency.KeyPair{
+				{Key: "foo", Value: "bar"},
+				{Key: "foo ", Value: "baz"},
+			},
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				TrimKeyNames: config.Bool(true),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app/foo"),
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			err = r.appendPrefixes(env, r.dependencies[0].(*dependency.KVListQuery), tc.data)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+			if !tc.err && !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("expected %v, got %v", tc.env, env)
+			}
+		})
+	}
+}
+
+func TestRunner_appendServices(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name           string
+		query          string
+		config         Config
+		data           []*dependency.CatalogService
+		keyValue       map[string]string
+		serviceID      string
+		serviceName    string
+		serviceAddress string
+		serviceTag     string
+		servicePort    string
+	}{
+		{
+			name:   "service appends data",
+			query:  "service",
+			config: Config{},
+			data: []*dependency.CatalogService{
+				&dependency.CatalogService{
+					ServiceID:      "id",
+					ServiceName:    "foo",
+					ServiceAddress: "address",
+					ServiceTags:    dependency.ServiceTags{"tag1", "tag2"},
+					ServicePort:    8080,
+				},
+			},
+			keyValue: map[string]string{
+				"foo/id":      "id",
+				"foo/name":    "foo",
+				"foo/address": "address",
+				"foo/tag":     "tag1,tag2",
+				"foo/port":    "8080",
+			},
+			serviceID:      "foo/id",
+			serviceName:    "foo/name",
+			serviceAddress: "foo/address",
+			serviceTag:     "foo/tag",
+			servicePort:    "foo/port",
+		},
+		{
+			name:   "service appends data",
+			query:  "service",
+			config: Config{},
+			data: []*dependency.CatalogService{
+				&dependency.CatalogService{
+					ServiceID:      "fail_id",
+					ServiceName:    "foo",
+					ServiceAddress: "fail_address",
+					ServiceTags:    dependency.ServiceTags{"tag1"},
+					ServicePort:    8081,
+				},
+				&dependency.CatalogService{
+					ServiceID:      "id",
+					ServiceName:    "foo",
+					ServiceAddress: "address",
+					ServiceTags:    dependency.ServiceTags{"tag1", "tag2"},
+					ServicePort:    8080,
+				},
+			},
+			keyValue: map[string]string{
+				"foo/id":      "id",
+				"foo/name":    "foo",
+				"foo/address": "address",
+				"foo/tag":     "tag1,tag2",
+				"foo/port":    "8080",
+			},
+			serviceID:      "foo/id",
+			serviceName:    "foo/name",
+			serviceAddress: "foo/address",
+			serviceTag:     "foo/tag",
+			servicePort:    "foo/port",
+		},
+		{
+			name:  "service appends data with a custom format",
+			query: "service",
+			config: Config{
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						Query:         config.String("service"),
+						FormatId:      config.String("{{key}}/{{service}}/test"),
+						FormatName:    config.String("{{key}}/{{service}}/test"),
+						FormatAddress: config.String("{{key}}/{{service}}/test"),
+						FormatTag:     config.String("{{key}}/{{service}}/test"),
+						FormatPort:    config.String("{{key}}/{{service}}/test"),
+					},
+				},
+			},
+			data: []*dependency.CatalogService{
+				&dependency.CatalogService{
+					ServiceID:      "id",
+					ServiceName:    "foo",
+					ServiceAddress: "address",
+					ServiceTags:    dependency.ServiceTags{"tag1", "tag2"},
+					ServicePort:    8080,
+				},
+			},
+			keyValue: map[string]string{
+				"id/foo/test":      "id",
+				"name/foo/test":    "foo",
+				"address/foo/test": "address",
+				"tag/foo/test":     "tag1,tag2",
+				"port/foo/test":    "8080",
+			},
+			serviceID:      "id/foo/test",
+			serviceName:    "name/foo/test",
+			serviceAddress: "address/foo/test",
+			serviceTag:     "tag/foo/test",
+			servicePort:    "port/foo/test",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig().Merge(&tc.config)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			csq, err := dependency.NewCatalogServiceQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := make(map[string]string)
+			appendError := r.appendServices(env, nil, csq, tc.data)
+			if appendError != nil {
+				t.Fatalf("got err: %s", appendError)
+			}
+
+			if len(env) != 5 {
+				t.Fatalf("Expected only 1 value in this test")
+			}
+
+			value, ok := env[tc.serviceID]
+			if !ok {
+				t.Fatalf("expected (%s) key, but was not found", tc.serviceID)
+			}
+			if ok && value != tc.keyValue[tc.serviceID] {
+				t.Fatalf("values didn't match, expected (%s), got (%s)", tc.keyValue[tc.serviceID], value)
+			}
+
+			value, ok = env[tc.serviceName]
+			if !ok {
+				t.Fatalf("expected (%s) key, but was not found", tc.serviceName)
+			}
+			if ok && value != tc.keyValue[tc.serviceName] {
+				t.Fatalf("values didn't match, expected (%s), got (%s)", tc.keyValue[tc.serviceName], value)
+			}
+
+			value, ok = env[tc.serviceAddress]
+			if !ok {
+				t.Fatalf("expected (%s) key, but was not found", tc.serviceAddress)
+			}
+			if ok && value != tc.keyValue[tc.serviceAddress] {
+				t.Fatalf("values didn't match, expected (%s), got (%s)", tc.keyValue[tc.serviceAddress], value)
+			}
+
+			value, ok = env[tc.serviceTag]
+			if !ok {
+				t.Fatalf("expected (%s) key, but was not found", tc.serviceTag)
+			}
+			if ok && value != tc.keyValue[tc.serviceTag] {
+				t.Fatalf("values didn't match, expected (%s), got (%s)", tc.keyValue[tc.serviceTag], value)
+			}
+
+			value, ok = env[tc.servicePort]
+			if !ok {
+				t.Fatalf("expected (%s) key, but was not found", tc.servicePort)
+			}
+			if ok && value != tc.keyValue[tc.servicePort] {
+				t.Fatalf("values didn't match, expected (%s), got (%s)", tc.keyValue[tc.servicePort], value)
+			}
+
+		})
+	}
+}
+
+func TestRunner_appendServices_instance(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		instance string
+		sort     string
+		id       string
+	}{
+		{"default_last_wins", "", "", "b"},
+		{"first", "first", "", "c"},
+		{"last", "last", "", "b"},
+		{"sort_port_first", "first", "port", "a"},
+		{"sort_address_last", "last", "address", "c"},
+		{"sort_id_index", "1", "id", "b"},
+		{"index_past_last", "3", "", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						Query:    config.String("foo"),
+						Instance: config.String(tc.instance),
+						Sort:     config.String(tc.sort),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csq, err := dependency.NewCatalogServiceQuery("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+				{ServiceID: "c", ServiceName: "foo", ServiceAddress: "10.0.0.3", ServicePort: 8082},
+				{ServiceID: "a", ServiceName: "foo", ServiceAddress: "10.0.0.1", ServicePort: 8080},
+				{ServiceID: "b", ServiceName: "foo", ServiceAddress: "10.0.0.2", ServicePort: 8081},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if env["foo/id"] != tc.id {
+				t.Errorf("expected instance %q, got %q", tc.id, env["foo/id"])
+			}
+		})
+	}
+
+	for _, s := range []*ServiceConfig{
+		{Query: config.String("foo"), Instance: config.String("middle")},
+		{Query: config.String("foo"), Instance: config.String("-1")},
+		{Query: config.String("foo"), Sort: config.String("weight")},
+	} {
+		cfg := Config{Services: &ServiceConfigs{s}}
+		if _, err := NewRunner(DefaultConfig().Merge(&cfg), true); err == nil {
+			t.Errorf("expected an error for %#v", s)
+		}
+	}
+}
+
+func TestRunner_appendServices_srv(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:     config.String("web"),
+				FormatSRV: config.String("_{{service}}._tcp/{{key}}"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csq, err := dependency.NewCatalogServiceQuery("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+		&dependency.CatalogService{
+			Address:     "10.0.0.1",
+			ServiceID:   "web1",
+			ServiceName: "web",
+			ServicePort: 8080,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"_web._tcp/0/priority": "1",
+		"_web._tcp/0/weight":   "1",
+		"_web._tcp/0/port":     "8080",
+		"_web._tcp/0/target":   "10.0.0.1",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, env[k])
+		}
+	}
+}
+
+func TestRunner_appendServices_nodeStatus(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:        config.String("web"),
+				FormatNode:   config.String("{{key}}/{{service}}/test"),
+				FormatStatus: config.String("{{key}}/{{service}}/test"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csq, err := dependency.NewCatalogServiceQuery("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The status is read from the health of the service, watched alongside
+	// it.
+	h, ok := r.healthQueries[csq.String()]
+	if !ok {
+		t.Fatal("expected a health dependency for the service")
+	}
+	r.Receive(h, []*dependency.HealthService{
+		&dependency.HealthService{
+			ID:     "web1",
+			Node:   "node1",
+			Status: "warning",
+		},
+	})
+
+	env := make(map[string]string)
+	if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+		&dependency.CatalogService{
+			Node:        "node1",
+			ServiceID:   "web1",
+			ServiceName: "web",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"node/web/test":   "node1",
+		"status/web/test": "warning",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, env[k])
+		}
+	}
+}
+
+func TestRunner_appendServices_taggedAddress(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:               config.String("web"),
+				FormatTaggedAddress: config.String("{{service}}/{{addr_type}}_address"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csq, err := dependency.NewCatalogServiceQuery("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+		&dependency.CatalogService{
+			Address:     "10.0.0.1",
+			ServiceID:   "web1",
+			ServiceName: "web",
+			TaggedAddresses: map[string]string{
+				"lan": "10.0.0.1",
+				"wan": "203.0.113.1",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"web/lan_address": "10.0.0.1",
+		"web/wan_address": "203.0.113.1",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, env[k])
+		}
+	}
+}
+
+func TestRunner_appendServices_groupByTag(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:      config.String("app"),
+				GroupByTag: config.String("group="),
+				Upcase:     config.Bool(true),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csq, err := dependency.NewCatalogServiceQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+		&dependency.CatalogService{
+			ServiceID:      "app1",
+			ServiceName:    "app",
+			ServiceAddress: "10.0.0.1",
+			ServicePort:    80,
+			ServiceTags:    dependency.ServiceTags{"v1", "group=web"},
+		},
+		&dependency.CatalogService{
+			ServiceID:      "app2",
+			ServiceName:    "app",
+			ServiceAddress: "10.0.0.2",
+			ServicePort:    5432,
+			ServiceTags:    dependency.ServiceTags{"group=db"},
+		},
+		&dependency.CatalogService{
+			ServiceID:      "app3",
+			ServiceName:    "app",
+			ServiceAddress: "10.0.0.3",
+			ServicePort:    80,
+			ServiceTags:    dependency.ServiceTags{"group=web", "group=db"},
+		},
+		&dependency.CatalogService{
+			ServiceID:      "app4",
+			ServiceName:    "app",
+			ServiceAddress: "10.0.0.4",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"WEB_0_ID":      "app1",
+		"WEB_0_ADDRESS": "10.0.0.1",
+		"WEB_0_PORT":    "80",
+		"WEB_1_ID":      "app3",
+		"WEB_1_ADDRESS": "10.0.0.3",
+		"DB_0_ID":       "app2",
+		"DB_0_ADDRESS":  "10.0.0.2",
+		"DB_0_PORT":     "5432",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, env[k])
+		}
+	}
+	if _, ok := env["DB_1_ID"]; ok {
+		t.Errorf("expected only the first group tag to be used, got %v", env)
+	}
+}
+
+func TestRunner_appendServices_tagFilter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		filter   string
+		explode  bool
+		tags     []string
+		expected map[string]string
+	}{
+		{
+			"no_filter",
+			"",
+			false,
+			[]string{"v1", "version=1.2", "primary"},
+			map[string]string{"WEB_TAG": "v1,version=1.2,primary"},
+		},
+		{
+			"filter",
+			"version=*",
+			false,
+			[]string{"v1", "version=1.2", "primary", "version=1.3"},
+			map[string]string{"WEB_TAG": "version=1.2,version=1.3"},
+		},
+		{
+			"filter_no_match",
+			"version=*",
+			false,
+			[]string{"v1", "primary"},
+			map[string]string{"WEB_TAG": ""},
+		},
+		{
+			"explode",
+			"",
+			true,
+			[]string{"v1", "primary"},
+			map[string]string{"WEB_TAG_0": "v1", "WEB_TAG_1": "primary"},
+		},
+		{
+			"filter_explode",
+			"version=*",
+			true,
+			[]string{"v1", "version=1.2", "primary", "version=1.3"},
+			map[string]string{"WEB_TAG_0": "version=1.2", "WEB_TAG_1": "version=1.3"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Sanitize: config.Bool(true),
+				Upcase:   config.Bool(true),
+				Services: &ServiceConfigs{
+					&ServiceConfig{
+						Query:      config.String("web"),
+						TagFilter:  config.String(tc.filter),
+						TagExplode: config.Bool(tc.explode),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csq, err := dependency.NewCatalogServiceQuery("web")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			if err := r.appendServices(env, nil, csq, []*dependency.CatalogService{
+				&dependency.CatalogService{
+					ServiceID:   "web1",
+					ServiceName: "web",
+					ServiceTags: dependency.ServiceTags(tc.tags),
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			for k := range env {
+				if strings.HasPrefix(k, "WEB_TAG") {
+					if _, ok := tc.expected[k]; !ok {
+						t.Errorf("unexpected %s in %v", k, env)
+					}
+				}
+			}
+			for k, v := range tc.expected {
+				if got, ok := env[k]; !ok || got != v {
+					t.Errorf("expected %s to be %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunner_stickyInstances(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Exec: &config.ExecConfig{
+			Command: config.String("sleep 10"),
+		},
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:           config.String("web"),
+				StickyInstances: config.TimeDuration(30 * time.Second),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	d := r.dependencies[0]
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	web := []*dependency.CatalogService{
+		{ServiceID: "web1", ServiceName: "web", ServiceAddress: "10.0.0.1"},
+	}
+
+	steps := []struct {
+		name      string
+		after     time.Duration
+		instances []*dependency.CatalogService
+		address   string
+		restarts  int
+	}{
+		{"initial", 0, web, "10.0.0.1", 0},
+		{"flap_empty", 10 * time.Second, nil, "10.0.0.1", 0},
+		{"recovered", 20 * time.Second, web, "10.0.0.1", 0},
+		// The last render with instances is older than the window, which
+		// starts when the service goes empty.
+		{"empty_after_stable", 100 * time.Second, nil, "10.0.0.1", 0},
+		{"empty_within_window", 125 * time.Second, nil, "10.0.0.1", 0},
+		{"empty_past_window", 131 * time.Second, nil, "", 1},
+	}
+
+	for _, step := range steps {
+		now := start.Add(step.after)
+		r.clock = func() time.Time { return now }
+
+		r.Receive(d, step.instances)
+		if _, err := r.Run(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+
+		if got := r.env["web/address"]; got != step.address {
+			t.Errorf("%s: expected address %q, got %q", step.name, step.address, got)
+		}
+		if r.restarts != step.restarts {
+			t.Errorf("%s: expected %d restarts, got %d", step.name, step.restarts, r.restarts)
+		}
+	}
+}
+
+func TestRunner_appendServices_sharedQuery(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:         config.String("web"),
+				FormatAddress: config.String("WEB_HOST"),
+			},
+			&ServiceConfig{
+				Query:      config.String("web"),
+				FormatPort: config.String("WEB_PORT"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.dependencies) != 1 {
+		t.Fatalf("expected a single query, got %d", len(r.dependencies))
+	}
+
+	env := make(map[string]string)
+	if err := r.appendServices(env, nil, r.dependencies[0].(*dependency.CatalogServiceQuery),
+		[]*dependency.CatalogService{
+			&dependency.CatalogService{
+				ServiceAddress: "10.0.0.1",
+				ServiceID:      "web1",
+				ServiceName:    "web",
+				ServicePort:    8080,
+			},
+		}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"WEB_HOST": "10.0.0.1",
+		"WEB_PORT": "8080",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, env[k])
+		}
+	}
+}
+
+func TestRunner_configEnv(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name      string
+		env       map[string]string
+		pristine  bool
+		custom    []string
+		whitelist []string
+		blacklist []string
+		output    map[string]string
+	}{
+		{
+			name:     "pristine env with no custom vars yields empty env",
+			env:      map[string]string{"PATH": "/bin"},
+			pristine: true,
+			output:   map[string]string{},
+		},
+		{
+			name:     "pristine env with custom vars only keeps custom vars",
+			env:      map[string]string{"PATH": "/bin"},
+			pristine: true,
+			custom:   []string{"GOPATH=/usr/go"},
+			output:   map[string]string{"GOPATH": "/usr/go"},
+		},
+		{
+			name:   "custom vars overwrite input vars",
+			env:    map[string]string{"PATH": "/bin"},
+			custom: []string{"PATH=/usr/bin"},
+			output: map[string]string{"PATH": "/usr/bin"},
+		},
+		{
+			name:      "whitelist filters input by key",
+			env:       map[string]string{"GOPATH": "/usr/go", "GO111MODULES": "true", "PATH": "/bin"},
+			whitelist: []string{"GO*"},
+			output:    map[string]string{"GOPATH": "/usr/go", "GO111MODULES": "true"},
+		},
+		{
+			name:      "blacklist takes precedence over whitelist",
+			env:       map[string]string{"GOPATH": "/usr/go", "PATH": "/bin", "EDITOR": "vi"},
+			whitelist: []string{"GO*", "EDITOR"},
+			blacklist: []string{"GO*"},
+			output:    map[string]string{"EDITOR": "vi"},
+		},
+		{
+			name:      "custom takes precedence over blacklist",
+			env:       map[string]string{"PATH": "/bin", "EDITOR": "vi"},
+			blacklist: []string{"EDITOR*"},
+			custom:    []string{"EDITOR=nvim"},
+			output:    map[string]string{"EDITOR": "nvim", "PATH": "/bin"},
+		},
+		{
+			name:   "inherited envconsul vars are stripped",
+			env:    map[string]string{"PATH": "/bin", "ENVCONSUL_PID": "123"},
+			output: map[string]string{"PATH": "/bin"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Env: &config.EnvConfig{
+						Pristine:  &tc.pristine,
+						Blacklist: tc.blacklist,
+						Whitelist: tc.whitelist,
+						Custom:    tc.custom,
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := r.applyConfigEnv(tc.env)
+
+			if !reflect.DeepEqual(result, tc.output) {
+				t.Fatalf("expected: %v\n got: %v", tc.output, result)
+			}
+		})
+	}
+}
+
+func TestRunner_outputDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "envconsul-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		Output: &OutputConfig{
+			Dir: config.String(dir),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:     config.String("secret/foo"),
+				NoPrefix: config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kv, secret := r.dependencies[0], r.dependencies[1]
+	r.Receive(kv, []*dependency.KeyPair{{Key: "a", Value: "1"}})
+
+	cases := []struct {
+		name   string
+		secret map[string]interface{}
+		files  map[string]string
+	}{
+		{
+			"initial",
+			map[string]interface{}{"user": "admin", "password": "hunter2"},
+			map[string]string{"user": "admin", "password": "hunter2"},
+		},
+		{
+			"changed",
+			map[string]interface{}{"password": "hunter3"},
+			map[string]string{"password": "hunter3"},
+		},
+	}
+
+	for _, tc := range cases {
+		r.Receive(secret, &dependency.Secret{Data: tc.secret})
+		if _, err := r.Run(); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]string)
+		for _, info := range infos {
+			if info.Mode() != DefaultOutputDirMode {
+				t.Errorf("%s: expected %s to have mode %s, got %s",
+					tc.name, info.Name(), DefaultOutputDirMode, info.Mode())
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[info.Name()] = string(b)
+		}
+		if !reflect.DeepEqual(files, tc.files) {
+			t.Errorf("%s: expected files %v, got %v", tc.name, tc.files, files)
+		}
+
+		// The variables of secrets hold the paths of their files.
+		expected := map[string]string{"a": "1"}
+		for k := range tc.files {
+			expected[k] = filepath.Join(dir, k)
+		}
+		if !reflect.DeepEqual(r.env, expected) {
+			t.Errorf("%s: expected env %v, got %v", tc.name, expected, r.env)
+		}
+	}
+}
+
+func TestRunner_deltaFile(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "envconsul-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cfg := Config{
+		DeltaFile: config.String(f.Name()),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/foo"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kv, secret := r.dependencies[0], r.dependencies[1]
+
+	cases := []struct {
+		name   string
+		kv     []*dependency.KeyPair
+		secret map[string]interface{}
+		delta  string
+	}{
+		{
+			"initial",
+			[]*dependency.KeyPair{
+				{Key: "a", Value: "1"},
+				{Key: "b", Value: "2"},
+			},
+			map[string]interface{}{"password": "hunter2"},
+			"+a=1\n+b=2\n+secret_foo_password=***\n",
+		},
+		{
+			"changed",
+			[]*dependency.KeyPair{
+				{Key: "a", Value: "1"},
+				{Key: "c", Value: "3"},
+			},
+			map[string]interface{}{"password": "hunter3"},
+			"-b\n+c=3\n~secret_foo_password=***\n",
+		},
+	}
+
+	for _, tc := range cases {
+		r.Receive(kv, tc.kv)
+		r.Receive(secret, &dependency.Secret{Data: tc.secret})
+		if _, err := r.Run(); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.delta {
+			t.Errorf("%s: expected delta %q, got %q", tc.name, tc.delta, string(b))
+		}
+	}
+}
+
+// TestRunner_logEnvDiff replaces the output of the standard logger, so it must
+// not run in parallel with other tests.
+func TestRunner_logEnvDiff(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := Config{
+		LogEnvDiff: config.Bool(true),
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/foo"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kv, secret := r.dependencies[0], r.dependencies[1]
+
+	r.Receive(kv, []*dependency.KeyPair{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+	})
+	r.Receive(secret, &dependency.Secret{Data: map[string]interface{}{"password": "hunter2"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	r.Receive(kv, []*dependency.KeyPair{
+		{Key: "a", Value: "10"},
+		{Key: "c", Value: "3"},
+	})
+	r.Receive(secret, &dependency.Secret{Data: map[string]interface{}{"password": "hunter3"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, line := range []string{
+		"(runner)   ~a=10\n",
+		"(runner)   -b\n",
+		"(runner)   +c=3\n",
+		"(runner)   ~secret_foo_password=***\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected log to contain %q, got %q", line, out)
+		}
+	}
+}
+
+func TestRunner_probe(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Exec: &config.ExecConfig{
+			Command: config.String("sleep 10"),
+		},
+		HealthProbe: &HealthProbeConfig{
+			Command:          config.String("false"),
+			Interval:         config.TimeDuration(time.Second),
+			FailureThreshold: config.Int(2),
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	first := r.child
+
+	probe := func() error {
+		return runProbe(config.StringVal(c.HealthProbe.Command),
+			config.TimeDurationVal(c.HealthProbe.Timeout))
+	}
+
+	generation := r.childGeneration
+	exitCh, err := r.probeResult(generation, probe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCh != nil || r.child != first {
+		t.Fatal("expected child to keep running below the failure threshold")
+	}
+
+	exitCh, err = r.probeResult(generation, probe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCh == nil || r.child == first {
+		t.Fatal("expected child to be restarted at the failure threshold")
+	}
+	if r.probeFailures != 0 {
+		t.Errorf("expected failures to reset after restart, got %d", r.probeFailures)
+	}
+
+	// A probe of the previous child which finishes after the restart is not
+	// counted against the new one.
+	if _, err := r.probeResult(generation, probe()); err != nil {
+		t.Fatal(err)
+	}
+	if r.probeFailures != 0 {
+		t.Errorf("expected a stale probe to be dropped, got %d failures", r.probeFailures)
+	}
+}
+
+func TestRunProbe_timeout(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	if err := runProbe("sleep 10", 100*time.Millisecond); err == nil {
+		t.Fatal("expected a probe which does not exit in time to fail")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected the probe to be killed after the timeout, took %s", d)
+	}
+}
+
+func TestRunner_execShell(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		command string
+		signal  os.Signal
+		code    int
+	}{
+		{
+			"expansion_and_pipes",
+			`echo "$FOO" | grep -q bar && exit 3`,
+			nil,
+			3,
+		},
+		{
+			"signal",
+			`trap 'exit 4' USR1; while :; do sleep 0.1; done`,
+			syscall.SIGUSR1,
+			4,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String(tc.command),
+				},
+				ExecShell: config.String("/bin/sh"),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app"),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			d := r.dependencies[0]
+			r.Receive(d, []*dependency.KeyPair{{Key: "FOO", Value: "bar"}})
+			exitCh, err := r.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.signal != nil {
+				// Give the shell time to install its trap.
+				time.Sleep(500 * time.Millisecond)
+				if err := r.child.Signal(tc.signal); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case code := <-exitCh:
+				if code != tc.code {
+					t.Errorf("expected exit code %d, got %d", tc.code, code)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the child to exit")
+			}
+		})
+	}
+}
+
+func TestRunner_watchFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	consul, stop := testConsulKV(t)
+	defer stop()
+
+	// The child records each time it starts.
+	starts := filepath.Join(dir, "starts")
+	cfg := Config{
+		Consul: consul,
+		Exec: &config.ExecConfig{
+			Command: config.String(fmt.Sprintf("sh -c 'echo >> %s; exec sleep 10'", starts)),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+		WatchFiles: []string{path},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	go r.Start()
+
+	waitStarts := func(n int) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			b, _ := ioutil.ReadFile(starts)
+			if strings.Count(string(b), "\n") >= n {
+				return
+			}
+			select {
+			case err := <-r.ErrCh:
+				t.Fatal(err)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		t.Fatalf("timed out waiting for %d starts of the child", n)
+	}
+
+	waitStarts(1)
+	if err := ioutil.WriteFile(path, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitStarts(2)
+}
+
+// fakeRestartLock is a restartLock which grants a slot each time a value is
+// sent on grantCh.
+type fakeRestartLock struct {
+	grantCh  chan struct{}
+	releases int32
+}
+
+func (l *fakeRestartLock) acquire(stopCh <-chan struct{}) (bool, error) {
+	select {
+	case <-l.grantCh:
+		return true, nil
+	case <-stopCh:
+		return false, nil
+	}
+}
+
+func (l *fakeRestartLock) release() error {
+	atomic.AddInt32(&l.releases, 1)
+	return nil
+}
+
+func TestRunner_restartCoordinationLock(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Exec: &config.ExecConfig{
+			Command: config.String("sleep 10"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	lock := &fakeRestartLock{grantCh: make(chan struct{})}
+	r.restartLock = lock
+
+	d := r.dependencies[0]
+	r.Receive(d, []*dependency.KeyPair{{Key: "a", Value: "1"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	first := r.child
+	if first == nil {
+		t.Fatal("expected the first child to start without the lock")
+	}
+
+	// The render does not wait for a slot, and the child keeps running until
+	// one is held.
+	r.Receive(d, []*dependency.KeyPair{{Key: "a", Value: "2"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if r.child != first {
+		t.Fatal("expected the restart to wait for the lock")
+	}
+	select {
+	case err := <-r.restartLockCh:
+		t.Fatalf("expected no slot to be held yet, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lock.grantCh <- struct{}{}
+	select {
+	case err := <-r.restartLockCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lock to be acquired")
+	}
+	if _, err := r.restartChild(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.child == first {
+		t.Error("expected the child to be restarted")
+	}
+	if n := atomic.LoadInt32(&lock.releases); n != 1 {
+		t.Errorf("expected the slot to be released once, got %d", n)
+	}
+}
+
+func TestRunner_restartCooldown(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Exec: &config.ExecConfig{
+			Command: config.String("sleep 10"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+		RestartCooldown: &RestartCooldownConfig{
+			Restarts: config.Int(2),
+			Window:   config.TimeDuration(time.Minute),
+			Cooldown: config.TimeDuration(200 * time.Millisecond),
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	d := r.dependencies[0]
+	render := func(v string) {
+		r.Receive(d, []*dependency.KeyPair{{Key: "a", Value: v}})
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second restart within the window starts the cooldown.
+	for _, v := range []string{"1", "2", "3"} {
+		render(v)
+	}
+	if r.restarts != 2 {
+		t.Fatalf("expected 2 restarts, got %d", r.restarts)
+	}
+
+	// Changes during the cooldown are deferred.
+	deferred := r.child
+	for _, v := range []string{"4", "5"} {
+		render(v)
+	}
+	if r.child != deferred || r.restarts != 2 {
+		t.Fatalf("expected the restarts to be deferred, got %d restarts", r.restarts)
+	}
+
+	select {
+	case <-r.cooldownCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the cooldown to end")
+	}
+	if _, err := r.endRestartCooldown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deferred changes are applied in one restart.
+	if r.child == deferred {
+		t.Error("expected the child to be restarted after the cooldown")
+	}
+	if r.restarts != 3 {
+		t.Errorf("expected 3 restarts, got %d", r.restarts)
+	}
+	if v := r.env["a"]; v != "5" {
+		t.Errorf("expected the latest value, got %q", v)
+	}
+}
+
+func TestRunner_retryFirstFetch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		failures int32
+		attempts int
+		err      string
+	}{
+		{
+			"recovers",
+			2,
+			3,
+			"",
+		},
+		{
+			"gives_up",
+			10,
+			2,
+			"giving up after 3 attempts: vault.read(secret/foo)",
+		},
+		{
+			"disabled",
+			10,
+			0,
+			"fetch failed",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var reads int32
+			clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/secret/foo" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if atomic.AddInt32(&reads, 1) <= tc.failures {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				writeVaultData(w, map[string]interface{}{"bar": "baz"})
+			}))
+			defer stop()
+
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("secret/foo"),
+					},
+				},
+			}
+			if tc.attempts > 0 {
+				cfg.OnceRetry = &config.RetryConfig{
+					Attempts: config.Int(tc.attempts),
+					Backoff:  config.TimeDuration(time.Millisecond),
+				}
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+			r.clients = clients
+
+			err = r.retryFirstFetch(fmt.Errorf("fetch failed"))
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := r.data[r.dependencies[0].String()]; !ok {
+					t.Error("expected the secret to be fetched")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestRunner_errored(t *testing.T) {
+	t.Parallel()
+
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/good":
+			writeVaultData(w, map[string]interface{}{"foo": "bar"})
+		case "/v1/secret/bad":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/good"),
+			},
+			&PrefixConfig{
+				Path: config.String("secret/bad"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range r.dependencies {
+		(&trackedDependency{Dependency: d, runner: r}).Fetch(clients, nil)
+	}
+
+	if v := r.emittedEnv()[EnvErrored]; v != "secret/bad" {
+		t.Errorf("expected %s to be %q, got %q", EnvErrored, "secret/bad", v)
+	}
+}
+
+func TestRunner_restartCount(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EmitRestartCount: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	for i, v := range []string{"a", "b", "c"} {
+		r.Receive(r.dependencies[0], []*dependency.KeyPair{
+			{Key: "key", Value: v},
+		})
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := strconv.Itoa(i)
+		if count := r.emittedEnv()[EnvRestartCount]; count != expected {
+			t.Errorf("expected %s to be %q, got %q", EnvRestartCount, expected, count)
+		}
+	}
+}
+
+func TestRunner_reloadSignal(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		changed  []int
+		restarts int
+	}{
+		{
+			"signal",
+			[]int{0},
+			0,
+		},
+		{
+			"no_signal",
+			[]int{1},
+			1,
+		},
+		{
+			"signal_and_no_signal",
+			[]int{0, 1},
+			1,
+		},
+		{
+			"different_signals",
+			[]int{0, 2},
+			1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("sleep 10"),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:         config.String("app/a"),
+						ReloadSignal: config.Signal(syscall.SIGUSR1),
+					},
+					&PrefixConfig{
+						Path: config.String("app/b"),
+					},
+					&PrefixConfig{
+						Path:         config.String("app/c"),
+						ReloadSignal: config.Signal(syscall.SIGUSR2),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			for i, d := range r.dependencies {
+				r.Receive(d, []*dependency.KeyPair{
+					{Key: fmt.Sprintf("key%d", i), Value: "a"},
+				})
+			}
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, i := range tc.changed {
+				r.Receive(r.dependencies[i], []*dependency.KeyPair{
+					{Key: fmt.Sprintf("key%d", i), Value: "b"},
+				})
+			}
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.restarts != tc.restarts {
+				t.Errorf("expected %d restarts, got %d", tc.restarts, r.restarts)
+			}
+		})
+	}
+}
+
+func TestRunner_refetch(t *testing.T) {
+	t.Parallel()
+
+	var value atomic.Value
+	value.Store("a")
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/foo":
+			writeVaultData(w, map[string]interface{}{"bar": value.Load()})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	f, err := ioutil.TempFile("", "envconsul-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cfg := Config{
+		Output: &OutputConfig{
+			Path: config.String(f.Name()),
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/foo"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	r.clients = clients
+
+	// Requests made while one is pending are coalesced.
+	for i := 0; i < 3; i++ {
+		r.Refetch()
+	}
+	if n := len(r.refetchCh); n != 1 {
+		t.Fatalf("expected 1 pending re-fetch, got %d", n)
+	}
+
+	for _, v := range []string{"a", "b"} {
+		value.Store(v)
+		r.refetch()
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.env["secret_foo_bar"]; got != v {
+			t.Errorf("expected %q, got %q", v, got)
+		}
+	}
+}
+
+func TestRunner_outputFile(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{
+			OutputFormatDotenv,
+			"a=\"it's \\\"quoted\\\"\\nsecond line\"\nb=\"two words\"\n",
+		},
+		{
+			OutputFormatJSON,
+			"{\n  \"a\": \"it's \\\"quoted\\\"\\nsecond line\",\n  \"b\": \"two words\"\n}\n",
+		},
+		{
+			OutputFormatExport,
+			"export a='it'\\''s \"quoted\"\nsecond line'\nexport b='two words'\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "envconsul-output")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+
+			// No command is given, so only the output file is written.
+			cfg := Config{
+				Output: &OutputConfig{
+					Path:   config.String(f.Name()),
+					Format: config.String(tc.format),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app/foo"),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "a", Value: "it's \"quoted\"\nsecond line"},
+				{Key: "b", Value: "two words"},
+			})
+			exitCh, err := r.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exitCh != nil || r.child != nil {
+				t.Fatal("expected no child process")
+			}
+
+			b, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
+
+func TestFormatBatch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		env      map[string]string
+		expected string
+		err      bool
+	}{
+		{
+			"spaces_and_percent",
+			map[string]string{
+				"b": "two words",
+				"a": "100% & %PATH%",
+			},
+			"set \"a=100%% & %%PATH%%\"\r\nset \"b=two words\"\r\n",
+			false,
+		},
+		{
+			"line_break",
+			map[string]string{
+				"a": "first\nsecond",
+			},
+			"",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := formatBatch(tc.env)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
+
+func TestFormatDotenvQuoted(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"a": "two words",
+		"b": "plain",
+	}
+
+	cases := []struct {
+		quoting  string
+		env      map[string]string
+		expected string
+		err      bool
+	}{
+		{
+			DotenvQuotingAlways,
+			env,
+			"a=\"two words\"\nb=\"plain\"\n",
+			false,
+		},
+		{
+			DotenvQuotingNever,
+			env,
+			"a=two words\nb=plain\n",
+			false,
+		},
+		{
+			DotenvQuotingWhenNeeded,
+			env,
+			"a=\"two words\"\nb=plain\n",
+			false,
+		},
+		{
+			DotenvQuotingNever,
+			map[string]string{"a": "first\nsecond"},
+			"",
+			true,
+		},
+		{
+			DotenvQuotingAlways,
+			map[string]string{
+				"a": "pa$${word}",
+				"b": "naïve ☃",
+				"c": `say "hi" \ bye`,
+				"d": "first\nsecond",
+			},
+			"a=\"pa\\$\\${word}\"\n" +
+				"b=\"naïve ☃\"\n" +
+				"c=\"say \\\"hi\\\" \\\\ bye\"\n" +
+				"d=\"first\\nsecond\"\n",
+			false,
+		},
+		{
+			DotenvQuotingWhenNeeded,
+			map[string]string{"a": "$HOME"},
+			"a=\"\\$HOME\"\n",
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.quoting, func(t *testing.T) {
+			b, err := formatDotenvQuoted(tc.env, tc.quoting)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
+
+func TestRunner_outputLineTemplate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		tmpl     string
+		expected string
+		err      bool
+	}{
+		{
+			"escaped",
+			"{{.Key}}: {{.Value}}",
+			"a: 8080\nb: 'it'\\''s here'\n",
+			false,
+		},
+		{
+			"raw",
+			"{{.Key}} => {{.Value | raw}}",
+			"a => 8080\nb => it's here\n",
+			false,
+		},
+		{
+			"execute error",
+			"{{.Key}}={{.Missing}}",
+			"old",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "envconsul-output")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("old")
+			f.Close()
+			defer os.Remove(f.Name())
+
+			cfg := Config{
+				Output: &OutputConfig{
+					Path:         config.String(f.Name()),
+					LineTemplate: config.String(tc.tmpl),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app/foo"),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "a", Value: "8080"},
+				{Key: "b", Value: "it's here"},
+			})
+			if _, err := r.Run(); (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+
+			b, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, string(b))
+			}
+		})
+	}
+}
+
+func TestRunner_defaults(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			{
+				Path: config.String("app"),
+				Defaults: map[string]string{
+					"db_host":   "localhost",
+					"log_level": "info",
+				},
+			},
+		},
+		Secrets: &PrefixConfigs{
+			{
+				Path: config.String("secret/app"),
+				Defaults: map[string]string{
+					"secret_app_password":  "unused",
+					"secret_app_feature_x": "off",
+				},
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Receive(r.dependencies[0], []*dependency.KeyPair{
+		{Key: "db_host", Value: "db.internal"},
+	})
+	r.Receive(r.dependencies[1], &dependency.Secret{
+		Data: map[string]interface{}{"password": "hunter2"},
+	})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"db_host":              "db.internal",
+		"log_level":            "info",
+		"secret_app_password":  "hunter2",
+		"secret_app_feature_x": "off",
+	}
+	if !reflect.DeepEqual(r.env, expected) {
+		t.Errorf("expected %v, got %v", expected, r.env)
+	}
+}
+
+func TestRunner_requireUTF8(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		require bool
+		err     string
+	}{
+		{
+			"disabled",
+			false,
+			"",
+		},
+		{
+			"enabled",
+			true,
+			"runner: values of blob, secret_app_key are not valid UTF-8",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				RequireUTF8: config.Bool(tc.require),
+				Prefixes: &PrefixConfigs{
+					{Path: config.String("app")},
+				},
+				Secrets: &PrefixConfigs{
+					{Path: config.String("secret/app")},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "text", Value: "héllo"},
+				{Key: "blob", Value: "\x89PNG\r\n\x1a\n\xff\xfe"},
+			})
+			r.Receive(r.dependencies[1], &dependency.Secret{
+				Data: map[string]interface{}{"key": "\xc3\x28"},
+			})
+
+			_, err = r.Run()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.env["blob"] != "\x89PNG\r\n\x1a\n\xff\xfe" {
+					t.Errorf("expected the binary value to be passed as is, got %q", r.env["blob"])
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestRunner_namespaceDatacenters(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		upcase   bool
+		expected map[string]string
+	}{
+		{
+			"namespaced",
+			false,
+			map[string]string{
+				"dc1_db_host":       "db.dc1",
+				"us_east_1_db_host": "db.us-east-1",
+				"db_host":           "db.local",
+				"region":            "dc1",
+			},
+		},
+		{
+			"upcase",
+			true,
+			map[string]string{
+				"DC1_DB_HOST":       "db.dc1",
+				"US_EAST_1_DB_HOST": "db.us-east-1",
+				"DB_HOST":           "db.local",
+				"REGION":            "dc1",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				NamespaceDatacenters: config.Bool(true),
+				Upcase:               config.Bool(tc.upcase),
+				Prefixes: &PrefixConfigs{
+					{Path: config.String("app")},
+					{Path: config.String("app@dc1")},
+					{Path: config.String("app@us-east-1")},
+					{Path: config.String("global@dc1")},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values := map[string][]*dependency.KeyPair{
+				"kv.list(app)":           {{Key: "db_host", Value: "db.local"}},
+				"kv.list(app@dc1)":       {{Key: "db_host", Value: "db.dc1"}},
+				"kv.list(app@us-east-1)": {{Key: "db_host", Value: "db.us-east-1"}},
+				"kv.list(global@dc1)":    {{Key: "region", Value: "dc1"}},
+			}
+			for _, d := range r.dependencies {
+				r.Receive(d, values[d.String()])
+			}
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(r.env, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, r.env)
+			}
+		})
+	}
+}
+
+func TestRunner_sourceSummary(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		DryRun: config.Bool(true),
+		Prefixes: &PrefixConfigs{
+			{Path: config.String("app/config")},
+			{Path: config.String("app/empty")},
+		},
+		Secrets: &PrefixConfigs{
+			{Path: config.String("secret/data/db")},
+		},
+		Services: &ServiceConfigs{
+			{
+				Query:         config.String("foo"),
+				FormatId:      config.String("FOO_ID"),
+				FormatName:    config.String("FOO_NAME"),
+				FormatAddress: config.String("FOO_ADDRESS"),
+				FormatTag:     config.String("FOO_TAG"),
+				FormatPort:    config.String("FOO_PORT"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	var out, errOut bytes.Buffer
+	r.outStream = &out
+	r.errStream = &errOut
+
+	for _, d := range r.dependencies {
+		switch d.String() {
+		case "kv.list(app/config)":
+			r.Receive(d, []*dependency.KeyPair{
+				{Key: "a", Value: "1"},
+				{Key: "b", Value: "2"},
+				{Key: "user", Value: "app"},
+			})
+		case "kv.list(app/empty)":
+			r.Receive(d, []*dependency.KeyPair{})
+		case "catalog.service(foo)":
+			r.Receive(d, []*dependency.CatalogService{
+				{ServiceID: "foo1", ServiceName: "foo", ServiceAddress: "10.0.0.1"},
+			})
+		default:
+			r.Receive(d, &dependency.Secret{
+				Data: map[string]interface{}{"user": "db", "password": "hunter2"},
+			})
+		}
+	}
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "exported app/config -> 3 vars, app/empty -> 0 vars, " +
+		"service foo -> 5 vars, secret/data/db -> 2 vars, 10 vars in total\n"
+	if got := errOut.String(); got != expected {
+		t.Errorf("expected summary %q, got %q", expected, got)
+	}
+}
+
+func TestRunner_dryRun(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		redact   bool
+		expected string
+	}{
+		{
+			"values",
+			false,
+			"db_host=\"db.internal\"\npassword=\"hunter2\"\n",
+		},
+		{
+			"redacted",
+			true,
+			"db_host=\"db.internal\"\npassword=\"***\"\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "envconsul-output")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			os.Remove(f.Name())
+			outPath := f.Name()
+
+			cfg := Config{
+				DryRun:       config.Bool(true),
+				DryRunRedact: config.Bool(tc.redact),
+				Pristine:     config.Bool(true),
+				Exec: &config.ExecConfig{
+					Command: config.String("false"),
+					Env: &config.EnvConfig{
+						Blacklist: []string{"db_debug"},
+					},
+				},
+				Output: &OutputConfig{
+					Path: config.String(outPath),
+				},
+				Prefixes: &PrefixConfigs{
+					{Path: config.String("app")},
+				},
+				Secrets: &PrefixConfigs{
+					{Path: config.String("secret/db"), NoPrefix: config.Bool(true)},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			var out bytes.Buffer
+			r.outStream = &out
+
+			for _, d := range r.dependencies {
+				switch d.(type) {
+				case *dependency.KVListQuery:
+					r.Receive(d, []*dependency.KeyPair{
+						{Key: "db_host", Value: "db.internal"},
+						{Key: "db_debug", Value: "true"},
+					})
+				case *vaultReadQuery:
+					r.Receive(d, &dependency.Secret{
+						Data: map[string]interface{}{"password": "hunter2"},
+					})
+				}
+			}
+			exitCh, err := r.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if exitCh != nil || r.child != nil {
+				t.Error("expected no child process to be started")
+			}
+			if !r.once {
+				t.Error("expected a dry run to imply once mode")
+			}
+			if out.String() != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, out.String())
+			}
+			if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+				t.Errorf("expected no output file, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRunner_emptyEnvExitCode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		pairs []*dependency.KeyPair
+		env   *config.EnvConfig
+		err   bool
+	}{
+		{
+			"empty",
+			[]*dependency.KeyPair{},
+			nil,
+			true,
+		},
+		{
+			"blacklisted",
+			[]*dependency.KeyPair{{Key: "debug", Value: "true"}},
+			&config.EnvConfig{Blacklist: []string{"debug"}},
+			true,
+		},
+		{
+			"custom",
+			[]*dependency.KeyPair{},
+			&config.EnvConfig{Custom: []string{"MODE=init"}},
+			false,
+		},
+		{
+			"not_empty",
+			[]*dependency.KeyPair{{Key: "host", Value: "db.internal"}},
+			nil,
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				EmptyEnvExitCode: config.Int(3),
+				Exec: &config.ExecConfig{
+					Env: tc.env,
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app"),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			r.Receive(r.dependencies[0], tc.pairs)
+			_, err = r.Run()
+			if !tc.err {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			typed, ok := err.(manager.ErrExitable)
+			if !ok {
+				t.Fatalf("expected an exitable error, got %v", err)
+			}
+			if code := typed.ExitStatus(); code != 3 {
+				t.Errorf("expected exit code 3, got %d", code)
+			}
+		})
+	}
+}
+
+func TestRunner_emptyEnvExitCodeRunning(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EmptyEnvExitCode: config.Int(3),
+		Exec: &config.ExecConfig{
+			Command: config.String("sleep 10"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	d := r.dependencies[0]
+	r.Receive(d, []*dependency.KeyPair{{Key: "host", Value: "db.internal"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if r.child == nil {
+		t.Fatal("expected the child to start")
+	}
+
+	// The check only applies before the first start.
+	r.Receive(d, []*dependency.KeyPair{})
+	if _, err := r.Run(); err != nil {
+		t.Fatalf("expected no error once the child is running, got %v", err)
+	}
+}
+
+func TestRunner_outputJSONStdout(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Output: &OutputConfig{
+			Path:   config.String(OutputStdout),
+			Format: config.String(OutputFormatJSON),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	var out bytes.Buffer
+	r.outStream = &out
+
+	data := []*dependency.KeyPair{
+		{Key: "zed", Value: `C:\path\to "file"`},
+		{Key: "alpha", Value: "<a&b>"},
+	}
+	r.Receive(r.dependencies[0], data)
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "{\n" +
+		"  \"alpha\": \"<a&b>\",\n" +
+		"  \"zed\": \"C:\\\\path\\\\to \\\"file\\\"\"\n" +
+		"}\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+
+	var decoded map[string]string
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["zed"] != data[0].Value {
+		t.Errorf("expected %q, got %q", data[0].Value, decoded["zed"])
+	}
+}
+
+func TestRunner_outputJSONPort(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Output: &OutputConfig{
+			Path:   config.String(OutputStdout),
+			Format: config.String(OutputFormatJSON),
+		},
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query:      config.String("web"),
+				FormatId:   config.String("WEB_ID"),
+				FormatPort: config.String("WEB_PORT"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	var out bytes.Buffer
+	r.outStream = &out
+
+	r.Receive(r.dependencies[0], []*dependency.CatalogService{
+		&dependency.CatalogService{
+			ServiceID:   "1234",
+			ServiceName: "web",
+			ServicePort: 8080,
+		},
+	})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := decoded["WEB_PORT"].(float64); !ok || v != 8080 {
+		t.Errorf("expected WEB_PORT to be the number 8080, got %#v", decoded["WEB_PORT"])
+	}
+	if v := decoded["WEB_ID"]; v != "1234" {
+		t.Errorf("expected WEB_ID to be the string %q, got %#v", "1234", v)
+	}
+
+	if v := r.env["WEB_PORT"]; v != "8080" {
+		t.Errorf("expected WEB_PORT to be %q in the environment, got %q", "8080", v)
+	}
+}
+
+func TestRunner_keyStyle(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		style    string
+		expected string
+	}{
+		{
+			"unset",
+			"",
+			"foo_bar",
+		},
+		{
+			"snake",
+			KeyStyleSnake,
+			"foo_bar",
+		},
+		{
+			"kebab",
+			KeyStyleKebab,
+			"foo-bar",
+		},
+		{
+			"camel",
+			KeyStyleCamel,
+			"fooBar",
+		},
+		{
+			"pascal",
+			KeyStylePascal,
+			"FooBar",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				Output: &OutputConfig{
+					Path:   config.String(OutputStdout),
+					Format: config.String(OutputFormatJSON),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String("app/foo"),
+						KeyStyle: config.String(tc.style),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			var out bytes.Buffer
+			r.outStream = &out
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "foo_bar", Value: "baz"},
+			})
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded map[string]string
+			if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]string{tc.expected: "baz"}
+			if !reflect.DeepEqual(decoded, expected) {
+				t.Errorf("expected %v, got %v", expected, decoded)
+			}
+
+			// The environment of the child keeps the original key.
+			if v := r.env["foo_bar"]; v != "baz" {
+				t.Errorf("expected foo_bar to be %q, got %q", "baz", v)
+			}
+		})
+	}
+}
+
+func TestRunner_keyStyleKebabFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		format string
+		err    bool
+	}{
+		{
+			"json",
+			OutputFormatJSON,
+			false,
+		},
+		{
+			"dotenv",
+			OutputFormatDotenv,
+			true,
+		},
+		{
+			"export",
+			OutputFormatExport,
+			true,
+		},
+		{
+			"batch",
+			OutputFormatBatch,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Output: &OutputConfig{
+					Path:   config.String(OutputStdout),
+					Format: config.String(tc.format),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String("app/foo"),
+						KeyStyle: config.String(KeyStyleKebab),
+					},
+				},
+			}
+			_, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error: %t, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestRunner_emitTokenTTL(t *testing.T) {
+	t.Parallel()
+
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeVaultData(w, map[string]interface{}{
+			"id":  "token",
+			"ttl": 3600,
+		})
+	}))
+	defer stop()
+
+	cfg := Config{
+		EmitTokenTTL: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	d := r.dependencies[0]
+	data, _, err := d.Fetch(clients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Receive(d, data)
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := r.emittedEnv()[EnvVaultTokenTTL]; ttl != "3600" {
+		t.Errorf("expected %s to be %q, got %q", EnvVaultTokenTTL, "3600", ttl)
+	}
+}
+
+func TestRunner_emitApplyOrder(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		config   *Config
+		expected string
+	}{
+		{
+			"configuration_order",
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{Path: config.String("app")},
+				},
+				Services: &ServiceConfigs{
+					&ServiceConfig{Query: config.String("web")},
+				},
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{Path: config.String("secret/app")},
+				},
+			},
+			"parent,prefixes,services,secrets",
+		},
+		{
+			"priority",
+			&Config{
+				Pristine: config.Bool(true),
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{Path: config.String("defaults")},
+					&PrefixConfig{Path: config.String("overrides"), Priority: config.Int(10)},
+				},
+				Services: &ServiceConfigs{
+					&ServiceConfig{Query: config.String("web")},
+				},
+				TimeWindows: &TimeWindowConfigs{
+					&TimeWindowConfig{
+						Key:   config.String("FEATURE_X"),
+						Start: config.String("09:00"),
+						End:   config.String("17:00"),
+					},
+				},
+				Exec: &config.ExecConfig{
+					Env: &config.EnvConfig{
+						Custom: []string{"FOO=bar"},
+					},
+				},
+			},
+			"prefixes,services,prefixes,time_windows,custom",
+		},
+		{
+			"pristine_exec",
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{Path: config.String("app")},
+				},
+				Exec: &config.ExecConfig{
+					Env: &config.EnvConfig{
+						Pristine: config.Bool(true),
+						Custom:   []string{"FOO=bar"},
+					},
+				},
+			},
+			"custom",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.config.EmitApplyOrder = config.Bool(true)
+			r, err := NewRunner(DefaultConfig().Merge(tc.config), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if order := r.emittedEnv()[EnvApplyOrder]; order != tc.expected {
+				t.Errorf("expected %s to be %q, got %q", EnvApplyOrder, tc.expected, order)
+			}
+		})
+	}
+}
+
+func TestRunner_emitNodeName(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/self" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Config": map[string]interface{}{
+				"Datacenter": "dc1",
+				"NodeName":   "node-1",
+			},
+		})
+	}))
+	defer ts.Close()
+
+	clients := dependency.NewClientSet()
+	if err := clients.CreateConsulClient(&dependency.CreateConsulClientInput{
+		Address: strings.TrimPrefix(ts.URL, "http://"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		EmitNodeName: config.Bool(true),
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.clients = clients
+
+	if err := r.lookupNodeName(); err != nil {
+		t.Fatal(err)
+	}
+	if node := r.emittedEnv()[EnvNode]; node != "node-1" {
+		t.Errorf("expected %s to be %q, got %q", EnvNode, "node-1", node)
+	}
+}
+
+func TestRunner_Resolve(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/app" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Key": "app/foo", "Value": base64.StdEncoding.EncodeToString([]byte("bar"))},
+		})
+	}))
+	defer ts.Close()
+
+	clients := dependency.NewClientSet()
+	if err := clients.CreateConsulClient(&dependency.CreateConsulClientInput{
+		Address: strings.TrimPrefix(ts.URL, "http://"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.clients = clients
+
+	env, err := r.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"foo": "bar"}
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("expected %#v to be %#v", env, expected)
+	}
+	if r.child != nil {
+		t.Errorf("expected no child process to be started")
+	}
+}
+
+func TestRunner_emitLogLevel(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		level    string
+		flag     string
+		expected string
+	}{
+		{
+			"config",
+			"debug",
+			"",
+			"DEBUG",
+		},
+		{
+			"flag",
+			"",
+			"info",
+			"INFO",
+		},
+		{
+			"flag_over_config",
+			"err",
+			"trace",
+			"TRACE",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &Config{
+				EmitLogLevel: config.Bool(true),
+			}
+			if tc.level != "" {
+				cfg.LogLevel = config.String(tc.level)
+			}
+
+			// The -log-level flag is merged over the configuration files.
+			flags := &Config{}
+			if tc.flag != "" {
+				flags.LogLevel = config.String(tc.flag)
+			}
+			c := DefaultConfig().Merge(cfg).Merge(flags)
+			c.Finalize()
+
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if level := r.emittedEnv()[EnvLogLevel]; level != tc.expected {
+				t.Errorf("expected %s to be %q, got %q", EnvLogLevel, tc.expected, level)
+			}
+		})
+	}
+}
+
+func TestRunner_emitMode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		once     bool
+		expected string
+	}{
+		{
+			"once",
+			true,
+			"once",
+		},
+		{
+			"watch",
+			false,
+			"watch",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				EmitMode: config.Bool(true),
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), tc.once)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mode := r.emittedEnv()[EnvMode]; mode != tc.expected {
+				t.Errorf("expected %s to be %q, got %q", EnvMode, tc.expected, mode)
+			}
+		})
+	}
+}
+
+func TestRunner_vaultTokenMandatory(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		Exec: &config.ExecConfig{
+			Command: config.String("sleep 10"),
+		},
+		Vault: &config.VaultConfig{
+			Address:    config.String(ts.URL),
+			Token:      config.String("token"),
+			RenewToken: config.Bool(true),
+		},
+		VaultTokenRenewGrace: config.TimeDuration(100 * time.Millisecond),
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	go r.Start()
+
+	select {
+	case err := <-r.ErrCh:
+		if _, ok := err.(*errVaultTokenRenewal); !ok {
+			t.Fatalf("expected a renewal error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the renewal to fail")
+	}
+}
+
+func TestRunner_lastFetch(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EmitLastFetch: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	r.lastFetch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if last := r.emittedEnv()[EnvLastFetch]; last != "2000-01-01T00:00:00Z" {
+		t.Fatalf("expected %s to be %q, got %q", EnvLastFetch, "2000-01-01T00:00:00Z", last)
+	}
+
+	r.Receive(r.dependencies[0], []*dependency.KeyPair{
+		{Key: "key", Value: "value"},
+	})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := time.Parse(time.RFC3339, r.emittedEnv()[EnvLastFetch])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(last) > time.Minute {
+		t.Fatalf("expected %s to be updated, got %s", EnvLastFetch, last)
+	}
+}
+
+func TestRunner_overridden(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EmitOverrides: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+			&PrefixConfig{
+				Path: config.String("app/bar"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	r.Receive(r.dependencies[0], []*dependency.KeyPair{
+		{Key: "shared", Value: "foo"},
+		{Key: "foo", Value: "foo"},
+	})
+	r.Receive(r.dependencies[1], []*dependency.KeyPair{
+		{Key: "shared", Value: "bar"},
+		{Key: "bar", Value: "bar"},
+	})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.env["shared"] != "bar" {
+		t.Errorf("expected the last source to win, got %q", r.env["shared"])
+	}
+	if overridden := r.emittedEnv()[EnvOverridden]; overridden != "shared" {
+		t.Errorf("expected %s to be %q, got %q", EnvOverridden, "shared", overridden)
+	}
+}
+
+func TestRunner_overridden_configOrder(t *testing.T) {
+	t.Parallel()
+
+	// Both prefixes are at the same depth, so only their order in the
+	// configuration decides which supplies the shared key.
+	cases := []struct {
+		name     string
+		paths    []string
+		expected string
+	}{
+		{
+			"sorted",
+			[]string{"app/a", "app/b"},
+			"app/b",
+		},
+		{
+			"reversed",
+			[]string{"app/b", "app/a"},
+			"app/a",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			prefixes := PrefixConfigs{}
+			for _, path := range tc.paths {
+				prefixes = append(prefixes, &PrefixConfig{
+					Path: config.String(path),
+				})
+			}
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("true"),
+				},
+				Prefixes: &prefixes,
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			for i, d := range r.dependencies {
+				r.Receive(d, []*dependency.KeyPair{
+					{Key: "shared", Value: tc.paths[i]},
+				})
+			}
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.env["shared"] != tc.expected {
+				t.Errorf("expected %q to win, got %q", tc.expected, r.env["shared"])
+			}
+		})
+	}
+}
+
+func TestRunner_priority(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		prefixes []*PrefixConfig
+		secret   *PrefixConfig
+		expected string
+	}{
+		{
+			"higher_priority_first",
+			[]*PrefixConfig{
+				{Path: config.String("overrides"), Priority: config.Int(10)},
+				{Path: config.String("defaults")},
+			},
+			nil,
+			"overrides",
+		},
+		{
+			"higher_priority_last",
+			[]*PrefixConfig{
+				{Path: config.String("defaults")},
+				{Path: config.String("overrides"), Priority: config.Int(10)},
+			},
+			nil,
+			"overrides",
+		},
+		{
+			"tie",
+			[]*PrefixConfig{
+				{Path: config.String("defaults"), Priority: config.Int(5)},
+				{Path: config.String("overrides"), Priority: config.Int(5)},
+			},
+			nil,
+			"overrides",
+		},
+		{
+			"secret_beats_prefix",
+			[]*PrefixConfig{
+				{Path: config.String("overrides"), Priority: config.Int(10)},
+			},
+			&PrefixConfig{
+				Path:     config.String("secret"),
+				NoPrefix: config.Bool(true),
+				Priority: config.Int(-1),
+			},
+			"secret",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			prefixes := PrefixConfigs(tc.prefixes)
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("true"),
+				},
+				Prefixes: &prefixes,
+			}
+			if tc.secret != nil {
+				cfg.Secrets = &PrefixConfigs{tc.secret}
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			for _, d := range r.dependencies {
+				switch typed := d.(type) {
+				case *dependency.KVListQuery:
+					r.Receive(d, []*dependency.KeyPair{
+						{Key: "shared", Value: config.StringVal(r.configPrefixMap[typed.String()].Path)},
+					})
+				case *vaultReadQuery:
+					r.Receive(d, &dependency.Secret{
+						Data: map[string]interface{}{"shared": "secret"},
+					})
+				}
+			}
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.env["shared"] != tc.expected {
+				t.Errorf("expected %q to win, got %q", tc.expected, r.env["shared"])
+			}
+		})
+	}
+}
+
+func TestRunner_arrayMergePolicy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		policy   string
+		expected string
+	}{
+		{
+			"replace",
+			ArrayMergeReplace,
+			"b,c",
+		},
+		{
+			"concat",
+			ArrayMergeConcat,
+			"a,b,b,c",
+		},
+		{
+			"unique_concat",
+			ArrayMergeUniqueConcat,
+			"a,b,c",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					{Path: config.String("defaults")},
+					{
+						Path:             config.String("overrides"),
+						ArrayMergePolicy: config.String(tc.policy),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "hosts", Value: "a,b"},
+			})
+			r.Receive(r.dependencies[1], []*dependency.KeyPair{
+				{Key: "hosts", Value: "b,c"},
+			})
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.env["hosts"] != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, r.env["hosts"])
+			}
+		})
+	}
+}
+
+func TestRunner_secretsChecksum(t *testing.T) {
+	t.Parallel()
+
+	r, err := NewRunner(DefaultConfig().Merge(&Config{
+		EmitSecretsChecksum: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			{Path: config.String("app")},
+		},
+		Secrets: &PrefixConfigs{
+			{Path: config.String("secret"), NoPrefix: config.Bool(true)},
+		},
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	render := func(kv, secret string) string {
+		for _, d := range r.dependencies {
+			switch d.(type) {
+			case *dependency.KVListQuery:
+				r.Receive(d, []*dependency.KeyPair{
+					{Key: "config", Value: kv},
+				})
+			case *vaultReadQuery:
+				r.Receive(d, &dependency.Secret{
+					Data: map[string]interface{}{"password": secret},
+				})
+			}
+		}
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return r.emittedEnv()[EnvSecretsChecksum]
+	}
+
+	initial := render("a", "s3cret")
+	if initial == "" {
+		t.Fatal("expected a secrets checksum")
+	}
+	if checksum := render("b", "s3cret"); checksum != initial {
+		t.Errorf("expected changing a prefix to keep %q, got %q", initial, checksum)
+	}
+	if checksum := render("b", "changed"); checksum == initial {
+		t.Errorf("expected changing a secret to change %q", initial)
+	}
+}
+
+func TestRunner_watchPaths(t *testing.T) {
+	t.Parallel()
+
+	r, err := NewRunner(DefaultConfig().Merge(&Config{
+		EmitTokenTTL:   config.Bool(true),
+		EmitWatchPaths: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			{Path: config.String("app/config")},
+			{Path: config.String("app/config")},
+		},
+		Secrets: &PrefixConfigs{
+			{Path: config.String("secret/db")},
+		},
+		Services: &ServiceConfigs{
+			{Query: config.String("web")},
+			{Query: config.String("api")},
+		},
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// The Vault token, watched for its TTL, is not listed.
+	expected := "api,app/config,secret/db,web"
+	if watches := r.emittedEnv()[EnvWatches]; watches != expected {
+		t.Errorf("expected %q, got %q", expected, watches)
+	}
+}
+
+func TestRunner_timeWindow(t *testing.T) {
+	t.Parallel()
+
+	day := func(hour, min int) time.Time {
+		return time.Date(2019, 8, 1, hour, min, 0, 0, time.Local)
+	}
+
+	cases := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		open       bool
+		next       time.Time
+	}{
+		{
+			"before",
+			"09:00", "17:00",
+			day(8, 59),
+			false,
+			day(9, 0),
+		},
+		{
+			"inside",
+			"09:00", "17:00",
+			day(9, 0),
+			true,
+			day(17, 0),
+		},
+		{
+			"after",
+			"09:00", "17:00",
+			day(17, 0),
+			false,
+			day(9, 0).AddDate(0, 0, 1),
+		},
+		{
+			"spans_midnight",
+			"22:00", "06:00",
+			day(1, 30),
+			true,
+			day(6, 0),
+		},
+		{
+			"spans_midnight_closed",
+			"22:00", "06:00",
+			day(12, 0),
+			false,
+			day(22, 0),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("true"),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("app/foo"),
+					},
+				},
+				TimeWindows: &TimeWindowConfigs{
+					&TimeWindowConfig{
+						Key:   config.String("FEATURE_X"),
+						Start: config.String(tc.start),
+						End:   config.String(tc.end),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+			r.clock = func() time.Time { return tc.now }
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "foo", Value: "bar"},
+			})
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			value, ok := r.env["FEATURE_X"]
+			if ok != tc.open {
+				t.Errorf("expected FEATURE_X to be set: %t, got %v", tc.open, r.env)
+			}
+			if ok && value != DefaultTimeWindowValue {
+				t.Errorf("expected FEATURE_X to be %q, got %q", DefaultTimeWindowValue, value)
+			}
+			if next := r.nextWindowChange(); !next.Equal(tc.next) {
+				t.Errorf("expected next change at %s, got %s", tc.next, next)
+			}
+
+			// Moving the clock to the next change flips the window.
+			r.clock = func() time.Time { return tc.next }
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := r.env["FEATURE_X"]; ok == tc.open {
+				t.Errorf("expected FEATURE_X to be set: %t, got %v", !tc.open, r.env)
+			}
+		})
+	}
+}
+
+func TestRunner_annotateSources(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		AnnotateSources: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+			&PrefixConfig{
+				Path: config.String("app/bar"),
+			},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:     config.String("secret/db"),
+				NoPrefix: config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	for _, d := range r.dependencies {
+		switch typed := d.(type) {
+		case *dependency.KVListQuery:
+			name := strings.TrimSuffix(strings.TrimPrefix(typed.String(), "kv.list(app/"), ")")
+			r.Receive(d, []*dependency.KeyPair{
+				{Key: "shared", Value: name},
+				{Key: name, Value: name},
+			})
+		case *vaultReadQuery:
+			// The secret was read from a KV version 2 secrets engine.
+			typed.secretPath = "secret/data/db"
+			r.Receive(d, &dependency.Secret{
+				Data: map[string]interface{}{"DATABASE_URL": "postgres://db"},
+			})
+		}
+	}
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	emitted := r.emittedEnv()
+	expected := map[string]string{
+		EnvSourcePrefix + "foo":          "app/foo",
+		EnvSourcePrefix + "bar":          "app/bar",
+		EnvSourcePrefix + "shared":       "app/bar",
+		EnvSourcePrefix + "DATABASE_URL": "secret/data/db",
+	}
+	for k, v := range expected {
+		if emitted[k] != v {
+			t.Errorf("expected %s to be %q, got %q", k, v, emitted[k])
+		}
+	}
+
+	// Annotations inherited from another envconsul are stripped.
+	env := r.applyConfigEnv(map[string]string{
+		EnvSourcePrefix + "shared": "app/bar",
+		EnvSourcePrefix + "OTHER":  "inherited",
+	})
+	if _, ok := env[EnvSourcePrefix+"OTHER"]; ok {
+		t.Errorf("expected inherited annotation to be stripped, got %v", env)
+	}
+	if _, ok := env[EnvSourcePrefix+"shared"]; !ok {
+		t.Errorf("expected annotation to be kept, got %v", env)
+	}
+}
+
+func TestRunner_counts(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EmitCounts: config.Bool(true),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/foo"),
+			},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/foo"),
+			},
+		},
+		Services: &ServiceConfigs{
+			&ServiceConfig{
+				Query: config.String("web"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	for _, d := range r.dependencies {
+		switch d.(type) {
+		case *dependency.KVListQuery:
+			r.Receive(d, []*dependency.KeyPair{
+				{Key: "a", Value: "a"},
+				{Key: "b", Value: "b"},
+			})
+		case *dependency.CatalogServiceQuery:
+			r.Receive(d, []*dependency.CatalogService{
+				{ServiceID: "web1", ServiceName: "web"},
+			})
+		default:
+			r.Receive(d, &dependency.Secret{
+				Data: map[string]interface{}{"bar": "baz"},
+			})
+		}
+	}
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"prefixes":2,"secrets":1,"services":5}`
+	if counts := r.emittedEnv()[EnvCounts]; counts != expected {
+		t.Errorf("expected %s to be %s, got %s", EnvCounts, expected, counts)
+	}
+}
+
+func TestRunner_required(t *testing.T) {
+	t.Parallel()
+
+	destroyed := &dependency.Secret{
+		Data: map[string]interface{}{
+			"data": nil,
+			"metadata": map[string]interface{}{
+				"destroyed": true,
+				"version":   "2",
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		required bool
+		secret   bool
+		data     interface{}
+		err      bool
+	}{
+		{
+			"empty_prefix",
+			true,
+			false,
+			[]*dependency.KeyPair{},
+			true,
+		},
+		{
+			"empty_prefix_not_required",
+			false,
+			false,
+			[]*dependency.KeyPair{},
+			false,
+		},
+		{
+			"prefix_with_keys",
+			true,
+			false,
+			[]*dependency.KeyPair{{Key: "a", Value: "b"}},
+			false,
+		},
+		{
+			"destroyed_secret",
+			true,
+			true,
+			destroyed,
+			true,
+		},
+		{
+			"destroyed_secret_not_required",
+			false,
+			true,
+			destroyed,
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := &PrefixConfig{
+				Path:     config.String("app/foo"),
+				Required: config.Bool(tc.required),
+			}
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("true"),
+				},
+			}
+			if tc.secret {
+				cfg.Secrets = &PrefixConfigs{pc}
+			} else {
+				cfg.Prefixes = &PrefixConfigs{pc}
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			for _, d := range r.dependencies {
+				r.Receive(d, tc.data)
+			}
+			_, err = r.Run()
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRunner_includeExclude(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		include []string
+		exclude []string
+		env     map[string]string
+	}{
+		{
+			"all",
+			nil,
+			nil,
+			map[string]string{"APP_DB_URL": "a", "APP_DB_DEBUG": "b", "APP_NOISY": "c"},
+		},
+		{
+			"include",
+			[]string{"APP_DB_*"},
+			nil,
+			map[string]string{"APP_DB_URL": "a", "APP_DB_DEBUG": "b"},
+		},
+		{
+			"exclude",
+			nil,
+			[]string{"APP_NOISY", "*_DEBUG"},
+			map[string]string{"APP_DB_URL": "a"},
+		},
+		{
+			"exclude_beats_include",
+			[]string{"APP_DB_*"},
+			[]string{"*_DEBUG"},
+			map[string]string{"APP_DB_URL": "a"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("true"),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:    config.String("app/foo"),
+						Format:  config.String("app_{{ key }}"),
+						Upcase:  config.Bool(true),
+						Include: tc.include,
+						Exclude: tc.exclude,
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			// The patterns match the final names, after formatting and
+			// upcasing.
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "db_url", Value: "a"},
+				{Key: "db_debug", Value: "b"},
+				{Key: "noisy", Value: "c"},
+			})
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r.env, tc.env) {
+				t.Errorf("expected %v to be %v", r.env, tc.env)
+			}
+		})
+	}
+}
+
+func TestRunner_parseYAML(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		value string
+		env   map[string]string
+	}{
+		{
+			"mapping",
+			"host: db.internal\nport: 5432\ntls:\n  enabled: true\n",
+			map[string]string{
+				"DB_HOST":        "db.internal",
+				"DB_PORT":        "5432",
+				"DB_TLS_ENABLED": "true",
+			},
+		},
+		{
+			"scalar",
+			"db.internal",
+			map[string]string{"DB": "db.internal"},
+		},
+		{
+			"invalid",
+			"host: [",
+			map[string]string{"DB": "host: ["},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Exec: &config.ExecConfig{
+					Command: config.String("true"),
+				},
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:      config.String("app"),
+						ParseYAML: config.Bool(true),
+						Upcase:    config.Bool(true),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			r.Receive(r.dependencies[0], []*dependency.KeyPair{
+				{Key: "db", Value: tc.value},
+			})
+			if _, err := r.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r.env, tc.env) {
+				t.Errorf("expected %v to be %v", r.env, tc.env)
+			}
+		})
+	}
+}
+
+func TestRunner_invalidExclude(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:    config.String("secret/foo"),
+				Exclude: []string{"[bad"},
+			},
+		},
+	}
+	_, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), `invalid pattern "[bad"`) {
+		t.Errorf("expected invalid pattern error, got %s", err)
+	}
+}
+
+func TestRunner_format(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		secret   bool
+		noPrefix *bool
+		format   string
+		expected map[string]string
+	}{
+		{
+			"prefix_key_function",
+			false,
+			config.Bool(false),
+			"custom_{{ key }}",
+			map[string]string{"custom_app_db_host": "db.internal"},
+		},
+		{
+			"prefix_fields",
+			false,
+			config.Bool(false),
+			"{{ .Path }}__{{ .Key | upper }}",
+			map[string]string{"app_db__HOST": "db.internal"},
+		},
+		{
+			"prefix_no_prefix_path",
+			false,
+			config.Bool(true),
+			"x{{ .NoPrefixPath }}_{{ .Key }}",
+			map[string]string{"x_host": "db.internal"},
+		},
+		{
+			"secret_fields",
+			true,
+			nil,
+			"DB__{{ .Key | upper }}",
+			map[string]string{"DB__HOST": "db.internal"},
+		},
+		{
+			"secret_no_prefix_path",
+			true,
+			nil,
+			"{{ .NoPrefixPath }}__{{ .Key }}",
+			map[string]string{"secret_db__host": "db.internal"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg Config
+			if tc.secret {
+				cfg.Secrets = &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String("secret/db"),
+						NoPrefix: tc.noPrefix,
+						Format:   config.String(tc.format),
+					},
+				}
+			} else {
+				cfg.Prefixes = &PrefixConfigs{
+					&PrefixConfig{
+						Path:     config.String("app/db"),
+						NoPrefix: tc.noPrefix,
+						Format:   config.String(tc.format),
+					},
+				}
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := make(map[string]string)
+			switch d := r.dependencies[0].(type) {
+			case *dependency.KVListQuery:
+				err = r.appendPrefixes(env, d, []*dependency.KeyPair{
+					{Key: "host", Value: "db.internal"},
+				})
+			default:
+				err = r.appendSecrets(env, d, &dependency.Secret{
+					Data: map[string]interface{}{"host": "db.internal"},
+				})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, env)
+			}
+		})
+	}
+}
+
+func TestRunner_invalidFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		format string
+	}{
+		{"syntax", "{{ .Key "},
+		{"unknown_function", "{{ .Key | reverse }}"},
+		{"unknown_field", "{{ .Name }}"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path:   config.String("app/db"),
+						Format: config.String(tc.format),
+					},
+				},
+			}
+			_, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), "invalid format") {
+				t.Errorf("expected invalid format error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestRunner_envPrefix(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EnvPrefix: config.String("APP1_"),
+		EnvSuffix: config.String("_V"),
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+			Env: &config.EnvConfig{
+				Custom: []string{"CUSTOM=value"},
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path:   config.String("app/foo"),
+				Format: config.String("database_{{ key }}"),
+				Upcase: config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	for _, d := range r.dependencies {
+		r.Receive(d, []*dependency.KeyPair{
+			{Key: "url", Value: "postgres://db"},
+		})
+	}
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"APP1_DATABASE_URL_V": "postgres://db"}
+	if !reflect.DeepEqual(r.env, expected) {
+		t.Errorf("expected %v to be %v", r.env, expected)
+	}
+
+	env := r.applyConfigEnv(map[string]string{"APP1_DATABASE_URL_V": "postgres://db"})
+	if v, ok := env["CUSTOM"]; !ok || v != "value" {
+		t.Errorf("expected CUSTOM to be unwrapped, got %v", env)
+	}
+}
+
+func TestRunner_redactKeys(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "envconsul-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cfg := Config{
+		DeltaFile:  config.String(f.Name()),
+		RedactKeys: []string{"*_PASSWORD"},
+		Exec: &config.ExecConfig{
+			Command: config.String("true"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app/db"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// Both keys come from Consul, so only the pattern causes redaction.
+	r.Receive(r.dependencies[0], []*dependency.KeyPair{
+		{Key: "DB_PASSWORD", Value: "hunter2"},
+		{Key: "DB_USER", Value: "admin"},
+	})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "+DB_PASSWORD=***\n+DB_USER=admin\n"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, string(b))
+	}
+
+	if v := r.logValue("DB_PASSWORD", "hunter2"); v != redactedValue {
+		t.Errorf("expected logged value to be redacted, got %q", v)
+	}
+}
+
+func TestRunner_emitBanner(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		EmitBanner: config.Bool(true),
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app/foo")},
+			&PrefixConfig{Path: config.String("app/bar")},
+		},
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("secret/foo")},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stderr bytes.Buffer
+	r.errStream = &stderr
+	r.emitBanner()
+
+	banner := stderr.String()
+	for _, s := range []string{"2 prefixes", "1 secrets", "0 services", "consul, vault"} {
+		if !strings.Contains(banner, s) {
+			t.Errorf("expected banner to contain %q, got %q", s, banner)
+		}
+	}
+	if strings.Count(banner, "\n") != 1 {
+		t.Errorf("expected a single line, got %q", banner)
+	}
+}
+
+func TestRunner_tolerateStale(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		tolerate bool
+	}{
+		{
+			"disabled",
+			false,
+		},
+		{
+			"enabled",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				TolerateStale: config.Bool(tc.tolerate),
+				Exec: &config.ExecConfig{
+					Command: config.String("sleep 10"),
+				},
+				Prefixes: &PrefixConfigs{
+					{
+						Path:     config.String("app"),
+						Required: config.Bool(true),
+					},
+				},
+			}
+			r, err := NewRunner(DefaultConfig().Merge(&cfg), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			d := r.dependencies[0]
+			pairs := func(v string) []*dependency.KeyPair {
+				return []*dependency.KeyPair{{Key: "key", Value: v}}
+			}
+
+			steps := []struct {
+				name     string
+				data     []*dependency.KeyPair
+				err      bool
+				value    string
+				restarts int
+			}{
+				{"initial", pairs("a"), false, "a", 0},
+				{"missing", nil, !tc.tolerate, "a", 0},
+				{"recovered", pairs("a"), false, "a", 0},
+				{"changed", pairs("b"), false, "b", 1},
+			}
+
+			for _, step := range steps {
+				r.Receive(d, step.data)
+				_, err := r.Run()
+				if step.err {
+					if err == nil {
+						t.Fatalf("%s: expected an error", step.name)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s: %s", step.name, err)
+				}
+
+				if got := r.env["key"]; got != step.value {
+					t.Errorf("%s: expected %q, got %q", step.name, step.value, got)
+				}
+				if r.restarts != step.restarts {
+					t.Errorf("%s: expected %d restarts, got %d", step.name, step.restarts, r.restarts)
+				}
+			}
+		})
+	}
+}
+
+func TestRunner_tolerateStale_fetch(t *testing.T) {
+	t.Parallel()
+
+	var reads int32
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/app" || atomic.AddInt32(&reads, 1) <= 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeVaultData(w, map[string]interface{}{"foo": "bar"})
+	}))
+	defer stop()
+
+	cfg := Config{
+		TolerateStale: config.Bool(true),
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/app"),
+			},
+		},
+	}
+	c := DefaultConfig().Merge(&cfg)
+	c.Vault.Retry.Backoff = config.TimeDuration(time.Millisecond)
+	r, err := NewRunner(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// The secret was read before, so it is retried rather than failing.
+	d := r.dependencies[0]
+	r.Receive(d, &dependency.Secret{Data: map[string]interface{}{"foo": "old"}})
+
+	data, _, err := (&trackedDependency{Dependency: d, runner: r}).Fetch(clients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&reads); n != 3 {
+		t.Errorf("expected 3 reads, got %d", n)
+	}
+	if v := data.(*dependency.Secret).Data["foo"]; v != "bar" {
+		t.Errorf("expected %q, got %q", "bar", v)
+	}
+}
+
+func TestRunner_vaultSealed(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		interval time.Duration
+		minReads int32
+		maxReads int32
+	}{
+		{
+			"backs_off",
+			50 * time.Millisecond,
+			2,
+			5,
+		},
+		{
+			"disabled",
+			0,
+			10,
+			math.MaxInt32,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Vault is sealed for the first 150ms.
+			start := time.Now()
+			var reads int32
+			clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/secret/app" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				atomic.AddInt32(&reads, 1)
+				if time.Since(start) < 150*time.Millisecond {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"errors": []string{"Vault is sealed"},
+					})
+					return
+				}
+				writeVaultData(w, map[string]interface{}{"foo": "bar"})
+			}))
+			defer stop()
+
+			// The Vault client's own retries of 5xx responses are disabled.
+			clients.Vault().SetMaxRetries(0)
+
+			cfg := Config{
+				TolerateStale:       config.Bool(true),
+				VaultSealedInterval: config.TimeDuration(tc.interval),
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("secret/app"),
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			c.Vault.Retry.Backoff = config.TimeDuration(time.Millisecond)
+			c.Vault.Retry.MaxBackoff = config.TimeDuration(time.Millisecond)
+			r, err := NewRunner(c, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			d := r.dependencies[0]
+			r.Receive(d, &dependency.Secret{Data: map[string]interface{}{"foo": "old"}})
+
+			type result struct {
+				data interface{}
+				err  error
+			}
+			doneCh := make(chan result, 1)
+			go func() {
+				data, _, err := (&trackedDependency{Dependency: d, runner: r}).Fetch(clients, nil)
+				doneCh <- result{data, err}
+			}()
+
+			// The last value is served while Vault is sealed.
+			time.Sleep(75 * time.Millisecond)
+			r.dependenciesLock.Lock()
+			res, err := r.resolve()
+			r.dependenciesLock.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := res.env["secret_app_foo"]; v != "old" {
+				t.Errorf("expected %q while sealed, got %q", "old", v)
+			}
+
+			select {
+			case res := <-doneCh:
+				if res.err != nil {
+					t.Fatal(res.err)
+				}
+				if v := res.data.(*dependency.Secret).Data["foo"]; v != "bar" {
+					t.Errorf("expected %q, got %q", "bar", v)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("secret was not read once unsealed")
+			}
+
+			n := atomic.LoadInt32(&reads)
+			if n < tc.minReads || n > tc.maxReads {
+				t.Errorf("expected between %d and %d reads, got %d", tc.minReads, tc.maxReads, n)
+			}
+		})
+	}
+}
+
+// testConsulKV starts a Consul agent stub serving the "app" prefix with a
+// single key, returning the Consul configuration to reach it.
+func testConsulKV(t *testing.T) (*config.ConsulConfig, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/app" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// Hold blocking queries, as Consul does while nothing changes.
+		if r.URL.Query().Get("index") != "" {
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Key": "app/foo", "Value": base64.StdEncoding.EncodeToString([]byte("bar"))},
+		})
+	}))
+
+	return &config.ConsulConfig{
+		Address: config.String(strings.TrimPrefix(ts.URL, "http://")),
+	}, ts.Close
+}
+
+func TestRunner_childExitCode(t *testing.T) {
+	t.Parallel()
+
+	consul, stop := testConsulKV(t)
+	defer stop()
+
+	cfg := Config{
+		Consul: consul,
+		Exec: &config.ExecConfig{
+			Command: config.String("sh -c 'exit 42'"),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	go r.Start()
+
+	select {
+	case code := <-r.ExitCh:
+		if code != 42 {
+			t.Errorf("expected exit code 42, got %d", code)
+		}
+	case err := <-r.ErrCh:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the child to exit")
+	}
+}
+
+func TestRunner_killTimeout(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Exec: &config.ExecConfig{
+			Command:     config.String("sh -c 'trap \"\" TERM; while :; do sleep 0.1; done'"),
+			KillSignal:  config.Signal(syscall.SIGTERM),
+			KillTimeout: config.TimeDuration(200 * time.Millisecond),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("app"),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Receive(r.dependencies[0], []*dependency.KeyPair{{Key: "foo", Value: "bar"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pid := r.child.Pid()
+
+	// Give the shell time to install its trap.
+	time.Sleep(500 * time.Millisecond)
+
+	// The child ignores the kill signal, so it is killed once the timeout
+	// passes.
+	start := time.Now()
+	r.Stop()
+	if d := time.Since(start); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Errorf("expected the runner to stop after the kill timeout, took %s", d)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("expected the child process %d to be killed", pid)
+	}
+}
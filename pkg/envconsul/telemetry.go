@@ -0,0 +1,125 @@
+package envconsul
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/pkg/errors"
+)
+
+// telemetryShutdownTimeout bounds how long in-flight requests to the
+// telemetry server may take once the runner stops.
+const telemetryShutdownTimeout = 5 * time.Second
+
+// telemetry holds the counters of a runner exposed by the telemetry server.
+// They are updated atomically, so they may be read while the runner renders.
+type telemetry struct {
+	// renders is the number of environments rendered from every dependency.
+	renders uint64
+
+	// consulErrors and vaultErrors are the number of failed fetches of Consul
+	// and Vault dependencies.
+	consulErrors uint64
+	vaultErrors  uint64
+
+	// restarts is the number of times the child process was restarted.
+	restarts uint64
+
+	// renewals is the number of leases of secrets renewed.
+	renewals uint64
+
+	// lastRender is the time of the most recent render in Unix nanoseconds, or
+	// zero before the first. It is kept apart from the runner's lastFetch so
+	// that metrics are served without waiting for a render in progress.
+	lastRender int64
+}
+
+// secretRenewed counts the renewal of the lease of a secret.
+func (t *telemetry) secretRenewed() {
+	atomic.AddUint64(&t.renewals, 1)
+}
+
+// listenTelemetry starts serving the metrics of the runner on the configured
+// address.
+func (r *Runner) listenTelemetry() error {
+	addr := config.StringVal(r.config.TelemetryAddr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "listening on telemetry address")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", r.serveMetrics)
+	r.telemetryServer = &http.Server{Handler: mux}
+
+	log.Printf("[INFO] (runner) serving telemetry on %q", l.Addr())
+	go func(srv *http.Server) {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERR] (runner) telemetry server: %s", err)
+		}
+	}(r.telemetryServer)
+	return nil
+}
+
+// serveMetrics writes the metrics of the runner in the Prometheus text format.
+func (r *Runner) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("envconsul_renders_total", "counter",
+		"Number of environments rendered.")
+	fmt.Fprintf(&buf, "envconsul_renders_total %d\n",
+		atomic.LoadUint64(&r.metrics.renders))
+
+	header("envconsul_fetch_errors_total", "counter",
+		"Number of failed fetches of prefixes, secrets and services, by backend.")
+	fmt.Fprintf(&buf, "envconsul_fetch_errors_total{backend=\"consul\"} %d\n",
+		atomic.LoadUint64(&r.metrics.consulErrors))
+	fmt.Fprintf(&buf, "envconsul_fetch_errors_total{backend=\"vault\"} %d\n",
+		atomic.LoadUint64(&r.metrics.vaultErrors))
+
+	header("envconsul_child_restarts_total", "counter",
+		"Number of times the child process was restarted.")
+	fmt.Fprintf(&buf, "envconsul_child_restarts_total %d\n",
+		atomic.LoadUint64(&r.metrics.restarts))
+
+	header("envconsul_secret_renewals_total", "counter",
+		"Number of leases of secrets renewed.")
+	fmt.Fprintf(&buf, "envconsul_secret_renewals_total %d\n",
+		atomic.LoadUint64(&r.metrics.renewals))
+
+	// The gauge is omitted until the first render.
+	if last := atomic.LoadInt64(&r.metrics.lastRender); last != 0 {
+		header("envconsul_seconds_since_last_render", "gauge",
+			"Seconds since every prefix, secret and service was last rendered.")
+		fmt.Fprintf(&buf, "envconsul_seconds_since_last_render %g\n",
+			time.Since(time.Unix(0, last)).Seconds())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// closeTelemetry stops the telemetry server, waiting briefly for requests in
+// flight.
+func (r *Runner) closeTelemetry() {
+	if r.telemetryServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryShutdownTimeout)
+	defer cancel()
+	if err := r.telemetryServer.Shutdown(ctx); err != nil {
+		log.Printf("[WARN] (runner) could not stop telemetry server: %s", err)
+	}
+	r.telemetryServer = nil
+}
@@ -0,0 +1,101 @@
+package envconsul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/dependency"
+)
+
+func TestRunner_telemetry(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		TelemetryAddr: config.String("127.0.0.1:0"),
+		Prefixes: &PrefixConfigs{
+			{Path: config.String("app")},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// The gauge is omitted before the first render.
+	rec := httptest.NewRecorder()
+	r.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "envconsul_seconds_since_last_render") {
+		t.Errorf("expected no render gauge before the first render:\n%s", rec.Body)
+	}
+
+	r.Receive(r.dependencies[0], []*dependency.KeyPair{
+		{Key: "foo", Value: "bar"},
+	})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed fetch of a Consul prefix is counted.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	clients := dependency.NewClientSet()
+	if err := clients.CreateConsulClient(&dependency.CreateConsulClientInput{
+		Address: strings.TrimPrefix(ts.URL, "http://"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	failing := &trackedDependency{Dependency: r.dependencies[0], runner: r}
+	if _, _, err := failing.Fetch(clients, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	r.metrics.secretRenewed()
+
+	// Metrics are served while a render holds the dependencies lock.
+	rec = httptest.NewRecorder()
+	r.dependenciesLock.Lock()
+	doneCh := make(chan struct{})
+	go func() {
+		r.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected metrics to be served during a render")
+	}
+	r.dependenciesLock.Unlock()
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE envconsul_renders_total counter",
+		"envconsul_renders_total 1",
+		`envconsul_fetch_errors_total{backend="consul"} 1`,
+		`envconsul_fetch_errors_total{backend="vault"} 0`,
+		"envconsul_child_restarts_total 0",
+		"envconsul_secret_renewals_total 1",
+		"# TYPE envconsul_seconds_since_last_render gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+
+	// The server is stopped with the runner.
+	if err := r.listenTelemetry(); err != nil {
+		t.Fatal(err)
+	}
+	srv := r.telemetryServer
+	r.Stop()
+	if r.telemetryServer != nil {
+		t.Error("expected the telemetry server to be stopped")
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		t.Errorf("expected the server to be closed, got %v", err)
+	}
+}
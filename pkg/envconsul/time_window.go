@@ -0,0 +1,85 @@
+package envconsul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// timeWindow is a parsed TimeWindowConfig. The start and end are offsets from
+// midnight in local time.
+type timeWindow struct {
+	key, value string
+	start, end time.Duration
+}
+
+// parseTimeWindow parses and validates the given time window.
+func parseTimeWindow(c *TimeWindowConfig) (*timeWindow, error) {
+	w := &timeWindow{
+		key:   config.StringVal(c.Key),
+		value: config.StringVal(c.Value),
+	}
+	if w.key == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+
+	var err error
+	if w.start, err = parseTimeOfDay(config.StringVal(c.Start)); err != nil {
+		return nil, fmt.Errorf("%s: invalid start: %s", w.key, err)
+	}
+	if w.end, err = parseTimeOfDay(config.StringVal(c.End)); err != nil {
+		return nil, fmt.Errorf("%s: invalid end: %s", w.key, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("%s: start and end must differ", w.key)
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses a time of day, such as "09:30", into an offset from
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse(TimeWindowLayout, s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// timeOfDay returns the offset of t from midnight, according to its clock.
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+}
+
+// open returns whether the window is open at the given time.
+func (w *timeWindow) open(now time.Time) bool {
+	tod := timeOfDay(now)
+	if w.start < w.end {
+		return tod >= w.start && tod < w.end
+	}
+	// The window spans midnight.
+	return tod >= w.start || tod < w.end
+}
+
+// nextChange returns the first time after now at which the window opens or
+// closes.
+func (w *timeWindow) nextChange(now time.Time) time.Time {
+	var next time.Time
+	for _, offset := range []time.Duration{w.start, w.end} {
+		// Build the boundary from its wall clock rather than adding the offset
+		// to midnight, which is off by the shift on daylight saving days.
+		hour, min := int(offset/time.Hour), int(offset%time.Hour/time.Minute)
+		y, m, d := now.Date()
+		t := time.Date(y, m, d, hour, min, 0, 0, now.Location())
+		if !t.After(now) {
+			t = time.Date(y, m, d+1, hour, min, 0, 0, now.Location())
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
@@ -0,0 +1,69 @@
+package envconsul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestTimeWindow_nextChangeDST(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %s", err)
+	}
+
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2019, month, day, hour, min, 0, 0, loc)
+	}
+
+	cases := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		next       time.Time
+	}{
+		{
+			"spring_forward",
+			"09:00", "17:00",
+			at(time.March, 10, 1, 0),
+			at(time.March, 10, 9, 0),
+		},
+		{
+			"fall_back",
+			"09:00", "17:00",
+			at(time.November, 3, 0, 30),
+			at(time.November, 3, 9, 0),
+		},
+		{
+			"spring_forward_next_day",
+			"00:30", "01:30",
+			at(time.March, 9, 23, 0),
+			at(time.March, 10, 0, 30),
+		},
+		{
+			"fall_back_end",
+			"22:00", "06:00",
+			at(time.November, 3, 1, 0),
+			at(time.November, 3, 6, 0),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := parseTimeWindow(&TimeWindowConfig{
+				Key:   config.String("FEATURE_X"),
+				Start: config.String(tc.start),
+				End:   config.String(tc.end),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := w.nextChange(tc.now); !next.Equal(tc.next) {
+				t.Errorf("expected next change at %s, got %s", tc.next, next)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package envconsul
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// valueTransforms are the transforms which may be applied to values, by name.
+var valueTransforms = map[string]func(string) (string, error){
+	// trim removes leading and trailing whitespace.
+	"trim": func(s string) (string, error) {
+		return strings.TrimSpace(s), nil
+	},
+
+	// base64-decode decodes standard base64.
+	"base64-decode": func(s string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	},
+
+	// normalize-newlines converts CRLF and CR line endings to LF.
+	"normalize-newlines": func(s string) (string, error) {
+		s = strings.Replace(s, "\r\n", "\n", -1)
+		return strings.Replace(s, "\r", "\n", -1), nil
+	},
+}
+
+// validateTransforms returns an error if any of the named transforms does not
+// exist.
+func validateTransforms(names []string) error {
+	for _, name := range names {
+		if _, ok := valueTransforms[name]; !ok {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+	}
+	return nil
+}
+
+// applyTransforms applies the named transforms to value in order.
+func applyTransforms(names []string, value string) (string, error) {
+	var err error
+	for _, name := range names {
+		if value, err = valueTransforms[name](value); err != nil {
+			return "", fmt.Errorf("transform %s: %s", name, err)
+		}
+	}
+	return value, nil
+}
+
+// transformValue returns a value read by the given prefix or secret with its
+// outer whitespace trimmed, if TrimSpace is set, and its transforms applied.
+func transformValue(cp *PrefixConfig, value string) (string, error) {
+	if config.BoolVal(cp.TrimSpace) {
+		value = strings.TrimSpace(value)
+	}
+	return applyTransforms(cp.Transforms, value)
+}
+
+// keyWords splits key into its words, at any character other than a letter or
+// digit, and where a lowercase letter or digit is followed by an uppercase
+// letter.
+func keyWords(key string) []string {
+	var words []string
+	var word []rune
+	prev := rune(0)
+	for _, c := range key {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			prev = 0
+			continue
+		}
+		if unicode.IsUpper(c) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+			words = append(words, string(word))
+			word = nil
+		}
+		word = append(word, c)
+		prev = c
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// styleKey converts key to the given key style. An empty style leaves the key
+// unchanged.
+func styleKey(style, key string) string {
+	words := keyWords(key)
+	for i, w := range words {
+		w = strings.ToLower(w)
+		if style == KeyStylePascal || (style == KeyStyleCamel && i > 0) {
+			runes := []rune(w)
+			runes[0] = unicode.ToUpper(runes[0])
+			w = string(runes)
+		}
+		words[i] = w
+	}
+
+	switch style {
+	case KeyStyleSnake:
+		return strings.Join(words, "_")
+	case KeyStyleKebab:
+		return strings.Join(words, "-")
+	case KeyStyleCamel, KeyStylePascal:
+		return strings.Join(words, "")
+	default:
+		return key
+	}
+}
@@ -0,0 +1,83 @@
+package envconsul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// vaultAuthRequired are the parameters each known auth method needs to log
+// in. Other methods are passed their parameters as is.
+var vaultAuthRequired = map[string][]string{
+	"approle":    {"role_id"},
+	"kubernetes": {"role"},
+}
+
+// validateVaultAuth checks that the parameters required by the configured
+// auth method are set.
+func validateVaultAuth(c *VaultAuthConfig) error {
+	method := config.StringVal(c.Method)
+	for _, param := range vaultAuthRequired[method] {
+		if c.Params[param] == "" {
+			return fmt.Errorf("the %s method requires the %q param", method, param)
+		}
+	}
+	return nil
+}
+
+// vaultLogin logs in to Vault with the configured auth method and sets the
+// resulting token on the Vault client, returning the login response.
+func vaultLogin(clients *dep.ClientSet, c *VaultAuthConfig) (*api.Secret, error) {
+	method := config.StringVal(c.Method)
+	path := fmt.Sprintf("auth/%s/login", strings.Trim(config.StringVal(c.Mount), "/"))
+
+	data := make(map[string]interface{}, len(c.Params)+1)
+	for k, v := range c.Params {
+		data[k] = v
+	}
+	if _, ok := data["jwt"]; method == "kubernetes" && !ok {
+		jwt, err := ioutil.ReadFile(config.StringVal(c.JWTPath))
+		if err != nil {
+			return nil, errors.Wrap(err, "vault_auth: reading service account token")
+		}
+		data["jwt"] = strings.TrimSpace(string(jwt))
+	}
+
+	log.Printf("[DEBUG] (runner) logging in to vault at %s", path)
+	secret, err := clients.Vault().Logical().Write(path, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "vault_auth: %s login failed", method)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault_auth: %s login returned no token", method)
+	}
+
+	clients.Vault().SetToken(secret.Auth.ClientToken)
+	log.Printf("[INFO] (runner) logged in to vault with the %s method", method)
+	return secret, nil
+}
+
+// loginVault logs in to Vault with the configured auth method, if any.
+func (r *Runner) loginVault() error {
+	if !config.StringPresent(r.config.VaultAuth.Method) {
+		return nil
+	}
+	_, err := vaultLogin(r.clients, r.config.VaultAuth)
+	return err
+}
+
+// newVaultLoginRenewQuery creates a token renewal dependency which logs in to
+// Vault again when the token cannot be renewed.
+func (r *Runner) newVaultLoginRenewQuery() *vaultTokenRenewQuery {
+	q := newVaultTokenRenewQuery(config.TimeDurationVal(r.config.VaultTokenRenewGrace))
+	q.login = func(clients *dep.ClientSet) (*api.Secret, error) {
+		return vaultLogin(clients, r.config.VaultAuth)
+	}
+	return q
+}
@@ -0,0 +1,192 @@
+package envconsul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+func TestVaultLogin(t *testing.T) {
+	t.Parallel()
+
+	jwt, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(jwt.Name())
+	if _, err := jwt.WriteString("service-account-token\n"); err != nil {
+		t.Fatal(err)
+	}
+	jwt.Close()
+
+	cases := []struct {
+		name   string
+		auth   *VaultAuthConfig
+		path   string
+		params map[string]interface{}
+		err    string
+	}{
+		{
+			"approle",
+			&VaultAuthConfig{
+				Method: config.String("approle"),
+				Params: map[string]string{"role_id": "role", "secret_id": "secret"},
+			},
+			"/v1/auth/approle/login",
+			map[string]interface{}{"role_id": "role", "secret_id": "secret"},
+			"",
+		},
+		{
+			"mount",
+			&VaultAuthConfig{
+				Method: config.String("approle"),
+				Mount:  config.String("/apps/"),
+				Params: map[string]string{"role_id": "role"},
+			},
+			"/v1/auth/apps/login",
+			map[string]interface{}{"role_id": "role"},
+			"",
+		},
+		{
+			"kubernetes",
+			&VaultAuthConfig{
+				Method:  config.String("kubernetes"),
+				Params:  map[string]string{"role": "app"},
+				JWTPath: config.String(jwt.Name()),
+			},
+			"/v1/auth/kubernetes/login",
+			map[string]interface{}{"role": "app", "jwt": "service-account-token"},
+			"",
+		},
+		{
+			"denied",
+			&VaultAuthConfig{
+				Method: config.String("approle"),
+				Params: map[string]string{"role_id": "wrong"},
+			},
+			"/v1/auth/approle/login",
+			nil,
+			"vault_auth: approle login failed",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var params map[string]interface{}
+			clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tc.path {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				json.NewDecoder(r.Body).Decode(&params)
+				if params["role_id"] == "wrong" {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"errors": ["invalid role ID"]}`))
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"auth": {"client_token": "login-token", "lease_duration": 60, "renewable": true}}`))
+			}))
+			defer stop()
+			clients.Vault().SetToken("")
+
+			auth := DefaultVaultAuthConfig().Merge(tc.auth)
+			auth.Finalize()
+
+			_, err := vaultLogin(clients, auth)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(params, tc.params) {
+				t.Errorf("expected params %v, got %v", tc.params, params)
+			}
+			if token := clients.Vault().Token(); token != "login-token" {
+				t.Errorf("expected the client to use the login token, got %q", token)
+			}
+		})
+	}
+}
+
+func TestValidateVaultAuth(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		VaultAuth: &VaultAuthConfig{
+			Method: config.String("approle"),
+			Params: map[string]string{"secret_id": "secret"},
+		},
+	}
+	_, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	expected := `runner: vault_auth: the approle method requires the "role_id" param`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestVaultTokenRenewQuery_login(t *testing.T) {
+	t.Parallel()
+
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			writeVaultData(w, map[string]interface{}{
+				"id":        "token",
+				"ttl":       1,
+				"renewable": true,
+			})
+		case "/v1/auth/token/renew-self":
+			// The token has reached its maximum TTL.
+			w.WriteHeader(http.StatusForbidden)
+		case "/v1/auth/approle/login":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"auth": {"client_token": "new-token", "lease_duration": 60, "renewable": true}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	cfg := Config{
+		VaultAuth: &VaultAuthConfig{
+			Method: config.String("approle"),
+			Params: map[string]string{"role_id": "role"},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := r.newVaultLoginRenewQuery()
+	defer d.Stop()
+
+	// The first fetch looks the token up, and the second logs in again in
+	// place of the failed renewal.
+	if _, _, err := d.Fetch(clients, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := d.Fetch(clients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := data.(time.Duration); ttl != time.Minute {
+		t.Errorf("expected a TTL of 1m, got %s", ttl)
+	}
+	if token := clients.Vault().Token(); token != "new-token" {
+		t.Errorf("expected the client to use the new token, got %q", token)
+	}
+}
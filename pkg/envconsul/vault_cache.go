@@ -0,0 +1,114 @@
+package envconsul
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// secretCache is a short-lived cache of secrets read from Vault, keyed by path
+// and version. Entries are kept for the lease of the secret, capped at the
+// maximum TTL. Concurrent reads of the same key share a single request, and a
+// secret read again near the end of its lease replaces the entry. A nil cache
+// reads straight through.
+type secretCache struct {
+	sync.Mutex
+
+	maxTTL  time.Duration
+	entries map[string]*secretCacheEntry
+}
+
+// secretCacheEntry is a single read, which may still be in flight.
+type secretCacheEntry struct {
+	ready   chan struct{}
+	secret  *api.Secret
+	err     error
+	expires time.Time
+}
+
+// newSecretCache creates a new cache with the given maximum TTL. It returns
+// nil, disabling caching, if the TTL is not positive.
+func newSecretCache(maxTTL time.Duration) *secretCache {
+	if maxTTL <= 0 {
+		return nil
+	}
+
+	return &secretCache{
+		maxTTL:  maxTTL,
+		entries: make(map[string]*secretCacheEntry),
+	}
+}
+
+// read returns the cached secret for key, calling read to populate the cache
+// if there is no live entry. Failed reads are not cached.
+func (c *secretCache) read(key string, read func() (*api.Secret, error)) (*api.Secret, error) {
+	if c == nil {
+		return read()
+	}
+
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.ready:
+			ok = e.err == nil && time.Now().Before(e.expires)
+		default:
+			// Another read is in flight; wait for it below.
+		}
+	}
+	if ok {
+		c.Unlock()
+		<-e.ready
+		log.Printf("[TRACE] (cache) using cached secret for %s", key)
+		return e.secret, e.err
+	}
+
+	e = &secretCacheEntry{ready: make(chan struct{})}
+	c.entries[key] = e
+	c.Unlock()
+
+	return c.fill(e, read)
+}
+
+// refresh calls read and replaces the cached secret for key with the result,
+// ignoring any live entry. It is used to read a secret again once its lease is
+// nearly over, when the cached entry may be that same secret.
+func (c *secretCache) refresh(key string, read func() (*api.Secret, error)) (*api.Secret, error) {
+	if c == nil {
+		return read()
+	}
+
+	e := &secretCacheEntry{ready: make(chan struct{})}
+	c.Lock()
+	c.entries[key] = e
+	c.Unlock()
+
+	return c.fill(e, read)
+}
+
+// fill populates the given entry by calling read, and marks it ready.
+func (c *secretCache) fill(e *secretCacheEntry, read func() (*api.Secret, error)) (*api.Secret, error) {
+	e.secret, e.err = read()
+	if e.err == nil {
+		e.expires = time.Now().Add(c.ttl(e.secret))
+	}
+	close(e.ready)
+
+	return e.secret, e.err
+}
+
+// ttl returns how long the given secret may be cached: its lease duration,
+// capped at the maximum TTL. Secrets without a lease use the maximum TTL.
+func (c *secretCache) ttl(s *api.Secret) time.Duration {
+	lease := time.Duration(s.LeaseDuration) * time.Second
+	if s.Auth != nil && s.Auth.LeaseDuration > 0 {
+		lease = time.Duration(s.Auth.LeaseDuration) * time.Second
+	}
+
+	if lease <= 0 || lease > c.maxTTL {
+		return c.maxTTL
+	}
+	return lease
+}
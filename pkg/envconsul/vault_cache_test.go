@@ -0,0 +1,123 @@
+package envconsul
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/vault/api"
+)
+
+func TestSecretCache_read(t *testing.T) {
+	t.Parallel()
+
+	var reads int64
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/foo":
+			atomic.AddInt64(&reads, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"lease_duration": 3600, "data": {"bar": "baz"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	cache := newSecretCache(time.Minute)
+	for i := 0; i < 2; i++ {
+		d, err := newVaultReadQuery("secret/foo", cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err := d.Fetch(clients, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := data.(*dep.Secret).Data["bar"]; v != "baz" {
+			t.Fatalf("expected %q, got %q", "baz", v)
+		}
+	}
+
+	if reads != 1 {
+		t.Errorf("expected 1 read within the TTL, got %d", reads)
+	}
+}
+
+func TestSecretCache_readAgain(t *testing.T) {
+	t.Parallel()
+
+	var reads int64
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/foo":
+			n := atomic.AddInt64(&reads, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"lease_duration": 1, "renewable": false, "data": {"bar": "%d"}}`, n)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	// The cache outlives the lease, but the secret read again near the end of
+	// its lease is fresh.
+	d, err := newVaultReadQuery("secret/foo", newSecretCache(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	for _, expected := range []string{"1", "2"} {
+		data, _, err := d.Fetch(clients, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := data.(*dep.Secret).Data["bar"]; v != expected {
+			t.Fatalf("expected %q, got %q", expected, v)
+		}
+	}
+}
+
+func TestSecretCache_ttl(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		secret *api.Secret
+		ttl    time.Duration
+	}{
+		{
+			"no_lease",
+			&api.Secret{},
+			time.Minute,
+		},
+		{
+			"short_lease",
+			&api.Secret{LeaseDuration: 30},
+			30 * time.Second,
+		},
+		{
+			"long_lease_capped",
+			&api.Secret{LeaseDuration: 3600},
+			time.Minute,
+		},
+		{
+			"auth_lease",
+			&api.Secret{Auth: &api.SecretAuth{LeaseDuration: 10}},
+			10 * time.Second,
+		},
+	}
+
+	cache := newSecretCache(time.Minute)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if ttl := cache.ttl(tc.secret); ttl != tc.ttl {
+				t.Errorf("expected %s, got %s", tc.ttl, ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package envconsul
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultListConcurrency is the default number of secrets read in parallel
+	// when expanding a wildcard secret path.
+	DefaultListConcurrency = 4
+
+	// wildcardSuffix marks a secret path whose children should be listed and
+	// read individually.
+	wildcardSuffix = "/*"
+)
+
+var (
+	// Ensure implements
+	_ dep.Dependency = (*vaultListReadQuery)(nil)
+)
+
+// listedSecret is a single secret read while expanding a wildcard path.
+type listedSecret struct {
+	Path   string
+	Secret *dep.Secret
+}
+
+// vaultListReadQuery lists a path in Vault and reads every secret directly
+// beneath it. Reads are spread over a bounded number of workers, but the
+// result is always returned in sorted path order so the resulting environment
+// is deterministic.
+type vaultListReadQuery struct {
+	stopCh chan struct{}
+	cache  *secretCache
+
+	rawPath     string
+	concurrency int
+
+	// headers are additional headers sent with each read.
+	headers http.Header
+
+	// mountPath, mountAccessor and isKVv2 are populated on the first fetch.
+	mountPath     string
+	mountAccessor string
+	isKVv2        *bool
+}
+
+// newVaultListReadQuery creates a new list-and-read dependency for the given
+// path (without the trailing wildcard). The cache may be nil.
+func newVaultListReadQuery(s string, concurrency int, cache *secretCache) (*vaultListReadQuery, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return nil, fmt.Errorf("vault.list.read: invalid format: %q", s)
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &vaultListReadQuery{
+		stopCh:      make(chan struct{}, 1),
+		cache:       cache,
+		rawPath:     s,
+		concurrency: concurrency,
+	}, nil
+}
+
+// Fetch lists the path and reads each of the secrets beneath it.
+func (d *vaultListReadQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	opts = opts.Merge(&dep.QueryOptions{})
+
+	// If this is not the first query, poll to simulate blocking-queries.
+	if opts.WaitIndex != 0 {
+		dur := dep.VaultDefaultLeaseDuration
+		log.Printf("[TRACE] %s: long polling for %s", d, dur)
+
+		select {
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		case <-time.After(dur):
+		}
+	}
+
+	client := clients.Vault()
+
+	if d.isKVv2 == nil {
+		mount, err := vaultKVMount(client, d.rawPath)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, d.String())
+		}
+		d.mountPath = mount.path
+		d.mountAccessor = mount.accessor
+		d.isKVv2 = &mount.isKVv2
+	}
+
+	listPath := d.rawPath
+	if *d.isKVv2 {
+		listPath = vaultKVPath(d.rawPath, d.mountPath, "metadata")
+	}
+
+	log.Printf("[TRACE] %s: LIST %s", d, listPath)
+	secret, err := client.Logical().List(listPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	var names []string
+	if secret != nil && secret.Data != nil {
+		keys, _ := secret.Data["keys"].([]interface{})
+		for _, k := range keys {
+			name, ok := k.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: non-string in list", d)
+			}
+
+			// Folders are not expanded; only the secrets directly beneath the
+			// path are read.
+			if strings.HasSuffix(name, "/") {
+				continue
+			}
+			names = append(names, path.Join(d.rawPath, name))
+		}
+	}
+	sort.Strings(names)
+
+	log.Printf("[TRACE] %s: reading %d secrets (concurrency: %d)",
+		d, len(names), d.concurrency)
+
+	result, err := readConcurrently(names, d.concurrency, d.stopCh, func(p string) (*dep.Secret, error) {
+		readPath := p
+		if *d.isKVv2 {
+			readPath = vaultKVPath(p, d.mountPath, "data")
+		}
+
+		key := readPath
+		if len(d.headers) > 0 {
+			key += "#" + url.Values(d.headers).Encode()
+		}
+
+		s, err := d.cache.read(key, func() (*api.Secret, error) {
+			s, err := vaultRead(client, readPath, nil, d.headers)
+			if err != nil {
+				return nil, err
+			}
+			if s == nil {
+				return nil, fmt.Errorf("no secret exists at %s", readPath)
+			}
+			return s, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var secret dep.Secret
+		updateSecret(&secret, s)
+		return &secret, nil
+	})
+	if err == dep.ErrStopped {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	return result, &dep.ResponseMetadata{
+		LastIndex: uint64(time.Now().Unix()),
+	}, nil
+}
+
+// CanShare returns if this dependency is shareable.
+func (d *vaultListReadQuery) CanShare() bool {
+	return false
+}
+
+// Stop halts the given dependency's fetch.
+func (d *vaultListReadQuery) Stop() {
+	close(d.stopCh)
+}
+
+// String returns the human-friendly version of this dependency.
+func (d *vaultListReadQuery) String() string {
+	return fmt.Sprintf("vault.list.read(%s)", d.rawPath)
+}
+
+// Type returns the type of this dependency.
+func (d *vaultListReadQuery) Type() dep.Type {
+	return dep.TypeVault
+}
+
+// readConcurrently calls read for each of the given paths using at most
+// concurrency workers. Results are returned in the same order as paths. If any
+// read fails, the first error (in path order) is returned. Once stopCh is
+// closed, no further reads are started and dep.ErrStopped is returned after
+// those in flight finish.
+func readConcurrently(paths []string, concurrency int, stopCh <-chan struct{},
+	read func(string) (*dep.Secret, error)) ([]*listedSecret, error) {
+
+	results := make([]*listedSecret, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, p := range paths {
+		// A slot may be free as well, so the stop is checked first.
+		select {
+		case <-stopCh:
+			wg.Wait()
+			return nil, dep.ErrStopped
+		default:
+		}
+		select {
+		case <-stopCh:
+			wg.Wait()
+			return nil, dep.ErrStopped
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			s, err := read(p)
+			if err != nil {
+				errs[i] = errors.Wrap(err, p)
+				return
+			}
+			results[i] = &listedSecret{Path: p, Secret: s}
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// vaultMount describes the secrets engine mount a secret path belongs to.
+type vaultMount struct {
+	path     string
+	accessor string
+	isKVv2   bool
+}
+
+// vaultKVMount returns the mount for the given secret path, including whether
+// it is a KV version 2 secrets engine. If the mount cannot be looked up, it is
+// assumed to be KV version 1, and its path and accessor are empty.
+func vaultKVMount(client *api.Client, p string) (*vaultMount, error) {
+	r := client.NewRequest("GET", "/v1/sys/internal/ui/mounts/"+p)
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		// Older versions of Vault do not have this endpoint, and anonymous
+		// requests may not be permitted to read it. Assume version 1.
+		if resp != nil && resp.StatusCode == 404 {
+			return &vaultMount{}, nil
+		}
+		if client.Token() == "" {
+			return &vaultMount{}, nil
+		}
+		return nil, err
+	}
+
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return &vaultMount{}, nil
+	}
+
+	mountPath, _ := secret.Data["path"].(string)
+	accessor, _ := secret.Data["accessor"].(string)
+	mountType, _ := secret.Data["type"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	version, _ := options["version"].(string)
+
+	return &vaultMount{
+		path:     mountPath,
+		accessor: accessor,
+		isKVv2:   mountType == "kv" && version == "2",
+	}, nil
+}
+
+// vaultKVPath inserts the KV version 2 API prefix (such as "data" or
+// "metadata") after the mount path.
+func vaultKVPath(p, mountPath, apiPrefix string) string {
+	if p == mountPath || p == strings.TrimSuffix(mountPath, "/") {
+		return path.Join(mountPath, apiPrefix)
+	}
+
+	p = strings.TrimPrefix(p, mountPath)
+	if strings.HasPrefix(p, apiPrefix+"/") {
+		return path.Join(mountPath, p)
+	}
+	return path.Join(mountPath, apiPrefix, p)
+}
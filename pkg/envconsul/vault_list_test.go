@@ -0,0 +1,199 @@
+package envconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	dep "github.com/hashicorp/consul-template/dependency"
+)
+
+// testVaultClients starts a fake Vault server backed by the given handler and
+// returns a client set pointed at it.
+func testVaultClients(t *testing.T, h http.Handler) (*dep.ClientSet, func()) {
+	ts := httptest.NewServer(h)
+
+	clients := dep.NewClientSet()
+	if err := clients.CreateVaultClient(&dep.CreateVaultClientInput{
+		Address: ts.URL,
+		Token:   "token",
+	}); err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	return clients, ts.Close
+}
+
+// writeVaultData writes the given data as the body of a Vault response.
+func writeVaultData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": data,
+	})
+}
+
+func TestVaultListReadQuery_Fetch(t *testing.T) {
+	t.Parallel()
+
+	const n = 50
+
+	var reads int64
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/sys/internal/ui/mounts/secret/apps":
+			writeVaultData(w, map[string]interface{}{
+				"path":    "secret/",
+				"type":    "kv",
+				"options": map[string]interface{}{"version": "2"},
+			})
+		case r.URL.Path == "/v1/secret/metadata/apps" && r.URL.Query().Get("list") == "true":
+			// Return the keys in reverse order, along with a folder which must
+			// not be expanded.
+			keys := []interface{}{"nested/"}
+			for i := n - 1; i >= 0; i-- {
+				keys = append(keys, fmt.Sprintf("svc%02d", i))
+			}
+			writeVaultData(w, map[string]interface{}{"keys": keys})
+		case strings.HasPrefix(r.URL.Path, "/v1/secret/data/apps/svc"):
+			atomic.AddInt64(&reads, 1)
+			name := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/apps/")
+			writeVaultData(w, map[string]interface{}{
+				"data": map[string]interface{}{
+					"value":  name,
+					"shared": name,
+				},
+				"metadata": map[string]interface{}{
+					"version": 1,
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	d, err := newVaultListReadQuery("secret/apps", 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _, err := d.Fetch(clients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads != n {
+		t.Fatalf("expected %d reads, got %d", n, reads)
+	}
+
+	typed := data.([]*listedSecret)
+	paths := make([]string, len(typed))
+	for i, s := range typed {
+		paths[i] = s.Path
+	}
+	if len(paths) != n || !sort.StringsAreSorted(paths) {
+		t.Fatalf("expected %d sorted paths, got %v", n, paths)
+	}
+
+	// A second fetch must produce the same ordering.
+	again, _, err := d.Fetch(clients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, again) {
+		t.Fatal("expected repeated fetches to return identical results")
+	}
+
+	c := DefaultConfig().Merge(&Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path: config.String("secret/apps/*"),
+			},
+		},
+	})
+	r, err := NewRunner(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := make(map[string]string)
+	if err := r.appendListedSecrets(env, r.dependencies[0].(*vaultListReadQuery), data); err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 2*n {
+		t.Fatalf("expected %d keys, got %d", 2*n, len(env))
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("svc%02d", i)
+		if v := env["secret_apps_"+name+"_value"]; v != name {
+			t.Errorf("expected %s value to be %q, got %q", name, name, v)
+		}
+	}
+}
+
+func TestReadConcurrently_order(t *testing.T) {
+	t.Parallel()
+
+	paths := make([]string, 100)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("secret/%03d", i)
+	}
+
+	var inFlight, maxInFlight int64
+	result, err := readConcurrently(paths, 3, nil, func(p string) (*dep.Secret, error) {
+		cur := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			old := atomic.LoadInt64(&maxInFlight)
+			if cur <= old || atomic.CompareAndSwapInt64(&maxInFlight, old, cur) {
+				break
+			}
+		}
+		return &dep.Secret{Data: map[string]interface{}{"path": p}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxInFlight > 3 {
+		t.Errorf("expected at most 3 concurrent reads, got %d", maxInFlight)
+	}
+	for i, s := range result {
+		if s.Path != paths[i] || s.Secret.Data["path"] != paths[i] {
+			t.Fatalf("result %d out of order: %q", i, s.Path)
+		}
+	}
+}
+
+func TestReadConcurrently_stop(t *testing.T) {
+	t.Parallel()
+
+	paths := make([]string, 100)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("secret/%03d", i)
+	}
+
+	stopCh := make(chan struct{})
+	var reads int64
+	_, err := readConcurrently(paths, 2, stopCh, func(p string) (*dep.Secret, error) {
+		if atomic.AddInt64(&reads, 1) == 1 {
+			close(stopCh)
+		}
+		time.Sleep(10 * time.Millisecond)
+		return &dep.Secret{}, nil
+	})
+	if err != dep.ErrStopped {
+		t.Fatalf("expected %v, got %v", dep.ErrStopped, err)
+	}
+	if n := atomic.LoadInt64(&reads); n > 2 {
+		t.Errorf("expected no reads to start after the stop, got %d", n)
+	}
+}
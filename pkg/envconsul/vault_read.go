@@ -0,0 +1,570 @@
+package envconsul
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+var (
+	// Ensure implements
+	_ dep.Dependency = (*vaultReadQuery)(nil)
+)
+
+// maxClockSkew is how far the wall clock may drift from the monotonic clock
+// during a wait for renewal before the lease is looked up again from Vault.
+const maxClockSkew = 30 * time.Second
+
+// vaultReadQuery reads a single secret from Vault. It behaves like the
+// upstream dependency.VaultReadQuery, renewing the secret's lease where
+// possible, but reads through a secretCache so the same secret is not read
+// from Vault repeatedly within its lease.
+type vaultReadQuery struct {
+	stopCh chan struct{}
+	cache  *secretCache
+
+	rawPath     string
+	queryValues url.Values
+
+	secret      *dep.Secret
+	vaultSecret *api.Secret
+
+	// threshold is when the secret's lease is renewed, or nil to use the
+	// Vault library's renewer.
+	threshold *renewThreshold
+
+	// headers are additional headers sent with each read.
+	headers http.Header
+
+	// renewed is called each time the secret's lease is renewed, if set.
+	renewed func()
+
+	// clock returns the wall clock time, or nil to use time.Now. It is only
+	// replaced in tests, to simulate the clock jumping.
+	clock func() time.Time
+
+	// secretPath, mountAccessor and isKVv2 are populated on the first fetch.
+	secretPath    string
+	mountAccessor string
+	isKVv2        *bool
+}
+
+// newVaultReadQuery creates a new read dependency for the given path, which
+// may include query parameters such as "?version=2". The cache may be nil.
+func newVaultReadQuery(s string, cache *secretCache) (*vaultReadQuery, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return nil, fmt.Errorf("vault.read: invalid format: %q", s)
+	}
+
+	secretURL, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vaultReadQuery{
+		stopCh:      make(chan struct{}, 1),
+		cache:       cache,
+		rawPath:     secretURL.Path,
+		queryValues: secretURL.Query(),
+	}, nil
+}
+
+// Fetch queries the Vault API, renewing or waiting out the lease of a
+// previously read secret first.
+func (d *vaultReadQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	opts = opts.Merge(&dep.QueryOptions{})
+
+	if d.secret != nil && d.threshold != nil {
+		if err := d.renewAtThreshold(clients.Vault()); err != nil {
+			return nil, nil, err
+		}
+	} else if d.secret != nil {
+		if vaultSecretRenewable(d.secret) {
+			log.Printf("[TRACE] %s: starting renewer", d)
+
+			renewer, err := clients.Vault().NewRenewer(&api.RenewerInput{
+				Grace:  opts.VaultGrace,
+				Secret: d.vaultSecret,
+			})
+			if err != nil {
+				return nil, nil, errors.Wrap(err, d.String())
+			}
+			go renewer.Renew()
+			defer renewer.Stop()
+
+		RENEW:
+			for {
+				select {
+				case err := <-renewer.DoneCh():
+					if err != nil {
+						log.Printf("[WARN] %s: failed to renew: %s", d, err)
+					}
+					log.Printf("[WARN] %s: renewer returned (maybe the lease expired)", d)
+					break RENEW
+				case renewal := <-renewer.RenewCh():
+					log.Printf("[TRACE] %s: successfully renewed", d)
+					updateSecret(d.secret, renewal.Secret)
+					d.notifyRenewed()
+				case <-d.stopCh:
+					return nil, nil, dep.ErrStopped
+				}
+			}
+		} else {
+			// The secret isn't renewable, probably the generic secret backend.
+			dur := vaultRenewDuration(d.secret)
+			log.Printf("[TRACE] %s: secret is not renewable, sleeping for %s", d, dur)
+			select {
+			case <-time.After(dur):
+			case <-d.stopCh:
+				return nil, nil, dep.ErrStopped
+			}
+		}
+	}
+
+	// We don't have a secret, or the prior renewal failed
+	vaultSecret, err := d.readSecret(clients)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+
+	for _, w := range vaultSecret.Warnings {
+		log.Printf("[WARN] %s: %s", d, w)
+	}
+
+	d.vaultSecret = vaultSecret
+	d.secret = &dep.Secret{}
+	updateSecret(d.secret, vaultSecret)
+
+	return d.secret, &dep.ResponseMetadata{
+		LastIndex: uint64(time.Now().Unix()),
+	}, nil
+}
+
+// renewAtThreshold renews the secret's lease each time it reaches the renewal
+// threshold. It returns once the lease cannot be renewed any further, so the
+// secret is read again.
+func (d *vaultReadQuery) renewAtThreshold(client *api.Client) error {
+	lease := vaultLeaseDuration(d.secret)
+	for {
+		dur := d.threshold.wait(lease)
+		log.Printf("[TRACE] %s: renewing in %s", d, dur)
+		if err := d.waitRenewal(client, lease, dur); err != nil {
+			return err
+		}
+
+		if !vaultSecretRenewable(d.secret) {
+			log.Printf("[DEBUG] %s: secret is not renewable, reading it again", d)
+			return nil
+		}
+
+		var renewal *api.Secret
+		var err error
+		if d.secret.Auth != nil {
+			renewal, err = client.Auth().Token().RenewTokenAsSelf(d.secret.Auth.ClientToken, 0)
+		} else {
+			renewal, err = client.Sys().Renew(d.secret.LeaseID, 0)
+		}
+		if err != nil {
+			log.Printf("[WARN] %s: failed to renew: %s", d, err)
+			return nil
+		}
+		log.Printf("[TRACE] %s: successfully renewed", d)
+		updateSecret(d.secret, renewal)
+		d.notifyRenewed()
+
+		// A lease renewed for less than before has reached its maximum TTL, so
+		// a fresh secret is read at the threshold rather than renewing again.
+		renewed := time.Duration(renewal.LeaseDuration) * time.Second
+		if renewal.Auth != nil {
+			renewed = time.Duration(renewal.Auth.LeaseDuration) * time.Second
+		}
+		if renewed < lease {
+			dur := d.threshold.wait(renewed)
+			log.Printf("[DEBUG] %s: lease reached its maximum TTL, reading it "+
+				"again in %s", d, dur)
+			return d.waitRenewal(client, renewed, dur)
+		}
+		lease = renewed
+	}
+}
+
+// waitRenewal waits dur into a lease of the given duration. Timers use the
+// monotonic clock, so a jump of the wall clock cannot fire them early. When a
+// jump is detected, though, the lease's remaining TTL is looked up from Vault,
+// and the wait is extended if more of the lease remains than expected.
+func (d *vaultReadQuery) waitRenewal(client *api.Client, lease, dur time.Duration) error {
+	start, wallStart := time.Now(), d.wallNow()
+	if err := d.sleep(dur); err != nil {
+		return err
+	}
+
+	skew := d.wallNow().Sub(wallStart) - time.Since(start)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew < maxClockSkew {
+		return nil
+	}
+
+	remaining, err := d.leaseRemaining(client)
+	if err != nil {
+		log.Printf("[WARN] %s: wall clock jumped by %s, but looking up the "+
+			"lease failed: %s", d, skew, err)
+		return nil
+	}
+
+	expected := lease - dur
+	log.Printf("[WARN] %s: wall clock jumped by %s, lease has %s remaining "+
+		"(expected %s)", d, skew, remaining, expected)
+	if extra := remaining - expected; extra > 0 {
+		return d.sleep(extra)
+	}
+	return nil
+}
+
+// sleep waits for the given duration, returning early if the query is
+// stopped.
+func (d *vaultReadQuery) sleep(dur time.Duration) error {
+	select {
+	case <-time.After(dur):
+		return nil
+	case <-d.stopCh:
+		return dep.ErrStopped
+	}
+}
+
+// wallNow returns the current wall clock time, without a monotonic reading.
+func (d *vaultReadQuery) wallNow() time.Time {
+	if d.clock != nil {
+		return d.clock()
+	}
+	return time.Now().Round(0)
+}
+
+// leaseRemaining looks up the remaining TTL of the secret's lease, or of its
+// token for an auth secret.
+func (d *vaultReadQuery) leaseRemaining(client *api.Client) (time.Duration, error) {
+	if d.secret.Auth != nil {
+		s, err := client.Auth().Token().Lookup(d.secret.Auth.ClientToken)
+		if err != nil {
+			return 0, err
+		}
+		if s == nil {
+			return 0, fmt.Errorf("no token information returned")
+		}
+		return s.TokenTTL()
+	}
+
+	s, err := client.Logical().Write("sys/leases/lookup", map[string]interface{}{
+		"lease_id": d.secret.LeaseID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if s == nil || s.Data == nil {
+		return 0, fmt.Errorf("no lease information returned")
+	}
+	ttl, ok := s.Data["ttl"].(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("lease has no ttl")
+	}
+	seconds, err := ttl.Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// readSecret reads the secret through the cache, detecting whether it lives
+// in a KV version 2 secrets engine on the first read.
+func (d *vaultReadQuery) readSecret(clients *dep.ClientSet) (*api.Secret, error) {
+	client := clients.Vault()
+
+	if d.isKVv2 == nil {
+		mount, err := vaultKVMount(client, d.rawPath)
+		if err != nil {
+			return nil, err
+		}
+
+		d.secretPath = d.rawPath
+		if mount.isKVv2 {
+			d.secretPath = vaultKVPath(d.rawPath, mount.path, "data")
+		}
+		d.mountAccessor = mount.accessor
+		d.isKVv2 = &mount.isKVv2
+	}
+
+	key := d.secretPath
+	if len(d.queryValues) > 0 {
+		key += "?" + d.queryValues.Encode()
+	}
+	if len(d.headers) > 0 {
+		// The headers may change the response, so secrets read with different
+		// headers are cached separately.
+		key += "#" + url.Values(d.headers).Encode()
+	}
+
+	read := func() (*api.Secret, error) {
+		log.Printf("[TRACE] %s: GET %s", d, &url.URL{
+			Path:     "/v1/" + d.secretPath,
+			RawQuery: d.queryValues.Encode(),
+		})
+		s, err := vaultRead(client, d.secretPath, d.queryValues, d.headers)
+		if err != nil {
+			return nil, err
+		}
+		if s == nil {
+			return nil, fmt.Errorf("no secret exists at %s", d.secretPath)
+		}
+		return s, nil
+	}
+
+	// A secret read again, because its lease is nearly over or could not be
+	// renewed, must not come from the cache, which may hold that same secret.
+	if d.secret != nil {
+		return d.cache.refresh(key, read)
+	}
+	return d.cache.read(key, read)
+}
+
+// vaultRead reads the secret at path with the given query parameters, like
+// Logical().ReadWithData, sending the given headers in addition to the
+// client's own. A secret which does not exist is returned as nil.
+func vaultRead(client *api.Client, path string, query url.Values, headers http.Header) (*api.Secret, error) {
+	if len(headers) == 0 {
+		return client.Logical().ReadWithData(path, query)
+	}
+
+	r := client.NewRequest("GET", "/v1/"+path)
+	if query != nil {
+		r.Params = query
+	}
+
+	// The request shares the client's headers, so they are copied rather than
+	// modified in place.
+	h := make(http.Header, len(r.Headers)+len(headers))
+	for k, v := range r.Headers {
+		h[k] = v
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	r.Headers = h
+
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return api.ParseSecret(resp.Body)
+}
+
+// notifyRenewed reports a renewal of the secret's lease.
+func (d *vaultReadQuery) notifyRenewed() {
+	if d.renewed != nil {
+		d.renewed()
+	}
+}
+
+// CanShare returns if this dependency is shareable.
+func (d *vaultReadQuery) CanShare() bool {
+	return false
+}
+
+// Stop halts the given dependency's fetch.
+func (d *vaultReadQuery) Stop() {
+	close(d.stopCh)
+}
+
+// String returns the human-friendly version of this dependency.
+func (d *vaultReadQuery) String() string {
+	// Include any query, such as a pinned version, so reads of different
+	// versions of the same secret are distinct dependencies.
+	if len(d.queryValues) > 0 {
+		return fmt.Sprintf("vault.read(%s?%s)", d.rawPath, d.queryValues.Encode())
+	}
+	return fmt.Sprintf("vault.read(%s)", d.rawPath)
+}
+
+// Type returns the type of this dependency.
+func (d *vaultReadQuery) Type() dep.Type {
+	return dep.TypeVault
+}
+
+// vaultSecretRenewable determines if the given secret is renewable.
+func vaultSecretRenewable(s *dep.Secret) bool {
+	if s.Auth != nil {
+		return s.Auth.Renewable
+	}
+	return s.Renewable
+}
+
+// vaultSealed returns whether the given error from reading Vault is because
+// Vault is sealed. Vault responds to every request with a 503 until it is
+// unsealed.
+func vaultSealed(err error) bool {
+	if respErr, ok := errors.Cause(err).(*api.ResponseError); ok {
+		if respErr.StatusCode != http.StatusServiceUnavailable {
+			return false
+		}
+	}
+	return strings.Contains(err.Error(), "Vault is sealed")
+}
+
+// vaultLeaseDuration returns the lease duration of the given secret, or the
+// default lease duration when the secret has none.
+func vaultLeaseDuration(s *dep.Secret) time.Duration {
+	base := s.LeaseDuration
+	if s.Auth != nil && s.Auth.LeaseDuration > 0 {
+		base = s.Auth.LeaseDuration
+	}
+
+	if base <= 0 {
+		return dep.VaultDefaultLeaseDuration
+	}
+	return time.Duration(base) * time.Second
+}
+
+// renewThreshold is the point in a lease at which it is renewed: either a
+// fraction of the lease, or a duration before the lease expires.
+type renewThreshold struct {
+	fraction float64
+	before   time.Duration
+}
+
+// parseRenewThreshold parses a renewal threshold, which is either a fraction
+// between 0 and 1 or a duration. An empty string returns nil.
+func parseRenewThreshold(s string) (*renewThreshold, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f <= 0 || f >= 1 {
+			return nil, fmt.Errorf("fraction %q must be between 0 and 1", s)
+		}
+		return &renewThreshold{fraction: f}, nil
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a fraction nor a duration", s)
+	}
+	if dur <= 0 {
+		return nil, fmt.Errorf("duration %q must be positive", s)
+	}
+	return &renewThreshold{before: dur}, nil
+}
+
+// wait returns how long to wait into a lease of the given duration before
+// renewing it. A lease shorter than the duration before expiry is renewed
+// immediately.
+func (t *renewThreshold) wait(lease time.Duration) time.Duration {
+	if t.before > 0 {
+		if lease <= t.before {
+			return 0
+		}
+		return lease - t.before
+	}
+	return time.Duration(float64(lease) * t.fraction)
+}
+
+// vaultRenewDuration returns the recommended amount of time to sleep before
+// renewing or re-reading the given secret.
+func vaultRenewDuration(s *dep.Secret) time.Duration {
+	sleep := float64(vaultLeaseDuration(s))
+
+	if vaultSecretRenewable(s) {
+		// Renew at 1/3 the remaining lease, with some randomness so many clients
+		// do not hit Vault simultaneously.
+		sleep = sleep / 3.0
+		sleep = sleep * (rand.Float64() + 1) / 2.0
+	} else {
+		// Use as much of the lease as possible, staggered over 85%-95%.
+		sleep = sleep * (.85 + rand.Float64()*0.1)
+	}
+
+	return time.Duration(sleep)
+}
+
+// updateSecret updates our secret with the data from the API. Renewals do not
+// include the original secret data, so missing fields are left untouched.
+func updateSecret(ours *dep.Secret, theirs *api.Secret) {
+	if theirs.RequestID != "" {
+		ours.RequestID = theirs.RequestID
+	}
+
+	if theirs.LeaseID != "" {
+		ours.LeaseID = theirs.LeaseID
+	}
+
+	if theirs.LeaseDuration != 0 {
+		ours.LeaseDuration = theirs.LeaseDuration
+	}
+
+	if theirs.Renewable {
+		ours.Renewable = theirs.Renewable
+	}
+
+	if len(theirs.Data) != 0 {
+		ours.Data = theirs.Data
+	}
+
+	if len(theirs.Warnings) != 0 {
+		ours.Warnings = theirs.Warnings
+	}
+
+	if theirs.Auth != nil {
+		if ours.Auth == nil {
+			ours.Auth = &dep.SecretAuth{}
+		}
+
+		if theirs.Auth.ClientToken != "" {
+			ours.Auth.ClientToken = theirs.Auth.ClientToken
+		}
+
+		if theirs.Auth.Accessor != "" {
+			ours.Auth.Accessor = theirs.Auth.Accessor
+		}
+
+		if len(theirs.Auth.Policies) != 0 {
+			ours.Auth.Policies = theirs.Auth.Policies
+		}
+
+		if len(theirs.Auth.Metadata) != 0 {
+			ours.Auth.Metadata = theirs.Auth.Metadata
+		}
+
+		if theirs.Auth.LeaseDuration != 0 {
+			ours.Auth.LeaseDuration = theirs.Auth.LeaseDuration
+		}
+
+		if theirs.Auth.Renewable {
+			ours.Auth.Renewable = theirs.Auth.Renewable
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package envconsul
+
+import (
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRenewThreshold(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		s    string
+		exp  *renewThreshold
+		err  bool
+	}{
+		{
+			"empty",
+			"",
+			nil,
+			false,
+		},
+		{
+			"fraction",
+			"0.7",
+			&renewThreshold{fraction: 0.7},
+			false,
+		},
+		{
+			"duration",
+			"30s",
+			&renewThreshold{before: 30 * time.Second},
+			false,
+		},
+		{
+			"fraction_too_large",
+			"1.5",
+			nil,
+			true,
+		},
+		{
+			"zero_duration",
+			"0s",
+			nil,
+			true,
+		},
+		{
+			"invalid",
+			"soon",
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			th, err := parseRenewThreshold(tc.s)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.exp, th) {
+				t.Errorf("expected %#v to be %#v", th, tc.exp)
+			}
+		})
+	}
+}
+
+func TestVaultReadQuery_renewThreshold(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		secret    string
+		threshold *renewThreshold
+		renews    int64
+	}{
+		{
+			"renewable",
+			`{"lease_id": "db/creds/1", "lease_duration": 2, "renewable": true, "data": {"user": "a"}}`,
+			&renewThreshold{fraction: 0.5},
+			1,
+		},
+		{
+			"not_renewable",
+			`{"lease_id": "aws/sts/1", "lease_duration": 2, "data": {"user": "a"}}`,
+			&renewThreshold{before: 1500 * time.Millisecond},
+			0,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var reads, renews int64
+			clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/v1/secret/creds":
+					atomic.AddInt64(&reads, 1)
+					w.Write([]byte(tc.secret))
+				case "/v1/sys/leases/renew":
+					// Renewed for less than the original lease, as when the
+					// lease reaches its maximum TTL.
+					atomic.AddInt64(&renews, 1)
+					w.Write([]byte(`{"lease_id": "db/creds/1", "lease_duration": 1, "renewable": true}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer stop()
+
+			d, err := newVaultReadQuery("secret/creds", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.threshold = tc.threshold
+
+			for i := 0; i < 2; i++ {
+				if _, _, err := d.Fetch(clients, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if reads != 2 {
+				t.Errorf("expected 2 reads, got %d", reads)
+			}
+			if renews != tc.renews {
+				t.Errorf("expected %d renewals, got %d", tc.renews, renews)
+			}
+		})
+	}
+}
+
+func TestVaultReadQuery_requestHeaders(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/foo":
+			got = r.Header.Get("X-Api-Version")
+			writeVaultData(w, map[string]interface{}{"bar": "baz"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	d, err := newVaultReadQuery("secret/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.headers = http.Header{"X-Api-Version": []string{"2"}}
+
+	if _, _, err := d.Fetch(clients, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got != "2" {
+		t.Errorf("expected X-Api-Version header %q, got %q", "2", got)
+	}
+}
+
+func TestVaultReadQuery_clockJump(t *testing.T) {
+	t.Parallel()
+
+	var renewedAt atomic.Value
+	clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/secret/creds":
+			w.Write([]byte(`{"lease_id": "db/creds/1", "lease_duration": 2, "renewable": true, "data": {"user": "a"}}`))
+		case "/v1/sys/leases/lookup":
+			// Vault reports the whole lease remaining, though the renewal
+			// threshold has passed.
+			writeVaultData(w, map[string]interface{}{"ttl": 2})
+		case "/v1/sys/leases/renew":
+			renewedAt.Store(time.Now())
+			w.Write([]byte(`{"lease_id": "db/creds/1", "lease_duration": 1, "renewable": true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stop()
+
+	d, err := newVaultReadQuery("secret/creds", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.threshold = &renewThreshold{fraction: 0.5}
+
+	// The wall clock jumps an hour forward after the first reading.
+	var calls int64
+	base := time.Now().Round(0)
+	d.clock = func() time.Time {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			return base
+		}
+		return base.Add(time.Hour)
+	}
+
+	if _, _, err := d.Fetch(clients, nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := d.Fetch(clients, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	at, ok := renewedAt.Load().(time.Time)
+	if !ok {
+		t.Fatal("expected the lease to be renewed")
+	}
+	if elapsed := at.Sub(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("expected renewal to wait for the remaining lease, renewed after %s", elapsed)
+	}
+}
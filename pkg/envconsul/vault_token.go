@@ -0,0 +1,271 @@
+package envconsul
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	dep "github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+var (
+	// Ensure implements
+	_ dep.Dependency = (*vaultTokenTTLQuery)(nil)
+	_ dep.Dependency = (*vaultTokenRenewQuery)(nil)
+)
+
+// vaultTokenTTLQuery looks up the remaining TTL of the Vault token. The token
+// itself is renewed by the watcher; this query looks the token up again a
+// third of the way through its TTL, which is when a renewal is due.
+type vaultTokenTTLQuery struct {
+	stopCh chan struct{}
+
+	// ttl is the TTL from the last lookup, or nil before the first.
+	ttl *time.Duration
+}
+
+// newVaultTokenTTLQuery creates a new token TTL dependency.
+func newVaultTokenTTLQuery() *vaultTokenTTLQuery {
+	return &vaultTokenTTLQuery{
+		stopCh: make(chan struct{}, 1),
+	}
+}
+
+// Fetch looks up the token, returning its remaining TTL as a time.Duration.
+func (d *vaultTokenTTLQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	if d.ttl != nil {
+		// A token without a TTL never expires, so there is nothing to update.
+		var wait <-chan time.Time
+		if *d.ttl > 0 {
+			dur := *d.ttl / 3
+			log.Printf("[TRACE] %s: looking up token again in %s", d, dur)
+			wait = time.After(dur)
+		}
+
+		select {
+		case <-wait:
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		}
+	}
+
+	secret, err := clients.Vault().Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+	if secret == nil {
+		return nil, nil, fmt.Errorf("%s: no token information returned", d)
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, d.String())
+	}
+	d.ttl = &ttl
+
+	return ttl, &dep.ResponseMetadata{
+		LastIndex: uint64(time.Now().Unix()),
+	}, nil
+}
+
+// CanShare returns if this dependency is shareable.
+func (d *vaultTokenTTLQuery) CanShare() bool {
+	return false
+}
+
+// Stop halts the given dependency's fetch.
+func (d *vaultTokenTTLQuery) Stop() {
+	close(d.stopCh)
+}
+
+// String returns the human-friendly version of this dependency.
+func (d *vaultTokenTTLQuery) String() string {
+	return "vault.token.ttl"
+}
+
+// Type returns the type of this dependency.
+func (d *vaultTokenTTLQuery) Type() dep.Type {
+	return dep.TypeVault
+}
+
+// vaultTokenRenewRetry is how often a failed renewal of the Vault token is
+// retried within the grace period.
+const vaultTokenRenewRetry = 5 * time.Second
+
+// errVaultTokenRenewal is returned by vaultTokenRenewQuery once the Vault
+// token could not be renewed for the whole grace period.
+type errVaultTokenRenewal struct {
+	err error
+}
+
+func (e *errVaultTokenRenewal) Error() string {
+	return fmt.Sprintf("vault token could not be renewed: %s", e.err)
+}
+
+// vaultTokenRenewQuery renews the Vault token in place of the watcher, so
+// that a token which can no longer be renewed is reported rather than only
+// logged. The token is looked up on the first fetch and renewed halfway
+// through its TTL after that. Failures are retried until the grace period has
+// passed, after which an errVaultTokenRenewal is returned.
+type vaultTokenRenewQuery struct {
+	stopCh chan struct{}
+
+	// grace is how long renewals may fail before the failure is terminal,
+	// and retry is how often they are retried in the meantime.
+	grace time.Duration
+	retry time.Duration
+
+	// ttl and renewable are from the last lookup or renewal, or nil before
+	// the first.
+	ttl       *time.Duration
+	renewable bool
+
+	// failingSince is the time of the first of the current run of failures,
+	// or zero if the last attempt succeeded.
+	failingSince time.Time
+
+	// login, if set, logs in to Vault again to replace a token which is not
+	// renewable or could not be renewed.
+	login func(*dep.ClientSet) (*api.Secret, error)
+}
+
+// newVaultTokenRenewQuery creates a new token renewal dependency with the
+// given grace period.
+func newVaultTokenRenewQuery(grace time.Duration) *vaultTokenRenewQuery {
+	return &vaultTokenRenewQuery{
+		stopCh: make(chan struct{}, 1),
+		grace:  grace,
+		retry:  vaultTokenRenewRetry,
+	}
+}
+
+// Fetch waits until the token is due for renewal and renews it, returning
+// its new TTL as a time.Duration.
+func (d *vaultTokenRenewQuery) Fetch(clients *dep.ClientSet, opts *dep.QueryOptions) (interface{}, *dep.ResponseMetadata, error) {
+	select {
+	case <-d.stopCh:
+		return nil, nil, dep.ErrStopped
+	default:
+	}
+
+	if d.ttl != nil {
+		// A token without a TTL never expires, so there is nothing to renew. A
+		// token which is not renewable is tried again once it has expired, so
+		// the failure is reported, unless it is replaced by logging in again.
+		var wait <-chan time.Time
+		if *d.ttl > 0 {
+			dur := *d.ttl / 2
+			if !d.renewable && d.login == nil {
+				dur = *d.ttl
+			}
+			log.Printf("[TRACE] %s: renewing token in %s", d, dur)
+			wait = time.After(dur)
+		}
+
+		select {
+		case <-wait:
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		}
+	}
+
+	for {
+		err := d.renew(clients)
+		if err == nil {
+			d.failingSince = time.Time{}
+			log.Printf("[DEBUG] %s: token is valid for %s (renewable: %t)",
+				d, *d.ttl, d.renewable)
+			return *d.ttl, &dep.ResponseMetadata{
+				LastIndex: uint64(time.Now().Unix()),
+			}, nil
+		}
+
+		now := time.Now()
+		if d.failingSince.IsZero() {
+			d.failingSince = now
+		}
+		failing := now.Sub(d.failingSince)
+		if failing >= d.grace {
+			return nil, nil, &errVaultTokenRenewal{err: err}
+		}
+
+		wait := d.retry
+		if remaining := d.grace - failing; remaining < wait {
+			wait = remaining
+		}
+		log.Printf("[WARN] %s: failed to renew token, retrying in %s: %s", d, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-d.stopCh:
+			return nil, nil, dep.ErrStopped
+		}
+	}
+}
+
+// renew looks the token up on the first call and renews it on later ones,
+// updating its TTL and whether it is renewable.
+func (d *vaultTokenRenewQuery) renew(clients *dep.ClientSet) error {
+	var secret *api.Secret
+	var err error
+	switch {
+	case d.ttl == nil:
+		secret, err = clients.Vault().Auth().Token().LookupSelf()
+	case d.login != nil && !d.renewable:
+		secret, err = d.login(clients)
+	default:
+		secret, err = clients.Vault().Auth().Token().RenewSelf(0)
+		if err != nil && d.login != nil {
+			log.Printf("[WARN] %s: failed to renew token, logging in again: %s", d, err)
+			secret, err = d.login(clients)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("no token information returned")
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return err
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return err
+	}
+
+	d.ttl = &ttl
+	d.renewable = renewable
+	return nil
+}
+
+// CanShare returns if this dependency is shareable.
+func (d *vaultTokenRenewQuery) CanShare() bool {
+	return false
+}
+
+// Stop halts the given dependency's fetch.
+func (d *vaultTokenRenewQuery) Stop() {
+	close(d.stopCh)
+}
+
+// String returns the human-friendly version of this dependency.
+func (d *vaultTokenRenewQuery) String() string {
+	return "vault.token.renew"
+}
+
+// Type returns the type of this dependency. It is not a Vault dependency, so
+// the watcher does not retry it on top of the grace period.
+func (d *vaultTokenRenewQuery) Type() dep.Type {
+	return dep.TypeLocal
+}
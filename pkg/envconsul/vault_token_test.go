@@ -0,0 +1,85 @@
+package envconsul
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVaultTokenRenewQuery_Fetch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		failures int32
+		err      bool
+	}{
+		{
+			"renewed",
+			0,
+			false,
+		},
+		{
+			"recovers_within_grace",
+			2,
+			false,
+		},
+		{
+			"fails_past_grace",
+			1000,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var renewals int32
+			clients, stop := testVaultClients(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/auth/token/lookup-self":
+					writeVaultData(w, map[string]interface{}{
+						"id":        "token",
+						"ttl":       1,
+						"renewable": true,
+					})
+				case "/v1/auth/token/renew-self":
+					if atomic.AddInt32(&renewals, 1) <= tc.failures {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{"auth": {"client_token": "token", "lease_duration": 60, "renewable": true}}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer stop()
+
+			d := newVaultTokenRenewQuery(200 * time.Millisecond)
+			d.retry = 10 * time.Millisecond
+			defer d.Stop()
+
+			// The first fetch looks the token up, and the second renews it.
+			if _, _, err := d.Fetch(clients, nil); err != nil {
+				t.Fatal(err)
+			}
+			data, _, err := d.Fetch(clients, nil)
+			if tc.err {
+				if _, ok := err.(*errVaultTokenRenewal); !ok {
+					t.Fatalf("expected a renewal error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl := data.(time.Duration); ttl != time.Minute {
+				t.Errorf("expected ttl %s, got %s", time.Minute, ttl)
+			}
+		})
+	}
+}